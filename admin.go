@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultTopTalkers is the number of top talkers served without n
+// parameter
+const defaultTopTalkers = 10
+
+// adminHandler serves the runtime counters of server as JSON on /stats
+// and, together with the Go runtime variables, on /debug/vars, the active
+// sessions on /sessions, UDP associations on /udp and the bans of bans on
+// /bans. The top talkers are served on /top if top is set, the usage
+// history on /usage if usage is set, and captures of sessions are
+// started on /sessions/{id}/capture if captures is set.
+func adminHandler(server *socks5.Server, bans *socks5.BanList, top *TopTalkers, usage *UsageHistory, captures *Captures) http.Handler {
+	expvar.Publish("socks5", expvar.Func(func() any { return server.Stats() }))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.Stats()); err != nil {
+			logrus.Debugf("failed to write stats: %v", err)
+		}
+	})
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	mux.HandleFunc("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.Sessions()); err != nil {
+			logrus.Debugf("failed to write sessions: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /udp", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(server.UDPAssociations()); err != nil {
+			logrus.Debugf("failed to write UDP associations: %v", err)
+		}
+	})
+	mux.HandleFunc("GET /bans", func(w http.ResponseWriter, r *http.Request) {
+		list := bans.List()
+		slices.SortFunc(list, func(a, b socks5.Ban) int { return a.IP.Compare(b.IP) })
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(list); err != nil {
+			logrus.Debugf("failed to write bans: %v", err)
+		}
+	})
+	mux.HandleFunc("POST /bans", func(w http.ResponseWriter, r *http.Request) {
+		serveBan(w, r, bans)
+	})
+	mux.HandleFunc("DELETE /bans/{ip}", func(w http.ResponseWriter, r *http.Request) {
+		ip, err := netip.ParseAddr(r.PathValue("ip"))
+		if err != nil {
+			http.Error(w, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		if !bans.IsBanned(ip) {
+			http.Error(w, "ip not banned", http.StatusNotFound)
+			return
+		}
+		if err := bans.Unban(ip); err != nil {
+			logrus.Errorf("failed to save ban list: %v", err)
+		}
+		logrus.Infof("admin endpoint lifted the ban of %v", ip)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	if top != nil {
+		mux.HandleFunc("GET /top", func(w http.ResponseWriter, r *http.Request) {
+			n := defaultTopTalkers
+			if v := r.URL.Query().Get("n"); v != "" {
+				var err error
+				if n, err = strconv.Atoi(v); err != nil || n < 1 {
+					http.Error(w, "invalid n", http.StatusBadRequest)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(top.Top(n)); err != nil {
+				logrus.Debugf("failed to write top talkers: %v", err)
+			}
+		})
+	}
+	if usage != nil {
+		mux.HandleFunc("GET /usage", func(w http.ResponseWriter, r *http.Request) {
+			serveUsage(w, r, usage)
+		})
+	}
+	if captures != nil {
+		mux.HandleFunc("POST /sessions/{id}/capture", captures.serveCapture)
+	}
+	return mux
+}
+
+// serveBan bans the client IP of the ip parameter for the duration of
+// ttl, with an optional reason
+func serveBan(w http.ResponseWriter, r *http.Request, bans *socks5.BanList) {
+	ip, err := netip.ParseAddr(r.FormValue("ip"))
+	if err != nil {
+		http.Error(w, "invalid ip", http.StatusBadRequest)
+		return
+	}
+	ttl, err := time.ParseDuration(r.FormValue("ttl"))
+	if err != nil || ttl <= 0 {
+		http.Error(w, "invalid ttl: must be a positive duration", http.StatusBadRequest)
+		return
+	}
+	reason := r.FormValue("reason")
+	if reason == "" {
+		reason = "banned on admin endpoint"
+	}
+	if err := bans.Ban(ip, ttl, reason); err != nil {
+		logrus.Errorf("failed to save ban list: %v", err)
+	}
+	logrus.Infof("admin endpoint banned %v for %s: %s", ip, ttl, reason)
+
+	list := bans.List()
+	i := slices.IndexFunc(list, func(ban socks5.Ban) bool { return ban.IP == ip.Unmap() })
+	if i < 0 {
+		http.Error(w, "ban expired", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(list[i]); err != nil {
+		logrus.Debugf("failed to write ban: %v", err)
+	}
+}
+
+// serveUsage reports the traffic of users, or destinations with
+// by=destination, in buckets of an hour or, with bucket=day, a day.
+// Optional since and until RFC 3339 times bound the report, name
+// restricts it to a single user or destination.
+func serveUsage(w http.ResponseWriter, r *http.Request, usage *UsageHistory) {
+	q := r.URL.Query()
+	var dests, daily bool
+	switch q.Get("by") {
+	case "", "user":
+	case "destination":
+		dests = true
+	default:
+		http.Error(w, "invalid by: must be user or destination", http.StatusBadRequest)
+		return
+	}
+	switch q.Get("bucket") {
+	case "", "hour":
+	case "day":
+		daily = true
+	default:
+		http.Error(w, "invalid bucket: must be hour or day", http.StatusBadRequest)
+		return
+	}
+	since, until := time.Now().Add(-usage.Retention), time.Now()
+	for param, t := range map[string]*time.Time{"since": &since, "until": &until} {
+		if v := q.Get(param); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "invalid "+param+": must be an RFC 3339 time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(usage.Report(dests, daily, q.Get("name"), since, until)); err != nil {
+		logrus.Debugf("failed to write usage: %v", err)
+	}
+}
+
+// requireToken serves h to requests carrying token as bearer token in
+// their Authorization header, to all requests if token is empty
+func requireToken(h http.Handler, token string) http.Handler {
+	if token == "" {
+		return h
+	}
+	want := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// adminListenAddr returns the address of ADMIN_ADDR to listen on, the
+// loopback interface if it has no host. Without a token it must be a
+// loopback address, since the endpoint exposes the sessions of all users.
+func adminListenAddr(addr string, token bool) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if !token {
+		if ip, err := netip.ParseAddr(host); host != "localhost" && (err != nil || !ip.IsLoopback()) {
+			return "", fmt.Errorf("%s is not a loopback address and ADMIN_TOKEN is not set", addr)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// serveAdmin opens the admin HTTP endpoint on addr and serves it in the
+// background, over HTTPS if tlsConf is set and to requests with token
+// only if set
+func serveAdmin(addr, token string, server *socks5.Server, bans *socks5.BanList, top *TopTalkers, usage *UsageHistory, captures *Captures, tlsConf *tls.Config) error {
+	l, err := upgrades.listen("tcp", addr, net.Listen)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Start listening admin endpoint on %s", addr)
+	srv := &http.Server{Handler: requireToken(adminHandler(server, bans, top, usage, captures), token), TLSConfig: tlsConf}
+	go func() {
+		var err error
+		if tlsConf != nil {
+			err = srv.ServeTLS(l, "", "")
+		} else {
+			err = srv.Serve(l)
+		}
+		logrus.Fatalf("admin endpoint: %v", err)
+	}()
+	return nil
+}
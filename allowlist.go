@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// allowlistLookupTimeout bounds the resolution of a single host name
+	allowlistLookupTimeout = 5 * time.Second
+
+	// allowlistFetchTimeout bounds the download of ALLOWED_IPS_URL
+	allowlistFetchTimeout = 30 * time.Second
+)
+
+// hostnamePattern matches valid DNS host names
+var hostnamePattern = regexp.MustCompile(`^([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)*[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.?$`)
+
+// Allowlist maintains the IP whitelist of a server from entries which are
+// either IP addresses or host names, such as DynDNS names of home
+// connections. Entries come from Entries and optionally a File and a URL,
+// which are reloaded on every Refresh. Host names are re-resolved on every
+// Refresh as well.
+type Allowlist struct {
+	Server  *socks5.Server
+	Entries []string
+	File    string
+	URL     string
+
+	// Last valid entries loaded from File and URL, kept when a reload fails
+	fileEntries []string
+	urlEntries  []string
+	etag        string
+
+	// resolved holds the last successful resolution of each host name, kept
+	// when a later lookup fails
+	resolved map[string][]netip.Addr
+}
+
+// NewAllowlist creates an Allowlist for the given entries
+func NewAllowlist(server *socks5.Server, entries []string, file, url string) *Allowlist {
+	return &Allowlist{
+		Server:   server,
+		Entries:  entries,
+		File:     file,
+		URL:      url,
+		resolved: make(map[string][]netip.Addr),
+	}
+}
+
+// Dynamic reports whether the whitelist needs periodic refreshing
+func (a *Allowlist) Dynamic() bool {
+	if a.File != "" || a.URL != "" {
+		return true
+	}
+	for _, entry := range a.Entries {
+		if _, err := netip.ParseAddr(entry); err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Refresh reloads the file and URL, resolves all entries and atomically
+// replaces the whitelist
+func (a *Allowlist) Refresh(ctx context.Context) {
+	if a.File != "" {
+		if entries, err := a.loadFile(); err != nil {
+			logrus.Errorf("failed to load allowlist file, keeping previous entries: %v", err)
+		} else {
+			a.fileEntries = entries
+		}
+	}
+	if a.URL != "" {
+		if err := a.fetchURL(ctx); err != nil {
+			logrus.Errorf("failed to fetch allowlist URL, keeping previous entries: %v", err)
+		}
+	}
+
+	var whitelist []netip.Addr
+	for _, entries := range [][]string{a.Entries, a.fileEntries, a.urlEntries} {
+		for _, entry := range entries {
+			whitelist = append(whitelist, a.resolve(ctx, entry)...)
+		}
+	}
+	a.Server.SetIPWhitelist(whitelist)
+}
+
+// Run refreshes the whitelist every interval until ctx is done
+func (a *Allowlist) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.Refresh(ctx)
+		}
+	}
+}
+
+// resolve returns the addresses of an entry
+func (a *Allowlist) resolve(ctx context.Context, entry string) []netip.Addr {
+	if ip, err := netip.ParseAddr(entry); err == nil {
+		return []netip.Addr{ip}
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, allowlistLookupTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupNetIP(lookupCtx, "ip", entry)
+	if err != nil {
+		logrus.Warnf("failed to resolve allowed host %s, keeping %v: %v", entry, a.resolved[entry], err)
+	} else {
+		a.resolved[entry] = addrs
+	}
+	return a.resolved[entry]
+}
+
+// loadFile reads the entries of File
+func (a *Allowlist) loadFile() ([]string, error) {
+	f, err := os.Open(a.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries, err := parseAllowlist(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", a.File, err)
+	}
+	return entries, nil
+}
+
+// fetchURL downloads the entries of URL unless they are unchanged since
+// the last fetch, as indicated by the ETag
+func (a *Allowlist) fetchURL(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, allowlistFetchTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return err
+	}
+	if a.etag != "" {
+		req.Header.Set("If-None-Match", a.etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil
+	case http.StatusOK:
+	default:
+		return fmt.Errorf("%s: unexpected status %s", a.URL, resp.Status)
+	}
+
+	entries, err := parseAllowlist(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s: %v", a.URL, err)
+	}
+	a.urlEntries = entries
+	a.etag = resp.Header.Get("ETag")
+	return nil
+}
+
+// parseAllowlist reads one IP address or host name per line. Empty lines
+// and lines starting with # are ignored, any invalid line fails the list.
+func parseAllowlist(r io.Reader) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := netip.ParseAddr(line); err != nil && !hostnamePattern.MatchString(line) {
+			return nil, fmt.Errorf("line %d: invalid IP address or host name %q", n, line)
+		}
+		entries = append(entries, line)
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+// parseBandwidth parses a "rate[:burst[:priority]]" limit in bytes per
+// second
+func parseBandwidth(s string) (socks5.Bandwidth, error) {
+	var bw socks5.Bandwidth
+	fields := strings.Split(s, ":")
+	if len(fields) > 3 {
+		return bw, fmt.Errorf("invalid bandwidth %q: want rate[:burst[:priority]]", s)
+	}
+	rate, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil || rate < 0 {
+		return bw, fmt.Errorf("invalid bandwidth %q: invalid rate %q", s, fields[0])
+	}
+	bw.Rate = rate
+	if len(fields) > 1 && fields[1] != "" {
+		if bw.Burst, err = strconv.ParseInt(fields[1], 10, 64); err != nil || bw.Burst < 0 {
+			return bw, fmt.Errorf("invalid bandwidth %q: invalid burst %q", s, fields[1])
+		}
+	}
+	if len(fields) > 2 {
+		if bw.Priority, err = strconv.Atoi(fields[2]); err != nil {
+			return bw, fmt.Errorf("invalid bandwidth %q: invalid priority %q", s, fields[2])
+		}
+	}
+	return bw, nil
+}
+
+// parseBandwidthClasses parses "name=rate[:burst[:priority]]" classes
+func parseBandwidthClasses(entries map[string]string) (map[string]socks5.Bandwidth, error) {
+	classes := make(map[string]socks5.Bandwidth, len(entries))
+	for name, entry := range entries {
+		bw, err := parseBandwidth(entry)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth class %q: %v", name, err)
+		}
+		classes[name] = bw
+	}
+	return classes, nil
+}
+
+// BandwidthRule assigns Class to destinations whose host and port match
+// the patterns
+type BandwidthRule struct {
+	HostPattern *regexp.Regexp
+	PortPattern *regexp.Regexp
+	Class       string
+}
+
+// parseBandwidthRule parses a "host-pattern port-pattern class" rule,
+// patterns match the whole host or port
+func parseBandwidthRule(s string, classes map[string]socks5.Bandwidth) (BandwidthRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return BandwidthRule{}, fmt.Errorf("invalid bandwidth rule %q: want host-pattern port-pattern class", s)
+	}
+
+	var rule BandwidthRule
+	var err error
+	if rule.HostPattern, err = regexp.Compile("^(?:" + fields[0] + ")$"); err != nil {
+		return BandwidthRule{}, fmt.Errorf("invalid bandwidth rule %q: %v", s, err)
+	}
+	if rule.PortPattern, err = regexp.Compile("^(?:" + fields[1] + ")$"); err != nil {
+		return BandwidthRule{}, fmt.Errorf("invalid bandwidth rule %q: %v", s, err)
+	}
+	if _, found := classes[fields[2]]; !found {
+		return BandwidthRule{}, fmt.Errorf("invalid bandwidth rule %q: unknown class %q", s, fields[2])
+	}
+	rule.Class = fields[2]
+	return rule, nil
+}
+
+// AssignBandwidthClass returns a RuleSet which assigns the class of the
+// first matching rule, or def, to requests allowed by rules
+func AssignBandwidthClass(rules socks5.RuleSet, classRules []BandwidthRule, def string) socks5.RuleSet {
+	return &BandwidthClassRuleSet{rules, classRules, def}
+}
+
+// BandwidthClassRuleSet is an implementation of the RuleSet which shapes
+// tunnels by destination
+type BandwidthClassRuleSet struct {
+	Rules        socks5.RuleSet
+	ClassRules   []BandwidthRule
+	DefaultClass string
+}
+
+func (b *BandwidthClassRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := b.Rules.Allow(ctx, req)
+	if !ok {
+		return ctx, ok
+	}
+	if _, found := socks5.BandwidthClassFromContext(ctx); found {
+		return ctx, ok
+	}
+
+	host := req.DestAddr.FQDN
+	if host == "" {
+		host = req.DestAddr.IP.String()
+	}
+	port := strconv.Itoa(req.DestAddr.Port)
+	for _, rule := range b.ClassRules {
+		if rule.HostPattern.MatchString(host) && rule.PortPattern.MatchString(port) {
+			return socks5.WithBandwidthClass(ctx, rule.Class), ok
+		}
+	}
+	if b.DefaultClass != "" {
+		ctx = socks5.WithBandwidthClass(ctx, b.DefaultClass)
+	}
+	return ctx, ok
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/sirupsen/logrus"
+)
+
+// benchTimeout is how long a tunnel of bench may take to be set up or to
+// echo a message after the end of the benchmark before it fails
+const benchTimeout = 10 * time.Second
+
+// bench implements the bench subcommand, relaying tunnels between
+// in-process clients and an echo target through a server built with the
+// relay settings of the configuration in the environment, see
+// benchConfig. Each of the concurrent clients opens a tunnel and sends
+// messages echoed back, reopening it after a number of messages. It
+// prints the throughput, the percentiles of the tunnel setup and round
+// trip latencies and the allocations of the process, and returns the exit
+// code: 0 if every tunnel succeeded, 1 if any failed and 2 on errors.
+// A client stops at its first failure.
+func bench(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	conns := flags.Int("conns", 64, "concurrent tunnels")
+	duration := flags.Duration("duration", 10*time.Second, "duration of the benchmark")
+	size := flags.Int("size", 32*1024, "size in bytes of the messages echoed")
+	messages := flags.Int("messages", 0, "messages per tunnel before it is reopened, 0 to keep tunnels open")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	fail := func(format string, args ...any) int {
+		fmt.Fprintf(stderr, "bench: "+format+"\n", args...)
+		return 2
+	}
+	if *conns <= 0 || *size <= 0 || *messages < 0 || *duration <= 0 {
+		return fail("--conns, --size and --duration must be positive")
+	}
+
+	environ, err := secretEnvironment()
+	if err != nil {
+		return fail("%v", err)
+	}
+	var cfg params
+	if err := env.ParseWithOptions(&cfg, env.Options{Environment: environ}); err != nil {
+		return fail("%v", err)
+	}
+	conf, err := benchConfig(cfg)
+	if err != nil {
+		return fail("%v", err)
+	}
+	server, err := socks5.New(conf)
+	if err != nil {
+		return fail("%v", err)
+	}
+	proxy, err := server.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fail("%v", err)
+	}
+	defer proxy.Close()
+	server.SetIPWhitelist([]netip.Addr{netip.MustParseAddr("127.0.0.1")})
+	go server.Serve(proxy)
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fail("%v", err)
+	}
+	defer target.Close()
+	go serveEcho(target)
+
+	relay := "goroutines"
+	if cfg.EventLoopRelay {
+		relay = "event loops"
+	}
+	fmt.Fprintf(stdout, "%-12s %d tunnels, %d byte messages, %s, relayed by %s, GOMAXPROCS %d\n",
+		"bench", *conns, *size, *duration, relay, runtime.GOMAXPROCS(0))
+
+	runtime.GC()
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	workers := make([]benchWorker, *conns)
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func(w *benchWorker) {
+			defer wg.Done()
+			w.run(proxy.Addr().String(), target.Addr().(*net.TCPAddr), cfg.User, cfg.Password, *size, *messages, deadline)
+		}(&workers[i])
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	var setups, roundTrips []time.Duration
+	var failures int
+	var firstErr error
+	for _, w := range workers {
+		setups = append(setups, w.setups...)
+		roundTrips = append(roundTrips, w.roundTrips...)
+		failures += w.failures
+		if firstErr == nil {
+			firstErr = w.err
+		}
+	}
+
+	mib := float64(len(roundTrips)) * float64(*size) / (1 << 20)
+	fmt.Fprintf(stdout, "%-12s %d opened, %d failed\n", "tunnels", len(setups), failures)
+	fmt.Fprintf(stdout, "%-12s %.1f MiB/s each way, %.0f round trips/s\n", "throughput",
+		mib/elapsed.Seconds(), float64(len(roundTrips))/elapsed.Seconds())
+	fmt.Fprintf(stdout, "%-12s %s\n", "setup", benchPercentiles(setups))
+	fmt.Fprintf(stdout, "%-12s %s\n", "round trip", benchPercentiles(roundTrips))
+	mallocs := after.Mallocs - before.Mallocs
+	allocated := after.TotalAlloc - before.TotalAlloc
+	perMessage := float64(max(len(roundTrips), 1))
+	fmt.Fprintf(stdout, "%-12s %d (%.1f per round trip), %.1f MiB (%.0f bytes per round trip), %d GC cycles\n", "allocations",
+		mallocs, float64(mallocs)/perMessage, float64(allocated)/(1<<20), float64(allocated)/perMessage, after.NumGC-before.NumGC)
+	if failures > 0 {
+		fmt.Fprintf(stdout, "%-12s %v\n", "first error", firstErr)
+		return 1
+	}
+	return 0
+}
+
+// benchConfig returns the configuration of the server benchmarked: the
+// settings of cfg affecting how tunnels are relayed, the static
+// credentials of PROXY_USER and PROXY_PASSWORD, and no policy, since the
+// echo target is on the loopback interface. Only warnings are logged.
+func benchConfig(cfg params) (*socks5.Config, error) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	conf := &socks5.Config{
+		Logger: logger,
+		Timeouts: socks5.Timeouts{
+			Negotiation: cfg.NegotiationTimeout,
+			Dial:        cfg.DialTimeout,
+			Idle:        cfg.IdleTimeout,
+		},
+		DSCP:           cfg.DSCP,
+		ListenMPTCP:    cfg.ListenMPTCP,
+		DialMPTCP:      cfg.DialMPTCP,
+		ListenFastOpen: cfg.ListenFastOpen,
+		DialFastOpen:   cfg.DialFastOpen,
+		EventLoopRelay: cfg.EventLoopRelay,
+		Capture:        cfg.CaptureDir != "",
+	}
+	if cfg.User+cfg.Password != "" {
+		creds := socks5.StaticCredentials{cfg.User: cfg.Password}
+		conf.AuthMethods = []socks5.Authenticator{socks5.UserPassAuthenticator{Credentials: creds}}
+	}
+	if cfg.LinkBandwidth != "" {
+		var err error
+		if conf.LinkBandwidth, err = parseBandwidth(cfg.LinkBandwidth); err != nil {
+			return nil, fmt.Errorf("invalid LINK_BANDWIDTH: %v", err)
+		}
+	}
+	return conf, nil
+}
+
+// benchWorker is a client of bench, with the latencies it measured
+type benchWorker struct {
+	setups     []time.Duration
+	roundTrips []time.Duration
+	failures   int
+	err        error
+}
+
+// run opens tunnels to target through proxy and echoes messages of size
+// bytes until deadline, reopening tunnels after messages if not zero. It
+// stops at the first tunnel failing.
+func (w *benchWorker) run(proxy string, target *net.TCPAddr, user, pass string, size, messages int, deadline time.Time) {
+	out := make([]byte, size)
+	for i := range out {
+		out[i] = byte(i)
+	}
+	in := make([]byte, size)
+	for time.Now().Before(deadline) {
+		if err := w.tunnel(proxy, target, user, pass, out, in, messages, deadline); err != nil {
+			w.failures++
+			w.err = err
+			return
+		}
+	}
+}
+
+// tunnel opens a tunnel and echoes out, up to messages times
+func (w *benchWorker) tunnel(proxy string, target *net.TCPAddr, user, pass string, out, in []byte, messages int, deadline time.Time) error {
+	start := time.Now()
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Messages are echoed in full, tunnels stuck time out
+	conn.SetDeadline(deadline.Add(benchTimeout))
+	if err := socksConnect(conn, user, pass, target.IP.String(), uint16(target.Port), func(string, string) {}); err != nil {
+		return err
+	}
+	w.setups = append(w.setups, time.Since(start))
+
+	for n := 0; (messages == 0 || n < messages) && time.Now().Before(deadline); n++ {
+		sent := time.Now()
+		if _, err := conn.Write(out); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, in); err != nil {
+			return err
+		}
+		w.roundTrips = append(w.roundTrips, time.Since(sent))
+	}
+	return nil
+}
+
+// benchPercentiles formats the percentiles of latencies
+func benchPercentiles(latencies []time.Duration) string {
+	if len(latencies) == 0 {
+		return "no samples"
+	}
+	slices.Sort(latencies)
+	var b strings.Builder
+	for _, p := range []float64{50, 90, 99, 99.9} {
+		i := int(float64(len(latencies)-1) * p / 100)
+		fmt.Fprintf(&b, "p%g %s  ", p, latencies[i].Round(time.Microsecond))
+	}
+	fmt.Fprintf(&b, "max %s", latencies[len(latencies)-1].Round(time.Microsecond))
+	return b.String()
+}
+
+// serveEcho echoes what is received on the connections of l, the target
+// of bench
+func serveEcho(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
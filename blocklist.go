@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// blocklistFetchTimeout bounds the download of a blocklist and its
+	// signature or checksum
+	blocklistFetchTimeout = 60 * time.Second
+
+	// maxBlocklistSize bounds the size of a downloaded blocklist
+	maxBlocklistSize = 64 << 20
+)
+
+// RemoteBlocklist returns a RuleSet which blocks destinations listed in
+// the blocklists downloaded from urls, see RemoteBlocklistRuleSet
+func RemoteBlocklist(rules socks5.RuleSet, urls []string, publicKey ed25519.PublicKey, checksums bool) *RemoteBlocklistRuleSet {
+	b := &RemoteBlocklistRuleSet{
+		Rules:     rules,
+		URLs:      urls,
+		PublicKey: publicKey,
+		Checksums: checksums,
+		lists:     make(map[string]*blocklist),
+	}
+	b.current.Store(newBlocklistIndex())
+	return b
+}
+
+// RemoteBlocklistRuleSet is an implementation of the RuleSet which blocks
+// destination domains, including their subdomains, and IPs listed in
+// remote blocklists of domains, IPs and CIDRs, e.g. abuse feeds. Lists
+// are verified against an ed25519 signature at their URL followed by
+// ".sig" if PublicKey is set, or a SHA-256 checksum at their URL followed
+// by ".sha256" if Checksums is set, and swapped in atomically on every
+// Refresh. A list failing to download or verify keeps its previous
+// entries.
+type RemoteBlocklistRuleSet struct {
+	Rules     socks5.RuleSet
+	URLs      []string
+	PublicKey ed25519.PublicKey
+	Checksums bool
+
+	// lists are the last valid lists by URL, only used by Refresh
+	lists   map[string]*blocklist
+	current atomic.Pointer[blocklistIndex]
+}
+
+// blocklist is a downloaded list and the ETag it was served with
+type blocklist struct {
+	domains  []string
+	prefixes []netip.Prefix
+	etag     string
+}
+
+// blocklistIndex maps the entries of lists to the source listing them.
+// Prefixes are indexed by length, so lookups mask the IP once per length
+// in use.
+type blocklistIndex struct {
+	domains  map[string]string
+	prefixes map[netip.Prefix]string
+	bits     []int
+}
+
+func (b *RemoteBlocklistRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := b.Rules.Allow(ctx, req)
+	if !ok {
+		return ctx, ok
+	}
+	if url := b.current.Load().lookup(req.DestAddr); url != "" {
+		requestLog(req).Warnf("blocking destination %v listed in %s", req.DestAddr, url)
+		return socks5.WithDenyReason(ctx, "blocklist", "listed in "+url), false
+	}
+	return ctx, true
+}
+
+// newBlocklistIndex returns an empty blocklistIndex
+func newBlocklistIndex() *blocklistIndex {
+	return &blocklistIndex{domains: make(map[string]string), prefixes: make(map[netip.Prefix]string)}
+}
+
+// add indexes the entries of list not listed yet as listed in source
+func (idx *blocklistIndex) add(list *blocklist, source string) {
+	for _, domain := range list.domains {
+		if _, found := idx.domains[domain]; !found {
+			idx.domains[domain] = source
+		}
+	}
+	for _, prefix := range list.prefixes {
+		if _, found := idx.prefixes[prefix]; !found {
+			idx.prefixes[prefix] = source
+		}
+		if !slices.Contains(idx.bits, prefix.Bits()) {
+			idx.bits = append(idx.bits, prefix.Bits())
+		}
+	}
+}
+
+// lookup returns the source of the list dest is listed in, if any
+func (idx *blocklistIndex) lookup(dest *socks5.AddrSpec) string {
+	if name := strings.ToLower(dest.FQDN); name != "" {
+		for {
+			if source, found := idx.domains[name]; found {
+				return source
+			}
+			_, parent, found := strings.Cut(name, ".")
+			if !found {
+				break
+			}
+			name = parent
+		}
+	}
+	if ip := dest.IP.Unmap(); ip.IsValid() {
+		for _, bits := range idx.bits {
+			if bits > ip.BitLen() {
+				continue
+			}
+			prefix, _ := ip.Prefix(bits)
+			if source, found := idx.prefixes[prefix]; found {
+				return source
+			}
+		}
+	}
+	return ""
+}
+
+// Refresh downloads the lists and atomically replaces the entries
+func (b *RemoteBlocklistRuleSet) Refresh(ctx context.Context) {
+	for _, url := range b.URLs {
+		list, err := b.fetch(ctx, url, b.lists[url])
+		if err != nil {
+			logrus.Errorf("failed to update blocklist, keeping previous entries: %v", err)
+			continue
+		}
+		if list != b.lists[url] {
+			logrus.Infof("loaded %d domains and %d networks from blocklist %s", len(list.domains), len(list.prefixes), url)
+			b.lists[url] = list
+		}
+	}
+
+	idx := newBlocklistIndex()
+	for _, url := range b.URLs {
+		if list := b.lists[url]; list != nil {
+			idx.add(list, url)
+		}
+	}
+	b.current.Store(idx)
+}
+
+// Run refreshes the lists every interval until ctx is done
+func (b *RemoteBlocklistRuleSet) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.Refresh(ctx)
+		}
+	}
+}
+
+// fetch downloads and verifies the list at url, returning prev if it is
+// unchanged since, as indicated by the ETag
+func (b *RemoteBlocklistRuleSet) fetch(ctx context.Context, url string, prev *blocklist) (*blocklist, error) {
+	ctx, cancel := context.WithTimeout(ctx, blocklistFetchTimeout)
+	defer cancel()
+
+	etag := ""
+	if prev != nil {
+		etag = prev.etag
+	}
+	body, etag, err := download(ctx, url, etag)
+	if err != nil {
+		return nil, err
+	}
+	if body == nil {
+		return prev, nil
+	}
+
+	switch {
+	case b.PublicKey != nil:
+		sig, _, err := download(ctx, url+".sig", "")
+		if err != nil {
+			return nil, err
+		}
+		sig, err = base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil || !ed25519.Verify(b.PublicKey, body, sig) {
+			return nil, fmt.Errorf("%s: invalid signature", url)
+		}
+	case b.Checksums:
+		sum, _, err := download(ctx, url+".sha256", "")
+		if err != nil {
+			return nil, err
+		}
+		// Accept the output of sha256sum, the hash followed by the name
+		want, _, _ := strings.Cut(strings.TrimSpace(string(sum)), " ")
+		got := sha256.Sum256(body)
+		if !strings.EqualFold(want, hex.EncodeToString(got[:])) {
+			return nil, fmt.Errorf("%s: checksum mismatch", url)
+		}
+	}
+
+	list, err := parseBlocklist(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", url, err)
+	}
+	list.etag = etag
+	return list, nil
+}
+
+// download returns the body of url and its ETag, or a nil body if it
+// still matches etag
+func download(ctx context.Context, url, etag string) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		if etag != "" {
+			return nil, etag, nil
+		}
+	case http.StatusOK:
+		body, err := io.ReadAll(io.LimitReader(resp.Body, maxBlocklistSize+1))
+		if err != nil {
+			return nil, "", fmt.Errorf("%s: %v", url, err)
+		}
+		if len(body) > maxBlocklistSize {
+			return nil, "", fmt.Errorf("%s: larger than %d bytes", url, maxBlocklistSize)
+		}
+		return body, resp.Header.Get("ETag"), nil
+	}
+	return nil, "", fmt.Errorf("%s: unexpected status %s", url, resp.Status)
+}
+
+// parseBlocklist reads one domain, IP address or CIDR per line. Domains
+// may be written as wildcards like *.example.com, which are equivalent.
+// Comments start with #, empty lines are ignored and any invalid line
+// fails the list.
+func parseBlocklist(r io.Reader) (*blocklist, error) {
+	list := &blocklist{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimPrefix(strings.TrimSpace(line), "*.")
+		if line == "" {
+			continue
+		}
+		if prefix, err := parsePrefix(line); err == nil {
+			list.prefixes = append(list.prefixes, prefix.Masked())
+			continue
+		}
+		if !hostnamePattern.MatchString(line) {
+			return nil, fmt.Errorf("line %d: invalid domain, IP address or CIDR %q", n, line)
+		}
+		list.domains = append(list.domains, strings.ToLower(strings.TrimSuffix(line, ".")))
+	}
+	return list, scanner.Err()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Captures writes packet captures of sessions requested on the admin
+// endpoint to files in a directory, each bounded in size and duration
+type Captures struct {
+	server      *socks5.Server
+	dir         string
+	maxBytes    int64
+	maxDuration time.Duration
+}
+
+// NewCaptures creates the directory dir and returns Captures writing to
+// it, bounded by maxBytes and maxDuration
+func NewCaptures(server *socks5.Server, dir string, maxBytes int64, maxDuration time.Duration) (*Captures, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Captures{server: server, dir: dir, maxBytes: maxBytes, maxDuration: maxDuration}, nil
+}
+
+// serveCapture starts capturing the session of the id path value. The
+// legs parameter selects the "payload" between client and destination,
+// the default, or "both" connections. Optional max_bytes and duration
+// parameters lower the limits of the capture.
+func (c *Captures) serveCapture(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid session id", http.StatusBadRequest)
+		return
+	}
+	q := r.URL.Query()
+	opts := socks5.CaptureOptions{MaxBytes: c.maxBytes, Duration: c.maxDuration}
+	switch q.Get("legs") {
+	case "", "payload":
+	case "both":
+		opts.BothLegs = true
+	default:
+		http.Error(w, "invalid legs", http.StatusBadRequest)
+		return
+	}
+	if v := q.Get("max_bytes"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || c.maxBytes > 0 && n > c.maxBytes {
+			http.Error(w, "invalid max_bytes", http.StatusBadRequest)
+			return
+		}
+		opts.MaxBytes = n
+	}
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || c.maxDuration > 0 && d > c.maxDuration {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		opts.Duration = d
+	}
+
+	path := filepath.Join(c.dir, fmt.Sprintf("session-%d-%s.pcap", id, time.Now().UTC().Format("20060102T150405")))
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		logrus.Errorf("failed to create capture: %v", err)
+		http.Error(w, "failed to create capture", http.StatusInternalServerError)
+		return
+	}
+	done, err := c.server.Capture(id, f, opts)
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		switch {
+		case errors.Is(err, socks5.ErrSessionNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, socks5.ErrNoTunnel), errors.Is(err, socks5.ErrCaptureActive):
+			http.Error(w, err.Error(), http.StatusConflict)
+		default:
+			logrus.Errorf("failed to start capture: %v", err)
+			http.Error(w, "failed to start capture", http.StatusInternalServerError)
+		}
+		return
+	}
+	logrus.Infof("capturing session %d to %s", id, path)
+	go func() {
+		err := <-done
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			logrus.Errorf("capture of session %d to %s failed: %v", id, path, err)
+			return
+		}
+		logrus.Infof("capture of session %d to %s finished", id, path)
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	if err := json.NewEncoder(w).Encode(map[string]string{"file": path}); err != nil {
+		logrus.Debugf("failed to write capture: %v", err)
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/netip"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// checkACLCommands are the commands accepted by check-acl --cmd
+var checkACLCommands = map[string]uint8{
+	"connect":   socks5.ConnectCommand,
+	"bind":      socks5.BindCommand,
+	"associate": socks5.AssociateCommand,
+}
+
+// checkACL implements the check-acl subcommand, evaluating the policy of
+// the configuration in the environment for a request given on the command
+// line without serving traffic. The policy consists of the settings a
+// shadow policy can override, see policyRules. It returns the exit code:
+// 0 if the request is allowed, 1 if it is denied and 2 on errors.
+func checkACL(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("check-acl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	user := flags.String("user", "", "user the client authenticated as, empty for none")
+	src := flags.String("src", "127.0.0.1", "client IP address")
+	dst := flags.String("dst", "", "destination as host:port")
+	cmd := flags.String("cmd", "connect", "command: connect, bind or associate")
+	resolve := flags.Bool("resolve", true, "resolve destination host names, as the server does")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	fail := func(format string, args ...any) int {
+		fmt.Fprintf(stderr, "check-acl: "+format+"\n", args...)
+		return 2
+	}
+	client, err := netip.ParseAddr(*src)
+	if err != nil {
+		return fail("invalid --src: %v", err)
+	}
+	command, found := checkACLCommands[*cmd]
+	if !found {
+		return fail("invalid --cmd %q", *cmd)
+	}
+	host, portStr, err := net.SplitHostPort(*dst)
+	if err != nil {
+		return fail("invalid --dst: %v", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return fail("invalid --dst port %q", portStr)
+	}
+
+	environ, err := secretEnvironment()
+	if err != nil {
+		return fail("%v", err)
+	}
+	var cfg params
+	if err := env.ParseWithOptions(&cfg, env.Options{Environment: environ}); err != nil {
+		return fail("%v", err)
+	}
+	rules, err := policyRules(cfg)
+	if err != nil {
+		return fail("%v", err)
+	}
+
+	req := &socks5.Request{
+		Version:    5,
+		Command:    command,
+		RemoteAddr: &socks5.AddrSpec{IP: client.Unmap()},
+		DestAddr:   &socks5.AddrSpec{Port: port},
+	}
+	if *user != "" {
+		req.AuthContext = &socks5.AuthContext{Method: socks5.UserPassAuth, Payload: map[string]string{"Username": *user}}
+	}
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		req.DestAddr.IP = ip.Unmap()
+	} else {
+		req.DestAddr.FQDN = strings.ToLower(strings.TrimSuffix(host, "."))
+		if *resolve {
+			if addrs, err := net.DefaultResolver.LookupNetIP(context.Background(), "ip", req.DestAddr.FQDN); err != nil {
+				fmt.Fprintf(stderr, "check-acl: failed to resolve %s, evaluating the name only: %v\n", host, err)
+			} else {
+				req.DestAddr.IP = addrs[0].Unmap()
+			}
+		}
+	}
+
+	ctx, ok := rules.Allow(context.Background(), req)
+	if !ok {
+		reason, _ := socks5.DenyReasonFromContext(ctx)
+		fmt.Fprintf(stdout, "deny %s %v rule=%s reason=%q\n", *cmd, req.DestAddr, reason.Rule, reason.Reason)
+		return 1
+	}
+	fmt.Fprintf(stdout, "allow %s %v", *cmd, req.DestAddr)
+	tags := socks5.TagsFromContext(ctx)
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		fmt.Fprintf(stdout, " tag_%s=%s", key, tags[key])
+	}
+	if class, ok := socks5.BandwidthClassFromContext(ctx); ok {
+		fmt.Fprintf(stdout, " bandwidth_class=%s", class)
+	}
+	fmt.Fprintln(stdout)
+	return 0
+}
+
+// runSubcommand runs the subcommand named by the first argument, if any,
+// and exits with its code. "service run" returns to serve.
+func runSubcommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "check-acl":
+		os.Exit(checkACL(args[1:], os.Stdout, os.Stderr))
+	case "bench":
+		os.Exit(bench(args[1:], os.Stdout, os.Stderr))
+	case "connect-test":
+		os.Exit(connectTest(args[1:], os.Stdout, os.Stderr))
+	case "service":
+		serviceCommand(args[1:])
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+// socksReplies describes the reply codes of RFC 1928 section 6
+var socksReplies = map[uint8]string{
+	socks5.ServerFailure:        "general SOCKS server failure",
+	socks5.RuleFailure:          "connection not allowed by ruleset",
+	socks5.NetworkUnreachable:   "network unreachable",
+	socks5.HostUnreachable:      "host unreachable",
+	socks5.ConnectionRefused:    "connection refused",
+	socks5.TTLExpired:           "TTL expired",
+	socks5.CommandNotSupported:  "command not supported",
+	socks5.AddrTypeNotSupported: "address type not supported",
+}
+
+// connectTest implements the connect-test subcommand, connecting to a
+// destination through a SOCKS5 proxy like a client and printing the
+// duration of each phase: the TCP connection to the proxy, the method
+// selection, the authentication, the dial of the destination by the
+// proxy and the first byte received from it, after a TLS handshake or a
+// probe sent. It returns the exit code: 0 if a byte was received, 1 if a
+// phase failed and 2 on usage errors.
+func connectTest(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("connect-test", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	via := flags.String("via", "localhost:1080", "proxy address as host:port")
+	user := flags.String("user", "", "username, empty to connect without authentication")
+	pass := flags.String("pass", "", "password")
+	useTLS := flags.String("tls", "auto", "TLS handshake with the destination: auto for port 443, yes or no")
+	send := flags.String("send", `HEAD / HTTP/1.0\r\n\r\n`, `data sent to the destination without TLS, \r and \n escaped, empty to wait for it to speak first`)
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of the whole test")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: connect-test [flags] host:port")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	usage := func(format string, args ...any) int {
+		fmt.Fprintf(stderr, "connect-test: "+format+"\n", args...)
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+	dest := flags.Arg(0)
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return usage("invalid destination: %v", err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return usage("invalid destination port %q", portStr)
+	}
+	if len(host) > 255 {
+		return usage("destination host name too long")
+	}
+	var handshakeTLS bool
+	switch *useTLS {
+	case "auto":
+		handshakeTLS = port == 443
+	case "yes":
+		handshakeTLS = true
+	case "no":
+	default:
+		return usage("invalid --tls %q: must be auto, yes or no", *useTLS)
+	}
+	if len(*user) > 255 || len(*pass) > 255 {
+		return usage("username and password are limited to 255 bytes")
+	}
+
+	start := time.Now()
+	last := start
+	phase := func(name, detail string) {
+		now := time.Now()
+		fmt.Fprintf(stdout, "%-11s %10s  %s\n", name, now.Sub(last).Round(time.Microsecond), detail)
+		last = now
+	}
+	fail := func(name string, err error) int {
+		fmt.Fprintf(stdout, "%-11s %10s  failed: %v\n", name, time.Since(last).Round(time.Microsecond), err)
+		return 1
+	}
+
+	conn, err := net.DialTimeout("tcp", *via, *timeout)
+	if err != nil {
+		return fail("connect", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(*timeout))
+	phase("connect", conn.RemoteAddr().String())
+
+	if err := socksConnect(conn, *user, *pass, host, uint16(port), phase); err != nil {
+		failed := err.(*socksPhaseError)
+		return fail(failed.phase, failed.err)
+	}
+
+	// First byte, the server hello with TLS
+	firstByte := &firstByteConn{Conn: conn}
+	if handshakeTLS {
+		tlsConn := tls.Client(firstByte, &tls.Config{ServerName: strings.Trim(host, "[]"), InsecureSkipVerify: true})
+		err := tlsConn.Handshake()
+		if !firstByte.at.IsZero() {
+			fmt.Fprintf(stdout, "%-11s %10s  server hello\n", "first byte", firstByte.at.Sub(last).Round(time.Microsecond))
+			last = firstByte.at
+		}
+		if err != nil {
+			return fail("tls", err)
+		}
+		st := tlsConn.ConnectionState()
+		detail := tls.VersionName(st.Version)
+		if len(st.PeerCertificates) > 0 {
+			detail += ", certificate " + st.PeerCertificates[0].Subject.CommonName
+			if err := st.PeerCertificates[0].VerifyHostname(strings.Trim(host, "[]")); err != nil {
+				detail += " (" + err.Error() + ")"
+			}
+		}
+		phase("tls", detail)
+	} else {
+		probe := strings.NewReplacer(`\r`, "\r", `\n`, "\n").Replace(*send)
+		if _, err := conn.Write([]byte(probe)); err != nil {
+			return fail("first byte", err)
+		}
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(firstByte, b); err != nil {
+			return fail("first byte", err)
+		}
+		phase("first byte", strconv.Quote(string(b)))
+	}
+	fmt.Fprintf(stdout, "%-11s %10s\n", "total", time.Since(start).Round(time.Microsecond))
+	return 0
+}
+
+// socksPhaseError is an error of socksConnect in the named phase
+type socksPhaseError struct {
+	phase string
+	err   error
+}
+
+func (e *socksPhaseError) Error() string {
+	return e.phase + ": " + e.err.Error()
+}
+
+func (e *socksPhaseError) Unwrap() error {
+	return e.err
+}
+
+// socksConnect negotiates a connection to host:port on conn, a client
+// connection to the proxy, authenticating as user unless empty. step is
+// called once each of the handshake, auth and dial phases succeeded,
+// with a detail; errors are *socksPhaseError.
+func socksConnect(conn net.Conn, user, pass, host string, port uint16, step func(phase, detail string)) error {
+	fail := func(phase string, err error) error {
+		return &socksPhaseError{phase, err}
+	}
+
+	// Method selection
+	method := socks5.NoAuth
+	if user != "" {
+		method = socks5.UserPassAuth
+	}
+	if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+		return fail("handshake", err)
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return fail("handshake", err)
+	}
+	if reply[0] != 5 {
+		return fail("handshake", fmt.Errorf("not a SOCKS5 proxy, version %d", reply[0]))
+	}
+	if reply[1] != method {
+		return fail("handshake", fmt.Errorf("method %#x not accepted", method))
+	}
+	if method == socks5.NoAuth {
+		step("handshake", "no authentication")
+	} else {
+		step("handshake", "username/password")
+
+		// RFC 1929 subnegotiation
+		msg := append([]byte{1, byte(len(user))}, user...)
+		msg = append(append(msg, byte(len(pass))), pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return fail("auth", err)
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return fail("auth", err)
+		}
+		if reply[1] != 0 {
+			return fail("auth", fmt.Errorf("credentials of %s rejected", user))
+		}
+		step("auth", "as "+user)
+	}
+
+	// Connect request, the proxy resolves host names
+	req := []byte{5, socks5.ConnectCommand, 0}
+	if ip, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil && ip.Unmap().Is4() {
+		req = append(append(req, 1), ip.Unmap().AsSlice()...)
+	} else if err == nil {
+		req = append(append(req, 4), ip.AsSlice()...)
+	} else {
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return fail("dial", err)
+	}
+	bound, code, err := readSocksReply(conn)
+	if err != nil {
+		return fail("dial", err)
+	}
+	if code != socks5.SuccessReply {
+		text, found := socksReplies[code]
+		if !found {
+			text = fmt.Sprintf("reply %#x", code)
+		}
+		return fail("dial", errors.New(text))
+	}
+	step("dial", net.JoinHostPort(host, strconv.Itoa(int(port)))+" via "+bound)
+	return nil
+}
+
+// readSocksReply reads a reply to a request, returning the bound
+// address and the reply code
+func readSocksReply(r io.Reader) (string, uint8, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", 0, err
+	}
+	if header[0] != 5 {
+		return "", 0, fmt.Errorf("invalid reply version %d", header[0])
+	}
+	var addr []byte
+	switch header[3] {
+	case 1:
+		addr = make([]byte, 4)
+	case 4:
+		addr = make([]byte, 16)
+	case 3:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(r, n); err != nil {
+			return "", 0, err
+		}
+		addr = make([]byte, n[0])
+	default:
+		return "", 0, fmt.Errorf("invalid reply address type %d", header[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return "", 0, err
+	}
+	if _, err := io.ReadFull(r, port); err != nil {
+		return "", 0, err
+	}
+	host := string(addr)
+	if ip, ok := netip.AddrFromSlice(addr); ok && header[3] != 3 {
+		host = ip.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), header[1], nil
+}
+
+// firstByteConn records when the first byte is read from a connection
+type firstByteConn struct {
+	net.Conn
+	at time.Time
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.at.IsZero() {
+		c.at = time.Now()
+	}
+	return n, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+// DestLists returns a RuleSet which restricts destinations to those
+// listed in the allow file, if set, and blocks those listed in the deny
+// file, if set
+func DestLists(rules socks5.RuleSet, allowFile, denyFile string) (socks5.RuleSet, error) {
+	d := &DestListsRuleSet{Rules: rules, AllowFile: allowFile, DenyFile: denyFile}
+	var err error
+	if allowFile != "" {
+		if d.allowed, err = loadDestList(allowFile); err != nil {
+			return nil, err
+		}
+	}
+	if denyFile != "" {
+		if d.denied, err = loadDestList(denyFile); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// DestListsRuleSet is an implementation of the RuleSet which checks
+// destinations against plain lists of domains, including their
+// subdomains, IPs and CIDRs. Denied entries take precedence over allowed
+// ones.
+type DestListsRuleSet struct {
+	Rules     socks5.RuleSet
+	AllowFile string
+	DenyFile  string
+
+	allowed, denied *blocklistIndex
+}
+
+func (d *DestListsRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := d.Rules.Allow(ctx, req)
+	if !ok {
+		return ctx, ok
+	}
+	if d.denied != nil && d.denied.lookup(req.DestAddr) != "" {
+		return socks5.WithDenyReason(ctx, "dest_deny_list", "listed in "+d.DenyFile), false
+	}
+	if d.allowed != nil && d.allowed.lookup(req.DestAddr) == "" {
+		return socks5.WithDenyReason(ctx, "dest_allow_list", "not listed in "+d.AllowFile), false
+	}
+	return ctx, true
+}
+
+// loadDestList reads a file of domains, IPs and CIDRs in the format of
+// parseBlocklist
+func loadDestList(path string) (*blocklistIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list, err := parseBlocklist(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	idx := newBlocklistIndex()
+	idx.add(list, path)
+	return idx, nil
+}
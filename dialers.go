@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"golang.org/x/net/proxy"
+)
+
+// UserDialers is a socks5.DialerSelector connecting the CONNECTs of
+// authenticated users with their own dialer, see parseDialer
+type UserDialers map[string]socks5.DialFunc
+
+func (u UserDialers) SelectDialer(ctx context.Context, auth *socks5.AuthContext, req *socks5.Request) socks5.DialFunc {
+	if auth == nil {
+		return nil
+	}
+	return u[auth.Payload["Username"]]
+}
+
+// parseUserDialers parses the dialer of each user, see parseDialer
+func parseUserDialers(specs map[string]string, passwords socks5.SecretStore) (UserDialers, error) {
+	dialers := make(UserDialers, len(specs))
+	for user, spec := range specs {
+		dial, err := parseDialer(spec, passwords)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dialer of %q: %v", user, err)
+		}
+		dialers[user] = dial
+	}
+	return dialers, nil
+}
+
+// ParamDialers is a socks5.DialerSelector connecting the CONNECTs of
+// users whose username carries a routing parameter, see
+// socks5.UsernameParser, with a pool of dialers by "key:value". A random
+// dialer of the pool is used unless the username has the Session
+// parameter, which pins the same dialer for the same user and value.
+// Other requests are passed to Next, if set.
+type ParamDialers struct {
+	Pools   map[string][]socks5.DialFunc
+	Session string
+	Next    socks5.DialerSelector
+}
+
+func (p *ParamDialers) SelectDialer(ctx context.Context, auth *socks5.AuthContext, req *socks5.Request) socks5.DialFunc {
+	if auth != nil {
+		for _, key := range slices.Sorted(maps.Keys(auth.Params)) {
+			pool := p.Pools[key+":"+auth.Params[key]]
+			if len(pool) == 0 {
+				continue
+			}
+			if session, found := auth.Params[p.Session]; found {
+				h := fnv.New32a()
+				h.Write([]byte(auth.Payload["Username"] + "\x00" + session))
+				return pool[h.Sum32()%uint32(len(pool))]
+			}
+			return pool[rand.IntN(len(pool))]
+		}
+	}
+	if p.Next == nil {
+		return nil
+	}
+	return p.Next.SelectDialer(ctx, auth, req)
+}
+
+// parseParamDialers parses the pools of "key:value" parameters, whose
+// dialers are separated by |, keys must be among params, see parseDialer
+func parseParamDialers(specs map[string]string, params []string, passwords socks5.SecretStore) (map[string][]socks5.DialFunc, error) {
+	pools := make(map[string][]socks5.DialFunc, len(specs))
+	for param, spec := range specs {
+		key, value, _ := strings.Cut(param, ":")
+		if !slices.Contains(params, key) || value == "" {
+			return nil, fmt.Errorf("invalid parameter %q: must be key:value with a key of USERNAME_PARAMS", param)
+		}
+		for _, member := range strings.Split(spec, "|") {
+			dial, err := parseDialer(member, passwords)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dialer of %q: %v", param, err)
+			}
+			pools[param] = append(pools[param], dial)
+		}
+	}
+	return pools, nil
+}
+
+// parseDialer parses comma separated dialer options: "source:IP" binds
+// outbound connections to a local egress address, "fwmark:N" sets the
+// firewall mark used by policy routing, and a socks5:// URL with optional
+// credentials tunnels them through an upstream proxy, itself reached with
+// the other options. The password of an upstream user without one is
+// looked up in passwords, if set, on every dial so rotations apply to new
+// tunnels.
+func parseDialer(spec string, passwords socks5.SecretStore) (socks5.DialFunc, error) {
+	dialer := &net.Dialer{}
+	var upstream *url.URL
+	for _, option := range strings.Split(spec, ",") {
+		option = strings.TrimSpace(option)
+		switch key, value, _ := strings.Cut(option, ":"); {
+		case key == "source":
+			ip, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source address %q", value)
+			}
+			dialer.LocalAddr = &net.TCPAddr{IP: ip.AsSlice(), Zone: ip.Zone()}
+		case key == "fwmark":
+			mark, err := strconv.ParseUint(value, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid fwmark %q", value)
+			}
+			if dialer.Control, err = markControl(int(mark)); err != nil {
+				return nil, err
+			}
+		case key == "socks5" || key == "socks5h":
+			u, err := url.Parse(option)
+			if err != nil || u.Host == "" {
+				return nil, fmt.Errorf("invalid upstream proxy %q", option)
+			}
+			upstream = u
+		default:
+			return nil, fmt.Errorf("invalid option %q: must be source:IP, fwmark:N or a socks5:// URL", option)
+		}
+	}
+	if upstream == nil {
+		return dialer.DialContext, nil
+	}
+	d, err := proxy.FromURL(upstream, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy %q: %v", upstream.Redacted(), err)
+	}
+	if _, hasPassword := upstream.User.Password(); upstream.User == nil || hasPassword || passwords == nil {
+		return d.(proxy.ContextDialer).DialContext, nil
+	}
+
+	user := upstream.User.Username()
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		password, found := passwords.Secret(user)
+		if !found {
+			return nil, fmt.Errorf("no password of upstream proxy user %q", user)
+		}
+		u := *upstream
+		u.User = url.UserPassword(user, password)
+		d, err := proxy.FromURL(&u, dialer)
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, network, addr)
+	}, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+const (
+	// dnsblLookupTimeout bounds a single DNSBL query
+	dnsblLookupTimeout = 2 * time.Second
+
+	// maxDNSBLCache is the cache size above which expired entries are purged
+	maxDNSBLCache = 10000
+)
+
+// DenyListedDest returns a RuleSet which blocks or flags destinations
+// listed in the given DNSBL zones or reputation feed
+func DenyListedDest(rules socks5.RuleSet, zones []string, feed []netip.Prefix, flagOnly bool, ttl time.Duration) socks5.RuleSet {
+	return &DNSBLRuleSet{
+		Rules:    rules,
+		Zones:    zones,
+		Feed:     feed,
+		FlagOnly: flagOnly,
+		TTL:      ttl,
+		cache:    make(map[netip.Addr]dnsblEntry),
+	}
+}
+
+// DNSBLRuleSet is an implementation of the RuleSet which checks
+// destination IPs against DNS blocklists and a local reputation feed
+type DNSBLRuleSet struct {
+	Rules    socks5.RuleSet
+	Zones    []string
+	Feed     []netip.Prefix
+	FlagOnly bool
+	TTL      time.Duration
+
+	mu    sync.Mutex
+	cache map[netip.Addr]dnsblEntry
+}
+
+// dnsblEntry is a cached lookup result, listedIn is empty if not listed
+type dnsblEntry struct {
+	listedIn string
+	expires  time.Time
+}
+
+func (d *DNSBLRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := d.Rules.Allow(ctx, req)
+	if !ok || !req.DestAddr.IP.IsValid() {
+		return ctx, ok
+	}
+
+	listedIn := d.lookup(ctx, req.DestAddr.IP.Unmap())
+	if listedIn == "" {
+		return ctx, true
+	}
+	if d.FlagOnly {
+		requestLog(req).Warnf("destination %v is listed in %s", req.DestAddr, listedIn)
+		return ctx, true
+	}
+	requestLog(req).Warnf("blocking destination %v listed in %s", req.DestAddr, listedIn)
+	return socks5.WithDenyReason(ctx, "dnsbl", "listed in "+listedIn), false
+}
+
+// lookup returns the feed or zone ip is listed in, using the cache
+func (d *DNSBLRuleSet) lookup(ctx context.Context, ip netip.Addr) string {
+	d.mu.Lock()
+	entry, found := d.cache[ip]
+	d.mu.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		return entry.listedIn
+	}
+
+	entry = dnsblEntry{expires: time.Now().Add(d.TTL)}
+	for _, prefix := range d.Feed {
+		if prefix.Contains(ip) {
+			entry.listedIn = "reputation feed (" + prefix.String() + ")"
+			break
+		}
+	}
+	if entry.listedIn == "" {
+		for _, zone := range d.Zones {
+			if dnsblListed(ctx, ip, zone) {
+				entry.listedIn = zone
+				break
+			}
+		}
+	}
+
+	d.mu.Lock()
+	// Drop expired entries before the cache grows unbounded
+	if len(d.cache) >= maxDNSBLCache {
+		now := time.Now()
+		for k, v := range d.cache {
+			if now.After(v.expires) {
+				delete(d.cache, k)
+			}
+		}
+	}
+	d.cache[ip] = entry
+	d.mu.Unlock()
+	return entry.listedIn
+}
+
+// dnsblListed queries a DNSBL zone, a 127.0.0.0/8 answer means listed.
+// Lookup failures are treated as not listed.
+func dnsblListed(ctx context.Context, ip netip.Addr, zone string) bool {
+	ctx, cancel := context.WithTimeout(ctx, dnsblLookupTimeout)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, dnsblName(ip, zone))
+	if err != nil {
+		return false
+	}
+	for _, a := range addrs {
+		if addr, err := netip.ParseAddr(a); err == nil && addr.Is4() && addr.As4()[0] == 127 {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsblName builds the query name: reversed octets for IPv4, reversed
+// nibbles for IPv6, followed by the zone
+func dnsblName(ip netip.Addr, zone string) string {
+	var labels []string
+	if ip.Is4() {
+		b := ip.As4()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprint(b[i]))
+		}
+	} else {
+		b := ip.As16()
+		for i := len(b) - 1; i >= 0; i-- {
+			labels = append(labels, fmt.Sprintf("%x", b[i]&0xf), fmt.Sprintf("%x", b[i]>>4))
+		}
+	}
+	return strings.Join(labels, ".") + "." + zone
+}
+
+// loadReputationFeed reads a file of IPs and CIDRs, one per line.
+// Empty lines and lines starting with # are ignored.
+func loadReputationFeed(path string) ([]netip.Prefix, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var feed []netip.Prefix
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prefix, err := parsePrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		feed = append(feed, prefix)
+	}
+	return feed, scanner.Err()
+}
+
+// parsePrefix parses a CIDR or a single IP address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		return netip.ParsePrefix(s)
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
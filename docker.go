@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// detectDockerNetworks returns the subnets of the Docker bridges visible
+// to the process: docker0 and br-* interfaces on the host or, when running
+// inside a container, the networks the container is attached to through
+// veth interfaces. The interfaces of the host seen by a container with
+// host networking are not trusted.
+func detectDockerNetworks() ([]netip.Prefix, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat("/.dockerenv")
+	inContainer := err == nil
+
+	networks := []netip.Prefix{}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		bridge := iface.Name == "docker0" || strings.HasPrefix(iface.Name, "br-")
+		if !bridge && !(inContainer && isVeth(iface)) {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			ip, _ := netip.AddrFromSlice(ipNet.IP)
+			ip = ip.Unmap()
+			if ip.IsLinkLocalUnicast() {
+				continue
+			}
+			ones, _ := ipNet.Mask.Size()
+			network := netip.PrefixFrom(ip, ones).Masked()
+			logrus.Infof("Detected Docker network %v on interface %s", network, iface.Name)
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// isVeth reports whether iface is the end of a veth pair, as the
+// interfaces of a container attached to Docker networks are: its link is
+// the peer interface on the host rather than itself
+func isVeth(iface net.Interface) bool {
+	data, err := os.ReadFile("/sys/class/net/" + iface.Name + "/iflink")
+	if err != nil {
+		return false
+	}
+	link, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	return err == nil && link != iface.Index
+}
+
+// dockerNetworks parses DOCKER_NETWORKS, falling back to detection when
+// unset. The value "none" disables the Docker network allowance.
+func dockerNetworks(values []string) ([]netip.Prefix, error) {
+	if len(values) == 0 {
+		return detectDockerNetworks()
+	}
+	networks := []netip.Prefix{}
+	if len(values) == 1 && values[0] == "none" {
+		return networks, nil
+	}
+	for _, v := range values {
+		prefix, err := parsePrefix(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, prefix.Masked())
+	}
+	return networks, nil
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// elasticQueue is the number of records waiting to be indexed, further
+	// ones are dropped
+	elasticQueue = 4096
+
+	// elasticBatch and elasticFlushInterval bound how many records are
+	// indexed together and how long they wait to be batched
+	elasticBatch         = 500
+	elasticFlushInterval = 5 * time.Second
+
+	// elasticTimeout bounds a request
+	elasticTimeout = 30 * time.Second
+
+	// elasticMinBackoff and elasticMaxBackoff bound the delay between
+	// retries, doubled after each failure
+	elasticMinBackoff = time.Second
+	elasticMaxBackoff = 5 * time.Minute
+
+	// elasticMemoryBatches is the number of failed batches kept in memory
+	// without a spool directory, older ones are dropped
+	elasticMemoryBatches = 100
+
+	// elasticSpoolMax bounds the size of the spool directory, further
+	// batches are dropped
+	elasticSpoolMax = 1 << 30
+)
+
+// elasticTemplate is the index template of the audit indices, strings
+// other than errors are mapped as keywords
+const elasticTemplate = `{
+	"index_patterns": [%q],
+	"priority": 100,
+	"template": {
+		"settings": {"number_of_shards": 1},
+		"mappings": {
+			"dynamic_templates": [
+				{"strings": {"match_mapping_type": "string", "mapping": {"type": "keyword"}}}
+			],
+			"properties": {
+				"@timestamp": {"type": "date"},
+				"start": {"type": "date"},
+				"session": {"type": "long"},
+				"client_ip": {"type": "ip"},
+				"bytes_up": {"type": "long"},
+				"bytes_down": {"type": "long"},
+				"duration_ms": {"type": "long"},
+				"error": {"type": "text"},
+				"deny_reason": {"type": "text"}
+			}
+		}
+	}
+}`
+
+// ElasticSink indexes an audit record per session into daily indices of an
+// Elasticsearch or OpenSearch cluster using the bulk API, named by a
+// prefix followed by the date, after installing an index template for
+// them. Failed batches are retried with exponential backoff, buffered in
+// memory or, to survive restarts, in a spool directory. Records beyond a
+// full queue are dropped.
+type ElasticSink struct {
+	url   string
+	auth  string
+	index string
+	host  string
+	spool string
+
+	records chan elasticRecord
+	flushes chan chan error
+	dropped atomic.Uint64
+
+	templated bool
+	pending   [][]byte
+	spooled   []string
+	backoff   time.Duration
+	retryAt   time.Time
+}
+
+// elasticRecord is an audit record and the index it goes to
+type elasticRecord struct {
+	index string
+	data  map[string]any
+}
+
+// NewElasticSink creates an ElasticSink for the cluster at rawURL, with
+// the basic auth credentials it contains or apiKey, indexing into indices
+// prefixed by index. Failed batches are kept in spool unless empty.
+func NewElasticSink(rawURL, apiKey, index, spool string) (*ElasticSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q: must be http or https", u.Redacted())
+	}
+	if index == "" || strings.ToLower(index) != index || strings.ContainsAny(index, `\/*?"<>| ,#:`) {
+		return nil, fmt.Errorf("invalid index %q: must be lowercase without special characters", index)
+	}
+	s := &ElasticSink{
+		index:   index,
+		spool:   spool,
+		records: make(chan elasticRecord, elasticQueue),
+		flushes: make(chan chan error),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req, _ := http.NewRequest(http.MethodPost, "/", nil)
+		req.SetBasicAuth(u.User.Username(), password)
+		s.auth = req.Header.Get("Authorization")
+		u.User = nil
+	}
+	if apiKey != "" {
+		s.auth = "ApiKey " + apiKey
+	}
+	s.url = strings.TrimSuffix(u.String(), "/")
+	s.host, _ = os.Hostname()
+
+	// Resume the batches spooled before the last restart
+	if spool != "" {
+		if err := os.MkdirAll(spool, 0o700); err != nil {
+			return nil, err
+		}
+		entries, err := os.ReadDir(spool)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if filepath.Ext(entry.Name()) == ".ndjson" {
+				s.spooled = append(s.spooled, filepath.Join(spool, entry.Name()))
+			}
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// Record queues the audit record of a finished session, it is a
+// socks5.Config.OnSessionEnd callback
+func (s *ElasticSink) Record(info socks5.SessionInfo) {
+	end := time.Now()
+	data := sessionEndData(info, end)
+	data["@timestamp"] = end.UTC()
+	data["client_ip"] = info.Client.Addr().String()
+	if s.host != "" {
+		data["host"] = s.host
+	}
+	r := elasticRecord{index: s.index + "-" + end.UTC().Format("2006.01.02"), data: data}
+	select {
+	case s.records <- r:
+	default:
+		if s.dropped.Add(1)%1000 == 1 {
+			logrus.Warnf("Elasticsearch queue full, dropped %d audit records so far", s.dropped.Load())
+		}
+	}
+}
+
+// Flush indexes the queued records, returning once they are indexed or
+// spooled, or when ctx is done. Failed batches kept in memory are
+// reported as an error, they are lost on exit.
+func (s *ElasticSink) Flush(ctx context.Context) error {
+	return requestFlush(ctx, s.flushes)
+}
+
+// run indexes the queued records in batches and retries failed ones
+func (s *ElasticSink) run() {
+	ticker := time.NewTicker(elasticFlushInterval)
+	defer ticker.Stop()
+	var batch bytes.Buffer
+	records := 0
+	add := func(r elasticRecord) {
+		if err := encodeBulk(&batch, r); err != nil {
+			logrus.Errorf("failed to encode audit record: %v", err)
+			return
+		}
+		records++
+	}
+	for {
+		select {
+		case r := <-s.records:
+			if add(r); records < elasticBatch {
+				continue
+			}
+		case <-ticker.C:
+			if records == 0 {
+				s.retry()
+				continue
+			}
+		case done := <-s.flushes:
+			for n := len(s.records); n > 0; n-- {
+				add(<-s.records)
+			}
+			if records > 0 {
+				s.flush(bytes.Clone(batch.Bytes()))
+				batch.Reset()
+				records = 0
+			}
+			s.retry()
+			var err error
+			if len(s.pending) > 0 {
+				err = fmt.Errorf("%d batches of audit records not indexed", len(s.pending))
+			}
+			done <- err
+			continue
+		}
+		s.flush(bytes.Clone(batch.Bytes()))
+		batch.Reset()
+		records = 0
+	}
+}
+
+// encodeBulk appends the bulk actions creating r to buf, with a random ID
+// so that retrying a batch does not duplicate records
+func encodeBulk(buf *bytes.Buffer, r elasticRecord) error {
+	doc, err := json.Marshal(r.data)
+	if err != nil {
+		return err
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	action, _ := json.Marshal(map[string]any{"create": map[string]string{"_index": r.index, "_id": hex.EncodeToString(id)}})
+	buf.Write(action)
+	buf.WriteByte('\n')
+	buf.Write(doc)
+	buf.WriteByte('\n')
+	return nil
+}
+
+// flush indexes body, or buffers it behind earlier failed batches
+func (s *ElasticSink) flush(body []byte) {
+	if len(s.pending) == 0 && len(s.spooled) == 0 && time.Now().After(s.retryAt) {
+		rest, err := s.bulk(body)
+		if err == nil {
+			return
+		}
+		s.failed(err)
+		body = rest
+	}
+	s.buffer(body)
+	s.retry()
+}
+
+// retry indexes the buffered batches, oldest first, once the backoff
+// expired
+func (s *ElasticSink) retry() {
+	for time.Now().After(s.retryAt) {
+		if len(s.spooled) > 0 {
+			path := s.spooled[0]
+			body, err := os.ReadFile(path)
+			if err != nil {
+				logrus.Errorf("failed to read spooled audit records: %v", err)
+			} else if rest, err := s.bulk(body); err != nil {
+				s.failed(err)
+				if len(rest) < len(body) {
+					writeSpool(path, rest)
+				}
+				return
+			}
+			os.Remove(path)
+			s.spooled = s.spooled[1:]
+		} else if len(s.pending) > 0 {
+			rest, err := s.bulk(s.pending[0])
+			if err != nil {
+				s.failed(err)
+				s.pending[0] = rest
+				return
+			}
+			s.pending = s.pending[1:]
+		} else {
+			return
+		}
+		s.backoff = 0
+	}
+}
+
+// failed logs err and backs off
+func (s *ElasticSink) failed(err error) {
+	s.backoff = min(max(2*s.backoff, elasticMinBackoff), elasticMaxBackoff)
+	s.retryAt = time.Now().Add(s.backoff)
+	logrus.Warnf("failed to index audit records, retrying in %v: %v", s.backoff, err)
+}
+
+// buffer keeps body for a later retry
+func (s *ElasticSink) buffer(body []byte) {
+	if s.spool == "" {
+		if len(s.pending) == elasticMemoryBatches {
+			logrus.Warnf("Elasticsearch retry buffer full, dropped %d audit records", bytes.Count(s.pending[0], []byte("\n"))/2)
+			s.pending = s.pending[1:]
+		}
+		s.pending = append(s.pending, body)
+		return
+	}
+
+	var size int64
+	for _, path := range s.spooled {
+		if info, err := os.Stat(path); err == nil {
+			size += info.Size()
+		}
+	}
+	if size+int64(len(body)) > elasticSpoolMax {
+		logrus.Warnf("Elasticsearch spool full, dropped %d audit records", bytes.Count(body, []byte("\n"))/2)
+		return
+	}
+	path := filepath.Join(s.spool, fmt.Sprintf("%020d.ndjson", time.Now().UnixNano()))
+	if err := writeSpool(path, body); err != nil {
+		logrus.Errorf("failed to spool %d audit records: %v", bytes.Count(body, []byte("\n"))/2, err)
+		return
+	}
+	s.spooled = append(s.spooled, path)
+}
+
+// writeSpool replaces the spool file at path with body
+func writeSpool(path string, body []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// bulk indexes the records of body, installing the index template first.
+// On failure, it returns the records to retry: all of them, or those
+// rejected temporarily. Records rejected for good are dropped.
+func (s *ElasticSink) bulk(body []byte) ([]byte, error) {
+	if !s.templated {
+		if err := s.putTemplate(); err != nil {
+			return body, fmt.Errorf("index template: %v", err)
+		}
+		s.templated = true
+	}
+
+	resp, err := s.request(http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return body, err
+	}
+	var result struct {
+		Errors bool                         `json:"errors"`
+		Items  []map[string]json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return body, err
+	}
+	if !result.Errors {
+		return nil, nil
+	}
+
+	lines := bytes.SplitAfter(body, []byte("\n"))
+	var rest bytes.Buffer
+	var dropped int
+	var reason string
+	for i, item := range result.Items {
+		var op struct {
+			Status int             `json:"status"`
+			Error  json.RawMessage `json:"error"`
+		}
+		json.Unmarshal(item["create"], &op)
+		switch {
+		case op.Status < 300, op.Status == http.StatusConflict:
+			// Indexed, possibly by an earlier attempt
+		case op.Status == http.StatusTooManyRequests, op.Status >= 500:
+			if 2*i+1 < len(lines) {
+				rest.Write(lines[2*i])
+				rest.Write(lines[2*i+1])
+			}
+		default:
+			dropped++
+			reason = string(op.Error)
+		}
+	}
+	if dropped > 0 {
+		logrus.Errorf("Elasticsearch rejected %d audit records: %s", dropped, reason)
+	}
+	if rest.Len() > 0 {
+		return rest.Bytes(), fmt.Errorf("%d records rejected temporarily", bytes.Count(rest.Bytes(), []byte("\n"))/2)
+	}
+	return nil, nil
+}
+
+// putTemplate installs the index template of the audit indices
+func (s *ElasticSink) putTemplate() error {
+	template := fmt.Sprintf(elasticTemplate, s.index+"-*")
+	_, err := s.request(http.MethodPut, "/_index_template/"+s.index, "application/json", []byte(template))
+	return err
+}
+
+// request sends a request to the cluster and returns the response body
+func (s *ElasticSink) request(method, path, contentType string, body []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), elasticTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.auth != "" {
+		req.Header.Set("Authorization", s.auth)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		if len(data) > 512 {
+			data = data[:512]
+		}
+		return nil, fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	return data, nil
+}
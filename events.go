@@ -0,0 +1,330 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/nats-io/nats.go"
+	"github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventQueue is the number of events waiting to be published, further
+	// ones are dropped
+	eventQueue = 4096
+
+	// eventBatch and eventFlushInterval bound how many events are
+	// published together and how long they wait to be batched
+	eventBatch         = 100
+	eventFlushInterval = time.Second
+
+	// eventPublishTimeout bounds the publication of a batch
+	eventPublishTimeout = 10 * time.Second
+)
+
+// eventFormats are the serializations of EventBus
+var eventFormats = []string{"json", "cloudevents"}
+
+// EventBus publishes session lifecycle and security events to the topics
+// of a Kafka cluster or the subjects of a NATS server, named by the prefix
+// followed by a dot and the event type: session_start, session_end,
+// denial, auth_failure and ban. Events are serialized as JSON objects with
+// a type and a time, or as structured CloudEvents 1.0 carrying the same
+// object as data. They are published in the background, events beyond a
+// full queue are dropped.
+type EventBus struct {
+	publisher eventPublisher
+	prefix    string
+	format    string
+	source    string
+
+	events  chan busEvent
+	flushes chan chan error
+	dropped atomic.Uint64
+}
+
+// busEvent is an event waiting to be published, key groups the events of
+// a client on the same Kafka partition
+type busEvent struct {
+	kind string
+	time time.Time
+	key  string
+	data map[string]any
+}
+
+// eventMessage is a serialized event published to a topic or subject
+type eventMessage struct {
+	subject string
+	key     []byte
+	data    []byte
+}
+
+// eventPublisher delivers messages to a message broker
+type eventPublisher interface {
+	Publish(ctx context.Context, msgs []eventMessage) error
+}
+
+// NewEventBus connects to the broker at rawURL, nats:// or kafka://
+// followed by comma separated servers, publishing events under prefix in
+// format
+func NewEventBus(rawURL, prefix, format string) (*EventBus, error) {
+	if !slices.Contains(eventFormats, format) {
+		return nil, fmt.Errorf("invalid format %q: must be json or cloudevents", format)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var publisher eventPublisher
+	switch u.Scheme {
+	case "nats", "tls":
+		conn, err := nats.Connect(rawURL, nats.Name("socks5-server"), nats.MaxReconnects(-1))
+		if err != nil {
+			return nil, err
+		}
+		publisher = natsPublisher{conn}
+	case "kafka":
+		brokers := strings.Split(u.Host, ",")
+		publisher = kafkaPublisher{&kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Balancer:               &kafka.Hash{},
+			RequiredAcks:           kafka.RequireOne,
+			BatchTimeout:           10 * time.Millisecond,
+			AllowAutoTopicCreation: true,
+		}}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q: must be nats or kafka", u.Scheme)
+	}
+
+	b := &EventBus{
+		publisher: publisher,
+		prefix:    prefix,
+		format:    format,
+		source:    "socks5-server",
+		events:    make(chan busEvent, eventQueue),
+		flushes:   make(chan chan error),
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		b.source += "/" + hostname
+	}
+	go b.run()
+	return b, nil
+}
+
+// SessionStart publishes the start of a session, it is a
+// socks5.Config.OnSessionStart callback
+func (b *EventBus) SessionStart(info socks5.SessionInfo) {
+	b.queue("session_start", info.Client.Addr().String(), sessionEventData(info))
+}
+
+// SessionEnd publishes the end of a session and its denial, if any, it is
+// a socks5.Config.OnSessionEnd callback
+func (b *EventBus) SessionEnd(info socks5.SessionInfo) {
+	data := sessionEndData(info, time.Now())
+	if info.DenyReason != nil {
+		b.queue("denial", info.Client.Addr().String(), maps.Clone(data))
+	}
+	b.queue("session_end", info.Client.Addr().String(), data)
+}
+
+// AuthFailure publishes a failed authentication, it is a
+// socks5.Config.OnAuthFailure callback
+func (b *EventBus) AuthFailure(failure socks5.AuthFailure) {
+	data := map[string]any{
+		"session": failure.ID,
+		"client":  failure.Client.String(),
+		"error":   failure.Err.Error(),
+	}
+	if failure.User != "" {
+		data["user"] = failure.User
+	}
+	b.queue("auth_failure", failure.Client.Addr().String(), data)
+}
+
+// Ban publishes a new ban, it is a socks5.BanList.OnBan callback
+func (b *EventBus) Ban(ban socks5.Ban) {
+	data := map[string]any{
+		"ip":      ban.IP.String(),
+		"expires": ban.Expires.UTC(),
+	}
+	if ban.Reason != "" {
+		data["reason"] = ban.Reason
+	}
+	b.queue("ban", ban.IP.String(), data)
+}
+
+// sessionEventData returns the fields describing a session
+func sessionEventData(info socks5.SessionInfo) map[string]any {
+	data := map[string]any{
+		"session": info.ID,
+		"client":  info.Client.String(),
+		"start":   info.Start.UTC(),
+	}
+	if info.User != "" {
+		data["user"] = info.User
+	}
+	if info.Command != "" {
+		data["command"] = info.Command
+	}
+	if info.Dest != nil {
+		data["dest"] = info.Dest.String()
+	}
+	if len(info.Tags) > 0 {
+		data["tags"] = info.Tags
+	}
+	return data
+}
+
+// sessionEndData returns the fields describing a session ended at end
+func sessionEndData(info socks5.SessionInfo, end time.Time) map[string]any {
+	data := sessionEventData(info)
+	data["bytes_up"] = info.BytesUp
+	data["bytes_down"] = info.BytesDown
+	data["duration_ms"] = end.Sub(info.Start).Milliseconds()
+	if info.Remote.IsValid() {
+		data["remote"] = info.Remote.String()
+	}
+	if info.Err != nil {
+		data["error"] = info.Err.Error()
+	}
+	if r := info.DenyReason; r != nil {
+		data["deny_rule"] = r.Rule
+		if r.Reason != "" {
+			data["deny_reason"] = r.Reason
+		}
+	}
+	return data
+}
+
+// queue publishes an event in the background unless the queue is full
+func (b *EventBus) queue(kind, key string, data map[string]any) {
+	select {
+	case b.events <- busEvent{kind: kind, time: time.Now(), key: key, data: data}:
+	default:
+		if b.dropped.Add(1)%1000 == 1 {
+			logrus.Warnf("event bus queue full, dropped %d events so far", b.dropped.Load())
+		}
+	}
+}
+
+// Flush publishes the queued events, returning once they are or when ctx
+// is done
+func (b *EventBus) Flush(ctx context.Context) error {
+	return requestFlush(ctx, b.flushes)
+}
+
+// run publishes the queued events in batches
+func (b *EventBus) run() {
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+	var batch []eventMessage
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), eventPublishTimeout)
+		err := b.publisher.Publish(ctx, batch)
+		if err != nil {
+			logrus.Errorf("failed to publish %d events: %v", len(batch), err)
+		}
+		cancel()
+		batch = batch[:0]
+		return err
+	}
+	add := func(e busEvent) error {
+		msg, err := b.encode(e)
+		if err != nil {
+			logrus.Errorf("failed to encode %s event: %v", e.kind, err)
+			return nil
+		}
+		if batch = append(batch, msg); len(batch) >= eventBatch {
+			return flush()
+		}
+		return nil
+	}
+	for {
+		select {
+		case e := <-b.events:
+			add(e)
+		case <-ticker.C:
+			flush()
+		case done := <-b.flushes:
+			var err error
+			for n := len(b.events); n > 0; n-- {
+				err = cmp.Or(add(<-b.events), err)
+			}
+			done <- cmp.Or(flush(), err)
+		}
+	}
+}
+
+// encode serializes an event in the format of the bus
+func (b *EventBus) encode(e busEvent) (eventMessage, error) {
+	subject := b.prefix + "." + e.kind
+	var v any
+	switch b.format {
+	case "cloudevents":
+		id := make([]byte, 16)
+		rand.Read(id)
+		v = map[string]any{
+			"specversion":     "1.0",
+			"id":              hex.EncodeToString(id),
+			"source":          b.source,
+			"type":            subject,
+			"time":            e.time.UTC(),
+			"datacontenttype": "application/json",
+			"data":            e.data,
+		}
+	default:
+		e.data["type"] = e.kind
+		e.data["time"] = e.time.UTC()
+		v = e.data
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return eventMessage{}, err
+	}
+	return eventMessage{subject: subject, key: []byte(e.key), data: data}, nil
+}
+
+// natsPublisher publishes to the subjects of a NATS server
+type natsPublisher struct {
+	conn *nats.Conn
+}
+
+func (p natsPublisher) Publish(ctx context.Context, msgs []eventMessage) error {
+	for _, msg := range msgs {
+		if err := p.conn.Publish(msg.subject, msg.data); err != nil {
+			return err
+		}
+	}
+	return p.conn.FlushWithContext(ctx)
+}
+
+// kafkaPublisher produces to the topics of a Kafka cluster
+type kafkaPublisher struct {
+	writer *kafka.Writer
+}
+
+func (p kafkaPublisher) Publish(ctx context.Context, msgs []eventMessage) error {
+	records := make([]kafka.Message, len(msgs))
+	for i, msg := range msgs {
+		records[i] = kafka.Message{Topic: msg.subject, Key: msg.key, Value: msg.data}
+	}
+	return p.writer.WriteMessages(ctx, records...)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxFanoutClients is the tracker size above which idle clients are purged
+	maxFanoutClients = 10000
+)
+
+// LimitDestFanout returns a RuleSet which detects clients connecting to more
+// than max distinct destinations within window. Such clients are either
+// throttled, having further new destinations denied until the window
+// passes, or added to bans for banFor when bans is not nil.
+func LimitDestFanout(rules socks5.RuleSet, max int, window time.Duration, bans *socks5.BanList, banFor time.Duration) socks5.RuleSet {
+	return &FanoutRuleSet{
+		Rules:   rules,
+		Max:     max,
+		Window:  window,
+		BanList: bans,
+		BanFor:  banFor,
+		clients: make(map[netip.Addr]*fanoutClient),
+	}
+}
+
+// FanoutRuleSet is an implementation of the RuleSet which limits the
+// number of distinct destinations per client, protecting against the
+// proxy being used as a port-scanning relay
+type FanoutRuleSet struct {
+	Rules   socks5.RuleSet
+	Max     int
+	Window  time.Duration
+	BanList *socks5.BanList
+	BanFor  time.Duration
+
+	mu      sync.Mutex
+	clients map[netip.Addr]*fanoutClient
+}
+
+// fanoutClient tracks the destinations recently requested by a client
+type fanoutClient struct {
+	dests    map[string]time.Time
+	lastSeen time.Time
+}
+
+func (f *FanoutRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := f.Rules.Allow(ctx, req)
+	if !ok || req.RemoteAddr == nil {
+		return ctx, ok
+	}
+	if !f.track(req, req.RemoteAddr.IP, req.DestAddr.String()) {
+		return socks5.WithDenyReason(ctx, "fanout", fmt.Sprintf("more than %d distinct destinations within %v", f.Max, f.Window)), false
+	}
+	return ctx, true
+}
+
+// track records a destination requested by ip and reports whether the
+// request is within limits
+func (f *FanoutRuleSet) track(req *socks5.Request, ip netip.Addr, dest string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	f.purge(now)
+
+	c, found := f.clients[ip]
+	if !found {
+		c = &fanoutClient{dests: make(map[string]time.Time)}
+		f.clients[ip] = c
+	}
+	c.lastSeen = now
+
+	// Forget destinations outside the window
+	for d, seen := range c.dests {
+		if now.Sub(seen) > f.Window {
+			delete(c.dests, d)
+		}
+	}
+
+	if _, known := c.dests[dest]; known || len(c.dests) < f.Max {
+		c.dests[dest] = now
+		return true
+	}
+
+	if f.BanList != nil {
+		clear(c.dests)
+		requestLog(req).Warnf("banning %v for %s: more than %d distinct destinations within %s", ip, f.BanFor, f.Max, f.Window)
+		if err := f.BanList.Ban(ip, f.BanFor, "destination fanout"); err != nil {
+			logrus.Errorf("failed to persist ban list: %v", err)
+		}
+	} else {
+		requestLog(req).Warnf("throttling %v: more than %d distinct destinations within %s", ip, f.Max, f.Window)
+	}
+	return false
+}
+
+// purge drops idle clients once the tracker grows large
+func (f *FanoutRuleSet) purge(now time.Time) {
+	if len(f.clients) < maxFanoutClients {
+		return
+	}
+	for ip, c := range f.clients {
+		if now.Sub(c.lastSeen) > f.Window {
+			delete(f.clients, ip)
+		}
+	}
+}
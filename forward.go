@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Forward is a static TCP tunnel from a local port to a fixed destination
+type Forward struct {
+	Port string
+	Dest *socks5.AddrSpec
+}
+
+// parseForward parses a "port:host:port" forward, IPv6 hosts in brackets
+func parseForward(s string) (Forward, error) {
+	port, target, found := strings.Cut(s, ":")
+	if !found {
+		return Forward{}, fmt.Errorf("invalid forward %q: want port:host:port", s)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return Forward{}, fmt.Errorf("invalid forward %q: invalid listen port %q", s, port)
+	}
+	host, destPort, err := net.SplitHostPort(target)
+	if err != nil {
+		return Forward{}, fmt.Errorf("invalid forward %q: %v", s, err)
+	}
+	n, err := strconv.Atoi(destPort)
+	if err != nil || n < 1 || n > 65535 {
+		return Forward{}, fmt.Errorf("invalid forward %q: invalid destination port %q", s, destPort)
+	}
+
+	dest := &socks5.AddrSpec{Port: n}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		dest.IP = ip
+	} else {
+		dest.FQDN = host
+	}
+	return Forward{Port: port, Dest: dest}, nil
+}
+
+// serveForwards opens a listener for every forward and serves it through
+// server
+func serveForwards(server *socks5.Server, forwards []string) error {
+	for _, entry := range forwards {
+		fwd, err := parseForward(entry)
+		if err != nil {
+			return err
+		}
+		l, err := upgrades.listen("tcp", ":"+fwd.Port, net.Listen)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Start forwarding port %s to %v", fwd.Port, fwd.Dest.Address())
+		go func() {
+			if err := server.ServeForward(l, fwd.Dest); err != nil && err != socks5.ErrServerClosed {
+				logrus.Errorf("forward of port %s stopped: %v", fwd.Port, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// serveDNS opens the UDP and TCP DNS listeners on port
+func serveDNS(server *socks5.Server, port string) error {
+	pc, err := upgrades.listenPacket("udp", ":"+port, net.ListenPacket)
+	if err != nil {
+		return err
+	}
+	l, err := upgrades.listen("tcp", ":"+port, net.Listen)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	logrus.Infof("Start listening DNS forwarder on port %s", port)
+	go func() {
+		if err := server.ServeDNS(pc); err != nil {
+			logrus.Errorf("DNS forwarder stopped: %v", err)
+		}
+	}()
+	go func() {
+		if err := server.ServeDNSStream(l); err != nil && err != socks5.ErrServerClosed {
+			logrus.Errorf("DNS forwarder stopped: %v", err)
+		}
+	}()
+	return nil
+}
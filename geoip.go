@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/sirupsen/logrus"
+)
+
+// geoCountry is the subset of a GeoLite2/GeoIP2 Country or City record we log
+type geoCountry struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// geoASN is the subset of a GeoLite2/GeoIP2 ASN record we log
+type geoASN struct {
+	Number       uint   `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// GeoIPEnricher is an implementation of the AccessLogEnricher which
+// annotates access log records with the country and ASN of the client
+// and destination, looked up from local MMDB files
+type GeoIPEnricher struct {
+	Country *maxminddb.Reader
+	ASN     *maxminddb.Reader
+}
+
+// NewGeoIPEnricher opens the given MMDB files, either of which may be empty
+func NewGeoIPEnricher(countryDB, asnDB string) (*GeoIPEnricher, error) {
+	e := &GeoIPEnricher{}
+	var err error
+	if countryDB != "" {
+		if e.Country, err = maxminddb.Open(countryDB); err != nil {
+			return nil, err
+		}
+	}
+	if asnDB != "" {
+		if e.ASN, err = maxminddb.Open(asnDB); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *GeoIPEnricher) Enrich(req *socks5.Request, fields logrus.Fields) {
+	if req.RemoteAddr != nil {
+		e.annotate("client", req.RemoteAddr.IP, fields)
+	}
+	if req.DestAddr != nil {
+		e.annotate("dest", req.DestAddr.IP, fields)
+	}
+}
+
+// annotate adds the country and ASN fields of ip using the given prefix
+func (e *GeoIPEnricher) annotate(prefix string, ip netip.Addr, fields logrus.Fields) {
+	if !ip.IsValid() || ip.IsPrivate() || ip.IsLoopback() {
+		return
+	}
+	addr := net.IP(ip.AsSlice())
+
+	if e.Country != nil {
+		var record geoCountry
+		if err := e.Country.Lookup(addr, &record); err == nil && record.Country.ISOCode != "" {
+			fields[prefix+"_country"] = record.Country.ISOCode
+		}
+	}
+	if e.ASN != nil {
+		var record geoASN
+		if err := e.ASN.Lookup(addr, &record); err == nil && record.Number != 0 {
+			fields[prefix+"_asn"] = record.Number
+			fields[prefix+"_as_org"] = record.Organization
+		}
+	}
+}
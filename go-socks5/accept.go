@@ -0,0 +1,88 @@
+package socks5
+
+import (
+	"math"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxAcceptRateBuckets is the number of client buckets kept before
+// refilled ones are pruned
+const maxAcceptRateBuckets = 10000
+
+// acceptLimiter limits the rate of accepted connections overall and per
+// client IP, see Config.AcceptRate
+type acceptLimiter struct {
+	global *tokenBucket
+
+	rate    float64
+	burst   int
+	mu      sync.Mutex
+	buckets map[netip.Addr]*tokenBucket
+}
+
+// newAcceptLimiter returns the acceptLimiter of conf, nil without limits
+func newAcceptLimiter(conf *Config) *acceptLimiter {
+	if conf.AcceptRate <= 0 && conf.AcceptRatePerIP <= 0 {
+		return nil
+	}
+	l := &acceptLimiter{rate: conf.AcceptRatePerIP, burst: conf.AcceptBurstPerIP, buckets: make(map[netip.Addr]*tokenBucket)}
+	if conf.AcceptRate > 0 {
+		burst := conf.AcceptBurst
+		if burst <= 0 {
+			burst = int(math.Ceil(conf.AcceptRate))
+		}
+		l.global = newTokenBucket(conf.AcceptRate, burst)
+	}
+	if l.burst <= 0 {
+		l.burst = int(math.Ceil(l.rate))
+	}
+	return l
+}
+
+// allow reports whether a connection from client may be accepted now. The
+// client is checked first, so a single flooding client does not use up
+// the global rate.
+func (l *acceptLimiter) allow(client netip.Addr) bool {
+	if l.rate > 0 {
+		l.mu.Lock()
+		bucket, found := l.buckets[client]
+		if !found {
+			if len(l.buckets) >= maxAcceptRateBuckets {
+				now := time.Now()
+				for ip, b := range l.buckets {
+					if b.full(now) {
+						delete(l.buckets, ip)
+					}
+				}
+			}
+			bucket = newTokenBucket(l.rate, l.burst)
+			l.buckets[client] = bucket
+		}
+		l.mu.Unlock()
+		if !bucket.Allow() {
+			return false
+		}
+	}
+	return l.global == nil || l.global.Allow()
+}
+
+// admitAccepted reports whether conn is within the accept rate, closing it
+// before any goroutine is spawned otherwise
+func (s *Server) admitAccepted(conn net.Conn) bool {
+	if s.acceptLimiter == nil {
+		return true
+	}
+	client := addrPort(conn.RemoteAddr()).Addr().Unmap()
+	if s.acceptLimiter.allow(client) {
+		return true
+	}
+	conn.Close()
+	s.countDenial("accept_rate")
+	s.logThrottled(logrus.WarnLevel, client.String(), "closing connection from %s: accept rate exceeded", client)
+	return false
+}
@@ -0,0 +1,91 @@
+package socks5
+
+import (
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AccessLogEnricher is used to add custom fields to access log records
+type AccessLogEnricher interface {
+	Enrich(req *Request, fields logrus.Fields)
+}
+
+// commandNames maps commands to their access log representation
+var commandNames = map[uint8]string{
+	ConnectCommand:    "connect",
+	BindCommand:       "bind",
+	AssociateCommand:  "associate",
+	UDPOverTCPCommand: "udp-over-tcp",
+}
+
+// logAccess writes the access log record of a finished request. With
+// sampling only every Config.AccessLogSampleRate successful request is
+// logged, failed and denied ones always are.
+func (s *Server) logAccess(sess *Session, req *Request, err error) {
+	s.stats.requests.Add(1)
+	s.countTags(req)
+	rate := s.config.AccessLogSampleRate
+	if err != nil {
+		s.stats.requestErrors.Add(1)
+	} else if rate > 1 && s.stats.successes.Add(1)%uint64(rate) != 0 {
+		s.stats.accessLogsSkipped.Add(1)
+		return
+	}
+
+	snapshot := s.sessionSnapshot(sess)
+	fields := logrus.Fields{
+		"session":  snapshot.ID,
+		"client":   req.RemoteAddr,
+		"command":  commandNames[req.Command],
+		"dest":     req.DestAddr,
+		"duration": time.Since(snapshot.Start).Round(time.Millisecond).String(),
+	}
+	if snapshot.Listener != "" {
+		fields["listener"] = snapshot.Listener
+	}
+	if dest := req.DestAddr; dest != nil && dest.FQDN != "" {
+		fields["dest_fqdn"] = dest.FQDN
+		if len(req.destIPs) > 0 {
+			ips := make([]string, len(req.destIPs))
+			for i, ip := range req.destIPs {
+				ips[i] = ip.String()
+			}
+			fields["dest_ips"] = strings.Join(ips, ",")
+		}
+		if req.resolver != "" {
+			fields["resolver"] = req.resolver
+		}
+	}
+	if req.connectedAddr.IsValid() {
+		fields["connected"] = req.connectedAddr.String()
+	}
+	if user := req.Username(); user != "" {
+		fields["user"] = user
+		for key, value := range req.AuthContext.Params {
+			fields["param_"+key] = value
+		}
+	}
+	if snapshot.ClientName != "" {
+		fields["client_name"] = snapshot.ClientName
+	}
+	for key, value := range snapshot.Tags {
+		fields["tag_"+key] = value
+	}
+	if err != nil {
+		fields["error"] = err.Error()
+	} else if rate > 1 {
+		fields["sample_rate"] = rate
+	}
+	if r := req.denyReason; r != nil {
+		fields["deny_rule"] = r.Rule
+		if r.Reason != "" {
+			fields["deny_reason"] = r.Reason
+		}
+	}
+	if s.config.AccessLogEnricher != nil {
+		s.config.AccessLogEnricher.Enrich(req, fields)
+	}
+	s.config.Logger.WithFields(fields).Info("access")
+}
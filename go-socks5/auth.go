@@ -1,8 +1,10 @@
 package socks5
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/netip"
 )
 
 const (
@@ -14,11 +16,48 @@ const (
 	authFailure     = uint8(1)
 )
 
+const (
+	// PrivateAuthMin and PrivateAuthMax delimit the method codes reserved
+	// for private methods, see RFC 1928 section 3
+	PrivateAuthMin = uint8(0x80)
+	PrivateAuthMax = uint8(0xfe)
+)
+
 var (
-	ErrUserAuthFailed  = fmt.Errorf("user authentication failed")
+	// ErrAuthFailed is wrapped by the errors of clients whose credentials
+	// are rejected, such as ErrUserAuthFailed. Only those are counted as
+	// failed authentications.
+	ErrAuthFailed = fmt.Errorf("authentication failed")
+
+	ErrUserAuthFailed  = fmt.Errorf("user %w", ErrAuthFailed)
 	ErrNoSupportedAuth = fmt.Errorf("no supported authentication mechanism")
 )
 
+// UserAuthError is returned by UserPassAuthenticator and
+// CHAPAuthenticator when they reject the credentials of User, it wraps
+// ErrUserAuthFailed
+type UserAuthError struct {
+	User string
+	Err  error
+}
+
+func (e *UserAuthError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UserAuthError) Unwrap() error {
+	return e.Err
+}
+
+// AuthFailure describes a failed authentication to Config.OnAuthFailure
+type AuthFailure struct {
+	Session
+	// User is the username presented if known, see UserAuthError
+	User string
+	// Err is the error the authentication failed with
+	Err error
+}
+
 // A Request encapsulates authentication state provided
 // during negotiation
 type AuthContext struct {
@@ -28,13 +67,61 @@ type AuthContext struct {
 	// Keys depend on the used auth method.
 	// For UserPassauth contains Username
 	Payload map[string]string
+	// Tags can be set by authenticators to tag the session, e.g. with the
+	// tenant of the user, see WithTags
+	Tags map[string]string
+	// Params are the routing parameters embedded in the username, see
+	// UsernameParser
+	Params map[string]string
 }
 
+// Authenticator implements an authentication method. Authenticate is
+// called once the client offered the method code, it must confirm the
+// selection with SelectAuthMethod before running its sub-negotiation.
+// Setting the "Username" payload key makes the identity available to
+// rules and logs. Rejected credentials must be reported with an error
+// wrapping ErrAuthFailed, e.g. a UserAuthError, for the failure to be
+// counted in Stats and passed to Config.OnAuthFailure.
 type Authenticator interface {
 	Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error)
 	GetCode() uint8
 }
 
+// ContextAuthenticator is implemented by authenticators that need the
+// context of the connection and the client address. It is used instead
+// of Authenticate if available.
+type ContextAuthenticator interface {
+	AuthenticateContext(ctx context.Context, reader io.Reader, writer io.Writer, client netip.AddrPort) (*AuthContext, error)
+}
+
+// SelectAuthMethod tells the client the method chosen by the server
+func SelectAuthMethod(writer io.Writer, method uint8) error {
+	_, err := writer.Write([]byte{socks5Version, method})
+	return err
+}
+
+// RegisterAuthenticator adds an Authenticator for a private-use method
+// code between PrivateAuthMin and PrivateAuthMax. It is safe to call while
+// the server is running, an Authenticator already registered for the code
+// is replaced.
+func (s *Server) RegisterAuthenticator(a Authenticator) error {
+	code := a.GetCode()
+	if code < PrivateAuthMin || code > PrivateAuthMax {
+		return fmt.Errorf("auth method code %#x is not in the private range %#x-%#x", code, PrivateAuthMin, PrivateAuthMax)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.authMethods.Load()
+	methods := make(map[uint8]Authenticator, len(*current)+1)
+	for c, cator := range *current {
+		methods[c] = cator
+	}
+	methods[code] = a
+	s.authMethods.Store(&methods)
+	return nil
+}
+
 // NoAuthAuthenticator is used to handle the "No Authentication" mode
 type NoAuthAuthenticator struct{}
 
@@ -43,14 +130,17 @@ func (a NoAuthAuthenticator) GetCode() uint8 {
 }
 
 func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
-	_, err := writer.Write([]byte{socks5Version, NoAuth})
-	return &AuthContext{NoAuth, nil}, err
+	err := SelectAuthMethod(writer, NoAuth)
+	return &AuthContext{Method: NoAuth}, err
 }
 
 // UserPassAuthenticator is used to handle username/password based
-// authentication
+// authentication. If Usernames is set, the parameters it parses out of
+// usernames are set as AuthContext.Params and the remaining user is
+// checked against Credentials.
 type UserPassAuthenticator struct {
 	Credentials CredentialStore
+	Usernames   UsernameParser
 }
 
 func (a UserPassAuthenticator) GetCode() uint8 {
@@ -58,14 +148,18 @@ func (a UserPassAuthenticator) GetCode() uint8 {
 }
 
 func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	return a.AuthenticateContext(context.Background(), reader, writer, netip.AddrPort{})
+}
+
+func (a UserPassAuthenticator) AuthenticateContext(ctx context.Context, reader io.Reader, writer io.Writer, client netip.AddrPort) (*AuthContext, error) {
 	// Tell the client to use user/pass auth
-	if _, err := writer.Write([]byte{socks5Version, UserPassAuth}); err != nil {
+	if err := SelectAuthMethod(writer, UserPassAuth); err != nil {
 		return nil, err
 	}
 
 	// Get the version and username length
-	header := []byte{0, 0}
-	if _, err := io.ReadAtLeast(reader, header, 2); err != nil {
+	header, err := readBytes(reader, 2)
+	if err != nil {
 		return nil, err
 	}
 
@@ -74,27 +168,46 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 		return nil, fmt.Errorf("unsupported auth version: %v", header[0])
 	}
 
-	// Get the user name
+	// Get the user name, both fields are 1 to 255 bytes long
 	userLen := int(header[1])
-	user := make([]byte, userLen)
-	if _, err := io.ReadAtLeast(reader, user, userLen); err != nil {
+	if userLen == 0 {
+		writer.Write([]byte{userAuthVersion, authFailure})
+		return nil, fmt.Errorf("empty username")
+	}
+	b, err := readBytes(reader, userLen)
+	if err != nil {
 		return nil, err
 	}
+	user := string(b)
 
 	// Get the password length
-	if _, err := reader.Read(header[:1]); err != nil {
+	if header, err = readBytes(reader, 1); err != nil {
 		return nil, err
 	}
 
 	// Get the password
 	passLen := int(header[0])
-	pass := make([]byte, passLen)
-	if _, err := io.ReadAtLeast(reader, pass, passLen); err != nil {
+	if passLen == 0 {
+		writer.Write([]byte{userAuthVersion, authFailure})
+		return nil, fmt.Errorf("empty password")
+	}
+	if b, err = readBytes(reader, passLen); err != nil {
 		return nil, err
 	}
+	pass := string(b)
+
+	// Split off routing parameters
+	username := user
+	var params map[string]string
+	if a.Usernames != nil {
+		if username, params, err = a.Usernames.ParseUsername(username); err != nil {
+			writer.Write([]byte{userAuthVersion, authFailure})
+			return nil, &UserAuthError{User: user, Err: fmt.Errorf("%w: %v", ErrUserAuthFailed, err)}
+		}
+	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
+	if ContextCredentials(a.Credentials).ValidContext(ctx, username, pass, client) {
 		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
 			return nil, err
 		}
@@ -102,27 +215,44 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
 			return nil, err
 		}
-		return nil, ErrUserAuthFailed
+		return nil, &UserAuthError{User: username, Err: ErrUserAuthFailed}
 	}
 
 	// Done
-	return &AuthContext{UserPassAuth, map[string]string{"Username": string(user)}}, nil
+	return &AuthContext{Method: UserPassAuth, Payload: map[string]string{"Username": username}, Params: params}, nil
 }
 
-// authenticate is used to handle connection authentication
-func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext, error) {
+// authenticate is used to handle connection authentication. If
+// requireAuth is set, the "No Authentication" method is not accepted.
+func (s *Server) authenticate(ctx context.Context, conn io.Writer, bufConn io.Reader, client netip.AddrPort, requireAuth bool) (*AuthContext, error) {
 	// Get the methods
 	methods, err := readMethods(bufConn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get auth methods: %v", err)
 	}
+	if len(methods) == 0 {
+		return nil, noAcceptableAuth(conn)
+	}
 
 	// Select a usable method
+	authMethods := s.authMethodsFor(ctx)
 	for _, method := range methods {
-		cator, found := s.authMethods[method]
-		if found {
-			return cator.Authenticate(bufConn, conn)
+		if requireAuth && method == NoAuth {
+			continue
 		}
+		cator, found := authMethods[method]
+		if !found {
+			continue
+		}
+		if c, ok := cator.(ContextAuthenticator); ok {
+			if timeout := s.config.AuthTimeout; timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			return c.AuthenticateContext(ctx, bufConn, conn, client)
+		}
+		return cator.Authenticate(bufConn, conn)
 	}
 
 	// No usable method found
@@ -137,15 +267,11 @@ func noAcceptableAuth(conn io.Writer) error {
 }
 
 // readMethods is used to read the number of methods
-// and proceeding auth methods
+// and proceeding auth methods. They are only valid until the next read.
 func readMethods(r io.Reader) ([]byte, error) {
-	header := []byte{0}
-	if _, err := r.Read(header); err != nil {
+	header, err := readBytes(r, 1)
+	if err != nil {
 		return nil, err
 	}
-
-	numMethods := int(header[0])
-	methods := make([]byte, numMethods)
-	_, err := io.ReadAtLeast(r, methods, numMethods)
-	return methods, err
+	return readBytes(r, int(header[0]))
 }
@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// testAuthenticator is a private method failing with err
+type testAuthenticator struct {
+	err error
+}
+
+func (a testAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	if err := SelectAuthMethod(writer, PrivateAuthMin); err != nil {
+		return nil, err
+	}
+	return nil, a.err
+}
+
+func (a testAuthenticator) GetCode() uint8 { return PrivateAuthMin }
+
+func TestAuthFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantUser string
+		counted  bool
+	}{
+		{"rejected credentials", fmt.Errorf("token expired: %w", ErrAuthFailed), "", true},
+		{"rejected user", &UserAuthError{User: "alice", Err: ErrUserAuthFailed}, "alice", true},
+		{"other error", errors.New("failed to read token"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			failures := make(chan AuthFailure, 1)
+			s, proxy := serveLoopback(t, "tcp4", &Config{
+				OnAuthFailure: func(f AuthFailure) { failures <- f },
+			})
+			if err := s.RegisterAuthenticator(testAuthenticator{tt.err}); err != nil {
+				t.Fatal(err)
+			}
+
+			c := dialProxyMethod(t, proxy, PrivateAuthMin)
+			// The server closes the connection once the authenticator failed
+			if _, err := c.Read(make([]byte, 1)); err == nil {
+				t.Fatal("connection not closed")
+			}
+			if counted := s.Stats().AuthFailures > 0; counted != tt.counted {
+				t.Fatalf("got failure counted %v, want %v", counted, tt.counted)
+			}
+			select {
+			case f := <-failures:
+				if !tt.counted {
+					t.Fatalf("got failure %+v, want none", f)
+				}
+				if f.User != tt.wantUser || !errors.Is(f.Err, tt.err) {
+					t.Errorf("got failure of %q with %v, want %q with %v", f.User, f.Err, tt.wantUser, tt.err)
+				}
+			default:
+				if tt.counted {
+					t.Error("failure not reported")
+				}
+			}
+		})
+	}
+}
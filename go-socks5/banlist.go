@@ -0,0 +1,161 @@
+package socks5
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Ban is an entry of the BanList
+type Ban struct {
+	IP      netip.Addr `json:"ip"`
+	Expires time.Time  `json:"expires"`
+	Reason  string     `json:"reason,omitempty"`
+}
+
+// BanList holds client IPs which are rejected until their ban expires.
+// If Path is set, the list is persisted to it on every change. OnBan is
+// called with every new ban, e.g. to publish security events.
+type BanList struct {
+	Path  string
+	OnBan func(Ban)
+
+	mu   sync.Mutex
+	bans map[netip.Addr]Ban
+}
+
+// NewBanList creates a BanList persisted to path, loading the bans
+// already stored there. An empty path keeps the list in memory only.
+func NewBanList(path string) (*BanList, error) {
+	b := &BanList{Path: path, bans: make(map[netip.Addr]Ban)}
+	if path == "" {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, ban := range bans {
+		if ban.Expires.After(now) {
+			b.bans[ban.IP] = ban
+		}
+	}
+	return b, nil
+}
+
+// Ban rejects ip for the given duration
+func (b *BanList) Ban(ip netip.Addr, d time.Duration, reason string) error {
+	b.mu.Lock()
+	ip = ip.Unmap()
+	ban := Ban{IP: ip, Expires: time.Now().Add(d), Reason: reason}
+	b.bans[ip] = ban
+	err := b.save()
+	b.mu.Unlock()
+	if b.OnBan != nil {
+		b.OnBan(ban)
+	}
+	return err
+}
+
+// Unban lifts the ban of ip
+func (b *BanList) Unban(ip netip.Addr) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.bans, ip.Unmap())
+	return b.save()
+}
+
+// IsBanned reports whether ip is currently banned
+func (b *BanList) IsBanned(ip netip.Addr) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ban, found := b.bans[ip.Unmap()]
+	if !found {
+		return false
+	}
+	if time.Now().After(ban.Expires) {
+		delete(b.bans, ban.IP)
+		return false
+	}
+	return true
+}
+
+// List returns the active bans
+func (b *BanList) List() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.prune()
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+// Restore adds bans, e.g. saved before a restart, skipping expired ones
+// and keeping existing bans of the same IPs
+func (b *BanList) Restore(bans []Ban) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	for _, ban := range bans {
+		ban.IP = ban.IP.Unmap()
+		if _, found := b.bans[ban.IP]; !found && ban.Expires.After(now) {
+			b.bans[ban.IP] = ban
+		}
+	}
+	return b.save()
+}
+
+// prune removes expired bans, the caller must hold the lock
+func (b *BanList) prune() {
+	now := time.Now()
+	for ip, ban := range b.bans {
+		if now.After(ban.Expires) {
+			delete(b.bans, ip)
+		}
+	}
+}
+
+// save writes the list to Path, the caller must hold the lock
+func (b *BanList) save() error {
+	if b.Path == "" {
+		return nil
+	}
+	b.prune()
+	bans := make([]Ban, 0, len(b.bans))
+	for _, ban := range b.bans {
+		bans = append(bans, ban)
+	}
+	data, err := json.Marshal(bans)
+	if err != nil {
+		return err
+	}
+
+	// Write atomically so a crash never leaves a truncated file
+	tmp, err := os.CreateTemp(filepath.Dir(b.Path), filepath.Base(b.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), b.Path)
+}
@@ -0,0 +1,118 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// bindAcceptTimeout is how long a BIND waits for the incoming connection
+	bindAcceptTimeout = 2 * time.Minute
+)
+
+// handleBind is used to handle a bind command
+func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := sendReply(conn, s.deny(ctx_, req), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return denyError("bind", req)
+	} else {
+		ctx = ctx_
+	}
+
+	// Open the listener
+	ln, err := s.listenTCP(s.bindIP(conn))
+	if err != nil {
+		if err := sendReply(conn, ServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("failed to open bind listener: %v", err)
+	}
+	defer ln.Close()
+
+	// Send the first reply with the listening address
+	bind := s.replyAddr(conn, ln.Addr())
+	if err := sendReply(conn, SuccessReply, bind); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	// Wait for the incoming connection, unless the connection ends or the
+	// client closes the control connection first. The read watching it is
+	// handed over to the relay, as clients may send data before the
+	// second reply.
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+	watch := &pendingReader{r: req.bufConn, pending: make(chan pendingRead, 1)}
+	var hungUp atomic.Bool
+	go func() {
+		b := make([]byte, 1)
+		n, err := watch.r.Read(b)
+		if err != nil {
+			hungUp.Store(true)
+			ln.Close()
+		}
+		watch.pending <- pendingRead{b[:n], err}
+	}()
+	req.bufConn = watch
+	ln.SetDeadline(time.Now().Add(bindAcceptTimeout))
+	target, err := ln.Accept()
+	ln.Close()
+	if err != nil && hungUp.Load() {
+		return fmt.Errorf("bind on %v abandoned: client closed the connection", bind)
+	} else if err != nil {
+		if err := sendReply(conn, ServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("bind on %v failed: %v", bind, err)
+	}
+	defer target.Close()
+	req.connectedAddr = addrPort(target.RemoteAddr())
+	req.outboundAddr = addrPort(target.LocalAddr())
+
+	// Only accept the peer announced in the request
+	remote := addrPort(target.RemoteAddr())
+	peerIP := remote.Addr().Unmap()
+	if expected := req.DestAddr.IP.Unmap(); expected.IsValid() && !expected.IsUnspecified() && expected.WithZone("") != peerIP.WithZone("") {
+		if err := sendReply(conn, RuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("bind on %v: unexpected connection from %v", bind, peerIP)
+	}
+
+	// Send the second reply with the peer address
+	peer := AddrSpec{IP: peerIP, Port: int(remote.Port())}
+	if err := sendReply(conn, SuccessReply, &peer); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	return s.relay(ctx, conn, target, req)
+}
+
+// pendingRead is the result of a read of pendingReader
+type pendingRead struct {
+	data []byte
+	err  error
+}
+
+// pendingReader returns the result of a read of r in progress before
+// reading r again
+type pendingReader struct {
+	r       io.Reader
+	pending chan pendingRead
+}
+
+func (p *pendingReader) Read(b []byte) (int, error) {
+	if p.pending != nil {
+		read := <-p.pending
+		p.pending = nil
+		if len(read.data) > 0 || read.err != nil {
+			return copy(b, read.data), read.err
+		}
+	}
+	return p.r.Read(b)
+}
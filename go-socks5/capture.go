@@ -0,0 +1,307 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// pcapLinkTypeRaw is the link type of captured packets, raw IPv4 or
+	// IPv6 without link layer header
+	pcapLinkTypeRaw = 101
+
+	// pcapSnapLen is the largest captured packet
+	pcapSnapLen = 65535
+
+	// maxCaptureSegment is the payload of the largest TCP segment
+	// written, longer reads are split
+	maxCaptureSegment = 65000
+)
+
+var (
+	// ErrCaptureDisabled is returned by Capture unless Config.Capture is set
+	ErrCaptureDisabled = fmt.Errorf("capture is disabled")
+	// ErrSessionNotFound is returned by Capture for unknown session IDs
+	ErrSessionNotFound = fmt.Errorf("session not found")
+	// ErrNoTunnel is returned by Capture for sessions not relaying a TCP
+	// tunnel, i.e. negotiating or serving a UDP association
+	ErrNoTunnel = fmt.Errorf("session has no TCP tunnel")
+	// ErrCaptureActive is returned by Capture for sessions already being
+	// captured
+	ErrCaptureActive = fmt.Errorf("session is already being captured")
+)
+
+// CaptureOptions configure a capture started with Server.Capture
+type CaptureOptions struct {
+	// BothLegs captures the client connection and the connection to the
+	// destination as two flows, instead of the payload as a single flow
+	// between the client and the destination
+	BothLegs bool
+	// MaxBytes ends the capture before the output exceeds this size,
+	// Duration after this long. Zero means no limit.
+	MaxBytes int64
+	Duration time.Duration
+}
+
+// captureTap holds the addresses of a relayed tunnel and the capture
+// attached to it
+type captureTap struct {
+	client, local, outbound, remote netip.AddrPort
+	capture                         atomic.Pointer[sessionCapture]
+}
+
+// sessionCapture writes the segments read by a tunnel to a pcap file
+type sessionCapture struct {
+	mu       sync.Mutex
+	w        io.Writer
+	bothLegs bool
+	maxBytes int64
+	written  int64
+	// seq is the next sequence number of the flows from the client, to
+	// the client, and with BothLegs of the flows to and from the
+	// destination
+	seq     [4]uint32
+	stopped bool
+	err     error
+	done    chan struct{}
+}
+
+// Capture starts writing the payload of the TCP tunnel of session id to
+// w in pcap format, as TCP segments between the client and the
+// destination. The framing of the segments is the one the payload was
+// read with, not the one seen on the wire. The capture runs until the
+// session ends, a limit of opts is reached or writing to w fails, then
+// the returned channel receives the write error, if any, and is closed.
+func (s *Server) Capture(id uint64, w io.Writer, opts CaptureOptions) (<-chan error, error) {
+	if !s.config.Capture {
+		return nil, ErrCaptureDisabled
+	}
+	var sess *Session
+	var tap *captureTap
+	s.mu.Lock()
+	for _, c := range s.conns {
+		if c.ID == id {
+			sess = c
+			if c.request != nil {
+				tap = c.request.tap.Load()
+			}
+			break
+		}
+	}
+	s.mu.Unlock()
+	if sess == nil {
+		return nil, ErrSessionNotFound
+	}
+	if tap == nil {
+		return nil, ErrNoTunnel
+	}
+
+	c := &sessionCapture{w: w, bothLegs: opts.BothLegs, maxBytes: opts.MaxBytes, done: make(chan struct{})}
+	for i := range c.seq {
+		c.seq[i] = 1
+	}
+	if !tap.capture.CompareAndSwap(nil, c) {
+		return nil, ErrCaptureActive
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.writeHeader(); err != nil {
+		tap.capture.Store(nil)
+		return nil, err
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer close(result)
+		var expired <-chan time.Time
+		if opts.Duration > 0 {
+			timer := time.NewTimer(opts.Duration)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-c.done:
+		case <-sess.done:
+		case <-expired:
+		}
+		tap.capture.CompareAndSwap(c, nil)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.stop(nil)
+		result <- c.err
+	}()
+	return result, nil
+}
+
+// tapCapture returns the readers of both directions of the tunnel of req,
+// which pass the payload to captures attached to it if Config.Capture
+// is set
+func (s *Server) tapCapture(req *Request, up, down io.Reader) (io.Reader, io.Reader) {
+	if !s.config.Capture {
+		return up, down
+	}
+	tap := &captureTap{
+		client:   netip.AddrPortFrom(req.RemoteAddr.IP, uint16(req.RemoteAddr.Port)),
+		local:    req.localAddr,
+		outbound: req.outboundAddr,
+		remote:   req.connectedAddr,
+	}
+	req.tap.Store(tap)
+	return tapReader{up, tap, true}, tapReader{down, tap, false}
+}
+
+// tapReader passes the data read from the client, if up, or the
+// destination to the capture of tap
+type tapReader struct {
+	io.Reader
+	tap *captureTap
+	up  bool
+}
+
+func (r tapReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		if c := r.tap.capture.Load(); c != nil {
+			c.payload(r.tap, r.up, p[:n])
+		}
+	}
+	return n, err
+}
+
+// stop ends the capture with err, the caller must hold c.mu
+func (c *sessionCapture) stop(err error) {
+	if c.stopped {
+		return
+	}
+	c.stopped, c.err = true, err
+	close(c.done)
+}
+
+// writeHeader writes the pcap global header
+func (c *sessionCapture) writeHeader() error {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(header[20:], pcapLinkTypeRaw)
+	n, err := c.w.Write(header)
+	c.written += int64(n)
+	return err
+}
+
+// payload writes data read by the tunnel of tap as segments of the
+// flows of its direction
+func (c *sessionCapture) payload(tap *captureTap, up bool, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for len(data) > 0 && !c.stopped {
+		chunk := data[:min(len(data), maxCaptureSegment)]
+		data = data[len(chunk):]
+		if !c.bothLegs {
+			c.segment(now, 0, up, tap.client, tap.remote, chunk)
+			continue
+		}
+		// The client leg ends at the address the client connected to,
+		// the leg to the destination starts at the outbound address
+		c.segment(now, 0, up, tap.client, tap.local, chunk)
+		c.segment(now, 1, up, tap.outbound, tap.remote, chunk)
+	}
+}
+
+// segment writes a TCP segment of leg, from the client side if up,
+// between client and server, the caller must hold c.mu
+func (c *sessionCapture) segment(now time.Time, leg int, up bool, client, server netip.AddrPort, data []byte) {
+	if c.stopped {
+		return
+	}
+	out, in := 2*leg, 2*leg+1
+	src, dst := client, server
+	if !up {
+		out, in = in, out
+		src, dst = server, client
+	}
+	packet := tcpPacket(src, dst, c.seq[out], c.seq[in], data)
+	if c.maxBytes > 0 && c.written+16+int64(len(packet)) > c.maxBytes {
+		c.stop(nil)
+		return
+	}
+	c.seq[out] += uint32(len(data))
+
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	n, err := c.w.Write(append(record, packet...))
+	c.written += int64(n)
+	if err != nil {
+		c.stop(err)
+	}
+}
+
+// tcpPacket returns an IP packet of a TCP segment carrying data. Mixed
+// address families are written as IPv6 with IPv4-mapped addresses.
+func tcpPacket(src, dst netip.AddrPort, seq, ack uint32, data []byte) []byte {
+	srcIP, dstIP := src.Addr().Unmap(), dst.Addr().Unmap()
+	v4 := srcIP.Is4() && dstIP.Is4()
+	if !v4 {
+		srcIP, dstIP = netip.AddrFrom16(srcIP.As16()), netip.AddrFrom16(dstIP.As16())
+	}
+
+	tcp := make([]byte, 20, 20+len(data))
+	binary.BigEndian.PutUint16(tcp[0:], src.Port())
+	binary.BigEndian.PutUint16(tcp[2:], dst.Port())
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = 0x18 // PSH, ACK
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, data...)
+
+	var packet, pseudo []byte
+	if v4 {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		binary.BigEndian.PutUint16(packet[6:], 0x4000) // don't fragment
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:16], srcIP.AsSlice())
+		copy(packet[16:20], dstIP.AsSlice())
+		binary.BigEndian.PutUint16(packet[10:], ^checksum(0, packet))
+		pseudo = append(packet[12:20:20], 0, 6, byte(len(tcp)>>8), byte(len(tcp)))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:24], srcIP.AsSlice())
+		copy(packet[24:40], dstIP.AsSlice())
+		pseudo = append(packet[8:40:40], 0, 0, byte(len(tcp)>>8), byte(len(tcp)), 0, 0, 0, 6)
+	}
+	binary.BigEndian.PutUint16(tcp[16:], ^checksum(checksum(0, pseudo), tcp))
+	return append(packet, tcp...)
+}
+
+// checksum adds data to the ones' complement sum of an internet checksum
+func checksum(sum uint16, data []byte) uint16 {
+	s := uint32(sum)
+	for i := 0; i+1 < len(data); i += 2 {
+		s += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		s += uint32(data[len(data)-1]) << 8
+	}
+	for s > 0xffff {
+		s = s>>16 + s&0xffff
+	}
+	return uint16(s)
+}
@@ -0,0 +1,145 @@
+package socks5
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// CHAPAuth is the Challenge-Handshake Authentication Protocol method,
+// see draft-ietf-aft-socks-chap
+const CHAPAuth = uint8(3)
+
+const (
+	chapVersion = uint8(1)
+
+	// Attribute types
+	chapStatus     = uint8(0x00)
+	chapUser       = uint8(0x02)
+	chapChallenge  = uint8(0x03)
+	chapResponse   = uint8(0x04)
+	chapAlgorithms = uint8(0x11)
+
+	// chapHMACMD5 is the only algorithm mandated by the draft
+	chapHMACMD5 = uint8(0x85)
+
+	chapChallengeLen = 16
+)
+
+// SecretStore is implemented by credential stores able to return the
+// password of a user, as needed to verify CHAP responses
+type SecretStore interface {
+	Secret(user string) (string, bool)
+}
+
+// CHAPAuthenticator is used to handle CHAP authentication, which never
+// sends the password over the connection
+type CHAPAuthenticator struct {
+	Secrets SecretStore
+}
+
+func (a CHAPAuthenticator) GetCode() uint8 {
+	return CHAPAuth
+}
+
+func (a CHAPAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*AuthContext, error) {
+	// Tell the client to use CHAP
+	if err := SelectAuthMethod(writer, CHAPAuth); err != nil {
+		return nil, err
+	}
+
+	// The client offers its algorithms, possibly with its identity
+	attrs, err := readCHAPMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(attrs[chapAlgorithms], chapHMACMD5) {
+		writeCHAPMessage(writer, chapAttr{chapStatus, []byte{authFailure}})
+		return nil, fmt.Errorf("no supported CHAP algorithm")
+	}
+	user := attrs[chapUser]
+
+	// Send the challenge
+	challenge := make([]byte, chapChallengeLen)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	if err := writeCHAPMessage(writer, chapAttr{chapAlgorithms, []byte{chapHMACMD5}}, chapAttr{chapChallenge, challenge}); err != nil {
+		return nil, err
+	}
+
+	// Read the response
+	attrs, err = readCHAPMessage(reader)
+	if err != nil {
+		return nil, err
+	}
+	if u, found := attrs[chapUser]; found {
+		user = u
+	}
+	response := attrs[chapResponse]
+
+	// Verify the response
+	secret, found := a.Secrets.Secret(string(user))
+	if found {
+		mac := hmac.New(md5.New, []byte(secret))
+		mac.Write(challenge)
+		found = hmac.Equal(response, mac.Sum(nil))
+	}
+	if !found {
+		if err := writeCHAPMessage(writer, chapAttr{chapStatus, []byte{authFailure}}); err != nil {
+			return nil, err
+		}
+		return nil, &UserAuthError{User: string(user), Err: ErrUserAuthFailed}
+	}
+	if err := writeCHAPMessage(writer, chapAttr{chapStatus, []byte{authSuccess}}); err != nil {
+		return nil, err
+	}
+
+	// Done
+	return &AuthContext{Method: CHAPAuth, Payload: map[string]string{"Username": string(user)}}, nil
+}
+
+// readCHAPMessage reads a CHAP message and returns its attributes by type
+func readCHAPMessage(r io.Reader) (map[uint8][]byte, error) {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != chapVersion {
+		return nil, fmt.Errorf("unsupported CHAP version: %v", header[0])
+	}
+
+	n := int(header[1])
+	attrs := make(map[uint8][]byte, n)
+	for i := 0; i < n; i++ {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, err
+		}
+		value := make([]byte, header[1])
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		attrs[header[0]] = value
+	}
+	return attrs, nil
+}
+
+// chapAttr is an attribute of a CHAP message
+type chapAttr struct {
+	typ   uint8
+	value []byte
+}
+
+// writeCHAPMessage sends a CHAP message made of attrs
+func writeCHAPMessage(w io.Writer, attrs ...chapAttr) error {
+	msg := []byte{chapVersion, uint8(len(attrs))}
+	for _, attr := range attrs {
+		msg = append(msg, attr.typ, uint8(len(attr.value)))
+		msg = append(msg, attr.value...)
+	}
+	_, err := w.Write(msg)
+	return err
+}
@@ -0,0 +1,99 @@
+package socks5
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCHAPAuthenticator(t *testing.T) {
+	tests := []struct {
+		name       string
+		algorithms []byte
+		user       string // sent with the algorithms
+		respUser   string // sent with the response
+		secret     string
+		want       bool
+	}{
+		{name: "user in offer", algorithms: []byte{chapHMACMD5}, user: "alice", secret: "secret", want: true},
+		{name: "user in response", algorithms: []byte{0x86, chapHMACMD5}, respUser: "alice", secret: "secret", want: true},
+		{name: "wrong secret", algorithms: []byte{chapHMACMD5}, user: "alice", secret: "other"},
+		{name: "unknown user", algorithms: []byte{chapHMACMD5}, user: "bob", secret: "secret"},
+		{name: "no supported algorithm", algorithms: []byte{0x86}, user: "alice", secret: "secret"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			type result struct {
+				ctx *AuthContext
+				err error
+			}
+			done := make(chan result, 1)
+			go func() {
+				defer server.Close()
+				ctx, err := CHAPAuthenticator{Secrets: StaticCredentials{"alice": "secret"}}.Authenticate(server, server)
+				done <- result{ctx, err}
+			}()
+
+			method := make([]byte, 2)
+			if _, err := io.ReadFull(client, method); err != nil || method[1] != CHAPAuth {
+				t.Fatalf("got method % x, %v, want CHAP", method, err)
+			}
+			offer := []chapAttr{{chapAlgorithms, tt.algorithms}}
+			if tt.user != "" {
+				offer = append(offer, chapAttr{chapUser, []byte(tt.user)})
+			}
+			if err := writeCHAPMessage(client, offer...); err != nil {
+				t.Fatal(err)
+			}
+			attrs, err := readCHAPMessage(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status, found := attrs[chapStatus]; found {
+				// Rejected without a challenge
+				if res := <-done; tt.want || !bytes.Equal(status, []byte{authFailure}) || res.err == nil {
+					t.Fatalf("got status % x and error %v instead of a challenge", status, res.err)
+				}
+				return
+			}
+
+			mac := hmac.New(md5.New, []byte(tt.secret))
+			mac.Write(attrs[chapChallenge])
+			response := []chapAttr{{chapResponse, mac.Sum(nil)}}
+			if tt.respUser != "" {
+				response = append(response, chapAttr{chapUser, []byte(tt.respUser)})
+			}
+			if err := writeCHAPMessage(client, response...); err != nil {
+				t.Fatal(err)
+			}
+			if attrs, err = readCHAPMessage(client); err != nil {
+				t.Fatal(err)
+			}
+			res := <-done
+			if got := attrs[chapStatus]; len(got) != 1 || (got[0] == authSuccess) != tt.want {
+				t.Fatalf("got status % x, want success %v", got, tt.want)
+			}
+			if !tt.want {
+				var userErr *UserAuthError
+				if !errors.As(res.err, &userErr) || !errors.Is(res.err, ErrAuthFailed) || userErr.User != tt.user {
+					t.Errorf("got error %v, want a UserAuthError of %q", res.err, tt.user)
+				}
+				return
+			}
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			if user := res.ctx.Payload["Username"]; user != "alice" {
+				t.Errorf("got user %q, want alice", user)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+// RuleSetFunc is an adapter to use a function as RuleSet
+type RuleSetFunc func(ctx context.Context, req *Request) (context.Context, bool)
+
+func (f RuleSetFunc) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	return f(ctx, req)
+}
+
+// And returns a RuleSet which allows requests allowed by all rules, in
+// order, and otherwise denies them as the first rule denying them does.
+// Every rule sees the context returned by the previous one. And without
+// rules allows all requests.
+func And(rules ...RuleSet) RuleSet {
+	return &AndRuleSet{rules}
+}
+
+// AndRuleSet is an implementation of the RuleSet which
+// requires all of its rules to allow a request
+type AndRuleSet struct {
+	Rules []RuleSet
+}
+
+func (a *AndRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	for _, rules := range a.Rules {
+		var ok bool
+		if ctx, ok = rules.Allow(ctx, req); !ok {
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
+
+// Or returns a RuleSet which allows requests allowed by any of the rules,
+// tried in order, as the first rule allowing them does. Requests denied
+// by all rules are denied as the last one does. Or without rules denies
+// all requests.
+func Or(rules ...RuleSet) RuleSet {
+	return &OrRuleSet{rules}
+}
+
+// OrRuleSet is an implementation of the RuleSet which
+// requires any of its rules to allow a request
+type OrRuleSet struct {
+	Rules []RuleSet
+}
+
+func (o *OrRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	denied := WithDenyReason(ctx, "or", "no rule allowed the request")
+	for _, rules := range o.Rules {
+		next, ok := rules.Allow(ctx, req)
+		if ok {
+			return next, true
+		}
+		denied = next
+	}
+	return denied, false
+}
+
+// Not returns a RuleSet which allows the requests denied by rules and
+// denies the requests it allows
+func Not(rules RuleSet) RuleSet {
+	return &NotRuleSet{Rules: rules}
+}
+
+// NotRuleSet is an implementation of the RuleSet which inverts
+// its rules. Denials are attributed to Name, "not" by default. The
+// context returned by the rules is discarded.
+type NotRuleSet struct {
+	Rules RuleSet
+	Name  string
+}
+
+func (n *NotRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if _, ok := n.Rules.Allow(ctx, req); ok {
+		name := n.Name
+		if name == "" {
+			name = "not"
+		}
+		return WithDenyReason(ctx, name, "request matched a negated rule"), false
+	}
+	return ctx, true
+}
+
+// Rule is an entry of FirstMatch: requests allowed by Match are allowed
+// when Permit is set, and denied as Name otherwise
+type Rule struct {
+	Name   string
+	Match  RuleSet
+	Permit bool
+}
+
+// FirstMatch returns a RuleSet deciding requests as the first rule
+// matching them, like the rules of a firewall. Placing denying rules
+// first makes them override later permitting ones. Requests matching no
+// rule are denied.
+func FirstMatch(rules ...Rule) RuleSet {
+	return &FirstMatchRuleSet{rules}
+}
+
+// FirstMatchRuleSet is an implementation of the RuleSet which
+// applies the first of its rules matching a request
+type FirstMatchRuleSet struct {
+	Rules []Rule
+}
+
+func (f *FirstMatchRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	for _, rule := range f.Rules {
+		next, ok := rule.Match.Allow(ctx, req)
+		if !ok {
+			continue
+		}
+		if !rule.Permit {
+			name := rule.Name
+			if name == "" {
+				name = "first_match"
+			}
+			return WithDenyReason(ctx, name, "request matched a denying rule"), false
+		}
+		return next, true
+	}
+	return WithDenyReason(ctx, "first_match", "request matched no rule"), false
+}
+
+// PermitDestCIDR returns a RuleSet which allows requests to resolved
+// destinations within any of the prefixes
+func PermitDestCIDR(prefixes ...netip.Prefix) RuleSet {
+	return &PermitDestCIDRRuleSet{prefixes}
+}
+
+// PermitDestCIDRRuleSet is an implementation of the RuleSet which
+// enables filtering destinations by network
+type PermitDestCIDRRuleSet struct {
+	Prefixes []netip.Prefix
+}
+
+func (p *PermitDestCIDRRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	ip := req.DestAddr.IP.Unmap()
+	if slices.ContainsFunc(p.Prefixes, func(prefix netip.Prefix) bool { return prefix.Contains(ip) }) {
+		return ctx, true
+	}
+	return WithDenyReason(ctx, "dest_cidr", fmt.Sprintf("%v is not in a permitted network", ip)), false
+}
+
+// PermitDestPort returns a RuleSet which allows requests to destination
+// ports within any of the ranges
+func PermitDestPort(ranges ...PortRange) RuleSet {
+	return &PermitDestPortRuleSet{ranges}
+}
+
+// PermitDestPortRuleSet is an implementation of the RuleSet which
+// enables filtering destination ports
+type PermitDestPortRuleSet struct {
+	Ranges []PortRange
+}
+
+func (p *PermitDestPortRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	port := uint16(req.DestAddr.Port)
+	if slices.ContainsFunc(p.Ranges, func(r PortRange) bool { return r.Min <= port && port <= r.Max }) {
+		return ctx, true
+	}
+	return WithDenyReason(ctx, "dest_port", fmt.Sprintf("port %d is not permitted", port)), false
+}
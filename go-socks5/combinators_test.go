@@ -0,0 +1,49 @@
+package socks5
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestCombinators(t *testing.T) {
+	web := PermitDestPort(PortRange{Min: 80, Max: 80}, PortRange{Min: 443, Max: 443})
+	lan := PermitDestCIDR(netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("fd00::/8"))
+	tests := []struct {
+		name     string
+		rules    RuleSet
+		dest     string
+		want     bool
+		wantRule string // the rule denying the request
+	}{
+		{"and allowed", And(web, lan), "10.0.0.1:443", true, ""},
+		{"and denied by first", And(web, lan), "10.0.0.1:22", false, "dest_port"},
+		{"and denied by second", And(web, lan), "192.0.2.1:443", false, "dest_cidr"},
+		{"and without rules", And(), "192.0.2.1:22", true, ""},
+		{"or allowed by first", Or(web, lan), "192.0.2.1:443", true, ""},
+		{"or allowed by second", Or(web, lan), "[fd00::1]:22", true, ""},
+		{"or denied", Or(web, lan), "192.0.2.1:22", false, "dest_cidr"},
+		{"or without rules", Or(), "192.0.2.1:443", false, "or"},
+		{"not allowed", Not(lan), "192.0.2.1:22", true, ""},
+		{"not denied", Not(lan), "10.0.0.1:22", false, "not"},
+		{"named not denied", &NotRuleSet{Rules: lan, Name: "no_lan"}, "10.0.0.1:22", false, "no_lan"},
+		{"IPv4-mapped", lan, "[::ffff:10.0.0.1]:22", true, ""},
+		{"first match permitting", FirstMatch(Rule{Name: "lan", Match: lan}, Rule{Match: web, Permit: true}), "192.0.2.1:443", true, ""},
+		{"first match denying", FirstMatch(Rule{Name: "lan", Match: lan}, Rule{Match: web, Permit: true}), "10.0.0.1:443", false, "lan"},
+		{"first match unnamed", FirstMatch(Rule{Match: lan}), "10.0.0.1:443", false, "first_match"},
+		{"first match none", FirstMatch(Rule{Match: web, Permit: true}), "192.0.2.1:22", false, "first_match"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := netip.MustParseAddrPort(tt.dest)
+			req := &Request{DestAddr: &AddrSpec{IP: dest.Addr(), Port: int(dest.Port())}}
+			ctx, ok := tt.rules.Allow(context.Background(), req)
+			if ok != tt.want {
+				t.Fatalf("got allowed %v, want %v", ok, tt.want)
+			}
+			if reason, _ := DenyReasonFromContext(ctx); !ok && reason.Rule != tt.wantRule {
+				t.Errorf("got denied by %q, want %q", reason.Rule, tt.wantRule)
+			}
+		})
+	}
+}
@@ -1,10 +1,48 @@
 package socks5
 
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
 // CredentialStore is used to support user/pass authentication
 type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// ContextCredentialStore is implemented by credential stores that need
+// the context of the authentication, to honor Config.AuthTimeout in
+// network lookups, or the client address to apply per-source policies.
+// It is used instead of Valid if available.
+type ContextCredentialStore interface {
+	ValidContext(ctx context.Context, user, password string, client netip.AddrPort) bool
+}
+
+// ContextCredentials returns store as a ContextCredentialStore, adapting
+// stores that only implement CredentialStore
+func ContextCredentials(store CredentialStore) ContextCredentialStore {
+	if s, ok := store.(ContextCredentialStore); ok {
+		return s
+	}
+	return credentialStoreAdapter{store}
+}
+
+// credentialStoreAdapter ignores the context and the client address
+type credentialStoreAdapter struct {
+	CredentialStore
+}
+
+func (a credentialStoreAdapter) ValidContext(ctx context.Context, user, password string, client netip.AddrPort) bool {
+	return a.Valid(user, password)
+}
+
 // StaticCredentials enables using a map directly as a credential store
 type StaticCredentials map[string]string
 
@@ -13,5 +51,82 @@ func (s StaticCredentials) Valid(user, password string) bool {
 	if !ok {
 		return false
 	}
-	return password == pass
+	return subtle.ConstantTimeCompare([]byte(password), []byte(pass)) == 1
+}
+
+func (s StaticCredentials) Secret(user string) (string, bool) {
+	pass, ok := s[user]
+	return pass, ok
+}
+
+// HashedCredentials is a credential store mapping users to password
+// hashes, see CheckPasswordHash, so plaintext passwords never need to be
+// configured. Unlike StaticCredentials it can't serve CHAP.
+type HashedCredentials map[string]string
+
+func (h HashedCredentials) Valid(user, password string) bool {
+	hash, ok := h[user]
+	if !ok {
+		return false
+	}
+	return CheckPasswordHash(hash, password)
+}
+
+// CheckPasswordHash compares password to a bcrypt hash, as written by
+// htpasswd -B, or to an argon2id or argon2i hash in the PHC string format
+// like $argon2id$v=19$m=65536,t=3,p=4$salt$hash, as written by the argon2
+// tool
+func CheckPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2") {
+		ok, err := checkArgon2(hash, password)
+		return err == nil && ok
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// ValidPasswordHash returns an error if hash can't be checked by
+// CheckPasswordHash
+func ValidPasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2") {
+		_, err := checkArgon2(hash, "")
+		return err
+	}
+	_, err := bcrypt.Cost([]byte(hash))
+	return err
+}
+
+// checkArgon2 compares password to an argon2 hash in the PHC string format
+func checkArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return false, fmt.Errorf("invalid argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time == 0 || threads == 0 {
+		return false, fmt.Errorf("invalid argon2 parameters %q", parts[3])
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, fmt.Errorf("invalid argon2 salt: %v", err)
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(want) == 0 {
+		return false, fmt.Errorf("invalid argon2 hash")
+	}
+
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant %q", parts[1])
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
 }
@@ -0,0 +1,79 @@
+package socks5
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// argon2Hash encodes the key derived from password by variant in the PHC
+// string format
+func argon2Hash(variant, password string) string {
+	salt := []byte("somesalt")
+	key := argon2.IDKey
+	if variant == "argon2i" {
+		key = argon2.Key
+	}
+	return fmt.Sprintf("$%s$v=%d$m=64,t=1,p=1$%s$%s", variant, argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key([]byte(password), salt, 1, 64, 1, 32)))
+}
+
+func TestCheckPasswordHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherBcrypt, err := bcrypt.GenerateFromPassword([]byte("other"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon2id := argon2Hash("argon2id", "secret")
+	tests := []struct {
+		name      string
+		hash      string
+		valid     bool // whether "secret" matches
+		wantError bool // whether ValidPasswordHash rejects the hash
+	}{
+		{name: "bcrypt", hash: string(bcryptHash), valid: true},
+		{name: "bcrypt from htpasswd", hash: "$2y$" + strings.TrimPrefix(string(bcryptHash), "$2a$"), valid: true},
+		{name: "argon2id", hash: argon2id, valid: true},
+		{name: "argon2i", hash: argon2Hash("argon2i", "secret"), valid: true},
+		{name: "other password bcrypt", hash: string(otherBcrypt)},
+		{name: "other password argon2id", hash: argon2Hash("argon2id", "other")},
+		{name: "argon2d", hash: strings.Replace(argon2id, "argon2id", "argon2d", 1), wantError: true},
+		{name: "argon2 version 16", hash: strings.Replace(argon2id, "v=19", "v=16", 1), wantError: true},
+		{name: "argon2 without time", hash: strings.Replace(argon2id, "t=1", "t=0", 1), wantError: true},
+		{name: "argon2 with invalid salt", hash: strings.Replace(argon2id, "c29tZXNhbHQ", "!!", 1), wantError: true},
+		{name: "argon2 without hash", hash: argon2id[:strings.LastIndex(argon2id, "$")+1], wantError: true},
+		{name: "truncated argon2", hash: "$argon2id$v=19$m=64,t=1,p=1", wantError: true},
+		{name: "plaintext", hash: "secret", wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := CheckPasswordHash(tt.hash, "secret"); got != tt.valid {
+				t.Errorf("CheckPasswordHash(%q) = %v, want %v", tt.hash, got, tt.valid)
+			}
+			if err := ValidPasswordHash(tt.hash); (err != nil) != tt.wantError {
+				t.Errorf("ValidPasswordHash(%q) = %v, want error %v", tt.hash, err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestHashedCredentials(t *testing.T) {
+	creds := HashedCredentials{"alice": argon2Hash("argon2id", "secret")}
+	if !creds.Valid("alice", "secret") {
+		t.Error("valid password rejected")
+	}
+	if creds.Valid("alice", "other") {
+		t.Error("wrong password accepted")
+	}
+	if creds.Valid("bob", "secret") {
+		t.Error("unknown user accepted")
+	}
+}
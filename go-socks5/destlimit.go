@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"strings"
+	"sync"
+)
+
+// maxDestStats is the number of destination hosts whose counters are
+// kept before those without open tunnels are pruned
+const maxDestStats = 10000
+
+// DestStats holds the saturation counters of a destination host
+type DestStats struct {
+	// Active is the number of open tunnels
+	Active int
+	// Peak is the highest number of simultaneous tunnels seen
+	Peak int
+	// Rejected counts tunnels rejected because the limit was reached
+	Rejected uint64
+}
+
+// DestLimiter caps the number of simultaneous tunnels to the same
+// destination host. Default applies to every host without an entry in
+// Overrides, zero meaning unlimited.
+type DestLimiter struct {
+	Default   int
+	Overrides map[string]int
+
+	mu    sync.Mutex
+	stats map[string]*DestStats
+}
+
+// NewDestLimiter creates a DestLimiter, override keys are host names or IPs
+func NewDestLimiter(def int, overrides map[string]int) *DestLimiter {
+	l := &DestLimiter{
+		Default:   def,
+		Overrides: make(map[string]int, len(overrides)),
+		stats:     make(map[string]*DestStats),
+	}
+	for host, max := range overrides {
+		l.Overrides[strings.ToLower(host)] = max
+	}
+	return l
+}
+
+// Acquire reserves a tunnel slot for dest. If ok is true, release must be
+// called once the tunnel is closed.
+func (l *DestLimiter) Acquire(dest *AddrSpec) (release func(), ok bool) {
+	host := destHost(dest)
+	max, found := l.Overrides[host]
+	if !found {
+		max = l.Default
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	st, found := l.stats[host]
+	if !found {
+		if len(l.stats) >= maxDestStats {
+			l.prune()
+		}
+		st = &DestStats{}
+		l.stats[host] = st
+	}
+	if max > 0 && st.Active >= max {
+		st.Rejected++
+		return nil, false
+	}
+	st.Active++
+	if st.Active > st.Peak {
+		st.Peak = st.Active
+	}
+
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		st.Active--
+	}, true
+}
+
+// prune drops the counters of the hosts without open tunnels, so that
+// clients requesting random host names cannot grow them without bound.
+// Must be called with l.mu held.
+func (l *DestLimiter) prune() {
+	for host, st := range l.stats {
+		if st.Active == 0 {
+			delete(l.stats, host)
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters per destination host
+func (l *DestLimiter) Stats() map[string]DestStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make(map[string]DestStats, len(l.stats))
+	for host, st := range l.stats {
+		stats[host] = *st
+	}
+	return stats
+}
+
+// destHost returns the host part used to group tunnels by destination
+func destHost(dest *AddrSpec) string {
+	if dest.FQDN != "" {
+		return strings.ToLower(dest.FQDN)
+	}
+	return dest.IP.Unmap().String()
+}
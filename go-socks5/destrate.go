@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxDestRateBuckets is the number of destination buckets kept before
+// refilled ones are pruned
+const maxDestRateBuckets = 10000
+
+// DestRateLimiter limits the rate of new tunnels to the same destination
+// host. Rate is the number of tunnels per second allowed to every host
+// without an entry in Overrides, zero meaning unlimited. Burst is the
+// number of tunnels that may be opened at once, if zero it defaults to
+// the rate rounded up.
+type DestRateLimiter struct {
+	Rate      float64
+	Burst     int
+	Overrides map[string]float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+// NewDestRateLimiter creates a DestRateLimiter, override keys are host
+// names or IPs
+func NewDestRateLimiter(rate float64, burst int, overrides map[string]float64) *DestRateLimiter {
+	l := &DestRateLimiter{
+		Rate:      rate,
+		Burst:     burst,
+		Overrides: make(map[string]float64, len(overrides)),
+		buckets:   make(map[string]*tokenBucket),
+	}
+	for host, rate := range overrides {
+		l.Overrides[strings.ToLower(host)] = rate
+	}
+	return l
+}
+
+// Allow reports whether a new tunnel to dest may be opened now
+func (l *DestRateLimiter) Allow(dest *AddrSpec) bool {
+	host := destHost(dest)
+	rate, found := l.Overrides[host]
+	if !found {
+		rate = l.Rate
+	}
+	return l.allow(host, rate)
+}
+
+// AllowRate is Allow at rate tunnels per second instead of the rate
+// configured for dest, e.g. chosen by the RuleSet with
+// WithDestConnectRate. Tunnels to a host at distinct rates are limited
+// separately.
+func (l *DestRateLimiter) AllowRate(dest *AddrSpec, rate float64) bool {
+	return l.allow(destHost(dest)+"@"+strconv.FormatFloat(rate, 'g', -1, 64), rate)
+}
+
+// allow takes a token of the bucket of key, refilled at rate
+func (l *DestRateLimiter) allow(key string, rate float64) bool {
+	if rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	bucket, found := l.buckets[key]
+	if !found {
+		if len(l.buckets) >= maxDestRateBuckets {
+			l.prune()
+		}
+		burst := l.Burst
+		if burst <= 0 {
+			burst = int(math.Ceil(rate))
+		}
+		bucket = newTokenBucket(rate, burst)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+
+	return bucket.Allow()
+}
+
+// prune drops the buckets that have refilled completely, as they behave
+// like new ones. Must be called with l.mu held.
+func (l *DestRateLimiter) prune() {
+	now := time.Now()
+	for host, bucket := range l.buckets {
+		if bucket.full(now) {
+			delete(l.buckets, host)
+		}
+	}
+}
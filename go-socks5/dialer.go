@@ -0,0 +1,18 @@
+package socks5
+
+import (
+	"context"
+	"net"
+)
+
+// DialFunc connects to addr on network, like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialerSelector is used to choose the dialer connecting to the
+// destination of a CONNECT by the identity of the client, e.g. to give
+// users distinct egress addresses, fwmarks or upstream proxies
+type DialerSelector interface {
+	// SelectDialer returns the dialer for req of a client authenticated
+	// with auth, nil without authentication, or nil for Config.Dial
+	SelectDialer(ctx context.Context, auth *AuthContext, req *Request) DialFunc
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// dnsAnswerTTL is the TTL of records answered by the DNS forwarder
+	dnsAnswerTTL = 60
+
+	// dnsTimeout bounds the resolution of a single query and the
+	// lifetime of idle DNS over TCP connections
+	dnsTimeout = 10 * time.Second
+
+	// maxDNSMessage is the largest DNS message served over TCP
+	maxDNSMessage = 65535
+)
+
+// ServeDNS answers A and AAAA queries received on pc with the configured
+// resolver, so clients resolve names the same way as their tunnels. Only
+// clients allowed to open tunnels without authentication are answered.
+func (s *Server) ServeDNS(pc net.PacketConn) error {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, from, err := pc.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !s.isTrustedClient(addrPort(from).Addr()) {
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.answerDNS(query); resp != nil {
+				pc.WriteTo(resp, from)
+			}
+		}()
+	}
+}
+
+// ServeDNSStream answers DNS queries over TCP connections accepted on l,
+// like ServeDNS
+func (s *Server) ServeDNSStream(l net.Listener) error {
+	return s.serveRaw(l, func(conn net.Conn) {
+		defer conn.Close()
+		if !s.isTrustedClient(addrPort(conn.RemoteAddr()).Addr()) {
+			return
+		}
+
+		length := make([]byte, 2)
+		for {
+			conn.SetDeadline(time.Now().Add(dnsTimeout))
+			if _, err := io.ReadFull(conn, length); err != nil {
+				return
+			}
+			query := make([]byte, binary.BigEndian.Uint16(length))
+			if _, err := io.ReadFull(conn, query); err != nil {
+				return
+			}
+			resp := s.answerDNS(query)
+			if resp == nil || len(resp) > maxDNSMessage {
+				return
+			}
+			msg := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(resp)), uint16(len(resp)))
+			if _, err := conn.Write(append(msg, resp...)); err != nil {
+				return
+			}
+		}
+	})
+}
+
+// isTrustedClient reports whether ip may use the proxy without
+// authentication
+func (s *Server) isTrustedClient(ip netip.Addr) bool {
+	if s.config.BanList != nil && s.config.BanList.IsBanned(ip) {
+		return false
+	}
+	return s.IsDockerNetwork(ip) || s.IsTailScale(ip) || s.isIPAllowed(ip)
+}
+
+// answerDNS builds the response to a DNS query, or returns nil if the
+// query is malformed
+func (s *Server) answerDNS(query []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	question, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	resp := dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		OpCode:             header.OpCode,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	}
+	var addrs []netip.Addr
+	switch {
+	case header.OpCode != 0 || question.Class != dnsmessage.ClassINET:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	case question.Type != dnsmessage.TypeA && question.Type != dnsmessage.TypeAAAA:
+		resp.RCode = dnsmessage.RCodeNotImplemented
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+		_, addrs, err = s.resolveAll(ctx, strings.TrimSuffix(question.Name.String(), "."))
+		cancel()
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			resp.RCode = dnsmessage.RCodeNameError
+		} else if err != nil {
+			resp.RCode = dnsmessage.RCodeServerFailure
+		}
+	}
+
+	b := dnsmessage.NewBuilder(nil, resp)
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(question)
+	b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: dnsAnswerTTL}
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() && question.Type == dnsmessage.TypeA {
+			b.AResource(rh, dnsmessage.AResource{A: addr.As4()})
+		} else if addr.Is6() && question.Type == dnsmessage.TypeAAAA {
+			b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: addr.As16()})
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		s.config.Logger.Errorf("failed to build DNS response: %v", err)
+		return nil
+	}
+	return msg
+}
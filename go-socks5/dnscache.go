@@ -0,0 +1,166 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dnsCacheRefreshTimeout bounds the background refresh of a stale entry
+const dnsCacheRefreshTimeout = 10 * time.Second
+
+// DNSCacheStats are the counters of a CachingResolver
+type DNSCacheStats struct {
+	// Entries is the number of cached names
+	Entries int `json:"entries"`
+	// Hits and Misses count the lookups answered from the cache or not,
+	// StaleHits those answered from an expired entry while refreshing it
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	StaleHits uint64 `json:"stale_hits"`
+	// Evictions counts the entries dropped to make room for new ones
+	Evictions uint64 `json:"evictions"`
+}
+
+// CachingResolver is a NameResolver caching the addresses returned by
+// Resolver for TTL, holding up to MaxEntries names. If Stale is set,
+// expired entries keep being answered for up to Stale while they are
+// refreshed in the background, smoothing over transient resolver outages
+// for hot destinations. Contexts returned by Resolver are not cached.
+type CachingResolver struct {
+	Resolver   NameResolver
+	TTL        time.Duration
+	Stale      time.Duration
+	MaxEntries int
+
+	mu      sync.Mutex
+	entries map[string]*dnsCacheEntry
+
+	hits, misses, staleHits, evictions atomic.Uint64
+}
+
+// dnsCacheEntry holds the addresses of a name until expires, refreshing is
+// set while a stale entry is being refreshed
+type dnsCacheEntry struct {
+	addrs      []netip.Addr
+	expires    time.Time
+	refreshing bool
+}
+
+// NewCachingResolver creates a CachingResolver in front of resolver
+func NewCachingResolver(resolver NameResolver, ttl, stale time.Duration, maxEntries int) *CachingResolver {
+	return &CachingResolver{
+		Resolver:   resolver,
+		TTL:        ttl,
+		Stale:      stale,
+		MaxEntries: maxEntries,
+		entries:    make(map[string]*dnsCacheEntry),
+	}
+}
+
+func (c *CachingResolver) String() string {
+	if r, ok := c.Resolver.(fmt.Stringer); ok {
+		return "cached " + r.String()
+	}
+	return fmt.Sprintf("cached %T", c.Resolver)
+}
+
+func (c *CachingResolver) Resolve(ctx context.Context, name string) (context.Context, netip.Addr, error) {
+	ctx, addrs, err := c.ResolveAll(ctx, name)
+	if err != nil {
+		return ctx, netip.Addr{}, err
+	}
+	return ctx, addrs[0], nil
+}
+
+func (c *CachingResolver) ResolveAll(ctx context.Context, name string) (context.Context, []netip.Addr, error) {
+	now := time.Now()
+	c.mu.Lock()
+	if e, found := c.entries[name]; found {
+		switch {
+		case now.Before(e.expires):
+			c.mu.Unlock()
+			c.hits.Add(1)
+			return ctx, slices.Clone(e.addrs), nil
+		case now.Before(e.expires.Add(c.Stale)):
+			if !e.refreshing {
+				e.refreshing = true
+				go c.refresh(name)
+			}
+			c.mu.Unlock()
+			c.staleHits.Add(1)
+			return ctx, slices.Clone(e.addrs), nil
+		}
+	}
+	c.mu.Unlock()
+
+	c.misses.Add(1)
+	ctx, addrs, err := resolveAll(ctx, c.Resolver, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	c.store(name, addrs)
+	return ctx, addrs, nil
+}
+
+// CacheStats returns the counters of the cache, reported in Stats.DNSCache
+// when the CachingResolver is the Config.Resolver
+func (c *CachingResolver) CacheStats() DNSCacheStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+	return DNSCacheStats{
+		Entries:   entries,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		StaleHits: c.staleHits.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// refresh resolves a stale entry again, keeping it on failure until it
+// is too old to be served
+func (c *CachingResolver) refresh(name string) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsCacheRefreshTimeout)
+	defer cancel()
+	if _, addrs, err := resolveAll(ctx, c.Resolver, name); err == nil {
+		c.store(name, addrs)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, found := c.entries[name]; found {
+		e.refreshing = false
+	}
+}
+
+// store caches the addresses of name, evicting entries beyond their
+// stale period or, if none, the entry expiring first when full
+func (c *CachingResolver) store(name string, addrs []netip.Addr) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.entries[name]; !found && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		for n, e := range c.entries {
+			if !now.Before(e.expires.Add(c.Stale)) {
+				delete(c.entries, n)
+				c.evictions.Add(1)
+			}
+		}
+		if len(c.entries) >= c.MaxEntries {
+			var oldest string
+			for n, e := range c.entries {
+				if oldest == "" || e.expires.Before(c.entries[oldest].expires) {
+					oldest = n
+				}
+			}
+			delete(c.entries, oldest)
+			c.evictions.Add(1)
+		}
+	}
+	c.entries[name] = &dnsCacheEntry{addrs: slices.Clone(addrs), expires: now.Add(c.TTL)}
+}
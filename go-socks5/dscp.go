@@ -0,0 +1,30 @@
+package socks5
+
+import "context"
+
+// maxDSCP is the largest Differentiated Services code point
+const maxDSCP = 63
+
+type dscpKey struct{}
+
+// WithDSCP returns a context carrying the DSCP value marked on the
+// outbound connection of the tunnel, so downstream QoS can classify it.
+// It takes precedence over Config.DSCP.
+func WithDSCP(ctx context.Context, dscp uint8) context.Context {
+	return context.WithValue(ctx, dscpKey{}, dscp)
+}
+
+// DSCPFromContext returns the DSCP value attached with WithDSCP, if any
+func DSCPFromContext(ctx context.Context) (uint8, bool) {
+	dscp, ok := ctx.Value(dscpKey{}).(uint8)
+	return dscp, ok
+}
+
+// dscp returns the DSCP value to mark the outbound connection with, zero
+// leaving it unmarked
+func (s *Server) dscp(ctx context.Context) uint8 {
+	if dscp, ok := DSCPFromContext(ctx); ok {
+		return dscp & maxDSCP
+	}
+	return s.config.DSCP
+}
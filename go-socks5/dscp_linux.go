@@ -0,0 +1,21 @@
+//go:build linux
+
+package socks5
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// markDSCP sets the DSCP bits of the traffic class of an outbound socket.
+// Errors are ignored so the tunnel is opened unmarked where not permitted.
+func markDSCP(network string, c syscall.RawConn, dscp uint8) error {
+	tos := int(dscp) << 2
+	return c.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+		if network == "tcp6" {
+			unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+		}
+	})
+}
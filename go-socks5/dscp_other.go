@@ -0,0 +1,12 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// markDSCP is a no-op on platforms without DSCP marking support
+func markDSCP(network string, c syscall.RawConn, dscp uint8) error {
+	return nil
+}
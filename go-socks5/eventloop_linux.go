@@ -0,0 +1,359 @@
+//go:build linux
+
+package socks5
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// eventLoopBufSize is the size of the read buffer of an event loop,
+	// shared by its tunnels
+	eventLoopBufSize = 64 << 10
+
+	// eventLoopBatch is the number of events handled per wait
+	eventLoopBatch = 256
+)
+
+// relayLoops are the event loops relaying tunnels with Config.EventLoopRelay
+type relayLoops struct {
+	loops []*relayLoop
+	next  atomic.Uint32
+}
+
+// relayLoop waits for the sockets of its tunnels to be ready with epoll
+// and copies between them. Data a destination is not ready for is held
+// until it is, and its source is not read in the meantime, so an idle
+// tunnel costs its two sockets and no buffer.
+type relayLoop struct {
+	epfd int
+	buf  []byte
+
+	mu      sync.Mutex
+	tunnels map[int32]*loopTunnel
+}
+
+// loopTunnel is a tunnel relayed by a relayLoop. Index 0 refers to the
+// client and 1 to the destination. Its state is only accessed by the
+// goroutine of the loop, except closed, guarded by mu.
+type loopTunnel struct {
+	loop *relayLoop
+	fds  [2]int
+	// pending holds the data read from fds[k] not yet written to the
+	// other side, eof is set once fds[k] reached the end of its stream and
+	// shut once the write side of fds[k] is shut down
+	pending   [2][]byte
+	eof, shut [2]bool
+	// events is the interest registered for fds[k], zero if none
+	events [2]uint32
+	// count is called with the bytes read from fds[k] and written to the
+	// other side
+	count [2]func(uint64)
+	// active stores the time of the last read, if the tunnel is subject
+	// to the reaper
+	active *atomic.Int64
+
+	mu     sync.Mutex
+	closed bool
+	done   chan error
+}
+
+// newRelayLoops starts one event loop per CPU
+func newRelayLoops() (*relayLoops, error) {
+	loops := &relayLoops{}
+	for range runtime.GOMAXPROCS(0) {
+		epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+		if err != nil {
+			return nil, os.NewSyscallError("epoll_create1", err)
+		}
+		l := &relayLoop{
+			epfd:    epfd,
+			buf:     make([]byte, eventLoopBufSize),
+			tunnels: make(map[int32]*loopTunnel),
+		}
+		loops.loops = append(loops.loops, l)
+		go l.run()
+	}
+	return loops, nil
+}
+
+// relayEventLoop relays the tunnel of req with an event loop if
+// Config.EventLoopRelay is set and the tunnel is between plain TCP
+// connections, is neither shaped nor captured and no data was read ahead
+// from the client. It reports whether it did, taking over both
+// connections.
+func (s *Server) relayEventLoop(ctx context.Context, conn conn, target net.Conn, req *Request, up, down io.Writer) (bool, error) {
+	if s.loops == nil || s.config.Capture {
+		return false, nil
+	}
+	client, ok := conn.(*net.TCPConn)
+	if !ok {
+		return false, nil
+	}
+	dest, ok := target.(*net.TCPConn)
+	if !ok || up != io.Writer(dest) || down != io.Writer(client) {
+		return false, nil
+	}
+	switch r := req.bufConn.(type) {
+	case *net.TCPConn:
+		ok = r == client
+	case *negotiationGuard:
+		ok = r.Reader == io.Reader(client)
+	default:
+		ok = false
+	}
+	if !ok {
+		return false, nil
+	}
+
+	t := &loopTunnel{
+		count: [2]func(uint64){
+			func(n uint64) { s.countUp(req, n) },
+			func(n uint64) { s.countDown(req, n) },
+		},
+		done: make(chan error, 1),
+	}
+	if s.watchIdle(ctx, req) {
+		t.active = &req.lastActive
+	}
+	// The loop works on duplicates of the sockets, closing the
+	// connections leaves them open
+	var err error
+	if t.fds[0], err = dupConn(client); err != nil {
+		return false, nil
+	}
+	if t.fds[1], err = dupConn(dest); err != nil {
+		unix.Close(t.fds[0])
+		return false, nil
+	}
+	client.Close()
+	dest.Close()
+
+	l := s.loops.loops[s.loops.next.Add(1)%uint32(len(s.loops.loops))]
+	if err := l.add(t); err != nil {
+		t.close(err)
+	}
+	stop := context.AfterFunc(ctx, t.stop)
+	defer stop()
+	return true, <-t.done
+}
+
+// dupConn returns a duplicate of the socket of c
+func dupConn(c *net.TCPConn) (int, error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	cerr := raw.Control(func(s uintptr) {
+		fd, err = unix.FcntlInt(s, unix.F_DUPFD_CLOEXEC, 0)
+	})
+	if cerr != nil {
+		return -1, cerr
+	}
+	return fd, err
+}
+
+// add registers the sockets of t
+func (l *relayLoop) add(t *loopTunnel) error {
+	t.loop = l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, fd := range t.fds {
+		l.tunnels[int32(fd)] = t
+	}
+	for k := range t.fds {
+		if err := t.update(k); err != nil {
+			l.remove(t)
+			return err
+		}
+	}
+	return nil
+}
+
+// remove unregisters the sockets of t, with mu held
+func (l *relayLoop) remove(t *loopTunnel) {
+	for k, fd := range t.fds {
+		delete(l.tunnels, int32(fd))
+		if t.events[k] != 0 {
+			unix.EpollCtl(l.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+		}
+	}
+}
+
+// run handles the events of the sockets, forever
+func (l *relayLoop) run() {
+	events := make([]unix.EpollEvent, eventLoopBatch)
+	for {
+		n, err := unix.EpollWait(l.epfd, events, -1)
+		if err != nil {
+			if err != unix.EINTR {
+				// Only possible with an invalid epoll descriptor
+				panic(os.NewSyscallError("epoll_wait", err))
+			}
+			continue
+		}
+		for _, ev := range events[:n] {
+			l.mu.Lock()
+			t := l.tunnels[ev.Fd]
+			l.mu.Unlock()
+			// Events of sockets closed in the same batch are skipped, or
+			// seen by the tunnel reusing the descriptor and ignored
+			if t != nil {
+				t.handle(int(ev.Fd), ev.Events)
+			}
+		}
+	}
+}
+
+// handle copies what the events of fd allow and updates the interest of
+// the tunnel
+func (t *loopTunnel) handle(fd int, events uint32) {
+	k := 0
+	if fd == t.fds[1] {
+		k = 1
+	}
+	peer := 1 - k
+	if events&(unix.EPOLLIN|unix.EPOLLHUP|unix.EPOLLERR) != 0 && t.events[k]&unix.EPOLLIN != 0 {
+		if err := t.read(k); err != nil {
+			t.finish(err)
+			return
+		}
+	}
+	if events&(unix.EPOLLOUT|unix.EPOLLHUP|unix.EPOLLERR) != 0 && t.pending[peer] != nil {
+		if err := t.write(peer); err != nil {
+			t.finish(err)
+			return
+		}
+	}
+
+	// Forward the end of a stream once its data is written, like
+	// CloseWrite does in user space relaying
+	for k := range t.fds {
+		if t.eof[k] && t.pending[k] == nil && !t.shut[1-k] {
+			t.shut[1-k] = true
+			unix.Shutdown(t.fds[1-k], unix.SHUT_WR)
+		}
+	}
+	if t.shut[0] && t.shut[1] {
+		t.finish(nil)
+		return
+	}
+	for k := range t.fds {
+		if err := t.update(k); err != nil {
+			t.finish(err)
+			return
+		}
+	}
+}
+
+// read reads from fds[k] and writes to the other side as much as it
+// takes, holding the rest
+func (t *loopTunnel) read(k int) error {
+	buf := t.loop.buf
+	n, err := unix.Read(t.fds[k], buf)
+	switch {
+	case err == unix.EAGAIN || err == unix.EINTR:
+		return nil
+	case err != nil:
+		return os.NewSyscallError("read", err)
+	case n == 0:
+		t.eof[k] = true
+		return nil
+	}
+	if t.active != nil {
+		t.active.Store(time.Now().UnixNano())
+	}
+	t.pending[k] = buf[:n]
+	err = t.write(k)
+	if t.pending[k] != nil {
+		// The buffer is reused by the next read of the loop
+		t.pending[k] = append([]byte(nil), t.pending[k]...)
+	}
+	return err
+}
+
+// write writes the data pending from fds[k] to the other side
+func (t *loopTunnel) write(k int) error {
+	n, err := unix.Write(t.fds[1-k], t.pending[k])
+	if n > 0 {
+		t.count[k](uint64(n))
+		if t.pending[k] = t.pending[k][n:]; len(t.pending[k]) == 0 {
+			t.pending[k] = nil
+		}
+	}
+	if err != nil && err != unix.EAGAIN && err != unix.EINTR {
+		return os.NewSyscallError("write", err)
+	}
+	return nil
+}
+
+// update registers the interest of the tunnel in fds[k]: reading if the
+// previous data was written and writing if data for it is pending.
+// Sockets without interest are removed from epoll, so that hang ups are
+// not reported over and over.
+func (t *loopTunnel) update(k int) error {
+	var events uint32
+	if !t.eof[k] && t.pending[k] == nil {
+		events |= unix.EPOLLIN
+	}
+	if t.pending[1-k] != nil {
+		events |= unix.EPOLLOUT
+	}
+	if events == t.events[k] {
+		return nil
+	}
+	op := unix.EPOLL_CTL_MOD
+	switch {
+	case t.events[k] == 0:
+		op = unix.EPOLL_CTL_ADD
+	case events == 0:
+		op = unix.EPOLL_CTL_DEL
+	}
+	t.events[k] = events
+	ev := unix.EpollEvent{Events: events, Fd: int32(t.fds[k])}
+	if err := unix.EpollCtl(t.loop.epfd, op, t.fds[k], &ev); err != nil {
+		return os.NewSyscallError("epoll_ctl", err)
+	}
+	return nil
+}
+
+// finish ends the tunnel, reporting err to relayEventLoop
+func (t *loopTunnel) finish(err error) {
+	t.loop.mu.Lock()
+	t.loop.remove(t)
+	t.loop.mu.Unlock()
+	t.close(err)
+}
+
+// close closes the sockets of the tunnel and reports err
+func (t *loopTunnel) close(err error) {
+	t.mu.Lock()
+	t.closed = true
+	for _, fd := range t.fds {
+		unix.Close(fd)
+	}
+	t.mu.Unlock()
+	t.done <- err
+}
+
+// stop makes the loop end the tunnel, by shutting down both sockets
+func (t *loopTunnel) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return
+	}
+	for _, fd := range t.fds {
+		unix.Shutdown(fd, unix.SHUT_RDWR)
+	}
+}
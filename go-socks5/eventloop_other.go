@@ -0,0 +1,21 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+)
+
+// relayLoops are not supported on this platform
+type relayLoops struct{}
+
+func newRelayLoops() (*relayLoops, error) {
+	return nil, fmt.Errorf("event loop relay is only supported on Linux")
+}
+
+func (s *Server) relayEventLoop(ctx context.Context, conn conn, target net.Conn, req *Request, up, down io.Writer) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,119 @@
+package socks5
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FailureCache is a ContextCredentialStore remembering the failed
+// authentications of Credentials for TTL, so clients retrying bad
+// credentials in tight loops don't hammer expensive backends such as
+// LDAP, webhooks or bcrypt hashes. Failures are keyed by a salted hash of
+// the username, password and client IP, a different password or client
+// is checked again. At most MaxEntries failures are remembered, zero
+// meaning no limit.
+type FailureCache struct {
+	Credentials CredentialStore
+	TTL         time.Duration
+	MaxEntries  int
+
+	salt       [16]byte
+	mu         sync.Mutex
+	failures   map[[sha256.Size]byte]time.Time
+	suppressed atomic.Uint64
+}
+
+// NewFailureCache creates a FailureCache in front of store
+func NewFailureCache(store CredentialStore, ttl time.Duration, maxEntries int) *FailureCache {
+	f := &FailureCache{
+		Credentials: store,
+		TTL:         ttl,
+		MaxEntries:  maxEntries,
+		failures:    make(map[[sha256.Size]byte]time.Time),
+	}
+	rand.Read(f.salt[:])
+	return f
+}
+
+func (f *FailureCache) Valid(user, password string) bool {
+	return f.ValidContext(context.Background(), user, password, netip.AddrPort{})
+}
+
+func (f *FailureCache) ValidContext(ctx context.Context, user, password string, client netip.AddrPort) bool {
+	key := f.key(user, password, client.Addr())
+	now := time.Now()
+	f.mu.Lock()
+	expires, found := f.failures[key]
+	if found && !now.Before(expires) {
+		delete(f.failures, key)
+	}
+	f.mu.Unlock()
+	if found && now.Before(expires) {
+		f.suppressed.Add(1)
+		return false
+	}
+
+	if ContextCredentials(f.Credentials).ValidContext(ctx, user, password, client) {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.MaxEntries > 0 && len(f.failures) >= f.MaxEntries {
+		for k, expires := range f.failures {
+			if !now.Before(expires) {
+				delete(f.failures, k)
+			}
+		}
+		if len(f.failures) >= f.MaxEntries {
+			return false
+		}
+	}
+	f.failures[key] = now.Add(f.TTL)
+	return false
+}
+
+// Suppressed returns the number of authentications rejected from the
+// cache without asking Credentials
+func (f *FailureCache) Suppressed() uint64 {
+	return f.suppressed.Load()
+}
+
+// key hashes a failed authentication, so passwords are not kept in memory
+func (f *FailureCache) key(user, password string, client netip.Addr) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write(f.salt[:])
+	h.Write([]byte(user))
+	h.Write([]byte{0})
+	h.Write([]byte(password))
+	h.Write([]byte{0})
+	ip, _ := client.Unmap().MarshalBinary()
+	h.Write(ip)
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// authFailuresCached sums the authentications suppressed by the
+// FailureCache of username/password authenticators
+func (s *Server) authFailuresCached() uint64 {
+	var n uint64
+	for _, a := range *s.authMethods.Load() {
+		var store CredentialStore
+		switch a := a.(type) {
+		case UserPassAuthenticator:
+			store = a.Credentials
+		case *UserPassAuthenticator:
+			store = a.Credentials
+		}
+		if f, ok := store.(*FailureCache); ok {
+			n += f.Suppressed()
+		}
+	}
+	return n
+}
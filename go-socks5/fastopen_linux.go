@@ -0,0 +1,28 @@
+//go:build linux
+
+package socks5
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// fastOpenQueueLen is the maximum number of pending TFO requests
+const fastOpenQueueLen = 256
+
+// listenFastOpen enables TCP Fast Open on a listening socket. Errors are
+// ignored so kernels without TFO fall back to a regular handshake.
+func listenFastOpen(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN, fastOpenQueueLen)
+	})
+}
+
+// dialFastOpen enables TCP Fast Open on an outbound socket. Errors are
+// ignored so kernels without TFO fall back to a regular handshake.
+func dialFastOpen(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1)
+	})
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"syscall"
+)
+
+// listenFastOpen is a no-op on platforms without TCP Fast Open support
+func listenFastOpen(network, address string, c syscall.RawConn) error {
+	return nil
+}
+
+// dialFastOpen is a no-op on platforms without TCP Fast Open support
+func dialFastOpen(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// rawConn is a client connection without SOCKS negotiation, replies are
+// not sent to it
+type rawConn struct {
+	net.Conn
+}
+
+func (c rawConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// ServeForward accepts plain TCP connections on l and forwards each of
+// them to dest, as if the client requested a CONNECT to dest
+func (s *Server) ServeForward(l net.Listener, dest *AddrSpec) error {
+	return s.serveRaw(l, func(conn net.Conn) { s.ServeForwardConn(conn, dest) })
+}
+
+// ServeTransparent accepts connections redirected by the firewall on a
+// listener created by ListenTransparent and forwards each of them to its
+// original destination
+func (s *Server) ServeTransparent(l net.Listener) error {
+	listenPort := addrPort(l.Addr()).Port()
+	return s.serveRaw(l, func(conn net.Conn) {
+		dst, err := originalDst(conn)
+		if err != nil {
+			s.config.Logger.Errorf("failed to get original destination of %v: %v", conn.RemoteAddr(), err)
+			conn.Close()
+			return
+		}
+		// Connections made to the listener itself would loop
+		if dst == addrPort(conn.LocalAddr()) && dst.Port() == listenPort {
+			s.config.Logger.Warnf("rejecting connection from %v: not redirected", conn.RemoteAddr())
+			conn.Close()
+			return
+		}
+		s.ServeForwardConn(conn, &AddrSpec{IP: dst.Addr().Unmap(), Port: int(dst.Port())})
+	})
+}
+
+// serveRaw accepts connections on l and serves each of them with serve
+func (s *Server) serveRaw(l net.Listener, serve func(net.Conn)) error {
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isDraining() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.admitAccepted(conn) {
+			continue
+		}
+		go serve(conn)
+	}
+}
+
+// ServeForwardConn forwards a single plain TCP connection to dest. The
+// connection is subject to the same client checks, rules and accounting
+// as a SOCKS CONNECT, but cannot authenticate.
+func (s *Server) ServeForwardConn(conn net.Conn, dest *AddrSpec) error {
+	defer conn.Close()
+	ctx, sess := s.startSession(context.Background(), conn)
+	defer s.endSession(conn)
+
+	requireAuth, err := s.admit(sess, conn, nil)
+	if err != nil {
+		return err
+	}
+	if requireAuth {
+		s.countDenial("auth_required")
+		return fmt.Errorf("forward to %v rejected: client must authenticate", dest)
+	}
+
+	d := *dest
+	request := &Request{
+		Version:  socks5Version,
+		Command:  ConnectCommand,
+		DestAddr: &d,
+		bufConn:  conn,
+	}
+	return s.serveRequest(ctx, sess, rawConn{conn}, request)
+}
@@ -0,0 +1,147 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// idleReapInterval is how often the reaper scans the sessions
+const idleReapInterval = time.Second
+
+// errIdleTimeout is the cause of the context of sessions closed by the
+// reaper
+var errIdleTimeout = fmt.Errorf("idle timeout")
+
+// idleBuckets are the upper bounds of the idle time distribution
+// reported by Stats, sessions idle longer are counted as "+Inf"
+var idleBuckets = []struct {
+	bound time.Duration
+	label string
+}{
+	{10 * time.Second, "10s"},
+	{time.Minute, "1m"},
+	{5 * time.Minute, "5m"},
+	{30 * time.Minute, "30m"},
+	{2 * time.Hour, "2h"},
+}
+
+// IdleBucket is the number of tunnels idle for up to UpTo
+type IdleBucket struct {
+	UpTo     string `json:"up_to"`
+	Sessions int    `json:"sessions"`
+}
+
+type idleTimeoutKey struct{}
+
+// WithIdleTimeout returns a context carrying the idle timeout of the
+// tunnel, taking precedence over Config.Timeouts.Idle
+func WithIdleTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, idleTimeoutKey{}, d)
+}
+
+// IdleTimeoutFromContext returns the idle timeout attached with
+// WithIdleTimeout, if any
+func IdleTimeoutFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(idleTimeoutKey{}).(time.Duration)
+	return d, ok
+}
+
+// idleTimeout returns the idle timeout that applies to a tunnel, zero
+// meaning none
+func (s *Server) idleTimeout(ctx context.Context) time.Duration {
+	if d, ok := IdleTimeoutFromContext(ctx); ok {
+		return d
+	}
+	return s.config.Timeouts.Idle
+}
+
+// trackIdle records the activity of the tunnel of req, making it subject
+// to the reaper if it has an idle timeout. It returns the readers of both
+// directions of the tunnel, which mark it active when data is read.
+func (s *Server) trackIdle(ctx context.Context, req *Request, up, down io.Reader) (io.Reader, io.Reader) {
+	if !s.watchIdle(ctx, req) {
+		return up, down
+	}
+	return activityReader{up, &req.lastActive}, activityReader{down, &req.lastActive}
+}
+
+// watchIdle makes the tunnel of req subject to the reaper if it has an
+// idle timeout, reporting whether it does. Activity must then be stored
+// in req.lastActive.
+func (s *Server) watchIdle(ctx context.Context, req *Request) bool {
+	timeout := s.idleTimeout(ctx)
+	if timeout <= 0 {
+		return false
+	}
+	req.lastActive.Store(time.Now().UnixNano())
+	req.idleTimeout.Store(int64(timeout))
+	s.reaper.Do(func() { go s.reapIdle() })
+	return true
+}
+
+// activityReader stores the time of the last successful read in last
+type activityReader struct {
+	io.Reader
+	last *atomic.Int64
+}
+
+func (r activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// reapIdle closes the tunnels idle beyond their timeout, forever
+func (s *Server) reapIdle() {
+	ticker := time.NewTicker(idleReapInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.mu.Lock()
+		for _, sess := range s.conns {
+			req := sess.request
+			if req == nil || req.idleTimeout.Load() == 0 {
+				continue
+			}
+			idle := now.Sub(time.Unix(0, req.lastActive.Load()))
+			if timeout := time.Duration(req.idleTimeout.Load()); idle > timeout {
+				s.requestLogger(req).Infof("closing tunnel to %v: idle for %s", req.DestAddr, idle.Truncate(time.Second))
+				req.idleTimeout.Store(0)
+				sess.cancel(errIdleTimeout)
+				s.stats.idleReaped.Add(1)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// idleSessions returns the distribution of the idle time of the tunnels
+// subject to the reaper
+func (s *Server) idleSessions() []IdleBucket {
+	buckets := make([]IdleBucket, len(idleBuckets)+1)
+	for i, b := range idleBuckets {
+		buckets[i].UpTo = b.label
+	}
+	buckets[len(idleBuckets)].UpTo = "+Inf"
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.conns {
+		req := sess.request
+		if req == nil || req.idleTimeout.Load() == 0 {
+			continue
+		}
+		idle := now.Sub(time.Unix(0, req.lastActive.Load()))
+		i := 0
+		for i < len(idleBuckets) && idle > idleBuckets[i].bound {
+			i++
+		}
+		buckets[i].Sessions++
+	}
+	return buckets
+}
@@ -0,0 +1,31 @@
+package socks5
+
+import (
+	"context"
+	"time"
+)
+
+type maxTunnelDurationKey struct{}
+
+// WithMaxTunnelDuration returns a context carrying the maximum lifetime of
+// the tunnel. RuleSets can use it to grant short-lived access; it takes
+// precedence over Config.Timeouts.Max.
+func WithMaxTunnelDuration(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxTunnelDurationKey{}, d)
+}
+
+// MaxTunnelDurationFromContext returns the tunnel lifetime attached with
+// WithMaxTunnelDuration, if any
+func MaxTunnelDurationFromContext(ctx context.Context) (time.Duration, bool) {
+	d, ok := ctx.Value(maxTunnelDurationKey{}).(time.Duration)
+	return d, ok
+}
+
+// maxTunnelDuration returns the lifetime limit that applies to a tunnel,
+// zero meaning unlimited
+func (s *Server) maxTunnelDuration(ctx context.Context) time.Duration {
+	if d, ok := MaxTunnelDurationFromContext(ctx); ok {
+		return d
+	}
+	return s.config.Timeouts.Max
+}
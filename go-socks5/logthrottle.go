@@ -0,0 +1,72 @@
+package socks5
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxThrottledLogs is the number of distinct messages tracked per window,
+// further ones are summarized together
+const maxThrottledLogs = 10000
+
+// logThrottle writes the first of similar messages from a client once per
+// window and a summary of the suppressed ones when the window ends
+type logThrottle struct {
+	mu      sync.Mutex
+	entries map[logThrottleKey]*int
+}
+
+// logThrottleKey identifies similar messages by format and client
+type logThrottleKey struct {
+	format string
+	client string
+}
+
+// logThrottled writes a message about client at level, unless a similar
+// message about it was written within Config.LogSuppressWindow
+func (s *Server) logThrottled(level logrus.Level, client string, format string, args ...any) {
+	window := s.config.LogSuppressWindow
+	if window <= 0 {
+		s.config.Logger.Logf(level, format, args...)
+		return
+	}
+
+	t := &s.logThrottle
+	key := logThrottleKey{format, client}
+	t.mu.Lock()
+	if t.entries == nil {
+		t.entries = make(map[logThrottleKey]*int)
+	}
+	if _, found := t.entries[key]; !found && len(t.entries) >= maxThrottledLogs {
+		key.client = "other clients"
+	}
+	if suppressed, found := t.entries[key]; found {
+		*suppressed++
+		t.mu.Unlock()
+		return
+	}
+	suppressed := new(int)
+	if key.client != client {
+		// Messages summarized together are all suppressed, the first too
+		*suppressed = 1
+	}
+	t.entries[key] = suppressed
+	t.mu.Unlock()
+
+	if key.client == client {
+		s.config.Logger.Logf(level, format, args...)
+	}
+	time.AfterFunc(window, func() {
+		t.mu.Lock()
+		n := *suppressed
+		delete(t.entries, key)
+		t.mu.Unlock()
+		if n > 0 {
+			message := fmt.Sprintf(format, args...)
+			s.config.Logger.Logf(level, "suppressed %d similar messages from %s in last %s: %s", n, key.client, window, message)
+		}
+	})
+}
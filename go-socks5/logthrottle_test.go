@@ -0,0 +1,84 @@
+package socks5
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLogThrottled(t *testing.T) {
+	const window = 20 * time.Millisecond
+	tests := []struct {
+		name    string
+		full    bool // whether maxThrottledLogs messages are tracked already
+		clients []string
+		want    []string
+	}{
+		{
+			name:    "single message",
+			clients: []string{"192.0.2.1"},
+			want:    []string{"rejected 192.0.2.1"},
+		},
+		{
+			name:    "repeated message",
+			clients: []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"},
+			want: []string{
+				"rejected 192.0.2.1",
+				"suppressed 2 similar messages from 192.0.2.1 in last 20ms: rejected 192.0.2.1",
+			},
+		},
+		{
+			name:    "other client",
+			clients: []string{"192.0.2.1", "192.0.2.2", "192.0.2.1"},
+			want: []string{
+				"rejected 192.0.2.1",
+				"rejected 192.0.2.2",
+				"suppressed 1 similar messages from 192.0.2.1 in last 20ms: rejected 192.0.2.1",
+			},
+		},
+		{
+			name:    "too many messages",
+			full:    true,
+			clients: []string{"192.0.2.1", "192.0.2.2"},
+			want:    []string{"suppressed 2 similar messages from other clients in last 20ms: rejected 192.0.2.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, hook := test.NewNullLogger()
+			s := &Server{config: &Config{Logger: logger, LogSuppressWindow: window}}
+			if tt.full {
+				s.logThrottle.entries = make(map[logThrottleKey]*int)
+				for i := range maxThrottledLogs {
+					s.logThrottle.entries[logThrottleKey{"filler", fmt.Sprint(i)}] = new(int)
+				}
+			}
+			for _, client := range tt.clients {
+				s.logThrottled(logrus.WarnLevel, client, "rejected %s", client)
+			}
+
+			// Wait for the summaries at the end of the window
+			var got []string
+			for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(window) {
+				got = got[:0]
+				for _, entry := range hook.AllEntries() {
+					got = append(got, entry.Message)
+				}
+				if len(got) >= len(tt.want) {
+					break
+				}
+			}
+			time.Sleep(2 * window)
+			if n := len(hook.AllEntries()); n != len(got) {
+				t.Fatalf("got %d messages after the window, want %d", n, len(got))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+)
+
+// nat64WellKnown are the addresses of ipv4only.arpa, see RFC 7050
+var nat64WellKnown = []netip.Addr{netip.AddrFrom4([4]byte{192, 0, 0, 170}), netip.AddrFrom4([4]byte{192, 0, 0, 171})}
+
+// validNAT64Prefix returns an error unless prefix is an IPv6 prefix of
+// one of the lengths of RFC 6052
+func validNAT64Prefix(prefix netip.Prefix) error {
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() || !slices.Contains([]int{32, 40, 48, 56, 64, 96}, prefix.Bits()) {
+		return fmt.Errorf("invalid NAT64 prefix %v: must be an IPv6 /32, /40, /48, /56, /64 or /96", prefix)
+	}
+	return nil
+}
+
+// nat64Positions returns the byte offsets of the IPv4 address embedded
+// in an IPv6 address of a prefix of bits, skipping the u octet 8
+func nat64Positions(bits int) [4]int {
+	var pos [4]int
+	i := bits / 8
+	for n := range pos {
+		if i == 8 {
+			i++
+		}
+		pos[n] = i
+		i++
+	}
+	return pos
+}
+
+// synthesizeNAT64 embeds ip in prefix as of RFC 6052
+func synthesizeNAT64(prefix netip.Prefix, ip netip.Addr) netip.Addr {
+	b := prefix.Masked().Addr().As16()
+	v4 := ip.As4()
+	for n, i := range nat64Positions(prefix.Bits()) {
+		b[i] = v4[n]
+	}
+	return netip.AddrFrom16(b)
+}
+
+// extractNAT64 returns the IPv4 address embedded in ip if it belongs to
+// prefix
+func extractNAT64(prefix netip.Prefix, ip netip.Addr) (netip.Addr, bool) {
+	if !ip.Is6() || !prefix.Contains(ip) {
+		return netip.Addr{}, false
+	}
+	b := ip.As16()
+	var v4 [4]byte
+	for n, i := range nat64Positions(prefix.Bits()) {
+		v4[n] = b[i]
+	}
+	return netip.AddrFrom4(v4), true
+}
+
+// nat64 returns the address to reach ip through Config.NAT64Prefix
+func (s *Server) nat64(ip netip.Addr) netip.Addr {
+	if !s.config.NAT64Prefix.IsValid() || !ip.Unmap().Is4() {
+		return ip
+	}
+	return synthesizeNAT64(s.config.NAT64Prefix, ip.Unmap())
+}
+
+// nat64All returns the addresses to reach ips through
+// Config.NAT64Prefix, native IPv6 addresses first
+func (s *Server) nat64All(ips []netip.Addr) []netip.Addr {
+	var native, synthesized []netip.Addr
+	for _, ip := range ips {
+		if ip.Unmap().Is4() {
+			synthesized = append(synthesized, s.nat64(ip))
+		} else {
+			native = append(native, ip)
+		}
+	}
+	return append(native, synthesized...)
+}
+
+// DiscoverNAT64Prefix returns the NAT64 prefix used by the DNS64 resolver
+// of the host, by looking up the AAAA records of ipv4only.arpa as of
+// RFC 7050
+func DiscoverNAT64Prefix(ctx context.Context) (netip.Prefix, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip6", "ipv4only.arpa")
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("failed to discover NAT64 prefix: %w", err)
+	}
+	for _, addr := range addrs {
+		for _, bits := range []int{96, 64, 56, 48, 40, 32} {
+			prefix, _ := addr.Prefix(bits)
+			if v4, ok := extractNAT64(prefix, addr); ok && slices.Contains(nat64WellKnown, v4) {
+				return prefix, nil
+			}
+		}
+	}
+	return netip.Prefix{}, fmt.Errorf("failed to discover NAT64 prefix: ipv4only.arpa is not synthesized")
+}
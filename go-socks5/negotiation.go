@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// errSlowNegotiation is returned by reads of connections closed for
+	// negotiating too slowly
+	errSlowNegotiation = fmt.Errorf("client too slow during negotiation")
+	// errNegotiationTimeout is returned by reads of connections closed
+	// for exceeding Config.Timeouts.Negotiation
+	errNegotiationTimeout = fmt.Errorf("negotiation timeout")
+)
+
+// negotiationReaders recycles the buffered readers of negotiations, which
+// are only needed until the request is read
+var negotiationReaders = sync.Pool{New: func() any { return bufio.NewReader(nil) }}
+
+// negotiationReader returns a buffered reader of src for the negotiation
+func negotiationReader(src io.Reader) *bufio.Reader {
+	r := negotiationReaders.Get().(*bufio.Reader)
+	r.Reset(src)
+	return r
+}
+
+// releaseNegotiationReader recycles r once the request is read, returning
+// a reader of src continuing where r stopped. src is the connection r read
+// through the negotiation guard and trace, so that relaying bypasses them.
+// Data the client sent ahead of the reply is kept.
+func releaseNegotiationReader(r *bufio.Reader, src io.Reader) io.Reader {
+	rest := src
+	if n := r.Buffered(); n > 0 {
+		ahead, _ := r.Peek(n)
+		rest = io.MultiReader(bytes.NewReader(bytes.Clone(ahead)), src)
+	}
+	r.Reset(nil)
+	negotiationReaders.Put(r)
+	return rest
+}
+
+// negotiationGuard closes the connection of a client not done within
+// Config.Timeouts.Negotiation, or sending fewer than
+// Config.NegotiationMinBytes within a Config.NegotiationWindow in which
+// the server waited for it
+type negotiationGuard struct {
+	io.Reader
+	ctx     context.Context
+	bytes   atomic.Int64
+	reading atomic.Bool
+	done    atomic.Bool
+}
+
+// guardNegotiation returns the reader of conn to be used until the
+// request is read, and a function ending the checks once it is
+func (s *Server) guardNegotiation(ctx context.Context, sess *Session, conn io.Reader) (io.Reader, func()) {
+	minBytes, window := int64(s.config.NegotiationMinBytes), s.config.NegotiationWindow
+	timeout := s.config.Timeouts.Negotiation
+	checkProgress := minBytes > 0 && window > 0
+	if !checkProgress && timeout <= 0 {
+		return conn, func() {}
+	}
+
+	g := &negotiationGuard{Reader: conn, ctx: ctx}
+	client := sess.Client.Addr().String()
+	var timers []*time.Timer
+	if timeout > 0 {
+		timers = append(timers, time.AfterFunc(timeout, func() {
+			if g.done.Load() {
+				return
+			}
+			s.logThrottled(logrus.WarnLevel, client, "closing connection from %s: negotiation not done within %s", client, timeout)
+			s.countDenial("negotiation_timeout")
+			sess.cancel(errNegotiationTimeout)
+		}))
+	}
+	if checkProgress {
+		var progress *time.Timer
+		progress = time.AfterFunc(window, func() {
+			// Time spent waiting for the authenticator or a reply to be
+			// written is not held against the client
+			n := g.bytes.Swap(0)
+			if g.done.Load() {
+				return
+			}
+			if n >= minBytes || !g.reading.Load() {
+				progress.Reset(window)
+				return
+			}
+			s.logThrottled(logrus.WarnLevel, client, "closing connection from %s: sent %d bytes in %s during negotiation", client, n, window)
+			s.countDenial("slow_negotiation")
+			sess.cancel(errSlowNegotiation)
+		})
+		timers = append(timers, progress)
+	}
+	return g, func() {
+		g.done.Store(true)
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
+
+func (g *negotiationGuard) Read(p []byte) (int, error) {
+	g.reading.Store(true)
+	n, err := g.Reader.Read(p)
+	g.reading.Store(false)
+	g.bytes.Add(int64(n))
+	if cause := context.Cause(g.ctx); err != nil && (cause == errSlowNegotiation || cause == errNegotiationTimeout) {
+		err = cause
+	}
+	return n, err
+}
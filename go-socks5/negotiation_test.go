@@ -0,0 +1,109 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReleaseNegotiationReader(t *testing.T) {
+	src := strings.NewReader("request")
+	r := negotiationReader(src)
+	if _, err := r.ReadByte(); err != nil {
+		t.Fatal(err)
+	}
+	// Everything left was buffered ahead by r
+	rest, err := io.ReadAll(releaseNegotiationReader(r, strings.NewReader(" and more")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rest) != "equest and more" {
+		t.Errorf("got %q, want the buffered data followed by the connection", rest)
+	}
+
+	r = negotiationReader(bytes.NewReader(nil))
+	conn, _ := net.Pipe()
+	defer conn.Close()
+	if rest := releaseNegotiationReader(r, conn); rest != conn {
+		t.Errorf("got %T without buffered data, want the connection itself", rest)
+	}
+}
+
+func TestNegotiationGuard(t *testing.T) {
+	tests := []struct {
+		name       string
+		conf       Config
+		greet      bool   // whether the client sends its greeting first
+		send       []byte // sent by the client before stalling
+		wantDenial string // empty if the connection must stay open
+	}{
+		{
+			name:       "timeout",
+			conf:       Config{Timeouts: Timeouts{Negotiation: 50 * time.Millisecond}},
+			wantDenial: "negotiation_timeout",
+		},
+		{
+			name:       "timeout after greeting",
+			conf:       Config{Timeouts: Timeouts{Negotiation: 50 * time.Millisecond}},
+			greet:      true,
+			send:       []byte{socks5Version, ConnectCommand},
+			wantDenial: "negotiation_timeout",
+		},
+		{
+			name:       "too few bytes in a window",
+			conf:       Config{NegotiationMinBytes: 3, NegotiationWindow: 30 * time.Millisecond},
+			send:       []byte{socks5Version},
+			wantDenial: "slow_negotiation",
+		},
+		{
+			name:  "request read in time",
+			conf:  Config{Timeouts: Timeouts{Negotiation: 50 * time.Millisecond}, NegotiationMinBytes: 3, NegotiationWindow: 30 * time.Millisecond},
+			greet: true,
+		},
+	}
+	echo := startEcho(t, "tcp4")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := tt.conf
+			s, proxy := serveLoopback(t, "tcp4", &conf)
+			var c net.Conn
+			if tt.greet {
+				c = dialProxy(t, proxy)
+			} else {
+				var err error
+				if c, err = net.Dial(proxy.Network(), proxy.String()); err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+			}
+
+			if tt.wantDenial == "" {
+				// The tunnel outlives the negotiation limits
+				sendRequest(t, c, ConnectCommand, encodeAddr(t, &AddrSpec{IP: echo.AddrPort().Addr(), Port: echo.Port}))
+				if code, _ := readReply(t, c); code != SuccessReply {
+					t.Fatalf("got reply %d, want success", code)
+				}
+				time.Sleep(100 * time.Millisecond)
+				echoThrough(t, c)
+				return
+			}
+
+			if _, err := c.Write(tt.send); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bufio.NewReader(c).ReadByte(); err == nil {
+				t.Fatal("got a reply, want the connection closed")
+			} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("connection not closed")
+			}
+			if n := s.Stats().DeniedBy[tt.wantDenial]; n != 1 {
+				t.Errorf("got %d %s denials, want 1", n, tt.wantDenial)
+			}
+		})
+	}
+}
@@ -0,0 +1,182 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"runtime/metrics"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// overloadRecovery is the fraction of its limit a reading must fall
+// below for the server to accept connections again, so that it does not
+// flap around the limit
+const overloadRecovery = 0.9
+
+// ErrServerOverloaded is returned by ServeConn for connections rejected
+// while the server is overloaded, see Config.Overload
+var ErrServerOverloaded = fmt.Errorf("server overloaded")
+
+// OverloadLimits are the pressure readings above which new connections
+// are rejected, see Config.Overload. Zero limits are not checked.
+type OverloadLimits struct {
+	// MaxMemory is the resident memory of the process in bytes. Where it
+	// cannot be read, the memory obtained by the Go runtime is checked.
+	MaxMemory uint64
+	// MaxFDs is the number of open file descriptors, only checked on Linux
+	MaxFDs int
+	// MaxAcceptQueue is the number of connections waiting to be accepted
+	// by any TCP listener, only checked on Linux. A growing queue means
+	// the server does not keep up with new connections.
+	MaxAcceptQueue int
+	// Interval is how often the readings are taken, defaults to 1 second
+	Interval time.Duration
+}
+
+// enabled reports whether any limit is set
+func (l OverloadLimits) enabled() bool {
+	return l.MaxMemory > 0 || l.MaxFDs > 0 || l.MaxAcceptQueue > 0
+}
+
+// OverloadStats are the last pressure readings, reported in Stats if
+// Config.Overload is set
+type OverloadStats struct {
+	// Overloaded is set while new connections are rejected, Reasons lists
+	// the readings above their limit: "memory", "fds" or "accept_queue"
+	Overloaded bool     `json:"overloaded"`
+	Reasons    []string `json:"reasons,omitempty"`
+	// Memory is the resident memory in bytes, FDs the open descriptors
+	// and AcceptQueue the longest accept queue of the listeners
+	Memory      uint64 `json:"memory"`
+	FDs         int    `json:"fds"`
+	AcceptQueue int    `json:"accept_queue"`
+}
+
+// overloadMonitor takes the readings of Config.Overload periodically
+type overloadMonitor struct {
+	limits OverloadLimits
+
+	mu    sync.Mutex
+	stats OverloadStats
+}
+
+// startOverloadMonitor takes readings, forever
+func (s *Server) startOverloadMonitor() {
+	m := &overloadMonitor{limits: s.config.Overload}
+	if m.limits.Interval <= 0 {
+		m.limits.Interval = time.Second
+	}
+	s.overload = m
+	go func() {
+		ticker := time.NewTicker(m.limits.Interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.sampleOverload()
+		}
+	}()
+}
+
+// sampleOverload takes the readings and updates the overload state,
+// logging its changes
+func (s *Server) sampleOverload() {
+	m := s.overload
+	var st OverloadStats
+	if m.limits.MaxMemory > 0 {
+		st.Memory = processMemory()
+	}
+	if m.limits.MaxFDs > 0 {
+		st.FDs = openFDs()
+	}
+	if m.limits.MaxAcceptQueue > 0 {
+		s.mu.Lock()
+		listeners := make([]net.Listener, 0, len(s.listeners))
+		for l := range s.listeners {
+			listeners = append(listeners, l)
+		}
+		s.mu.Unlock()
+		for _, l := range listeners {
+			st.AcceptQueue = max(st.AcceptQueue, acceptQueue(l))
+		}
+	}
+
+	m.mu.Lock()
+	was := m.stats.Overloaded
+	// Once overloaded, readings must fall well below their limit
+	bound := 1.0
+	if was {
+		bound = overloadRecovery
+	}
+	above := func(reading, limit uint64) bool {
+		return limit > 0 && float64(reading) > float64(limit)*bound
+	}
+	if above(st.Memory, m.limits.MaxMemory) {
+		st.Reasons = append(st.Reasons, "memory")
+	}
+	if above(uint64(st.FDs), uint64(m.limits.MaxFDs)) {
+		st.Reasons = append(st.Reasons, "fds")
+	}
+	if above(uint64(st.AcceptQueue), uint64(m.limits.MaxAcceptQueue)) {
+		st.Reasons = append(st.Reasons, "accept_queue")
+	}
+	st.Overloaded = len(st.Reasons) > 0
+	m.stats = st
+	m.mu.Unlock()
+
+	switch {
+	case st.Overloaded && !was:
+		s.config.Logger.Warnf("server overloaded by %s (memory %d bytes, %d fds, accept queue %d), rejecting new connections",
+			strings.Join(st.Reasons, ", "), st.Memory, st.FDs, st.AcceptQueue)
+	case !st.Overloaded && was:
+		s.config.Logger.Infof("server no longer overloaded, accepting new connections")
+	}
+}
+
+// overloaded reports whether new connections are to be rejected
+func (s *Server) overloaded() bool {
+	if s.overload == nil {
+		return false
+	}
+	s.overload.mu.Lock()
+	defer s.overload.mu.Unlock()
+	return s.overload.stats.Overloaded
+}
+
+// overloadStats returns the last readings, nil without Config.Overload
+func (s *Server) overloadStats() *OverloadStats {
+	if s.overload == nil {
+		return nil
+	}
+	s.overload.mu.Lock()
+	defer s.overload.mu.Unlock()
+	st := s.overload.stats
+	st.Reasons = append([]string(nil), st.Reasons...)
+	return &st
+}
+
+// rejectOverloaded answers the method selection of the client of sess
+// with no acceptable method, the one reply clients understand before
+// authenticating, and counts the denial
+func (s *Server) rejectOverloaded(sess *Session, conn io.Writer, bufConn io.Reader) error {
+	s.countDenial("overload")
+	s.logThrottled(logrus.WarnLevel, sess.Client.Addr().String(), "rejecting connection from %s: server overloaded", sess.Client.Addr())
+	if _, err := readMethods(bufConn); err != nil {
+		return fmt.Errorf("failed to get auth methods: %v", err)
+	}
+	conn.Write([]byte{socks5Version, noAcceptable})
+	return ErrServerOverloaded
+}
+
+// goMemory returns the memory obtained from the operating system by the
+// Go runtime and not returned to it
+func goMemory() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
@@ -0,0 +1,63 @@
+//go:build linux
+
+package socks5
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// processMemory returns the resident memory of the process
+func processMemory() uint64 {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return goMemory()
+	}
+	fields := bytes.Fields(statm)
+	if len(fields) < 2 {
+		return goMemory()
+	}
+	pages, err := strconv.ParseUint(string(fields[1]), 10, 64)
+	if err != nil {
+		return goMemory()
+	}
+	return pages * uint64(os.Getpagesize())
+}
+
+// openFDs returns the number of open file descriptors of the process
+func openFDs() int {
+	dir, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	defer dir.Close()
+	names, _ := dir.Readdirnames(-1)
+	// Without the descriptor of the directory itself
+	return max(len(names)-1, 0)
+}
+
+// acceptQueue returns the number of connections waiting to be accepted
+// by l, which the kernel reports as unacknowledged segments of listening
+// sockets
+func acceptQueue(l net.Listener) int {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return 0
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var queue int
+	raw.Control(func(fd uintptr) {
+		if info, err := unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO); err == nil {
+			queue = int(info.Unacked)
+		}
+	})
+	return queue
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package socks5
+
+import "net"
+
+// processMemory returns the memory obtained by the Go runtime, the
+// resident memory is not read on this platform
+func processMemory() uint64 {
+	return goMemory()
+}
+
+// openFDs is not supported on this platform
+func openFDs() int {
+	return 0
+}
+
+// acceptQueue is not supported on this platform
+func acceptQueue(l net.Listener) int {
+	return 0
+}
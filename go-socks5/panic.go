@@ -0,0 +1,22 @@
+package socks5
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// recoverPanic is deferred by the goroutine serving sess to recover from
+// a panic, logging it with its stack and passing it to Config.OnPanic, so
+// a bug triggered by one connection doesn't take down the server
+func (s *Server) recoverPanic(sess *Session) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	stack := debug.Stack()
+	s.stats.panics.Add(1)
+	s.config.Logger.WithField("panic", fmt.Sprint(v)).Errorf("panic serving connection from %v: %v\n%s", sess.Client, v, stack)
+	if s.config.OnPanic != nil {
+		s.config.OnPanic(s.sessionSnapshot(sess), v, stack)
+	}
+}
@@ -0,0 +1,73 @@
+package socks5
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+)
+
+// PortRange is an inclusive range of local ports
+type PortRange struct {
+	Min uint16
+	Max uint16
+}
+
+// IsZero reports whether the range is unset
+func (r PortRange) IsZero() bool {
+	return r.Min == 0 && r.Max == 0
+}
+
+// bindIP returns the address to listen on for BIND and UDP ASSOCIATE,
+// defaulting to the local address of the control connection. A specific
+// Config.BindIP of the other address family than the control connection
+// is not reachable by the client and ignored.
+func (s *Server) bindIP(conn conn) netip.Addr {
+	local := addrPort(conn.LocalAddr()).Addr().Unmap()
+	if ip := s.config.BindIP; ip.IsValid() {
+		if ip.IsUnspecified() || !local.IsValid() || ip.Unmap().Is4() == local.Is4() {
+			return ip
+		}
+	}
+	return local
+}
+
+// listenTCP opens a TCP listener on ip using a port from Config.PortRange
+func (s *Server) listenTCP(ip netip.Addr) (*net.TCPListener, error) {
+	var ln *net.TCPListener
+	err := s.forEachPort(func(port uint16) (err error) {
+		ln, err = net.ListenTCP("tcp", net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, port)))
+		return err
+	})
+	return ln, err
+}
+
+// listenUDP opens a UDP socket on ip using a port from Config.PortRange
+func (s *Server) listenUDP(ip netip.Addr) (*net.UDPConn, error) {
+	var pc *net.UDPConn
+	err := s.forEachPort(func(port uint16) (err error) {
+		pc, err = net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, port)))
+		return err
+	})
+	return pc, err
+}
+
+// forEachPort calls listen with the ports of Config.PortRange, starting at
+// a random offset, until it succeeds. Without a range the OS picks a port.
+func (s *Server) forEachPort(listen func(port uint16) error) error {
+	r := s.config.PortRange
+	if r.IsZero() {
+		return listen(0)
+	}
+
+	size := int(r.Max) - int(r.Min) + 1
+	offset := rand.IntN(size)
+	var err error
+	for i := 0; i < size; i++ {
+		port := r.Min + uint16((offset+i)%size)
+		if err = listen(port); err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no free port in range %d-%d: %v", r.Min, r.Max, err)
+}
@@ -0,0 +1,39 @@
+package socks5
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestBindIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		bindIP  string
+		control string
+		want    string
+	}{
+		{"IPv4 control connection", "", "192.0.2.1:1080", "192.0.2.1"},
+		{"IPv6 control connection", "", "[2001:db8::1]:1080", "2001:db8::1"},
+		{"zoned IPv6 control connection", "", "[fe80::1%eth0]:1080", "fe80::1%eth0"},
+		{"IPv4-mapped control connection", "", "[::ffff:192.0.2.1]:1080", "192.0.2.1"},
+		{"IPv4 BindIP", "198.51.100.1", "192.0.2.1:1080", "198.51.100.1"},
+		{"IPv6 BindIP", "2001:db8::2", "[2001:db8::1]:1080", "2001:db8::2"},
+		{"IPv4-mapped BindIP", "::ffff:198.51.100.1", "192.0.2.1:1080", "::ffff:198.51.100.1"},
+		{"IPv6 BindIP of an IPv4 client", "2001:db8::2", "192.0.2.1:1080", "192.0.2.1"},
+		{"IPv4 BindIP of an IPv6 client", "198.51.100.1", "[2001:db8::1]:1080", "2001:db8::1"},
+		{"unspecified IPv4 BindIP", "0.0.0.0", "[2001:db8::1]:1080", "0.0.0.0"},
+		{"unspecified IPv6 BindIP", "::", "192.0.2.1:1080", "::"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{config: &Config{}}
+			if tt.bindIP != "" {
+				s.config.BindIP = netip.MustParseAddr(tt.bindIP)
+			}
+			conn := testConn{local: tcpAddr(tt.control), remote: tcpAddr("192.0.2.100:50000")}
+			if got := s.bindIP(conn); got != netip.MustParseAddr(tt.want) {
+				t.Errorf("got %v, want %s", got, tt.want)
+			}
+		})
+	}
+}
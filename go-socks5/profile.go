@@ -0,0 +1,93 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// Profile overrides the authentication, rules and egress of the Config
+// for the connections of a listener served with ServeProfile, so that one
+// Server, with its accounting, limits and stats, serves listeners with
+// distinct policies, e.g. an internal one without authentication and a
+// public one requiring it
+type Profile struct {
+	// Name identifies the listener in sessions and access logs
+	Name string
+	// AuthMethods replace Config.AuthMethods and the authenticators added
+	// with RegisterAuthenticator if not nil
+	AuthMethods []Authenticator
+	// RequireAuth makes every client authenticate, trusted or not
+	RequireAuth bool
+	// AllowUntrustedWithAuth admits clients outside the whitelist and
+	// trusted networks if they authenticate, as Config.AllowUntrustedWithAuth
+	AllowUntrustedWithAuth bool
+	// Rules are evaluated before Config.Rules, a request must be allowed
+	// by both
+	Rules RuleSet
+	// DialerSelector is consulted before Config.DialerSelector
+	DialerSelector DialerSelector
+
+	// authMethods are AuthMethods by code, nil to use those of the server
+	authMethods map[uint8]Authenticator
+}
+
+// profileKey is the context key of the Profile of a connection
+type profileKey struct{}
+
+// ServeProfile is Serve for a listener whose connections are handled with
+// the overrides of p
+func (s *Server) ServeProfile(l net.Listener, p *Profile) error {
+	profile := *p
+	if p.AuthMethods != nil {
+		profile.authMethods = make(map[uint8]Authenticator, len(p.AuthMethods))
+		for _, a := range p.AuthMethods {
+			if a.GetCode() == noAcceptable {
+				return fmt.Errorf("invalid auth method code of profile %s: %#x", p.Name, a.GetCode())
+			}
+			profile.authMethods[a.GetCode()] = a
+		}
+	}
+	return s.ServeContext(context.WithValue(context.Background(), profileKey{}, &profile), l)
+}
+
+// profileFromContext returns the Profile of the listener of a
+// connection, nil if it is served without
+func profileFromContext(ctx context.Context) *Profile {
+	p, _ := ctx.Value(profileKey{}).(*Profile)
+	return p
+}
+
+// authMethodsFor returns the authenticators of the connection of ctx
+func (s *Server) authMethodsFor(ctx context.Context) map[uint8]Authenticator {
+	if p := profileFromContext(ctx); p != nil && p.authMethods != nil {
+		return p.authMethods
+	}
+	return *s.authMethods.Load()
+}
+
+// allowRules passes req through the rules of the profile of the
+// connection, if any, and Config.Rules
+func (s *Server) allowRules(ctx context.Context, req *Request) (context.Context, bool) {
+	if p := profileFromContext(ctx); p != nil && p.Rules != nil {
+		var ok bool
+		if ctx, ok = p.Rules.Allow(ctx, req); !ok {
+			return ctx, false
+		}
+	}
+	return s.config.Rules.Allow(ctx, req)
+}
+
+// selectDialer returns the dialer of req selected by the profile of the
+// connection or the Config, nil for Config.Dial
+func (s *Server) selectDialer(ctx context.Context, req *Request) DialFunc {
+	if p := profileFromContext(ctx); p != nil && p.DialerSelector != nil {
+		if selected := p.DialerSelector.SelectDialer(ctx, req.AuthContext, req); selected != nil {
+			return selected
+		}
+	}
+	if s.config.DialerSelector != nil {
+		return s.config.DialerSelector.SelectDialer(ctx, req.AuthContext, req)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// errQuotaExceeded is the cause of the context of sessions closed once
+// their user exceeded the quota
+var errQuotaExceeded = fmt.Errorf("quota exceeded")
+
+// Quotas caps the traffic of authenticated users. Usage is the payload
+// relayed in both directions, counted like Stats.BytesUp and
+// Stats.BytesDown. The default quota applies to every user without a
+// limit of their own, zero meaning unlimited. Allowance left unused when
+// the quotas are reset can be carried over as credit added to the next
+// quota.
+type Quotas struct {
+	mu     sync.Mutex
+	def    uint64
+	limits map[string]uint64
+	used   map[string]uint64
+	credit map[string]uint64
+}
+
+// NewQuotas creates Quotas with the given limits in bytes
+func NewQuotas(def uint64, limits map[string]uint64) *Quotas {
+	return &Quotas{def: def, limits: limits, used: make(map[string]uint64), credit: make(map[string]uint64)}
+}
+
+// SetLimits replaces the default quota and the limits of users, keeping
+// their usage and credit
+func (q *Quotas) SetLimits(def uint64, limits map[string]uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.def, q.limits = def, limits
+}
+
+// base returns the configured quota of user, zero meaning unlimited. The
+// caller must hold the lock.
+func (q *Quotas) base(user string) uint64 {
+	if limit, found := q.limits[user]; found {
+		return limit
+	}
+	return q.def
+}
+
+// limit returns the quota of user including its credit, the caller must
+// hold the lock
+func (q *Quotas) limit(user string) uint64 {
+	base := q.base(user)
+	if base == 0 {
+		return 0
+	}
+	return base + q.credit[user]
+}
+
+// Limit returns the current quota of user including credit carried over,
+// zero meaning unlimited
+func (q *Quotas) Limit(user string) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit(user)
+}
+
+// Add charges n bytes to user
+func (q *Quotas) Add(user string, n uint64) {
+	if user == "" || n == 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used[user] += n
+}
+
+// charge adds n bytes to user and reports whether they exceeded their
+// quota
+func (q *Quotas) charge(user string, n uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used[user] += n
+	limit := q.limit(user)
+	return limit != 0 && q.used[user] >= limit
+}
+
+// Exceeded reports whether user has used up their quota
+func (q *Quotas) Exceeded(user string) bool {
+	if user == "" {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	limit := q.limit(user)
+	return limit != 0 && q.used[user] >= limit
+}
+
+// Usage returns the bytes used by each user
+func (q *Quotas) Usage() map[string]uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	used := make(map[string]uint64, len(q.used))
+	for user, n := range q.used {
+		used[user] = n
+	}
+	return used
+}
+
+// Restore replaces the usage of every user, e.g. with the Usage saved
+// before a restart
+func (q *Quotas) Restore(used map[string]uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.used = make(map[string]uint64, len(used))
+	for user, n := range used {
+		q.used[user] = n
+	}
+}
+
+// Rebase replaces the usage counted up to base, a previous result of
+// Usage, with totals, keeping usage added since. It lets instances of a
+// fleet share quotas through an external store.
+func (q *Quotas) Rebase(base, totals map[string]uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for user, n := range base {
+		if q.used[user] > n {
+			q.used[user] -= n
+		} else {
+			delete(q.used, user)
+		}
+	}
+	for user, n := range totals {
+		q.used[user] += n
+	}
+}
+
+// Reset clears the usage of user
+func (q *Quotas) Reset(user string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.used, user)
+}
+
+// ResetAll clears the usage of every user, starting a new quota period.
+// With rollover the allowance each user left unused, up to one quota, is
+// credited to the new period. Users who neither have a limit of their own
+// nor any usage or credit get no rollover.
+func (q *Quotas) ResetAll(rollover bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	credit := make(map[string]uint64)
+	if rollover {
+		users := make(map[string]bool)
+		for _, m := range []map[string]uint64{q.limits, q.used, q.credit} {
+			for user := range m {
+				users[user] = true
+			}
+		}
+		for user := range users {
+			if limit := q.limit(user); limit > q.used[user] {
+				credit[user] = min(limit-q.used[user], q.base(user))
+			}
+		}
+	}
+	q.used = make(map[string]uint64)
+	q.credit = credit
+}
+
+// Credits returns the allowance of each user carried over from the
+// previous period
+func (q *Quotas) Credits() map[string]uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	credit := make(map[string]uint64, len(q.credit))
+	for user, n := range q.credit {
+		credit[user] = n
+	}
+	return credit
+}
+
+// RestoreCredits replaces the credit of every user, e.g. with the Credits
+// saved before a restart
+func (q *Quotas) RestoreCredits(credit map[string]uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.credit = make(map[string]uint64, len(credit))
+	for user, n := range credit {
+		q.credit[user] = n
+	}
+}
+
+// quotaRuleSet denies requests of users who exceeded their quota before
+// consulting Rules
+type quotaRuleSet struct {
+	Rules  RuleSet
+	Quotas *Quotas
+}
+
+func (r quotaRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	if user := req.Username(); r.Quotas.Exceeded(user) {
+		return WithDenyReason(ctx, "quota", fmt.Sprintf("quota of %d bytes exceeded", r.Quotas.Limit(user))), false
+	}
+	return r.Rules.Allow(ctx, req)
+}
+
+// chargeQuota counts traffic relayed for req against the user's quota,
+// closing the connection of req once it is exceeded
+func (s *Server) chargeQuota(req *Request, n uint64) {
+	q := s.config.Quotas
+	user := req.Username()
+	if q == nil || user == "" || n == 0 {
+		return
+	}
+	if q.charge(user, n) && req.cancel != nil && !req.overQuota.Swap(true) {
+		s.requestLogger(req).Infof("closing tunnel to %v: quota of %d bytes exceeded", req.DestAddr, q.Limit(user))
+		req.cancel(errQuotaExceeded)
+	}
+}
+
+// countingReader passes the number of bytes of every read to count
+type countingReader struct {
+	io.Reader
+	count func(uint64)
+}
+
+func (r countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.count(uint64(n))
+	}
+	return n, err
+}
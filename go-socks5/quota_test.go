@@ -0,0 +1,120 @@
+package socks5
+
+import (
+	"maps"
+	"testing"
+)
+
+func TestQuotas(t *testing.T) {
+	tests := []struct {
+		name         string
+		def          uint64
+		limits       map[string]uint64
+		used         uint64
+		user         string
+		wantLimit    uint64
+		wantExceeded bool
+	}{
+		{"default", 100, nil, 50, "alice", 100, false},
+		{"default used up", 100, nil, 100, "alice", 100, true},
+		{"own limit above default", 100, map[string]uint64{"alice": 200}, 150, "alice", 200, false},
+		{"own limit below default", 100, map[string]uint64{"alice": 10}, 50, "alice", 10, true},
+		{"unlimited default", 0, map[string]uint64{"bob": 10}, 1 << 40, "alice", 0, false},
+		{"unlimited user", 100, map[string]uint64{"alice": 0}, 1 << 40, "alice", 0, false},
+		{"anonymous", 100, nil, 0, "", 100, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuotas(tt.def, tt.limits)
+			q.Add(tt.user, tt.used)
+			if got := q.Limit(tt.user); got != tt.wantLimit {
+				t.Errorf("got limit %d, want %d", got, tt.wantLimit)
+			}
+			if got := q.Exceeded(tt.user); got != tt.wantExceeded {
+				t.Errorf("got exceeded %v, want %v", got, tt.wantExceeded)
+			}
+		})
+	}
+}
+
+func TestQuotasCharge(t *testing.T) {
+	q := NewQuotas(100, nil)
+	if q.charge("alice", 99) {
+		t.Fatal("quota exceeded below the limit")
+	}
+	if !q.charge("alice", 1) {
+		t.Fatal("quota not exceeded at the limit")
+	}
+	if q.charge("bob", 1) {
+		t.Fatal("usage of another user was charged")
+	}
+}
+
+func TestQuotasSetLimits(t *testing.T) {
+	q := NewQuotas(100, nil)
+	q.Add("alice", 150)
+	if !q.Exceeded("alice") {
+		t.Fatal("quota not exceeded")
+	}
+	q.SetLimits(100, map[string]uint64{"alice": 200})
+	if q.Exceeded("alice") {
+		t.Error("quota exceeded after raising the limit")
+	}
+	if got := q.Usage()["alice"]; got != 150 {
+		t.Errorf("got usage %d after setting limits, want 150", got)
+	}
+}
+
+func TestQuotasResetAll(t *testing.T) {
+	tests := []struct {
+		name       string
+		def        uint64
+		limits     map[string]uint64
+		used       map[string]uint64
+		credit     map[string]uint64
+		rollover   bool
+		wantCredit map[string]uint64
+	}{
+		{
+			name:       "no rollover",
+			def:        100,
+			used:       map[string]uint64{"alice": 40},
+			wantCredit: map[string]uint64{},
+		},
+		{
+			name:       "unused allowance",
+			def:        100,
+			limits:     map[string]uint64{"bob": 50},
+			used:       map[string]uint64{"alice": 40, "carol": 100},
+			rollover:   true,
+			wantCredit: map[string]uint64{"alice": 60, "bob": 50},
+		},
+		{
+			name:       "credit capped at one quota",
+			def:        100,
+			credit:     map[string]uint64{"alice": 100},
+			rollover:   true,
+			wantCredit: map[string]uint64{"alice": 100},
+		},
+		{
+			name:       "unlimited",
+			used:       map[string]uint64{"alice": 40},
+			rollover:   true,
+			wantCredit: map[string]uint64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQuotas(tt.def, tt.limits)
+			q.Restore(tt.used)
+			q.RestoreCredits(tt.credit)
+			q.ResetAll(tt.rollover)
+			if got := q.Credits(); !maps.Equal(got, tt.wantCredit) {
+				t.Errorf("got credit %v, want %v", got, tt.wantCredit)
+			}
+			if used := q.Usage(); len(used) != 0 {
+				t.Errorf("got usage %v after reset, want none", used)
+			}
+		})
+	}
+}
@@ -1,13 +1,22 @@
 package socks5
 
 import (
+	"bufio"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"net/netip"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/idna"
 )
 
 const (
@@ -19,20 +28,45 @@ const (
 	ipv6Address      = uint8(4)
 )
 
+// UDPOverTCPCommand is the command of the UDP over TCP extension, which
+// relays datagrams over the control connection. It is only accepted if
+// Config.UDPOverTCP is set.
+const UDPOverTCPCommand = uint8(0xf3)
+
+// Reply codes of RFC 1928 section 6, e.g. for WithDenyReply
 const (
-	successReply uint8 = iota
-	serverFailure
-	ruleFailure
-	networkUnreachable
-	hostUnreachable
-	connectionRefused
-	ttlExpired
-	commandNotSupported
-	addrTypeNotSupported
+	SuccessReply uint8 = iota
+	ServerFailure
+	RuleFailure
+	NetworkUnreachable
+	HostUnreachable
+	ConnectionRefused
+	TTLExpired
+	CommandNotSupported
+	AddrTypeNotSupported
 )
 
+// maxDomainLen is the longest domain name accepted in a request
+const maxDomainLen = 253
+
+// idnaProfile maps domain names for lookup, allowing underscores as used
+// in service names
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
 var (
 	ErrUnrecognizedAddrType = fmt.Errorf("unrecognized address type")
+	ErrInvalidDomain        = fmt.Errorf("invalid domain name")
+	ErrMalformedRequest     = fmt.Errorf("malformed request")
+
+	// ErrNotAllowedByRuleset is wrapped by the errors of requests denied
+	// by the RuleSet
+	ErrNotAllowedByRuleset = fmt.Errorf("blocked by rules")
+	// ErrHostUnreachable is wrapped by the errors of requests whose
+	// destination could not be resolved or connected to
+	ErrHostUnreachable = fmt.Errorf("host unreachable")
+	// ErrUnsupportedCommand is wrapped by the errors of requests with an
+	// unknown or disabled command
+	ErrUnsupportedCommand = fmt.Errorf("unsupported command")
 )
 
 // AddressRewriter is used to rewrite a destination transparently
@@ -52,13 +86,13 @@ func (a *AddrSpec) String() string {
 	if a.FQDN != "" {
 		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
 	}
-	return fmt.Sprintf("%s:%d", a.IP, a.Port)
+	return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
 }
 
 // Address returns a string suitable to dial; prefer returning IP-based
 // address, fallback to FQDN
 func (a AddrSpec) Address() string {
-	if len(a.String()) != 0 {
+	if a.IP.IsValid() {
 		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
 	}
 	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
@@ -78,62 +112,124 @@ type Request struct {
 	DestAddr *AddrSpec
 	// AddrSpec of the actual destination (might be affected by rewrite)
 	realDestAddr *AddrSpec
-	bufConn      io.Reader
+	// All addresses the destination FQDN resolved to, and by which resolver
+	destIPs  []netip.Addr
+	resolver string
+	// Address of the destination the tunnel was connected to, and the
+	// local addresses of the tunnel to it and of the client connection
+	connectedAddr netip.AddrPort
+	outboundAddr  netip.AddrPort
+	localAddr     netip.AddrPort
+	// denyReason is set if the RuleSet denied the request
+	denyReason *DenyReason
+	// Payload relayed for the request in each direction, and the UDP
+	// datagrams carrying it
+	bytesUp, bytesDown         atomic.Uint64
+	datagramsUp, datagramsDown atomic.Uint64
+	// Idle timeout of the tunnel and when it last relayed data, in
+	// nanoseconds, zero if it is not subject to the reaper
+	idleTimeout, lastActive atomic.Int64
+	// tags set by the authenticator and the RuleSet
+	tags atomic.Pointer[map[string]string]
+	// cancel ends the connection of the request, overQuota is set once
+	// it was ended because its user exceeded their quota
+	cancel    context.CancelCauseFunc
+	overQuota atomic.Bool
+	// tap of the tunnel for Server.Capture, set once it relays
+	tap     atomic.Pointer[captureTap]
+	bufConn io.Reader
+	// dest and remote hold DestAddr and RemoteAddr as parsed, sparing
+	// them allocations of their own
+	dest, remote AddrSpec
+}
+
+// Username returns the user the request was authenticated as, or an empty
+// string for unauthenticated requests
+func (r *Request) Username() string {
+	if r.AuthContext == nil {
+		return ""
+	}
+	return r.AuthContext.Payload["Username"]
 }
 
 type conn interface {
 	Write([]byte) (int, error)
 	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
 }
 
 // NewRequest creates a new Request from the tcp connection
 func NewRequest(bufConn io.Reader) (*Request, error) {
 	// Read the version byte
-	header := []byte{0, 0, 0}
-	if _, err := io.ReadAtLeast(bufConn, header, 3); err != nil {
+	header, err := readBytes(bufConn, 3)
+	if err != nil {
 		return nil, fmt.Errorf("failed to get command version: %v", err)
 	}
 
-	// Ensure we are compatible
+	// Ensure we are compatible, anything else is garbage before the request
 	if header[0] != socks5Version {
-		return nil, fmt.Errorf("unsupported command version: %v", header[0])
+		return nil, fmt.Errorf("%w: unsupported command version: %v", ErrMalformedRequest, header[0])
 	}
-
-	// Read in the destination address
-	dest, err := readAddrSpec(bufConn)
-	if err != nil {
-		return nil, err
+	if header[2] != 0 {
+		return nil, fmt.Errorf("%w: reserved byte is %v", ErrMalformedRequest, header[2])
 	}
 
 	request := &Request{
-		Version:  socks5Version,
-		Command:  header[1],
-		DestAddr: dest,
-		bufConn:  bufConn,
+		Version: socks5Version,
+		Command: header[1],
+		bufConn: bufConn,
 	}
 
+	// Read in the destination address
+	if err := readAddrSpec(bufConn, &request.dest); err != nil {
+		return nil, err
+	}
+	request.DestAddr = &request.dest
+
 	return request, nil
 }
 
+// requestLogger returns a logger annotated with the user of the request
+func (s *Server) requestLogger(req *Request) logrus.FieldLogger {
+	tags := req.Tags()
+	user := req.Username()
+	if user == "" && len(tags) == 0 {
+		return s.config.Logger
+	}
+	fields := make(logrus.Fields, len(tags)+1)
+	if user != "" {
+		fields["user"] = user
+	}
+	for key, value := range tags {
+		fields["tag_"+key] = value
+	}
+	return s.config.Logger.WithFields(fields)
+}
+
 // handleRequest is used for request processing after authentication
-func (s *Server) handleRequest(req *Request, conn conn) error {
-	ctx := context.Background()
+func (s *Server) handleRequest(ctx context.Context, req *Request, conn conn) error {
 
 	// Resolve the address if we have a FQDN
 	dest := req.DestAddr
-	if dest.FQDN != "" {
-		s.config.Logger.Infof("requesting: %v on port: %v", dest.FQDN, dest.Port)
-		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+	if ip, ok := parseIPLiteral(dest.FQDN); ok {
+		// Some clients send IP literals as domain names
+		s.requestLogger(req).Infof("requesting: %v on port: %v", dest.FQDN, dest.Port)
+		dest.IP = ip
+	} else if dest.FQDN != "" {
+		s.requestLogger(req).Infof("requesting: %v on port: %v", dest.FQDN, dest.Port)
+		req.resolver = s.resolverName()
+		ctx_, addrs, err := s.resolveAll(ctx, dest.FQDN)
 		if err != nil {
-			if err := sendReply(conn, hostUnreachable, nil); err != nil {
+			if err := sendReply(conn, HostUnreachable, nil); err != nil {
 				return fmt.Errorf("failed to send reply: %v", err)
 			}
-			return fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+			return fmt.Errorf("failed to resolve destination '%v': %w: %w", dest.FQDN, ErrHostUnreachable, err)
 		}
 		ctx = ctx_
-		dest.IP = addr
+		dest.IP = addrs[0]
+		req.destIPs = addrs
 	} else {
-		s.config.Logger.Infof("requesting: %v on port: %v", dest.IP.String(), dest.Port)
+		s.requestLogger(req).Infof("requesting: %v on port: %v", dest.IP.String(), dest.Port)
 	}
 
 	// Apply any address rewrites
@@ -150,219 +246,502 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 		return s.handleBind(ctx, conn, req)
 	case AssociateCommand:
 		return s.handleAssociate(ctx, conn, req)
-	default:
-		if err := sendReply(conn, commandNotSupported, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+	case UDPOverTCPCommand:
+		if s.config.UDPOverTCP {
+			return s.handleAssociate(ctx, conn, req)
 		}
-		return fmt.Errorf("unsupported command: %v", req.Command)
 	}
+	if err := sendReply(conn, CommandNotSupported, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+	return fmt.Errorf("%w: %v", ErrUnsupportedCommand, req.Command)
 }
 
 // handleConnect is used to handle a connect command
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
+	base := ctx
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := sendReply(conn, s.deny(ctx_, req), nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("connect to %v blocked by rules", req.DestAddr)
+		return denyError("connect", req)
 	} else {
 		ctx = ctx_
 	}
+	if dest, ok := RewriteFromContext(ctx); ok {
+		req.realDestAddr = dest
+	}
+
+	// Limit the rate of new tunnels to the destination
+	if !s.allowDestRate(ctx, req) {
+		if err := sendReply(conn, ServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("connect to %v rejected: tunnel rate to destination exceeded", req.DestAddr)
+	}
+
+	// Limit simultaneous tunnels to the destination
+	if s.config.DestLimiter != nil {
+		release, ok := s.config.DestLimiter.Acquire(req.DestAddr)
+		if !ok {
+			if err := sendReply(conn, ServerFailure, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("connect to %v rejected: too many tunnels to destination", req.DestAddr)
+		}
+		defer release()
+	}
 
 	// Attempt to connect
 	dial := s.config.Dial
+	if selected := s.selectDialer(ctx, req); selected != nil {
+		dial = selected
+	}
 	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+		dialer := &net.Dialer{}
+		dialer.SetMultipathTCP(s.config.DialMPTCP)
+		if dscp := s.dscp(ctx); s.config.DialFastOpen || dscp != 0 {
+			dialer.Control = func(network, address string, c syscall.RawConn) error {
+				if s.config.DialFastOpen {
+					if err := dialFastOpen(network, address, c); err != nil {
+						return err
+					}
+				}
+				if dscp != 0 {
+					return markDSCP(network, c, dscp)
+				}
+				return nil
+			}
+		}
+		dial = dialer.DialContext
+	}
+	var target net.Conn
+	var err error
+	for i, addr := range s.dialAddrs(req) {
+		if i > 0 {
+			ctx_, ok := s.allowDestIP(base, req, req.destIPs[i])
+			if !ok {
+				s.requestLogger(req).Debugf("not dialing %v for %v: denied by ruleset", addr, req.DestAddr.FQDN)
+				continue
+			}
+			ctx = ctx_
+		}
+		if target, err = s.dialTimeout(ctx, dial, addr); err == nil {
+			break
+		}
+		if i > 0 || len(req.destIPs) > 1 {
+			s.requestLogger(req).Debugf("connect to %v via %v failed: %v", req.DestAddr, addr, err)
 		}
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
 	if err != nil {
 		msg := err.Error()
-		resp := hostUnreachable
+		resp := HostUnreachable
 		if strings.Contains(msg, "refused") {
-			resp = connectionRefused
+			resp = ConnectionRefused
 		} else if strings.Contains(msg, "network is unreachable") {
-			resp = networkUnreachable
+			resp = NetworkUnreachable
 		}
 		if err := sendReply(conn, resp, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("connect to %v failed: %v", req.DestAddr, err)
+		return fmt.Errorf("connect to %v failed: %w: %w", req.DestAddr, ErrHostUnreachable, err)
 	}
 	defer target.Close()
+	req.connectedAddr = addrPort(target.RemoteAddr())
+	req.outboundAddr = addrPort(target.LocalAddr())
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
-	localAddr, _ := netip.AddrFromSlice(local.IP)
-	bind := AddrSpec{IP: localAddr, Port: local.Port}
-	if err := sendReply(conn, successReply, &bind); err != nil {
+	bind := s.replyAddr(conn, target.LocalAddr())
+	if err := sendReply(conn, SuccessReply, bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
-	// Start proxying
-	errCh := make(chan error, 2)
-	go proxy(target, req.bufConn, errCh)
-	go proxy(conn, target, errCh)
+	return s.relay(ctx, conn, target, req)
+}
 
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
+// dialTimeout dials addr, giving up after Timeouts.Dial so that the
+// next resolved address gets the whole timeout too
+func (s *Server) dialTimeout(ctx context.Context, dial DialFunc, addr string) (net.Conn, error) {
+	if timeout := s.config.Timeouts.Dial; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return dial(ctx, "tcp", addr)
+}
+
+// allowDestRate reports whether Config.DestRateLimiter admits a new tunnel
+// to the destination of req, at the rate of the verdict if it set one
+func (s *Server) allowDestRate(ctx context.Context, req *Request) bool {
+	l := s.config.DestRateLimiter
+	if l == nil {
+		return true
+	}
+	if rate, ok := DestConnectRateFromContext(ctx); ok {
+		return l.AllowRate(req.DestAddr, rate)
+	}
+	return l.Allow(req.DestAddr)
+}
+
+// allowDestIP makes ip, the next resolved address of the destination to
+// dial after the previous one failed, the destination of req and checks it
+// against the rules like the first. If they allow it, their verdict
+// replaces the previous one, otherwise the destination is left unchanged.
+func (s *Server) allowDestIP(ctx context.Context, req *Request, ip netip.Addr) (context.Context, bool) {
+	prev := req.DestAddr.IP
+	req.DestAddr.IP = ip
+	ctx, ok := s.allow(ctx, req)
+	if !ok {
+		req.DestAddr.IP = prev
+	}
+	return ctx, ok
+}
+
+// dialAddrs returns the addresses to try in order when connecting. All
+// resolved IPs are tried unless the destination was rewritten.
+func (s *Server) dialAddrs(req *Request) []string {
+	if req.realDestAddr != req.DestAddr || len(req.destIPs) < 2 {
+		dest := *req.realDestAddr
+		if dest.IP.IsValid() {
+			dest.IP = s.nat64(dest.IP)
 		}
+		return []string{dest.Address()}
 	}
-	return nil
+	port := strconv.Itoa(req.DestAddr.Port)
+	ips := req.destIPs
+	if s.config.NAT64Prefix.IsValid() {
+		ips = s.nat64All(ips)
+	}
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return addrs
 }
 
-// handleBind is used to handle a connect command
-func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
-	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+// relay proxies data between the client and target until either side is
+// done or the tunnel lifetime is exceeded
+func (s *Server) relay(ctx context.Context, conn conn, target net.Conn, req *Request) error {
+	// Enforce the maximum tunnel lifetime
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var expired atomic.Bool
+	if limit := s.maxTunnelDuration(ctx); limit > 0 {
+		timer := time.AfterFunc(limit, func() {
+			expired.Store(true)
+			s.requestLogger(req).Infof("closing tunnel to %v: maximum lifetime of %s reached", req.DestAddr, limit)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+
+	// Start proxying, shaped by the bandwidth class of the verdict
+	bw, _ := s.bandwidth(ctx)
+	up, down := bw.shape(target, s.linkUp), bw.shape(conn, s.linkDown)
+	looped, err := s.relayEventLoop(ctx, conn, target, req, up, down)
+	if !looped {
+		stop := context.AfterFunc(ctx, func() { target.Close() })
+		defer stop()
+		err = s.relayCopy(ctx, target, req, up, down)
+	}
+	if err != nil && (expired.Load() || context.Cause(ctx) == errIdleTimeout) {
+		return nil
+	}
+	if context.Cause(ctx) == errQuotaExceeded {
+		return fmt.Errorf("tunnel to %v closed: %w", req.DestAddr, errQuotaExceeded)
+	}
+	// return from this function closes target (and conn).
+	return err
+}
+
+// relayCopy relays a tunnel by copying the upload in a goroutine and
+// the download in this one. An upload error closes target to end the
+// download early, a download error returns and the closing of both
+// connections ends the upload.
+func (s *Server) relayCopy(ctx context.Context, target net.Conn, req *Request, up, down io.Writer) error {
+	src, dst := s.trackIdle(ctx, req, req.bufConn, target)
+	src, dst = s.tapCapture(req, src, dst)
+	countUp, countDown := func(n uint64) { s.countUp(req, n) }, func(n uint64) { s.countDown(req, n) }
+	if q := s.config.Quotas; q != nil && req.Username() != "" && q.Limit(req.Username()) != 0 {
+		// Count while relaying, so that exceeding the quota closes the tunnel
+		src, dst = countingReader{src, countUp}, countingReader{dst, countDown}
+		countUp, countDown = func(uint64) {}, func(uint64) {}
+	}
+
+	upErr := make(chan error, 1)
+	go func() {
+		err := proxy(up, src, countUp)
+		upErr <- err
+		if err != nil {
+			target.Close()
 		}
-		return fmt.Errorf("bind to %v blocked by rules", req.DestAddr)
+	}()
+	err := proxy(down, dst, countDown)
+	if err == nil {
+		// Wait for the client to finish uploading
+		err = <-upErr
 	} else {
-		ctx = ctx_
+		// Report the upload error which closed target, if any
+		select {
+		case e := <-upErr:
+			if e != nil {
+				err = e
+			}
+		default:
+		}
 	}
+	return err
+}
 
-	// TODO: Support bind
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+// replyAddr returns the BND.ADDR reported for a local socket address.
+// Unspecified addresses are replaced by the local address of the control
+// connection, and Config.PublicIP overrides the address when behind NAT.
+func (s *Server) replyAddr(conn conn, local net.Addr) *AddrSpec {
+	ap := addrPort(local)
+	ip := ap.Addr().Unmap()
+	if !ip.IsValid() || ip.IsUnspecified() {
+		ip = addrPort(conn.LocalAddr()).Addr().Unmap()
 	}
-	return nil
+	if s.config.PublicIP.IsValid() {
+		ip = s.config.PublicIP
+	}
+	return &AddrSpec{IP: ip, Port: int(ap.Port())}
 }
 
-// handleAssociate is used to handle a connect command
-func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
-	// Check if this is allowed
-	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ruleFailure, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+// addrPort converts a net.Addr to a netip.AddrPort, returning the zero
+// value if it does not hold an IP address
+func addrPort(addr net.Addr) netip.AddrPort {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.AddrPort()
+	case *net.UDPAddr:
+		return a.AddrPort()
+	case nil:
+		return netip.AddrPort{}
+	}
+	ap, _ := netip.ParseAddrPort(addr.String())
+	return ap
+}
+
+// parseIPLiteral parses an IP address sent as a domain name, including
+// bracketed IPv6 addresses and zone IDs. Zones are only kept for
+// link-local and interface-local addresses, the only ones they select an
+// interface for.
+func parseIPLiteral(name string) (netip.Addr, bool) {
+	if name == "" {
+		return netip.Addr{}, false
+	}
+	if inner, found := strings.CutPrefix(name, "["); found {
+		if name, found = strings.CutSuffix(inner, "]"); !found {
+			return netip.Addr{}, false
 		}
-		return fmt.Errorf("associate to %v blocked by rules", req.DestAddr)
-	} else {
-		ctx = ctx_
 	}
+	ip, err := netip.ParseAddr(name)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	if !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsInterfaceLocalMulticast() {
+		ip = ip.WithZone("")
+	}
+	return ip.Unmap(), true
+}
 
-	// TODO: Support associate
-	if err := sendReply(conn, commandNotSupported, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+// normalizeDomain converts a domain name to its lowercase ASCII form
+// without trailing dot, so rules can't be bypassed with unicode or mixed
+// case variants. IP literals are returned unchanged.
+func normalizeDomain(name string) (string, error) {
+	if _, ok := parseIPLiteral(name); ok {
+		return name, nil
 	}
-	return nil
+	name, err := idnaProfile.ToASCII(name)
+	if err != nil {
+		return "", err
+	}
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > maxDomainLen {
+		return "", fmt.Errorf("invalid length")
+	}
+	return name, nil
 }
 
-// readAddrSpec is used to read AddrSpec.
-// Expects an address type byte, follwed by the address and port
-func readAddrSpec(r io.Reader) (*AddrSpec, error) {
-	d := &AddrSpec{}
+// maxDomainCache bounds the number of names kept by domainCache
+const maxDomainCache = 4096
+
+// domainCache maps domain names as sent by clients to their normalized
+// form, so that requests to popular destinations neither allocate the
+// name nor map it again. It is cleared when full.
+var domainCache struct {
+	sync.RWMutex
+	names map[string]string
+}
+
+// cachedDomain returns the normalized form of the domain name fqdn
+func cachedDomain(fqdn []byte) (string, error) {
+	domainCache.RLock()
+	name, found := domainCache.names[string(fqdn)]
+	domainCache.RUnlock()
+	if found {
+		return name, nil
+	}
+	name, err := normalizeDomain(string(fqdn))
+	if err != nil {
+		return "", err
+	}
+	domainCache.Lock()
+	if domainCache.names == nil || len(domainCache.names) >= maxDomainCache {
+		domainCache.names = make(map[string]string)
+	}
+	domainCache.names[string(fqdn)] = name
+	domainCache.Unlock()
+	return name, nil
+}
 
+// readAddrSpec is used to read AddrSpec into d.
+// Expects an address type byte, follwed by the address and port
+func readAddrSpec(r io.Reader, d *AddrSpec) error {
 	// Get the address type
-	addrType := []byte{0}
-	if _, err := r.Read(addrType); err != nil {
-		return nil, err
+	addrType, err := readBytes(r, 1)
+	if err != nil {
+		return err
 	}
 
 	// Handle on a per type basis
 	switch addrType[0] {
 	case ipv4Address:
-		addr := make([]byte, 4)
-		if _, err := io.ReadAtLeast(r, addr, len(addr)); err != nil {
-			return nil, err
+		addr, err := readBytes(r, 4)
+		if err != nil {
+			return err
 		}
-		d.IP, _ = netip.AddrFromSlice(addr)
+		d.IP = netip.AddrFrom4([4]byte(addr))
 
 	case ipv6Address:
-		addr := make([]byte, 16)
-		if _, err := io.ReadAtLeast(r, addr, len(addr)); err != nil {
-			return nil, err
+		addr, err := readBytes(r, 16)
+		if err != nil {
+			return err
 		}
-		d.IP, _ = netip.AddrFromSlice(addr)
+		// IPv4-mapped addresses are handled as IPv4 by rules and dialing
+		d.IP = netip.AddrFrom16([16]byte(addr)).Unmap()
 
 	case fqdnAddress:
-		if _, err := r.Read(addrType); err != nil {
-			return nil, err
+		length, err := readBytes(r, 1)
+		if err != nil {
+			return err
 		}
-		addrLen := int(addrType[0])
-		fqdn := make([]byte, addrLen)
-		if _, err := io.ReadAtLeast(r, fqdn, addrLen); err != nil {
-			return nil, err
+		addrLen := int(length[0])
+		if addrLen == 0 || addrLen > maxDomainLen {
+			return fmt.Errorf("%w: length %d", ErrInvalidDomain, addrLen)
 		}
-		d.FQDN = string(fqdn)
+		fqdn, err := readBytes(r, addrLen)
+		if err != nil {
+			return err
+		}
+		for _, c := range fqdn {
+			if c <= ' ' || c == 0x7f {
+				return fmt.Errorf("%w: %q", ErrInvalidDomain, fqdn)
+			}
+		}
+		name, err := cachedDomain(fqdn)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrInvalidDomain, fqdn, err)
+		}
+		d.FQDN = name
 
 	default:
-		return nil, ErrUnrecognizedAddrType
+		return ErrUnrecognizedAddrType
 	}
 
 	// Read the port
-	port := []byte{0, 0}
-	if _, err := io.ReadAtLeast(r, port, 2); err != nil {
-		return nil, err
+	port, err := readBytes(r, 2)
+	if err != nil {
+		return err
 	}
-	d.Port = (int(port[0]) << 8) | int(port[1])
+	d.Port = int(binary.BigEndian.Uint16(port))
 
-	return d, nil
+	return nil
+}
+
+// readBytes reads the next n bytes of r. They are only valid until the
+// next read, buffered readers return them without copying.
+func readBytes(r io.Reader, n int) ([]byte, error) {
+	if br, ok := r.(*bufio.Reader); ok && n <= br.Size() {
+		b, err := br.Peek(n)
+		if err != nil {
+			if err == io.EOF && len(b) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		br.Discard(n)
+		return b, nil
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
 }
 
 // sendReply is used to send a reply message
 func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
-	// Format the address
-	var addrType uint8
-	var addrBody []byte
-	var addrPort uint16
+	// Connections without negotiation get no replies
+	if _, ok := w.(rawConn); ok {
+		return nil
+	}
+
+	// Format the message, sized for the longest domain name
+	buf := make([]byte, 0, 3+2+maxDomainLen+2)
+	msg, err := appendAddr(append(buf, socks5Version, resp, 0), addr)
+	if err != nil {
+		return err
+	}
+
+	// Send the message
+	_, err = w.Write(msg)
+	return err
+}
+
+// formatAddr encodes an AddrSpec as address type, address and port, the
+// layout shared by replies and UDP datagram headers
+func formatAddr(addr *AddrSpec) ([]byte, error) {
+	return appendAddr(nil, addr)
+}
+
+// appendAddr appends the encoding of formatAddr to b
+func appendAddr(b []byte, addr *AddrSpec) ([]byte, error) {
 	switch {
 	case addr == nil:
-		addrType = ipv4Address
-		addrBody = []byte{0, 0, 0, 0}
-		addrPort = 0
+		return append(b, ipv4Address, 0, 0, 0, 0, 0, 0), nil
 
 	case addr.FQDN != "":
-		addrType = fqdnAddress
-		addrBody = append([]byte{byte(len(addr.FQDN))}, addr.FQDN...)
-		addrPort = uint16(addr.Port)
+		b = append(b, fqdnAddress, byte(len(addr.FQDN)))
+		b = append(b, addr.FQDN...)
 
-	case addr.IP.As4() != [4]byte{}:
-		addrType = ipv4Address
-		addrBody = addr.IP.AsSlice()
-		addrPort = uint16(addr.Port)
+	case addr.IP.Unmap().Is4():
+		ip := addr.IP.Unmap().As4()
+		b = append(append(b, ipv4Address), ip[:]...)
 
-	case addr.IP.As16() != [16]byte{}:
-		addrType = ipv6Address
-		addrBody = addr.IP.AsSlice()
-		addrPort = uint16(addr.Port)
+	case addr.IP.Is6():
+		ip := addr.IP.As16()
+		b = append(append(b, ipv6Address), ip[:]...)
 
 	default:
-		return fmt.Errorf("failed to format address: %v", addr)
+		return nil, fmt.Errorf("failed to format address: %v", addr)
 	}
-
-	// Format the message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = socks5Version
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
-
-	// Send the message
-	_, err := w.Write(msg)
-	return err
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port)), nil
 }
 
 type closeWriter interface {
 	CloseWrite() error
 }
 
-// proxy is used to shuffle data from src to destination, and sends errors
-// down a dedicated channel
-func proxy(dst io.Writer, src io.Reader, errCh chan error) {
-	_, err := io.Copy(dst, src)
+// proxy is used to shuffle data from src to destination, passes the bytes
+// copied to count and returns the error ending the copy
+func proxy(dst io.Writer, src io.Reader, count func(uint64)) error {
+	n, err := io.Copy(dst, src)
+	count(uint64(n))
 	if tcpConn, ok := dst.(closeWriter); ok {
 		tcpConn.CloseWrite()
 	}
-	errCh <- err
+	return err
 }
@@ -0,0 +1,238 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"testing"
+)
+
+// testConn is a conn with fixed addresses which discards writes
+type testConn struct {
+	local, remote net.Addr
+}
+
+func (c testConn) Write(b []byte) (int, error) { return len(b), nil }
+func (c testConn) LocalAddr() net.Addr         { return c.local }
+func (c testConn) RemoteAddr() net.Addr        { return c.remote }
+
+func tcpAddr(s string) *net.TCPAddr {
+	return net.TCPAddrFromAddrPort(netip.MustParseAddrPort(s))
+}
+
+func TestParseIPLiteral(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+		{"[fe80::1%eth0]", "fe80::1%eth0"},
+		{"ff02::1%eth0", "ff02::1%eth0"},
+		{"2001:db8::1%eth0", "2001:db8::1"},
+		{"[fd00:ec2::254%eth0]", "fd00:ec2::254"},
+		{"::ffff:192.0.2.1", "192.0.2.1"},
+		{"[::ffff:192.0.2.1]", "192.0.2.1"},
+		{"", ""},
+		{"example.com", ""},
+		{"[2001:db8::1", ""},
+		{"2001:db8::1]", ""},
+		{"[]", ""},
+		{"[example.com]", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := parseIPLiteral(tt.name)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("parseIPLiteral(%q) = %v, want no IP", tt.name, ip)
+			}
+			continue
+		}
+		if !ok || ip != netip.MustParseAddr(tt.want) {
+			t.Errorf("parseIPLiteral(%q) = %v, %v, want %s", tt.name, ip, ok, tt.want)
+		}
+	}
+}
+
+func TestReadAddrSpec(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     []byte
+		want    AddrSpec
+		wantErr error
+	}{
+		{
+			name: "IPv4",
+			msg:  []byte{ipv4Address, 192, 0, 2, 1, 0x1f, 0x90},
+			want: AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 8080},
+		},
+		{
+			name: "IPv6",
+			msg:  []byte{ipv6Address, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80},
+			want: AddrSpec{IP: netip.MustParseAddr("2001:db8::1"), Port: 80},
+		},
+		{
+			name: "IPv4-mapped IPv6",
+			msg:  []byte{ipv6Address, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 192, 0, 2, 1, 0, 80},
+			want: AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 80},
+		},
+		{
+			name: "domain",
+			msg:  append([]byte{fqdnAddress, 11}, "example.com\x01\xbb"...),
+			want: AddrSpec{FQDN: "example.com", Port: 443},
+		},
+		{
+			name: "mixed case domain",
+			msg:  append([]byte{fqdnAddress, 12}, "Example.COM.\x01\xbb"...),
+			want: AddrSpec{FQDN: "example.com", Port: 443},
+		},
+		{
+			name: "bracketed IPv6 literal",
+			msg:  append([]byte{fqdnAddress, 13}, "[2001:db8::1]\x00\x50"...),
+			want: AddrSpec{FQDN: "[2001:db8::1]", Port: 80},
+		},
+		{
+			name: "zoned IPv6 literal",
+			msg:  append([]byte{fqdnAddress, 12}, "fe80::1%eth0\x00\x50"...),
+			want: AddrSpec{FQDN: "fe80::1%eth0", Port: 80},
+		},
+		{
+			name:    "empty domain",
+			msg:     []byte{fqdnAddress, 0, 0, 80},
+			wantErr: ErrInvalidDomain,
+		},
+		{
+			name:    "domain with a space",
+			msg:     append([]byte{fqdnAddress, 8}, "evil com\x00\x50"...),
+			wantErr: ErrInvalidDomain,
+		},
+		{
+			name:    "unknown address type",
+			msg:     []byte{0x02, 192, 0, 2, 1, 0, 80},
+			wantErr: ErrUnrecognizedAddrType,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var d AddrSpec
+			err := readAddrSpec(bytes.NewReader(tt.msg), &d)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d != tt.want {
+				t.Errorf("got %+v, want %+v", d, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadAddrSpecTruncated(t *testing.T) {
+	msgs := [][]byte{
+		{ipv4Address, 192, 0, 2},
+		{ipv6Address, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0},
+		{fqdnAddress, 11, 'e', 'x'},
+		{ipv4Address, 192, 0, 2, 1, 0},
+	}
+	for _, msg := range msgs {
+		var d AddrSpec
+		if err := readAddrSpec(bytes.NewReader(msg), &d); err == nil {
+			t.Errorf("readAddrSpec(% x) = %+v, want an error", msg, d)
+		}
+	}
+}
+
+func TestFormatAddr(t *testing.T) {
+	tests := []struct {
+		name string
+		addr *AddrSpec
+		want []byte
+	}{
+		{"none", nil, []byte{ipv4Address, 0, 0, 0, 0, 0, 0}},
+		{"IPv4", &AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 8080}, []byte{ipv4Address, 192, 0, 2, 1, 0x1f, 0x90}},
+		{"IPv4-mapped IPv6", &AddrSpec{IP: netip.MustParseAddr("::ffff:192.0.2.1"), Port: 80}, []byte{ipv4Address, 192, 0, 2, 1, 0, 80}},
+		{"IPv6", &AddrSpec{IP: netip.MustParseAddr("2001:db8::1"), Port: 80}, []byte{ipv6Address, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}},
+		{"zoned IPv6", &AddrSpec{IP: netip.MustParseAddr("fe80::1%eth0"), Port: 80}, []byte{ipv6Address, 0xfe, 0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}},
+		{"domain", &AddrSpec{FQDN: "example.com", Port: 443}, append([]byte{fqdnAddress, 11}, "example.com\x01\xbb"...)},
+	}
+	for _, tt := range tests {
+		got, err := formatAddr(tt.addr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: got % x, want % x", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := formatAddr(&AddrSpec{Port: 80}); err == nil {
+		t.Error("an address without IP or domain was formatted")
+	}
+}
+
+func TestReplyAddr(t *testing.T) {
+	tests := []struct {
+		name     string
+		local    string
+		control  string
+		publicIP string
+		want     AddrSpec
+	}{
+		{"IPv4", "192.0.2.1:1080", "192.0.2.1:1080", "", AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 1080}},
+		{"unspecified IPv4", "0.0.0.0:40000", "192.0.2.1:1080", "", AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 40000}},
+		{"IPv6", "[2001:db8::1]:40000", "[2001:db8::1]:1080", "", AddrSpec{IP: netip.MustParseAddr("2001:db8::1"), Port: 40000}},
+		{"unspecified IPv6", "[::]:40000", "[2001:db8::1]:1080", "", AddrSpec{IP: netip.MustParseAddr("2001:db8::1"), Port: 40000}},
+		{"dual stack", "[::]:40000", "[::ffff:192.0.2.1]:1080", "", AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 40000}},
+		{"IPv4-mapped", "[::ffff:192.0.2.1]:40000", "[::ffff:192.0.2.1]:1080", "", AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 40000}},
+		{"zoned IPv6", "[fe80::1%eth0]:40000", "[fe80::1%eth0]:1080", "", AddrSpec{IP: netip.MustParseAddr("fe80::1%eth0"), Port: 40000}},
+		{"public IP", "[::]:40000", "[2001:db8::1]:1080", "198.51.100.1", AddrSpec{IP: netip.MustParseAddr("198.51.100.1"), Port: 40000}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{config: &Config{}}
+			if tt.publicIP != "" {
+				s.config.PublicIP = netip.MustParseAddr(tt.publicIP)
+			}
+			conn := testConn{local: tcpAddr(tt.control), remote: tcpAddr("192.0.2.100:50000")}
+			if got := s.replyAddr(conn, tcpAddr(tt.local)); *got != tt.want {
+				t.Errorf("got %v, want %v", got, &tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkNewRequest(b *testing.B) {
+	requests := []struct {
+		name string
+		msg  []byte
+	}{
+		{"IPv4", []byte{socks5Version, ConnectCommand, 0, ipv4Address, 192, 0, 2, 1, 0, 80}},
+		{"IPv6", []byte{socks5Version, ConnectCommand, 0, ipv6Address, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 80}},
+		{"domain", append([]byte{socks5Version, ConnectCommand, 0, fqdnAddress, 11}, "example.com\x01\xbb"...)},
+		{"mixed case domain", append([]byte{socks5Version, ConnectCommand, 0, fqdnAddress, 12}, "Example.COM.\x01\xbb"...)},
+	}
+	for _, req := range requests {
+		b.Run(req.name, func(b *testing.B) {
+			src := bytes.NewReader(req.msg)
+			r := bufio.NewReader(src)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				src.Reset(req.msg)
+				r.Reset(src)
+				if _, err := NewRequest(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package socks5
 
 import (
 	"context"
+	"fmt"
 	"net"
 	"net/netip"
 )
@@ -11,9 +12,19 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, netip.Addr, error)
 }
 
+// MultiNameResolver is implemented by resolvers able to return every
+// address of a name, allowing connects to fall back to the next address
+type MultiNameResolver interface {
+	ResolveAll(ctx context.Context, name string) (context.Context, []netip.Addr, error)
+}
+
 // DNSResolver uses the system DNS to resolve host names
 type DNSResolver struct{}
 
+func (d DNSResolver) String() string {
+	return "system"
+}
+
 func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context, netip.Addr, error) {
 	ipAddr, err := net.ResolveIPAddr("ip", name)
 
@@ -24,3 +35,45 @@ func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context,
 	addr := netip.MustParseAddr(ipAddr.String())
 	return ctx, addr, err
 }
+
+func (d DNSResolver) ResolveAll(ctx context.Context, name string) (context.Context, []netip.Addr, error) {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	for i, addr := range addrs {
+		addrs[i] = addr.Unmap()
+	}
+	return ctx, addrs, nil
+}
+
+// resolverName identifies the configured resolver in access logs, by its
+// String method if it has one or by its type
+func (s *Server) resolverName() string {
+	if r, ok := s.config.Resolver.(fmt.Stringer); ok {
+		return r.String()
+	}
+	return fmt.Sprintf("%T", s.config.Resolver)
+}
+
+// resolveAll resolves every address of name with the configured resolver
+func (s *Server) resolveAll(ctx context.Context, name string) (context.Context, []netip.Addr, error) {
+	return resolveAll(ctx, s.config.Resolver, name)
+}
+
+// resolveAll resolves every address of name if r supports it, or the
+// single address returned by Resolve otherwise
+func resolveAll(ctx context.Context, r NameResolver, name string) (context.Context, []netip.Addr, error) {
+	if r, ok := r.(MultiNameResolver); ok {
+		ctx, addrs, err := r.ResolveAll(ctx, name)
+		if err == nil && len(addrs) == 0 {
+			err = fmt.Errorf("no addresses found for %v", name)
+		}
+		return ctx, addrs, err
+	}
+	ctx, addr, err := r.Resolve(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, []netip.Addr{addr}, nil
+}
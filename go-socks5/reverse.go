@@ -0,0 +1,80 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultReverseLookupTimeout is used when Config.ReverseLookupTimeout
+	// is not set
+	defaultReverseLookupTimeout = time.Second
+
+	// reverseLookupTTL is how long PTR results, including failures, are
+	// cached
+	reverseLookupTTL = 10 * time.Minute
+
+	// maxReverseLookupCache is the cache size above which expired entries
+	// are purged
+	maxReverseLookupCache = 10000
+)
+
+// reverseCache caches PTR lookups of client addresses
+type reverseCache struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]reverseEntry
+}
+
+type reverseEntry struct {
+	name    string
+	expires time.Time
+}
+
+// lookupClientName resolves the PTR record of the session client in the
+// background and stores it in the session
+func (s *Server) lookupClientName(sess *Session) {
+	ip := sess.Client.Addr()
+	if !ip.IsValid() {
+		return
+	}
+
+	s.reverseCache.mu.Lock()
+	entry, found := s.reverseCache.entries[ip]
+	s.reverseCache.mu.Unlock()
+	if found && time.Now().Before(entry.expires) {
+		s.updateSession(sess, func(sess *Session) { sess.ClientName = entry.name })
+		return
+	}
+
+	go func() {
+		timeout := s.config.ReverseLookupTimeout
+		if timeout <= 0 {
+			timeout = defaultReverseLookupTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		entry := reverseEntry{expires: time.Now().Add(reverseLookupTTL)}
+		if names, err := net.DefaultResolver.LookupAddr(ctx, ip.String()); err == nil && len(names) > 0 {
+			entry.name = strings.TrimSuffix(names[0], ".")
+		}
+
+		s.reverseCache.mu.Lock()
+		if len(s.reverseCache.entries) >= maxReverseLookupCache {
+			now := time.Now()
+			for k, v := range s.reverseCache.entries {
+				if now.After(v.expires) {
+					delete(s.reverseCache.entries, k)
+				}
+			}
+		}
+		s.reverseCache.entries[ip] = entry
+		s.reverseCache.mu.Unlock()
+
+		s.updateSession(sess, func(sess *Session) { sess.ClientName = entry.name })
+	}()
+}
@@ -2,6 +2,8 @@ package socks5
 
 import (
 	"context"
+	"fmt"
+	"net/netip"
 )
 
 // RuleSet is used to provide custom rules to allow or prohibit actions
@@ -30,12 +32,55 @@ type PermitCommand struct {
 func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Context, bool) {
 	switch req.Command {
 	case ConnectCommand:
-		return ctx, p.EnableConnect
+		if !p.EnableConnect {
+			return WithDenyReason(ctx, "command", "connect not permitted"), false
+		}
+		return ctx, true
 	case BindCommand:
-		return ctx, p.EnableBind
-	case AssociateCommand:
-		return ctx, p.EnableAssociate
+		if !p.EnableBind {
+			return WithDenyReason(ctx, "command", "bind not permitted"), false
+		}
+		return ctx, true
+	case AssociateCommand, UDPOverTCPCommand:
+		if !p.EnableAssociate {
+			return WithDenyReason(ctx, "command", "associate not permitted"), false
+		}
+		return ctx, true
 	}
 
-	return ctx, false
+	return WithDenyReason(ctx, "command", fmt.Sprintf("command %v not permitted", req.Command)), false
+}
+
+// CloudMetadataAddrs are the instance metadata endpoints of common cloud
+// providers, blocked by DenyCloudMetadata
+var CloudMetadataAddrs = []netip.Addr{
+	netip.MustParseAddr("169.254.169.254"), // AWS, GCP, Azure, OpenStack, DigitalOcean, Oracle
+	netip.MustParseAddr("169.254.170.2"),   // AWS ECS task metadata
+	netip.MustParseAddr("169.254.170.23"),  // AWS EKS pod identity
+	netip.MustParseAddr("fd00:ec2::254"),   // AWS IPv6
+	netip.MustParseAddr("fd00:ec2::23"),    // AWS EKS pod identity IPv6
+	netip.MustParseAddr("100.100.100.200"), // Alibaba Cloud
+	netip.MustParseAddr("192.0.0.192"),     // Oracle Cloud legacy
+}
+
+// DenyCloudMetadata returns a RuleSet which blocks requests to the cloud
+// metadata endpoints in CloudMetadataAddrs and otherwise defers to rules
+func DenyCloudMetadata(rules RuleSet) RuleSet {
+	return &DenyCloudMetadataRuleSet{rules}
+}
+
+// DenyCloudMetadataRuleSet is an implementation of the RuleSet which
+// prevents clients from harvesting instance credentials through the proxy
+type DenyCloudMetadataRuleSet struct {
+	Rules RuleSet
+}
+
+func (d *DenyCloudMetadataRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	ip := req.DestAddr.IP.Unmap()
+	for _, addr := range CloudMetadataAddrs {
+		if ip == addr {
+			return WithDenyReason(ctx, "cloud_metadata", fmt.Sprintf("%v is a cloud metadata endpoint", ip)), false
+		}
+	}
+	return d.Rules.Allow(ctx, req)
 }
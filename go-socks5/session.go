@@ -0,0 +1,159 @@
+package socks5
+
+import (
+	"cmp"
+	"context"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// Session describes a client connection served by the Server
+type Session struct {
+	// ID uniquely identifies the session within the server
+	ID uint64 `json:"id"`
+	// Client is the address of the client
+	Client netip.AddrPort `json:"client"`
+	// ClientName is the reverse DNS name of the client, if looked up
+	ClientName string `json:"client_name,omitempty"`
+	// User the client authenticated as, empty without authentication
+	User string `json:"user,omitempty"`
+	// Command requested by the client, empty during negotiation
+	Command string `json:"command,omitempty"`
+	// Dest is the requested destination, nil during negotiation
+	Dest *AddrSpec `json:"dest,omitempty"`
+	// Start is when the connection was accepted
+	Start time.Time `json:"start"`
+	// LastActive is when the tunnel last relayed data, zero unless it
+	// has an idle timeout
+	LastActive time.Time `json:"last_active"`
+	// Tags are the tags set by the authenticator and the RuleSet, see
+	// WithTags
+	Tags map[string]string `json:"tags,omitempty"`
+	// Listener is the Profile name of the listener the client connected
+	// to, empty unless served with ServeProfile
+	Listener string `json:"listener,omitempty"`
+
+	// request is the request being served, nil during negotiation
+	request *Request
+	// cancel cancels the context of the connection, done is closed once
+	// it ended
+	cancel context.CancelCauseFunc
+	done   <-chan struct{}
+}
+
+// SessionInfo describes a request to the session callbacks of Config
+type SessionInfo struct {
+	Session
+	// BytesUp and BytesDown are the payload relayed so far in each
+	// direction, DatagramsUp and DatagramsDown the datagrams carrying it
+	// for UDP associations
+	BytesUp       uint64
+	BytesDown     uint64
+	DatagramsUp   uint64
+	DatagramsDown uint64
+	// Local is the address the client connected to. Outbound and Remote
+	// are the local and remote addresses of the tunnel to the
+	// destination, if one was established.
+	Local    netip.AddrPort
+	Outbound netip.AddrPort
+	Remote   netip.AddrPort
+	// DenyReason is set if the request was denied
+	DenyReason *DenyReason
+	// Err is the error the request failed with, nil on success
+	Err error
+}
+
+// Sessions returns a snapshot of the active sessions ordered by ID
+func (s *Server) Sessions() []Session {
+	s.mu.Lock()
+	sessions := make([]Session, 0, len(s.conns))
+	for _, sess := range s.conns {
+		sessions = append(sessions, sess.snapshot())
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return sessions
+}
+
+// startSession registers a connection as active, making it visible in
+// Sessions and subject to Drain. It returns the context of the
+// connection, derived from ctx, whose end closes the connection.
+func (s *Server) startSession(ctx context.Context, c net.Conn) (context.Context, *Session) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	context.AfterFunc(ctx, func() { c.Close() })
+	sess := &Session{
+		ID:     s.nextSessionID.Add(1),
+		Client: addrPort(c.RemoteAddr()),
+		Start:  time.Now(),
+		cancel: cancel,
+		done:   ctx.Done(),
+	}
+	if p := profileFromContext(ctx); p != nil {
+		sess.Listener = p.Name
+	}
+	sess.Client = netip.AddrPortFrom(sess.Client.Addr().Unmap(), sess.Client.Port())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conns[c] = sess
+	return ctx, sess
+}
+
+// endSession removes a connection from the active sessions and cancels
+// its context
+func (s *Server) endSession(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sess, found := s.conns[c]; found {
+		sess.cancel(nil)
+		delete(s.conns, c)
+	}
+}
+
+// updateSession modifies a session while holding the server lock
+func (s *Server) updateSession(sess *Session, update func(*Session)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	update(sess)
+}
+
+// sessionSnapshot returns a copy of a session taken under the server lock
+func (s *Server) sessionSnapshot(sess *Session) Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return sess.snapshot()
+}
+
+// snapshot returns a copy of the session with the state of its request,
+// the caller must hold the server lock
+func (sess *Session) snapshot() Session {
+	snapshot := *sess
+	if req := sess.request; req != nil {
+		if req.idleTimeout.Load() != 0 {
+			snapshot.LastActive = time.Unix(0, req.lastActive.Load())
+		}
+		snapshot.Tags = req.Tags()
+	}
+	return snapshot
+}
+
+// sessionInfo describes the request of a session finished with err
+func (s *Server) sessionInfo(sess *Session, req *Request, err error) SessionInfo {
+	return SessionInfo{
+		Session:       s.sessionSnapshot(sess),
+		BytesUp:       req.bytesUp.Load(),
+		BytesDown:     req.bytesDown.Load(),
+		DatagramsUp:   req.datagramsUp.Load(),
+		DatagramsDown: req.datagramsDown.Load(),
+		Local:         req.localAddr,
+		Outbound:      req.outboundAddr,
+		Remote:        req.connectedAddr,
+		DenyReason:    req.denyReason,
+		Err:           err,
+	}
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// maxShapedWrite is the largest chunk a shaped tunnel writes at once, so
+// bulk transfers can't delay other tunnels by a whole buffer
+const maxShapedWrite = 16 * 1024
+
+// Bandwidth limits the throughput of each direction of a tunnel
+type Bandwidth struct {
+	// Rate is the number of bytes per second, zero means unlimited
+	Rate int64
+	// Burst is the number of bytes that may be sent at once, it
+	// defaults to Rate
+	Burst int64
+	// Priority orders tunnels competing for Config.LinkBandwidth, higher
+	// priorities are served first. It has no effect without a link limit.
+	Priority int
+}
+
+// bandwidth returns the limit of the bandwidth class assigned by the
+// RuleSet, if any
+func (s *Server) bandwidth(ctx context.Context) (Bandwidth, bool) {
+	class, ok := BandwidthClassFromContext(ctx)
+	if !ok {
+		return Bandwidth{}, false
+	}
+	bw, found := s.config.BandwidthClasses[class]
+	return bw, found
+}
+
+// shape returns a writer limiting w to the bandwidth of the tunnel and
+// its share of link, or w itself if neither limits it
+func (bw Bandwidth) shape(w io.Writer, link *linkShaper) io.Writer {
+	sw := &shapedWriter{w: w, link: link, priority: bw.Priority}
+	if bw.Rate > 0 {
+		burst := bw.Burst
+		if burst <= 0 {
+			burst = bw.Rate
+		}
+		sw.bucket = newTokenBucket(float64(bw.Rate), int(burst))
+	}
+	if sw.bucket == nil && sw.link == nil {
+		return w
+	}
+	return sw
+}
+
+// shapedWriter delays writes to keep within the rate of its bucket and
+// of the link shared with other tunnels
+type shapedWriter struct {
+	w        io.Writer
+	bucket   *tokenBucket
+	link     *linkShaper
+	priority int
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxShapedWrite)]
+		if s.bucket != nil {
+			time.Sleep(s.bucket.reserve(float64(len(chunk))))
+		}
+		if s.link != nil {
+			s.link.wait(len(chunk), s.priority)
+		}
+		n, err := s.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (s *shapedWriter) CloseWrite() error {
+	if cw, ok := s.w.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// linkShaper shares a bandwidth between all tunnels. Writers of lower
+// priority wait while higher priority ones are queued, so
+// interactive tunnels stay responsive when bulk transfers saturate the
+// link.
+type linkShaper struct {
+	bucket *tokenBucket
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting map[int]int // queued writers by priority
+}
+
+// newLinkShaper creates a linkShaper for bw, or returns nil if bw is
+// unlimited
+func newLinkShaper(bw Bandwidth) *linkShaper {
+	if bw.Rate <= 0 {
+		return nil
+	}
+	burst := bw.Burst
+	if burst <= 0 {
+		burst = bw.Rate
+	}
+	l := &linkShaper{bucket: newTokenBucket(float64(bw.Rate), int(burst)), waiting: make(map[int]int)}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// wait blocks until n bytes may be written to the link. Writers of lower
+// priority are held back while it waits.
+func (l *linkShaper) wait(n, priority int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.waiting[priority]++
+	defer func() {
+		l.waiting[priority]--
+		l.cond.Broadcast()
+	}()
+
+	for {
+		if l.preempted(priority) {
+			l.cond.Wait()
+			continue
+		}
+		d := l.bucket.take(float64(n))
+		if d == 0 {
+			return
+		}
+		l.mu.Unlock()
+		time.Sleep(d)
+		l.mu.Lock()
+	}
+}
+
+// preempted reports whether writers of higher priority are queued, the
+// caller must hold the lock
+func (l *linkShaper) preempted(priority int) bool {
+	for p, n := range l.waiting {
+		if p > priority && n > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -1,11 +1,15 @@
 package socks5
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/netip"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -14,6 +18,16 @@ const (
 	socks5Version = uint8(5)
 )
 
+var (
+	// DefaultDockerNetworks is used when Config.DockerNetworks is nil.
+	// Class B private range in CIDR notation: 172.16.0.0/12
+	DefaultDockerNetworks = []netip.Prefix{netip.MustParsePrefix("172.16.0.0/12")}
+
+	// ErrServerClosed is returned by Serve and ListenAndServe after a call
+	// to Drain.
+	ErrServerClosed = errors.New("socks: server closed")
+)
+
 // Config is used to setup and configure a Server
 type Config struct {
 	// AuthMethods can be provided to implement custom authentication
@@ -26,6 +40,10 @@ type Config struct {
 	// and AUthMethods is nil, then "auth-less" mode is enabled.
 	Credentials CredentialStore
 
+	// AuthTimeout bounds the credential check of authenticators and
+	// credential stores supporting a context. Zero means unlimited.
+	AuthTimeout time.Duration
+
 	// Resolver can be provided to do custom name resolution.
 	// Defaults to DNSResolver if not provided.
 	Resolver NameResolver
@@ -39,23 +57,259 @@ type Config struct {
 	// Defaults to NoRewrite.
 	Rewriter AddressRewriter
 
+	// BanList can be provided to reject connections from banned client
+	// IPs before any other check
+	BanList *BanList
+
+	// DockerNetworks are the ranges whose clients are always allowed to
+	// connect. Defaults to DefaultDockerNetworks if nil, set to an empty
+	// slice to disable.
+	DockerNetworks []netip.Prefix
+
+	// TraceClients are the ranges of clients whose negotiation is
+	// hex-dumped to the Logger, from the method selection to the reply to
+	// the request, to diagnose failing handshakes. Passwords are redacted.
+	TraceClients []netip.Prefix
+
+	// AllowUntrustedWithAuth lets clients outside the whitelist and trusted
+	// networks connect, provided they authenticate with a method other
+	// than "auth-less" mode
+	AllowUntrustedWithAuth bool
+
 	// BindIP is used for bind or udp associate
 	BindIP netip.Addr
 
+	// PublicIP overrides the address reported in replies (BND.ADDR),
+	// useful when the server is behind NAT
+	PublicIP netip.Addr
+
+	// PortRange restricts the local ports used for bind and udp associate.
+	// Defaults to ephemeral ports chosen by the OS.
+	PortRange PortRange
+
 	// Logger can be used to provide a custom log target.
 	// Defaults to stdout.
 	Logger *logrus.Logger
 
+	// ReverseLookup enables asynchronous PTR lookups of client addresses,
+	// reported in access logs and Sessions. Lookups taking longer than
+	// ReverseLookupTimeout are abandoned, defaults to 1 second.
+	ReverseLookup        bool
+	ReverseLookupTimeout time.Duration
+
+	// LogSuppressWindow limits warnings about rejected clients, such as
+	// connections from addresses outside the whitelist or failed
+	// authentications, to one per client and window followed by a count
+	// of the suppressed ones. Zero logs every occurrence.
+	LogSuppressWindow time.Duration
+
+	// NegotiationMinBytes and NegotiationWindow close connections whose
+	// client sends fewer than NegotiationMinBytes within a window while
+	// the server waits for its handshake or request, e.g. slowloris
+	// attacks trickling them. Zero disables the check.
+	NegotiationMinBytes int
+	NegotiationWindow   time.Duration
+
+	// AccessLogSampleRate logs only one in this many successful requests
+	// in the access log, with a sample_rate field. Failed and denied
+	// requests are always logged and all are counted in Stats. Zero or
+	// one logs every request.
+	AccessLogSampleRate int
+
+	// AccessLogEnricher can add fields to the access log record written
+	// for every request
+	AccessLogEnricher AccessLogEnricher
+
+	// NAT64Prefix, e.g. 64:ff9b::/96, reaches IPv4 destinations through a
+	// NAT64 gateway from IPv6-only networks. Requested and resolved IPv4
+	// addresses are embedded in the prefix as of RFC 6052 once rules
+	// allowed them, native IPv6 addresses of a name being tried first.
+	// See DiscoverNAT64Prefix.
+	NAT64Prefix netip.Prefix
+
 	// Optional function for dialing out
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// DialerSelector can choose another dialer than Dial per request. The
+	// dialers it returns replace the default dialer including its MPTCP,
+	// Fast Open and DSCP options.
+	DialerSelector DialerSelector
+
+	// ListenMPTCP enables Multipath TCP on the listener of ListenAndServe
+	// and DialMPTCP on connections made by the default dialer. Both fall
+	// back to plain TCP where MPTCP is not supported.
+	ListenMPTCP bool
+	DialMPTCP   bool
+
+	// ListenFastOpen enables TCP Fast Open on the listener of
+	// ListenAndServe and DialFastOpen on connections made by the default
+	// dialer. Only supported on Linux, elsewhere they have no effect.
+	ListenFastOpen bool
+	DialFastOpen   bool
+
+	// ListenControl can be provided to set socket options such as
+	// SO_REUSEPORT or IP_FREEBIND on the listener of Listen and
+	// ListenAndServe, before it is bound. It is not used by Serve.
+	ListenControl func(network, address string, c syscall.RawConn) error
+
+	// DSCP is the Differentiated Services code point (0-63) marked on
+	// connections made by the default dialer, unless a RuleSet sets one
+	// with WithDSCP. Zero leaves them unmarked. Only supported on Linux.
+	DSCP uint8
+
+	// DestLimiter can be provided to cap simultaneous tunnels per
+	// destination host
+	DestLimiter *DestLimiter
+
+	// DestRateLimiter can be provided to limit the rate of new tunnels
+	// per destination host, at the rates set by the RuleSet with
+	// WithDestConnectRate too
+	DestRateLimiter *DestRateLimiter
+
+	// AcceptRate limits the connections accepted per second, AcceptBurst
+	// the connections accepted at once, to absorb connect floods before
+	// any negotiation. AcceptRatePerIP and AcceptBurstPerIP do the same
+	// per client IP. Zero rates mean unlimited, zero bursts default to
+	// the rate rounded up.
+	AcceptRate       float64
+	AcceptBurst      int
+	AcceptRatePerIP  float64
+	AcceptBurstPerIP int
+
+	// Timeouts bound negotiating, dialing and the idle time and lifetime
+	// of tunnels
+	Timeouts Timeouts
+
+	// BandwidthClasses are the traffic shaping classes RuleSets can assign
+	// to tunnels with WithBandwidthClass
+	BandwidthClasses map[string]Bandwidth
+
+	// LinkBandwidth limits the total throughput of all tunnels in each
+	// direction, sharing it by the Priority of their bandwidth class.
+	// Its own Priority is ignored, a zero Rate means unlimited.
+	LinkBandwidth Bandwidth
+
+	// Quotas can be provided to cap the traffic of authenticated users,
+	// whose requests are denied once their quota is used up
+	Quotas *Quotas
+
+	// UDPIdleTimeout closes UDP associations that relayed no datagram
+	// for this long. Defaults to 2 minutes.
+	UDPIdleTimeout time.Duration
+
+	// MaxUDPAssociations caps the number of concurrent UDP associations.
+	// Zero means unlimited.
+	MaxUDPAssociations int
+
+	// UDPDatagramRate limits the datagrams per second a single UDP
+	// association may relay to its destinations, allowing bursts of up to
+	// UDPDatagramBurst. Zero means unlimited.
+	UDPDatagramRate  float64
+	UDPDatagramBurst int
+
+	// UDPMaxDatagram is the largest UDP datagram accepted by the relay,
+	// including the SOCKS header of client datagrams. Larger ones are
+	// dropped and counted. Defaults to 65535.
+	UDPMaxDatagram int
+
+	// UDPReadBuffer and UDPWriteBuffer set the socket buffer sizes of UDP
+	// relays, e.g. for high-rate QUIC or game traffic. Zero keeps the
+	// operating system default.
+	UDPReadBuffer  int
+	UDPWriteBuffer int
+
+	// UDPFragmentTimeout enables reassembly of fragmented UDP datagrams,
+	// abandoning incomplete sequences after this long. If zero, fragments
+	// are dropped and counted.
+	UDPFragmentTimeout time.Duration
+
+	// UDPOverTCP accepts the UDPOverTCPCommand extension, relaying UDP
+	// datagrams over the control connection for clients on networks
+	// blocking UDP. They are sent from a socket connected to each
+	// destination, without a relay socket for the client.
+	UDPOverTCP bool
+
+	// UDPPermissive relaxes the source checks of UDP associations:
+	// datagrams are accepted from any port of the client's IP, ignoring
+	// the address declared in the request, and relayed back from any
+	// host rather than only from the destinations the client sent to.
+	// It helps clients behind NAT which declare their private address.
+	UDPPermissive bool
+
+	// Capture allows attaching packet captures to tunnels with
+	// Server.Capture. Tunnels are then always relayed through user space
+	// buffers instead of being spliced by the kernel.
+	Capture bool
+
+	// EventLoopRelay relays tunnels with a few epoll event loops instead
+	// of two goroutines each, so that idle tunnels cost their sockets
+	// only. Tunnels which are shaped, captured or received data ahead of
+	// the reply are relayed by goroutines regardless. It is only
+	// supported on Linux.
+	EventLoopRelay bool
+
+	// Overload rejects new connections while the resident memory, the
+	// open file descriptors or the accept queue exceed their limits,
+	// until they fall back below 90% of them. Existing tunnels keep
+	// running instead of the process being killed mid-traffic for
+	// running out of memory or descriptors. Rejected clients are told no
+	// authentication method is acceptable.
+	Overload OverloadLimits
+
+	// OnSessionStart and OnSessionEnd are called when a request is
+	// received and once it is finished, e.g. for custom accounting or
+	// alerting. They run on the goroutine serving the connection and
+	// should return quickly.
+	OnSessionStart func(SessionInfo)
+	OnSessionEnd   func(SessionInfo)
+
+	// OnAuthFailure is called when a client fails to authenticate, e.g.
+	// to publish security events. It runs on the goroutine serving the
+	// connection and should return quickly.
+	OnAuthFailure func(AuthFailure)
+
+	// OnPanic is called with the value and the stack of a panic recovered
+	// while serving a session, e.g. to report it to an error tracker. The
+	// panic is logged with a "panic" field and the connection closed.
+	OnPanic func(sess Session, v any, stack []byte)
 }
 
 // Server is reponsible for accepting connections and handling
 // the details of the SOCKS5 protocol
 type Server struct {
 	config      *Config
-	authMethods map[uint8]Authenticator
-	isIPAllowed func(netip.Addr) bool
+	authMethods atomic.Pointer[map[uint8]Authenticator]
+	whitelist   atomic.Pointer[[]netip.Addr]
+
+	// Bookkeeping for Drain
+	mu        sync.Mutex
+	draining  bool
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]*Session
+
+	// addr is the address of the last listener opened by Listen
+	addr net.Addr
+
+	nextSessionID atomic.Uint64
+
+	// linkUp and linkDown share Config.LinkBandwidth between tunnels
+	linkUp, linkDown *linkShaper
+	reverseCache     reverseCache
+
+	udpAssociations     atomic.Int32
+	udpAssocs           map[*udpAssociation]struct{}
+	udpFragmentsDropped atomic.Uint64
+
+	stats       serverStats
+	logThrottle logThrottle
+	// reaper starts the goroutine closing idle tunnels
+	reaper sync.Once
+	// acceptLimiter enforces Config.AcceptRate, nil without limits
+	acceptLimiter *acceptLimiter
+	// loops relay tunnels with Config.EventLoopRelay, nil without
+	loops *relayLoops
+	// overload takes the readings of Config.Overload, nil without limits
+	overload *overloadMonitor
 }
 
 // New creates a new Server and potentially returns an error
@@ -63,7 +317,7 @@ func New(conf *Config) (*Server, error) {
 	// Ensure we have at least one authentication method enabled
 	if len(conf.AuthMethods) == 0 {
 		if conf.Credentials != nil {
-			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
+			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{Credentials: conf.Credentials}}
 		} else {
 			conf.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
 		}
@@ -78,6 +332,24 @@ func New(conf *Config) (*Server, error) {
 	if conf.Rules == nil {
 		conf.Rules = PermitAll()
 	}
+	if conf.Quotas != nil {
+		conf.Rules = quotaRuleSet{conf.Rules, conf.Quotas}
+	}
+
+	// Ensure we have Docker networks
+	if conf.DockerNetworks == nil {
+		conf.DockerNetworks = DefaultDockerNetworks
+	}
+
+	if conf.NAT64Prefix.IsValid() {
+		if err := validNAT64Prefix(conf.NAT64Prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.DSCP > maxDSCP {
+		return nil, fmt.Errorf("invalid DSCP value: %d", conf.DSCP)
+	}
 
 	// Ensure we have a log target
 	if conf.Logger == nil {
@@ -85,134 +357,408 @@ func New(conf *Config) (*Server, error) {
 	}
 
 	server := &Server{
-		config: conf,
+		config:        conf,
+		listeners:     make(map[net.Listener]struct{}),
+		conns:         make(map[net.Conn]*Session),
+		udpAssocs:     make(map[*udpAssociation]struct{}),
+		acceptLimiter: newAcceptLimiter(conf),
 	}
-
-	server.authMethods = make(map[uint8]Authenticator)
-
-	for _, a := range conf.AuthMethods {
-		server.authMethods[a.GetCode()] = a
+	server.reverseCache.entries = make(map[netip.Addr]reverseEntry)
+	server.linkUp, server.linkDown = newLinkShaper(conf.LinkBandwidth), newLinkShaper(conf.LinkBandwidth)
+	if conf.EventLoopRelay {
+		loops, err := newRelayLoops()
+		if err != nil {
+			return nil, err
+		}
+		server.loops = loops
+	}
+	if conf.Overload.enabled() {
+		server.startOverloadMonitor()
 	}
 
-	// Set default IP whitelist function
-	server.isIPAllowed = func(ip netip.Addr) bool {
-		return false // default block all IPs
+	authMethods := make(map[uint8]Authenticator)
+	for _, a := range conf.AuthMethods {
+		if a.GetCode() == noAcceptable {
+			return nil, fmt.Errorf("invalid auth method code: %#x", a.GetCode())
+		}
+		authMethods[a.GetCode()] = a
 	}
+	server.authMethods.Store(&authMethods)
 
 	return server, nil
 }
 
 // ListenAndServe is used to create a listener and serve on it
 func (s *Server) ListenAndServe(network, addr string) error {
-	l, err := net.Listen(network, addr)
+	l, err := s.Listen(network, addr)
 	if err != nil {
 		return err
 	}
 	return s.Serve(l)
 }
 
+// Listen opens a listener on addr with the socket options of the config,
+// ready to be passed to Serve. Its address, e.g. the port chosen for
+// ":0", is also reported by Addr.
+func (s *Server) Listen(network, addr string) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	lc.SetMultipathTCP(s.config.ListenMPTCP)
+	if s.config.ListenFastOpen || s.config.ListenControl != nil {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			if s.config.ListenFastOpen {
+				if err := listenFastOpen(network, address, c); err != nil {
+					return err
+				}
+			}
+			if s.config.ListenControl != nil {
+				return s.config.ListenControl(network, address, c)
+			}
+			return nil
+		}
+	}
+	l, err := lc.Listen(context.Background(), network, addr)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.addr = l.Addr()
+	s.mu.Unlock()
+	return l, nil
+}
+
+// Addr returns the address of the last listener opened by Listen or
+// ListenAndServe, or nil if there is none
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addr
+}
+
 // Serve is used to serve connections from a listener
 func (s *Server) Serve(l net.Listener) error {
+	return s.ServeContext(context.Background(), l)
+}
+
+// ServeContext serves connections from a listener until ctx is done,
+// then closes the listener and the connections accepted from it and
+// returns the error of ctx. The contexts of the connections derive from
+// ctx.
+func (s *Server) ServeContext(ctx context.Context, l net.Listener) error {
+	if !s.trackListener(l, true) {
+		return ErrServerClosed
+	}
+	defer s.trackListener(l, false)
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isDraining() {
+				return ErrServerClosed
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 			return err
 		}
-		go s.ServeConn(conn)
+		if !s.admitAccepted(conn) {
+			continue
+		}
+		go s.ServeConnContext(ctx, conn)
 	}
 }
 
-// SetIPWhitelist sets the function to check if a given IP is allowed
-func (s *Server) SetIPWhitelist(allowedIPs []netip.Addr) {
-	s.isIPAllowed = func(ip netip.Addr) bool {
-		for _, allowedIP := range allowedIPs {
-			if ip.Compare(allowedIP) == 0 {
-				return true
-			}
+// Drain stops accepting new connections and waits up to timeout for the
+// active ones to finish. Connections still open after the timeout are
+// forcibly closed. Progress is logged every second while waiting.
+func (s *Server) Drain(timeout time.Duration) error {
+	s.mu.Lock()
+	s.draining = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		active := s.ActiveConnections()
+		if active == 0 {
+			s.config.Logger.Infof("drain complete")
+			return nil
+		}
+		if !time.Now().Before(deadline) {
+			break
+		}
+		s.config.Logger.Infof("draining: %d connections remaining", active)
+		<-ticker.C
+	}
+
+	s.mu.Lock()
+	stragglers := len(s.conns)
+	for c, sess := range s.conns {
+		sess.cancel(nil)
+		c.Close()
+	}
+	s.mu.Unlock()
+
+	s.config.Logger.Warnf("drain timeout: force-closed %d connections", stragglers)
+	return fmt.Errorf("drain timeout exceeded, force-closed %d connections", stragglers)
+}
+
+// ActiveConnections returns the number of connections currently served
+func (s *Server) ActiveConnections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// DroppedUDPFragments returns the number of UDP datagram fragments that
+// were dropped instead of being reassembled
+func (s *Server) DroppedUDPFragments() uint64 {
+	return s.udpFragmentsDropped.Load()
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// trackListener adds or removes a listener from the set closed by Drain.
+// It returns false if the server is already draining.
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		if s.draining {
+			return false
 		}
+		s.listeners[l] = struct{}{}
+	} else {
+		delete(s.listeners, l)
+	}
+	return true
+}
+
+// SetIPWhitelist sets the IPs allowed to connect. It is safe to call while
+// the server is running, by default all IPs are blocked.
+func (s *Server) SetIPWhitelist(allowedIPs []netip.Addr) {
+	whitelist := make([]netip.Addr, len(allowedIPs))
+	for i, ip := range allowedIPs {
+		whitelist[i] = ip.Unmap()
+	}
+	s.whitelist.Store(&whitelist)
+}
+
+// isIPAllowed checks if a given IP is in the whitelist
+func (s *Server) isIPAllowed(ip netip.Addr) bool {
+	whitelist := s.whitelist.Load()
+	if whitelist == nil {
 		return false
 	}
+	ip = ip.Unmap()
+	for _, allowedIP := range *whitelist {
+		if ip.Compare(allowedIP) == 0 {
+			return true
+		}
+	}
+	return false
 }
 
 // ServeConn is used to serve a single connection.
 func (s *Server) ServeConn(conn net.Conn) error {
+	return s.ServeConnContext(context.Background(), conn)
+}
+
+// ServeConnContext serves a single connection with a context derived from
+// ctx, passed to authenticators, resolvers, rules and dialers. It is
+// cancelled once the connection is finished, when ctx is done, which also
+// closes the connection, or when a drain times out.
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) error {
 	defer conn.Close()
-	bufConn := bufio.NewReader(conn)
+	ctx, sess := s.startSession(ctx, conn)
+	defer s.endSession(conn)
+	defer s.recoverPanic(sess)
+	// Reads after the request bypass the trace and the guard
+	raw := conn
+	var trace *negotiationTrace
+	if s.traced(sess.Client.Addr()) {
+		trace = s.traceNegotiation(sess, conn)
+		conn = trace
+	}
+	src, negotiated := s.guardNegotiation(ctx, sess, conn)
+	defer negotiated()
+	bufConn := negotiationReader(src)
+	defer func() {
+		if bufConn != nil {
+			releaseNegotiationReader(bufConn, src)
+		}
+	}()
 
-	// Check client IP against whitelist
-	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	requireAuth, err := s.admit(sess, conn, profileFromContext(ctx))
 	if err != nil {
-		s.config.Logger.Errorf("failed to get client IP address: %v", err)
 		return err
 	}
-	ip, _ := netip.ParseAddr(string(clientIP))
-	if s.IsDockerNetwork(ip) {
-		s.config.Logger.Infof("connection from Docker IP address: %s", clientIP)
-	} else if s.IsTailScale(ip) {
-		s.config.Logger.Infof("connection from Tailscale IP address: %s", clientIP)
-	} else if s.isIPAllowed(ip) {
-		s.config.Logger.Infof("connection from allowed address: %s", clientIP)
-	} else {
-		s.config.Logger.Warnf("connection from not allowed IP address: %s", clientIP)
-		return fmt.Errorf("connection from not allowed IP address")
-	}
 
 	// Read the version byte
-	version := []byte{0}
-	if _, err := bufConn.Read(version); err != nil {
-		s.config.Logger.Errorf("failed to get version byte: %v", err)
+	version, err := bufConn.ReadByte()
+	if err != nil {
+		s.logThrottled(logrus.ErrorLevel, sess.Client.Addr().String(), "failed to get version byte: %v", err)
 		return err
 	}
 
 	// Ensure we are compatible
-	if version[0] != socks5Version {
+	if version != socks5Version {
 		err := fmt.Errorf("unsupported SOCKS version: %v", version)
-		s.config.Logger.Errorf("socks: %v", err)
+		s.logThrottled(logrus.ErrorLevel, sess.Client.Addr().String(), "socks: %v", err)
 		return err
 	}
 
+	if s.overloaded() {
+		return s.rejectOverloaded(sess, conn, bufConn)
+	}
+
 	// Authenticate the connection
-	authContext, err := s.authenticate(conn, bufConn)
+	authContext, err := s.authenticate(ctx, conn, bufConn, sess.Client, requireAuth)
 	if err != nil {
-		err = fmt.Errorf("failed to authenticate: %v", err)
-		s.config.Logger.Errorf("socks: %v", err)
+		if errors.Is(err, ErrAuthFailed) || err == ErrNoSupportedAuth {
+			s.stats.authFailures.Add(1)
+			if s.config.OnAuthFailure != nil {
+				failure := AuthFailure{Session: s.sessionSnapshot(sess), Err: err}
+				var userErr *UserAuthError
+				if errors.As(err, &userErr) {
+					failure.User = userErr.User
+				}
+				s.config.OnAuthFailure(failure)
+			}
+		}
+		err = fmt.Errorf("failed to authenticate: %w", err)
+		s.logThrottled(logrus.ErrorLevel, sess.Client.Addr().String(), "socks: %v", err)
 		return err
 	}
 
 	request, err := NewRequest(bufConn)
 	if err != nil {
 		if err == ErrUnrecognizedAddrType {
-			if err := sendReply(conn, addrTypeNotSupported, nil); err != nil {
+			if err := sendReply(conn, AddrTypeNotSupported, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+		} else if errors.Is(err, ErrMalformedRequest) || errors.Is(err, ErrInvalidDomain) {
+			if err := sendReply(conn, ServerFailure, nil); err != nil {
 				return fmt.Errorf("failed to send reply: %v", err)
 			}
 		}
 		return fmt.Errorf("failed to read destination address: %v", err)
 	}
+	negotiated()
+	if trace != nil {
+		trace.requestRead()
+	}
+	request.bufConn = releaseNegotiationReader(bufConn, raw)
+	bufConn = nil
 	request.AuthContext = authContext
-	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
-		addr, _ := netip.ParseAddr(string(client.IP))
-		request.RemoteAddr = &AddrSpec{IP: addr, Port: client.Port}
+	s.updateSession(sess, func(sess *Session) { sess.User = request.Username() })
+
+	return s.serveRequest(ctx, sess, conn, request)
+}
+
+// admit checks the client of conn against the ban list and the trusted
+// networks, reporting whether it must authenticate. profile is that of
+// the listener, nil without.
+func (s *Server) admit(sess *Session, conn net.Conn, profile *Profile) (requireAuth bool, err error) {
+	// Check client IP against whitelist
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		s.config.Logger.Errorf("failed to get client IP address: %v", err)
+		return false, err
+	}
+	ip, _ := netip.ParseAddr(string(clientIP))
+	if s.config.BanList != nil && s.config.BanList.IsBanned(ip) {
+		s.logThrottled(logrus.WarnLevel, clientIP, "connection from banned IP address: %s", clientIP)
+		s.countDenial("ban")
+		return false, fmt.Errorf("connection from banned IP address")
+	} else if s.IsDockerNetwork(ip) {
+		s.config.Logger.Infof("connection from Docker IP address: %s", clientIP)
+	} else if s.IsTailScale(ip) {
+		s.config.Logger.Infof("connection from Tailscale IP address: %s", clientIP)
+	} else if s.isIPAllowed(ip) {
+		s.config.Logger.Infof("connection from allowed address: %s", clientIP)
+	} else if s.config.AllowUntrustedWithAuth || profile != nil && profile.AllowUntrustedWithAuth {
+		s.config.Logger.Infof("connection from untrusted address, requiring authentication: %s", clientIP)
+		requireAuth = true
+	} else {
+		s.logThrottled(logrus.WarnLevel, clientIP, "connection from not allowed IP address: %s", clientIP)
+		s.countDenial("whitelist")
+		return false, fmt.Errorf("connection from not allowed IP address")
+	}
+	if s.config.ReverseLookup {
+		s.lookupClientName(sess)
+	}
+	if profile != nil && profile.RequireAuth {
+		requireAuth = true
+	}
+	return requireAuth, nil
+}
+
+// serveRequest processes a negotiated request and records it in the
+// session and the access log
+func (s *Server) serveRequest(ctx context.Context, sess *Session, conn conn, request *Request) error {
+	if client := addrPort(conn.RemoteAddr()); client.IsValid() {
+		request.remote = AddrSpec{IP: client.Addr().Unmap(), Port: int(client.Port())}
+		request.RemoteAddr = &request.remote
+	}
+	request.localAddr = addrPort(conn.LocalAddr())
+	request.cancel = sess.cancel
+
+	if a := request.AuthContext; a != nil && len(a.Tags) > 0 {
+		ctx = WithTags(ctx, a.Tags)
+		tags := TagsFromContext(ctx)
+		request.tags.Store(&tags)
+	}
+
+	dest := *request.DestAddr
+	s.updateSession(sess, func(sess *Session) {
+		sess.request = request
+		sess.Command = commandNames[request.Command]
+		sess.Dest = &dest
+	})
+
+	if s.config.OnSessionStart != nil {
+		s.config.OnSessionStart(s.sessionInfo(sess, request, nil))
 	}
 
 	// Process the client request
-	if err := s.handleRequest(request, conn); err != nil {
-		err = fmt.Errorf("failed to handle request: %v", err)
-		s.config.Logger.Errorf("socks: %v", err)
+	err := s.handleRequest(ctx, request, conn)
+	s.logAccess(sess, request, err)
+	if s.config.OnSessionEnd != nil {
+		s.config.OnSessionEnd(s.sessionInfo(sess, request, err))
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to handle request: %w", err)
+		s.requestLogger(request).Errorf("socks: %v", err)
 		return err
 	}
 
 	return nil
 }
 
+// IsDockerNetwork reports whether ip belongs to one of Config.DockerNetworks
 func (s *Server) IsDockerNetwork(ip netip.Addr) bool {
-	if !ip.IsValid() || !ip.Is4() {
+	if !ip.IsValid() {
 		return false
 	}
 
-	// Class B private range in CIDR notation: 172.16.0.0/12
-	classBCIDR := netip.MustParsePrefix("172.16.0.0/12")
-
-	return classBCIDR.Contains(ip)
+	ip = ip.Unmap()
+	for _, network := range s.config.DockerNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) IsTailScale(ip netip.Addr) bool {
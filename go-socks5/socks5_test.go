@@ -0,0 +1,486 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// testLogger returns a logger discarding its entries
+func testLogger() *logrus.Logger {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return logger
+}
+
+// listenLoopback listens on network at the loopback address of its
+// family, skipping the test if it is not available
+func listenLoopback(t *testing.T, network string) net.Listener {
+	t.Helper()
+	addr := "127.0.0.1:0"
+	if network == "tcp6" {
+		addr = "[::1]:0"
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("no %s loopback: %v", network, err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// startServer serves conf on a loopback listener of network, trusting
+// the loopback addresses
+func startServer(t *testing.T, network string, conf *Config) net.Addr {
+	t.Helper()
+	_, addr := serveLoopback(t, network, conf)
+	return addr
+}
+
+// serveLoopback is startServer also returning the server
+func serveLoopback(t *testing.T, network string, conf *Config) (*Server, net.Addr) {
+	t.Helper()
+	if conf.Logger == nil {
+		conf.Logger = testLogger()
+	}
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetIPWhitelist([]netip.Addr{netip.MustParseAddr("127.0.0.1"), netip.MustParseAddr("::1")})
+	l := listenLoopback(t, network)
+	go s.Serve(l)
+	return s, l.Addr()
+}
+
+// startEcho serves a TCP echo on a loopback listener of network
+func startEcho(t *testing.T, network string) *net.TCPAddr {
+	t.Helper()
+	l := listenLoopback(t, network)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+// startUDPEcho serves a UDP echo on the loopback address of network,
+// skipping the test if it is not available
+func startUDPEcho(t *testing.T, network string) *net.UDPConn {
+	t.Helper()
+	ip := net.IPv4(127, 0, 0, 1)
+	if network == "udp6" {
+		ip = net.IPv6loopback
+	}
+	c, err := net.ListenUDP(network, &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skipf("no %s loopback: %v", network, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := c.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			c.WriteToUDPAddrPort(buf[:n], from)
+		}
+	}()
+	return c
+}
+
+// dialProxy connects to the proxy at addr and negotiates no
+// authentication
+func dialProxy(t *testing.T, addr net.Addr) net.Conn {
+	t.Helper()
+	return dialProxyMethod(t, addr, NoAuth)
+}
+
+// dialProxyMethod connects to the proxy at addr and offers only method,
+// which the proxy must select
+func dialProxyMethod(t *testing.T, addr net.Addr, method uint8) net.Conn {
+	t.Helper()
+	c, err := net.Dial(addr.Network(), addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte{socks5Version, 1, method}); err != nil {
+		t.Fatal(err)
+	}
+	selected := make([]byte, 2)
+	if _, err := io.ReadFull(c, selected); err != nil {
+		t.Fatal(err)
+	}
+	if selected[1] != method {
+		t.Fatalf("got method %#x, want %#x", selected[1], method)
+	}
+	return c
+}
+
+// sendRequest sends a request of cmd to dest, in the encoding of
+// formatAddr
+func sendRequest(t *testing.T, c net.Conn, cmd uint8, dest []byte) {
+	t.Helper()
+	if _, err := c.Write(append([]byte{socks5Version, cmd, 0}, dest...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readReply reads a reply, returning its code and address
+func readReply(t *testing.T, c net.Conn) (uint8, *AddrSpec) {
+	t.Helper()
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(c, header); err != nil {
+		t.Fatal(err)
+	}
+	var addr AddrSpec
+	if err := readAddrSpec(c, &addr); err != nil {
+		t.Fatal(err)
+	}
+	return header[1], &addr
+}
+
+// encodeAddr encodes addr like formatAddr, failing the test on errors
+func encodeAddr(t *testing.T, addr *AddrSpec) []byte {
+	t.Helper()
+	b, err := formatAddr(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// fqdn encodes name as a domain name destination
+func fqdn(name string, port int) []byte {
+	return append(append([]byte{fqdnAddress, byte(len(name))}, name...), byte(port>>8), byte(port))
+}
+
+// ipv6Dest encodes ip and port as an IPv6 destination, keeping
+// IPv4-mapped addresses in the IPv6 encoding unlike formatAddr
+func ipv6Dest(ip netip.Addr, port int) []byte {
+	b := ip.As16()
+	return append(append([]byte{ipv6Address}, b[:]...), byte(port>>8), byte(port))
+}
+
+// echoThrough checks that data sent on c comes back
+func echoThrough(t *testing.T, c net.Conn) {
+	t.Helper()
+	msg := []byte("hello over IPv6")
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("got %q, want %q", got, msg)
+	}
+}
+
+// failResolver fails every lookup, for requests that must not be resolved
+type failResolver struct{}
+
+func (failResolver) Resolve(ctx context.Context, name string) (context.Context, netip.Addr, error) {
+	return ctx, netip.Addr{}, errors.New("unexpected lookup of " + name)
+}
+
+func TestConnectIPv6(t *testing.T) {
+	echo6 := startEcho(t, "tcp6")
+	echo4 := startEcho(t, "tcp4")
+	proxy := startServer(t, "tcp6", &Config{Resolver: failResolver{}})
+
+	tests := []struct {
+		name     string
+		dest     []byte
+		wantBind netip.Addr
+	}{
+		{"IPv6", ipv6Dest(echo6.AddrPort().Addr(), echo6.Port), netip.MustParseAddr("::1")},
+		{"bracketed IPv6 literal", fqdn("[::1]", echo6.Port), netip.MustParseAddr("::1")},
+		{"IPv6 literal", fqdn("::1", echo6.Port), netip.MustParseAddr("::1")},
+		{"IPv4-mapped IPv6", ipv6Dest(netip.MustParseAddr("::ffff:127.0.0.1"), echo4.Port), netip.MustParseAddr("127.0.0.1")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialProxy(t, proxy)
+			sendRequest(t, c, ConnectCommand, tt.dest)
+			code, bind := readReply(t, c)
+			if code != SuccessReply {
+				t.Fatalf("got reply %d, want success", code)
+			}
+			if bind.IP != tt.wantBind || bind.Port == 0 {
+				t.Fatalf("got BND.ADDR %v, want %v", bind, tt.wantBind)
+			}
+			echoThrough(t, c)
+		})
+	}
+}
+
+func TestBindIPv6(t *testing.T) {
+	proxy := startServer(t, "tcp6", &Config{})
+	c := dialProxy(t, proxy)
+	sendRequest(t, c, BindCommand, ipv6Dest(netip.MustParseAddr("::1"), 0))
+	code, bind := readReply(t, c)
+	if code != SuccessReply || bind.IP != netip.MustParseAddr("::1") || bind.Port == 0 {
+		t.Fatalf("got first reply %d %v, want success on [::1]", code, bind)
+	}
+
+	peer, err := net.Dial("tcp6", bind.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	code, from := readReply(t, c)
+	if code != SuccessReply || from.IP != netip.MustParseAddr("::1") || from.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("got second reply %d %v, want success from %v", code, from, peer.LocalAddr())
+	}
+
+	go io.Copy(peer, peer)
+	echoThrough(t, c)
+}
+
+func TestAssociateIPv6(t *testing.T) {
+	proxy := startServer(t, "tcp6", &Config{})
+	target := startUDPEcho(t, "udp6")
+
+	c := dialProxy(t, proxy)
+	sendRequest(t, c, AssociateCommand, ipv6Dest(netip.IPv6Unspecified(), 0))
+	code, relay := readReply(t, c)
+	if code != SuccessReply || relay.IP != netip.MustParseAddr("::1") || relay.Port == 0 {
+		t.Fatalf("got reply %d %v, want success on [::1]", code, relay)
+	}
+
+	client, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	dest := encodeAddr(t, &AddrSpec{IP: netip.MustParseAddr("::1"), Port: target.LocalAddr().(*net.UDPAddr).Port})
+	datagram := append(append([]byte{0, 0, 0}, dest...), "ping"...)
+	if _, err := client.WriteToUDPAddrPort(datagram, netip.AddrPortFrom(relay.IP, uint16(relay.Port))); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], datagram) {
+		t.Fatalf("got datagram % x, want % x", buf[:n], datagram)
+	}
+}
+
+func TestUDPOverTCP(t *testing.T) {
+	s, proxy := serveLoopback(t, "tcp4", &Config{UDPOverTCP: true})
+	c := dialProxy(t, proxy)
+	sendRequest(t, c, UDPOverTCPCommand, encodeAddr(t, &AddrSpec{IP: netip.IPv4Unspecified()}))
+	if code, bind := readReply(t, c); code != SuccessReply || !bind.IP.IsUnspecified() || bind.Port != 0 {
+		t.Fatalf("got reply %d %v, want success without a relay", code, bind)
+	}
+	if assocs := s.UDPAssociations(); len(assocs) != 1 || assocs[0].Relay.IsValid() {
+		t.Fatalf("got associations %+v, want one without a relay", assocs)
+	}
+
+	for _, network := range []string{"udp4", "udp6"} {
+		t.Run(network, func(t *testing.T) {
+			target := startUDPEcho(t, network)
+			addr := target.LocalAddr().(*net.UDPAddr).AddrPort()
+			dest := encodeAddr(t, &AddrSpec{IP: addr.Addr(), Port: int(addr.Port())})
+			payload := []byte("ping over " + network)
+			frame := append(append([]byte{0, byte(len(payload)), 0}, dest...), payload...)
+			if _, err := c.Write(frame); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(frame))
+			if _, err := io.ReadFull(c, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, frame) {
+				t.Fatalf("got frame % x, want % x", got, frame)
+			}
+		})
+	}
+}
+
+// denyPrefixes is a RuleSet denying destinations in its prefixes and
+// recording the IP addresses it was asked about
+type denyPrefixes struct {
+	prefixes []netip.Prefix
+	seen     chan netip.Addr
+}
+
+func (d *denyPrefixes) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	d.seen <- req.DestAddr.IP
+	for _, prefix := range d.prefixes {
+		if prefix.Contains(req.DestAddr.IP) {
+			return ctx, false
+		}
+	}
+	return ctx, true
+}
+
+func TestRulesIPv6(t *testing.T) {
+	rules := &denyPrefixes{
+		prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("2001:db8::/32")},
+		seen:     make(chan netip.Addr, 1),
+	}
+	proxy := startServer(t, "tcp6", &Config{Rules: DenyCloudMetadata(rules), Resolver: failResolver{}})
+
+	tests := []struct {
+		name     string
+		dest     []byte
+		wantSeen string // empty if the request must be denied before rules
+	}{
+		{"IPv6", ipv6Dest(netip.MustParseAddr("2001:db8::1"), 80), "2001:db8::1"},
+		{"IPv4-mapped IPv6", ipv6Dest(netip.MustParseAddr("::ffff:192.0.2.1"), 80), "192.0.2.1"},
+		{"bracketed IPv6 literal", fqdn("[2001:db8::1]", 80), "2001:db8::1"},
+		{"IPv4-mapped literal", fqdn("::ffff:192.0.2.1", 80), "192.0.2.1"},
+		{"zoned IPv6 literal", fqdn("[2001:db8::1%lo]", 80), "2001:db8::1"},
+		{"cloud metadata", ipv6Dest(netip.MustParseAddr("fd00:ec2::254"), 80), ""},
+		{"zoned cloud metadata literal", fqdn("fd00:ec2::254%eth0", 80), ""},
+		{"IPv4-mapped cloud metadata", ipv6Dest(netip.MustParseAddr("::ffff:169.254.169.254"), 80), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := dialProxy(t, proxy)
+			sendRequest(t, c, ConnectCommand, tt.dest)
+			if code, _ := readReply(t, c); code != RuleFailure {
+				t.Fatalf("got reply %d, want rule failure", code)
+			}
+			select {
+			case ip := <-rules.seen:
+				if tt.wantSeen == "" || ip != netip.MustParseAddr(tt.wantSeen) {
+					t.Fatalf("rules got %v, want %q", ip, tt.wantSeen)
+				}
+			default:
+				if tt.wantSeen != "" {
+					t.Fatalf("rules were not asked about %s", tt.wantSeen)
+				}
+			}
+		})
+	}
+}
+
+// staticResolver resolves every name to its addresses
+type staticResolver []netip.Addr
+
+func (r staticResolver) Resolve(ctx context.Context, name string) (context.Context, netip.Addr, error) {
+	return ctx, r[0], nil
+}
+
+func (r staticResolver) ResolveAll(ctx context.Context, name string) (context.Context, []netip.Addr, error) {
+	return ctx, r, nil
+}
+
+func TestConnectFallback(t *testing.T) {
+	echo := startEcho(t, "tcp4")
+	// Nothing listens on the port of the echo at the other loopback
+	// addresses, so connects to them are refused
+	refused := netip.MustParseAddr("127.0.0.2")
+	denied := netip.MustParseAddr("127.0.0.3")
+	tests := []struct {
+		name     string
+		addrs    staticResolver
+		wantCode uint8
+		wantSeen int // number of addresses the rules are asked about
+	}{
+		{"first address", staticResolver{echo.AddrPort().Addr(), refused, denied}, SuccessReply, 1},
+		{"next address after refused and denied ones", staticResolver{refused, denied, echo.AddrPort().Addr()}, SuccessReply, 3},
+		{"denied address is not dialed", staticResolver{refused, denied}, ConnectionRefused, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := &denyPrefixes{
+				prefixes: []netip.Prefix{netip.PrefixFrom(denied, 32)},
+				seen:     make(chan netip.Addr, len(tt.addrs)+1),
+			}
+			proxy := startServer(t, "tcp4", &Config{Rules: rules, Resolver: tt.addrs})
+			c := dialProxy(t, proxy)
+			sendRequest(t, c, ConnectCommand, fqdn("example.com", echo.Port))
+			if code, _ := readReply(t, c); code != tt.wantCode {
+				t.Fatalf("got reply %d, want %d", code, tt.wantCode)
+			}
+			if tt.wantCode == SuccessReply {
+				echoThrough(t, c)
+			}
+			// The rules are asked once about every address to dial, in order
+			close(rules.seen)
+			var seen []netip.Addr
+			for ip := range rules.seen {
+				seen = append(seen, ip)
+			}
+			if want := tt.addrs[:tt.wantSeen]; !slices.Equal(seen, want) {
+				t.Errorf("rules got %v, want %v", seen, want)
+			}
+		})
+	}
+}
+
+// pipeConn is one end of a net.Pipe with TCP addresses, as admission
+// control requires
+type pipeConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c pipeConn) LocalAddr() net.Addr  { return c.local }
+func (c pipeConn) RemoteAddr() net.Addr { return c.remote }
+
+func BenchmarkServeConnHandshake(b *testing.B) {
+	s, err := New(&Config{
+		Logger: testLogger(),
+		// Deny every request so that only the negotiation is measured
+		Rules: PermitNone(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	s.SetIPWhitelist([]netip.Addr{netip.MustParseAddr("127.0.0.1")})
+
+	msg := []byte{
+		socks5Version, 1, NoAuth,
+		socks5Version, ConnectCommand, 0, ipv4Address, 127, 0, 0, 1, 0, 80,
+	}
+	reply := make([]byte, 2+10)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		client, server := net.Pipe()
+		done := make(chan struct{})
+		go func() {
+			s.ServeConn(pipeConn{server, tcpAddr("127.0.0.1:1080"), tcpAddr("127.0.0.1:50000")})
+			close(done)
+		}()
+		// net.Pipe writes block until they are read, the server reads
+		// the request after sending its method
+		go client.Write(msg)
+		if _, err := io.ReadFull(client, reply); err != nil {
+			b.Fatal(err)
+		}
+		if reply[1] != NoAuth || reply[3] != RuleFailure {
+			b.Fatalf("unexpected replies % x", reply)
+		}
+		client.Close()
+		<-done
+	}
+}
@@ -0,0 +1,199 @@
+package socks5
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the server's runtime counters
+type Stats struct {
+	// ActiveSessions is the number of connections currently served
+	ActiveSessions int `json:"active_sessions"`
+	// TotalSessions is the number of connections accepted since start
+	TotalSessions uint64 `json:"total_sessions"`
+	// BytesUp is the payload relayed from clients to destinations. TCP
+	// tunnels are counted once a direction closes, UDP per datagram.
+	BytesUp uint64 `json:"bytes_up"`
+	// BytesDown is the payload relayed from destinations to clients
+	BytesDown uint64 `json:"bytes_down"`
+	// Denied is the number of connections and requests rejected by the
+	// ban list, the whitelist or the RuleSet
+	Denied uint64 `json:"denied"`
+	// DeniedBy counts denials by rule: "ban", "whitelist", "auth_required",
+	// "accept_rate", "overload", "negotiation_timeout", "slow_negotiation"
+	// or the rule of the DenyReason set by the RuleSet
+	DeniedBy map[string]uint64 `json:"denied_by"`
+	// Tags is the traffic of finished requests by "key=value" tag, see
+	// WithTags
+	Tags map[string]TagStats `json:"tags,omitempty"`
+	// AuthFailures is the number of failed authentications,
+	// AuthFailuresCached those rejected by a FailureCache without asking
+	// its credential store
+	AuthFailures       uint64 `json:"auth_failures"`
+	AuthFailuresCached uint64 `json:"auth_failures_cached"`
+	// Panics is the number of panics recovered while serving connections
+	Panics uint64 `json:"panics"`
+	// Requests is the number of requests served, RequestErrors those that
+	// failed or were denied
+	Requests      uint64 `json:"requests"`
+	RequestErrors uint64 `json:"request_errors"`
+	// AccessLogsSkipped is the number of successful requests left out of
+	// the access log by Config.AccessLogSampleRate
+	AccessLogsSkipped uint64 `json:"access_logs_skipped"`
+	// IdleReaped is the number of tunnels closed for being idle beyond
+	// their timeout, IdleSessions the distribution of the idle time of
+	// the open ones with a timeout
+	IdleReaped   uint64       `json:"idle_reaped"`
+	IdleSessions []IdleBucket `json:"idle_sessions"`
+	// UDPAssociations is the number of active UDP associations
+	UDPAssociations int `json:"udp_associations"`
+	// UDPFragmentsDropped is the number of dropped UDP datagram fragments
+	UDPFragmentsDropped uint64 `json:"udp_fragments_dropped"`
+	// UDPDatagramsUp and UDPDatagramsDown are the UDP datagrams relayed
+	// from clients to destinations and back
+	UDPDatagramsUp   uint64 `json:"udp_datagrams_up"`
+	UDPDatagramsDown uint64 `json:"udp_datagrams_down"`
+	// UDPDroppedBy counts the UDP datagrams dropped by cause: "policy",
+	// "size" for exceeding Config.UDPMaxDatagram, "rate_limit",
+	// "resolve", "malformed", "no_client", "unsolicited" for datagrams
+	// from addresses the client did not send to, or "send"
+	UDPDroppedBy map[string]uint64 `json:"udp_dropped_by"`
+	// DNSCache are the counters of the Config.Resolver if it is a
+	// CachingResolver
+	DNSCache *DNSCacheStats `json:"dns_cache,omitempty"`
+	// Overload are the last pressure readings if Config.Overload is set
+	Overload *OverloadStats `json:"overload,omitempty"`
+}
+
+// serverStats holds the counters of a Server not tracked elsewhere
+type serverStats struct {
+	bytesUp      atomic.Uint64
+	bytesDown    atomic.Uint64
+	denied       atomic.Uint64
+	authFailures atomic.Uint64
+	panics       atomic.Uint64
+
+	requests          atomic.Uint64
+	requestErrors     atomic.Uint64
+	accessLogsSkipped atomic.Uint64
+	successes         atomic.Uint64
+	idleReaped        atomic.Uint64
+	udp               udpCounters
+
+	mu       sync.Mutex
+	deniedBy map[string]uint64
+	tags     map[string]*TagStats
+}
+
+// countUp counts n bytes relayed from the client of req to destinations
+func (s *Server) countUp(req *Request, n uint64) {
+	s.stats.bytesUp.Add(n)
+	req.bytesUp.Add(n)
+	s.chargeQuota(req, n)
+}
+
+// countDown counts n bytes relayed from destinations to the client of req
+func (s *Server) countDown(req *Request, n uint64) {
+	s.stats.bytesDown.Add(n)
+	req.bytesDown.Add(n)
+	s.chargeQuota(req, n)
+}
+
+// countDenial counts a connection or request denied by rule
+func (s *Server) countDenial(rule string) {
+	s.stats.denied.Add(1)
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if s.stats.deniedBy == nil {
+		s.stats.deniedBy = make(map[string]uint64)
+	}
+	s.stats.deniedBy[rule]++
+}
+
+// RestoreStats adds the cumulative counters of st, e.g. saved before a
+// restart, to the server's counters. Gauges like ActiveSessions are
+// ignored.
+func (s *Server) RestoreStats(st Stats) {
+	s.nextSessionID.Add(st.TotalSessions)
+	s.stats.bytesUp.Add(st.BytesUp)
+	s.stats.bytesDown.Add(st.BytesDown)
+	s.stats.denied.Add(st.Denied)
+	s.stats.authFailures.Add(st.AuthFailures)
+	s.stats.requests.Add(st.Requests)
+	s.stats.requestErrors.Add(st.RequestErrors)
+	s.stats.accessLogsSkipped.Add(st.AccessLogsSkipped)
+	s.stats.idleReaped.Add(st.IdleReaped)
+	s.udpFragmentsDropped.Add(st.UDPFragmentsDropped)
+	s.stats.udp.datagramsUp.Add(st.UDPDatagramsUp)
+	s.stats.udp.datagramsDown.Add(st.UDPDatagramsDown)
+	for cause, name := range udpDropNames {
+		s.stats.udp.dropped[cause].Add(st.UDPDroppedBy[name])
+	}
+
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if s.stats.deniedBy == nil {
+		s.stats.deniedBy = make(map[string]uint64)
+	}
+	for rule, n := range st.DeniedBy {
+		s.stats.deniedBy[rule] += n
+	}
+	if len(st.Tags) > 0 && s.stats.tags == nil {
+		s.stats.tags = make(map[string]*TagStats)
+	}
+	for label, t := range st.Tags {
+		if s.stats.tags[label] == nil {
+			s.stats.tags[label] = &TagStats{}
+		}
+		s.stats.tags[label].Requests += t.Requests
+		s.stats.tags[label].BytesUp += t.BytesUp
+		s.stats.tags[label].BytesDown += t.BytesDown
+	}
+}
+
+// Stats returns a snapshot of the server's runtime counters
+func (s *Server) Stats() Stats {
+	s.stats.mu.Lock()
+	deniedBy := make(map[string]uint64, len(s.stats.deniedBy))
+	for rule, n := range s.stats.deniedBy {
+		deniedBy[rule] = n
+	}
+	var tags map[string]TagStats
+	if len(s.stats.tags) > 0 {
+		tags = make(map[string]TagStats, len(s.stats.tags))
+		for label, t := range s.stats.tags {
+			tags[label] = *t
+		}
+	}
+	s.stats.mu.Unlock()
+	var dnsCache *DNSCacheStats
+	if c, ok := s.config.Resolver.(*CachingResolver); ok {
+		st := c.CacheStats()
+		dnsCache = &st
+	}
+
+	return Stats{
+		ActiveSessions:      s.ActiveConnections(),
+		TotalSessions:       s.nextSessionID.Load(),
+		BytesUp:             s.stats.bytesUp.Load(),
+		BytesDown:           s.stats.bytesDown.Load(),
+		Denied:              s.stats.denied.Load(),
+		DeniedBy:            deniedBy,
+		Tags:                tags,
+		AuthFailures:        s.stats.authFailures.Load(),
+		AuthFailuresCached:  s.authFailuresCached(),
+		Panics:              s.stats.panics.Load(),
+		Requests:            s.stats.requests.Load(),
+		RequestErrors:       s.stats.requestErrors.Load(),
+		AccessLogsSkipped:   s.stats.accessLogsSkipped.Load(),
+		IdleReaped:          s.stats.idleReaped.Load(),
+		IdleSessions:        s.idleSessions(),
+		UDPAssociations:     int(s.udpAssociations.Load()),
+		UDPFragmentsDropped: s.udpFragmentsDropped.Load(),
+		UDPDatagramsUp:      s.stats.udp.datagramsUp.Load(),
+		UDPDatagramsDown:    s.stats.udp.datagramsDown.Load(),
+		UDPDroppedBy:        s.stats.udp.droppedBy(),
+		DNSCache:            dnsCache,
+		Overload:            s.overloadStats(),
+	}
+}
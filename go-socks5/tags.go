@@ -0,0 +1,86 @@
+package socks5
+
+import (
+	"context"
+	"maps"
+	"slices"
+)
+
+// maxTagStats bounds the tag values counted in Stats.Tags, further ones
+// are counted as "(other)"
+const maxTagStats = 1000
+
+type tagsKey struct{}
+
+// TagStats is the traffic of the requests carrying a tag
+type TagStats struct {
+	Requests  uint64 `json:"requests"`
+	BytesUp   uint64 `json:"bytes_up"`
+	BytesDown uint64 `json:"bytes_down"`
+}
+
+// WithTags returns a context carrying key/value tags of the session, e.g.
+// its tenant or environment, added to those already attached. Tags of
+// the context returned by the RuleSet appear in the access log, the
+// session list and Stats.Tags.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	merged := maps.Clone(TagsFromContext(ctx))
+	if merged == nil {
+		merged = make(map[string]string, len(tags))
+	}
+	maps.Copy(merged, tags)
+	return context.WithValue(ctx, tagsKey{}, merged)
+}
+
+// TagsFromContext returns the tags attached with WithTags, or those set by
+// the authenticator in AuthContext.Tags. The map must not be modified.
+func TagsFromContext(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(tagsKey{}).(map[string]string)
+	return tags
+}
+
+// allow passes req through the RuleSet and records the tags of its
+// verdict in the request
+func (s *Server) allow(ctx context.Context, req *Request) (context.Context, bool) {
+	ctx, ok := s.allowRules(ctx, req)
+	if tags := TagsFromContext(ctx); len(tags) > 0 {
+		req.tags.Store(&tags)
+	}
+	return ctx, ok
+}
+
+// Tags returns the tags of the request
+func (r *Request) Tags() map[string]string {
+	if tags := r.tags.Load(); tags != nil {
+		return *tags
+	}
+	return nil
+}
+
+// countTags adds a finished request to the traffic of its tags
+func (s *Server) countTags(req *Request) {
+	tags := req.Tags()
+	if len(tags) == 0 {
+		return
+	}
+	s.stats.mu.Lock()
+	defer s.stats.mu.Unlock()
+	if s.stats.tags == nil {
+		s.stats.tags = make(map[string]*TagStats)
+	}
+	for _, key := range slices.Sorted(maps.Keys(tags)) {
+		label := key + "=" + tags[key]
+		t, found := s.stats.tags[label]
+		if !found && len(s.stats.tags) >= maxTagStats {
+			label = "(other)"
+			t, found = s.stats.tags[label]
+		}
+		if !found {
+			t = &TagStats{}
+			s.stats.tags[label] = t
+		}
+		t.Requests++
+		t.BytesUp += req.bytesUp.Load()
+		t.BytesDown += req.bytesDown.Load()
+	}
+}
@@ -0,0 +1,25 @@
+package socks5
+
+import "time"
+
+// Timeouts bound the phases of a connection, whose sensible values
+// differ by orders of magnitude: seconds for negotiating and dialing,
+// hours for established tunnels. Zero values mean unlimited.
+type Timeouts struct {
+	// Negotiation bounds the handshake, authentication and request of a
+	// connection, from accepting it until its request is read
+	Negotiation time.Duration
+
+	// Dial bounds each attempt to connect to an address of the
+	// destination of a CONNECT
+	Dial time.Duration
+
+	// Idle closes tunnels that relayed no data in either direction for
+	// this long. RuleSets can override it per request with
+	// WithIdleTimeout.
+	Idle time.Duration
+
+	// Max closes tunnels after they have been open this long. RuleSets
+	// can override it per request with WithMaxTunnelDuration.
+	Max time.Duration
+}
@@ -0,0 +1,220 @@
+package socks5
+
+import (
+	"encoding/hex"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// traceState is the field of the negotiation expected next from the
+// client
+type traceState int
+
+const (
+	traceGreeting traceState = iota
+	traceMethods
+	traceMethod
+	traceUserVersion
+	traceUserLen
+	traceUser
+	tracePassLen
+	tracePass
+	traceOpaqueAuth
+	traceRequestHeader
+	traceRequestDomainLen
+	traceRequestAddr
+	traceDone
+)
+
+// negotiationTrace is a connection of a client in Config.TraceClients
+// hex-dumping what it reads and writes to the Logger, from the method
+// selection to the reply to the request. Passwords are redacted, as are
+// the bytes of authentication methods other than "auth-less" and
+// username/password.
+type negotiationTrace struct {
+	net.Conn
+	log *logrus.Entry
+
+	mu sync.Mutex
+	// state is the field of the client stream being read, need the bytes
+	// left of it
+	state traceState
+	need  int
+	// pending holds client bytes read ahead of the method selection,
+	// which decides how they are decoded
+	pending []byte
+	// requested and replied are set once the request was read and its
+	// reply written
+	requested, replied bool
+}
+
+// traced reports whether the negotiation of client is traced
+func (s *Server) traced(client netip.Addr) bool {
+	for _, prefix := range s.config.TraceClients {
+		if prefix.Contains(client) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceNegotiation returns conn tracing the negotiation of sess
+func (s *Server) traceNegotiation(sess *Session, conn net.Conn) *negotiationTrace {
+	return &negotiationTrace{
+		Conn:  conn,
+		log:   s.config.Logger.WithFields(logrus.Fields{"session": sess.ID, "client": sess.Client.String()}),
+		state: traceGreeting,
+		need:  2,
+	}
+}
+
+func (t *negotiationTrace) Read(p []byte) (int, error) {
+	n, err := t.Conn.Read(p)
+	if n > 0 {
+		t.mu.Lock()
+		t.client(p[:n])
+		t.mu.Unlock()
+	}
+	return n, err
+}
+
+func (t *negotiationTrace) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	if !t.replied {
+		t.server(p)
+	}
+	t.mu.Unlock()
+	return t.Conn.Write(p)
+}
+
+func (t *negotiationTrace) CloseWrite() error {
+	if cw, ok := t.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// client dumps bytes read from the client, redacted, up to the end of
+// the request
+func (t *negotiationTrace) client(data []byte) {
+	if t.state == traceDone {
+		return
+	}
+	if t.state == traceMethod {
+		t.pending = append(t.pending, data...)
+		return
+	}
+	dump := make([]byte, 0, len(data))
+	redacted := 0
+	for len(data) > 0 && t.state != traceDone && t.state != traceMethod {
+		n := min(t.need, len(data))
+		if t.state == traceOpaqueAuth {
+			n = len(data)
+		}
+		field := data[:n]
+		data = data[n:]
+		if t.state == tracePass || t.state == traceOpaqueAuth {
+			for range field {
+				dump = append(dump, 'x')
+			}
+			redacted += n
+		} else {
+			dump = append(dump, field...)
+		}
+		if t.need -= n; t.need == 0 || t.state == traceOpaqueAuth {
+			t.next(field)
+		}
+	}
+	if t.state == traceMethod && len(data) > 0 {
+		t.pending = append(t.pending, data...)
+	}
+	t.dump("client", dump, redacted)
+}
+
+// next advances the state once the field ending with last was read
+func (t *negotiationTrace) next(last []byte) {
+	switch t.state {
+	case traceGreeting:
+		t.state, t.need = traceMethods, int(last[len(last)-1])
+		if t.need == 0 {
+			t.state = traceMethod
+		}
+	case traceMethods:
+		t.state = traceMethod
+	case traceUserVersion:
+		t.state, t.need = traceUserLen, 1
+	case traceUserLen:
+		t.state, t.need = traceUser, int(last[0])
+	case traceUser:
+		t.state, t.need = tracePassLen, 1
+	case tracePassLen:
+		t.state, t.need = tracePass, int(last[0])
+	case tracePass:
+		t.state, t.need = traceRequestHeader, 4
+	case traceRequestHeader:
+		switch last[len(last)-1] {
+		case ipv4Address:
+			t.state, t.need = traceRequestAddr, 4+2
+		case ipv6Address:
+			t.state, t.need = traceRequestAddr, 16+2
+		case fqdnAddress:
+			t.state, t.need = traceRequestDomainLen, 1
+		default:
+			t.state = traceDone
+		}
+	case traceRequestDomainLen:
+		t.state, t.need = traceRequestAddr, int(last[0])+2
+	case traceRequestAddr:
+		t.state = traceDone
+	}
+	if t.need == 0 && t.state != traceDone && t.state != traceMethod && t.state != traceOpaqueAuth {
+		// Zero length fields end immediately
+		t.next(nil)
+	}
+}
+
+// server dumps bytes written to the client, the method selection decides
+// how the client bytes following the greeting are decoded
+func (t *negotiationTrace) server(data []byte) {
+	t.dump("server", data, 0)
+	switch {
+	case t.state == traceMethod && len(data) == 2:
+		switch data[1] {
+		case NoAuth:
+			t.state, t.need = traceRequestHeader, 4
+		case UserPassAuth:
+			t.state, t.need = traceUserVersion, 1
+		default:
+			t.state = traceOpaqueAuth
+		}
+		pending := t.pending
+		t.pending = nil
+		if len(pending) > 0 {
+			t.client(pending)
+		}
+	case t.requested:
+		t.replied = true
+	}
+}
+
+// requestRead marks the request as read, the next write being its reply
+func (t *negotiationTrace) requestRead() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.state, t.requested = traceDone, true
+}
+
+// dump logs data sent by from, of which redacted bytes are masked
+func (t *negotiationTrace) dump(from string, data []byte, redacted int) {
+	if len(data) == 0 {
+		return
+	}
+	log := t.log.WithField("from", from)
+	if redacted > 0 {
+		log = log.WithField("redacted", redacted)
+	}
+	log.Infof("negotiation trace, %d bytes:\n%s", len(data), hex.Dump(data))
+}
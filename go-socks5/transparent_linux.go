@@ -0,0 +1,91 @@
+//go:build linux
+
+package socks5
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ip6tSoOriginalDst is IP6T_SO_ORIGINAL_DST, the IPv6 counterpart of
+// SO_ORIGINAL_DST
+const ip6tSoOriginalDst = 80
+
+// ListenTransparent listens on a TCP address for connections redirected
+// by the firewall, to be served with ServeTransparent. With tproxy set the
+// socket is marked IP_TRANSPARENT for TPROXY rules, which requires
+// CAP_NET_ADMIN, otherwise REDIRECT rules are expected.
+func ListenTransparent(address string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var sockErr error
+			err := c.Control(func(fd uintptr) {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1); sockErr != nil {
+					return
+				}
+				if network == "tcp6" || network == "tcp" {
+					// Ignored on IPv4 only sockets
+					unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+				}
+			})
+			if err != nil {
+				return err
+			}
+			if sockErr != nil {
+				return fmt.Errorf("failed to set IP_TRANSPARENT: %v", sockErr)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// originalDst returns the destination a redirected connection was
+// originally sent to. Connections without a NAT entry, as received through
+// TPROXY, already carry it as their local address.
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	local := addrPort(conn.LocalAddr())
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return local, nil
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Unmap().Is4() {
+			var mreq *unix.IPv6Mreq
+			if mreq, sockErr = unix.GetsockoptIPv6Mreq(int(fd), unix.SOL_IP, unix.SO_ORIGINAL_DST); sockErr == nil {
+				// struct sockaddr_in: family, port, address
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+		var info *unix.IPv6MTUInfo
+		if info, sockErr = unix.GetsockoptIPv6MTUInfo(int(fd), unix.SOL_IPV6, ip6tSoOriginalDst); sockErr == nil {
+			// Port is stored in network byte order
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if sockErr != nil {
+		return local, nil
+	}
+	return dst, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+package socks5
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// ListenTransparent is only supported on Linux
+func ListenTransparent(address string, tproxy bool) (net.Listener, error) {
+	return nil, errors.New("transparent proxying is only supported on Linux")
+}
+
+// originalDst is only supported on Linux
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.New("transparent proxying is only supported on Linux")
+}
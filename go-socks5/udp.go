@@ -0,0 +1,600 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxUDPDatagram is the largest datagram the relay reads unless
+	// Config.UDPMaxDatagram is set
+	maxUDPDatagram = 65535
+
+	// defaultUDPIdleTimeout is used when Config.UDPIdleTimeout is not set
+	defaultUDPIdleTimeout = 2 * time.Minute
+
+	// maxUDPRuleCache bounds the per association cache of rule verdicts
+	maxUDPRuleCache = 1024
+)
+
+// udpAssociation relays datagrams between a client and its destinations
+// over a single UDP socket, or over the control connection and a socket
+// per destination for UDP over TCP
+type udpAssociation struct {
+	server   *Server
+	logger   logrus.FieldLogger
+	req      *Request
+	relay    *net.UDPConn
+	clientIP netip.Addr
+	client   netip.AddrPort
+	limiter  *tokenBucket
+
+	// mu guards peers, conns, fragments and verdicts, used by the
+	// goroutine of the control connection of a UDP over TCP association
+	// too
+	mu sync.Mutex
+
+	// clientPort is the port the client declared to send from, zero if
+	// any port of clientIP is accepted
+	clientPort uint16
+
+	// peers are the addresses and ports the client sent datagrams to,
+	// the only ones whose datagrams are relayed back unless
+	// Config.UDPPermissive
+	peers map[netip.AddrPort]struct{}
+
+	// stream is the control connection of a UDP over TCP association,
+	// which carries the client datagrams instead of relay. streamMu
+	// serializes the datagrams written to it.
+	stream   io.Writer
+	streamMu sync.Mutex
+
+	// conns are the sockets of a UDP over TCP association, which has no
+	// relay, each connected to a destination so that only its datagrams
+	// are received. nil once the association is closed.
+	conns map[netip.AddrPort]*net.UDPConn
+
+	// active is signalled by the datagrams of a UDP over TCP association,
+	// which is closed once idle
+	active chan struct{}
+
+	// fragments is the reassembly queue of the current fragment sequence
+	fragments *udpReassembly
+
+	// verdicts caches the RuleSet decision per destination
+	verdicts map[string]bool
+
+	start    time.Time
+	counters udpCounters
+}
+
+// udpReassembly collects the fragments of a datagram, see RFC 1928 section 7
+type udpReassembly struct {
+	dest    *AddrSpec
+	data    []byte
+	last    uint8 // position of the last fragment queued
+	count   uint64
+	started time.Time
+}
+
+// handleAssociate is used to handle an associate command
+func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
+	// Check if this is allowed
+	if ctx_, ok := s.allow(ctx, req); !ok {
+		if err := sendReply(conn, s.deny(ctx_, req), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return denyError("associate", req)
+	} else {
+		ctx = ctx_
+	}
+
+	// Enforce the association limit
+	if max := s.config.MaxUDPAssociations; max > 0 {
+		if int(s.udpAssociations.Add(1)) > max {
+			s.udpAssociations.Add(-1)
+			if err := sendReply(conn, ServerFailure, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("associate rejected: limit of %d UDP associations reached", max)
+		}
+	} else {
+		s.udpAssociations.Add(1)
+	}
+	defer s.udpAssociations.Add(-1)
+
+	assoc := &udpAssociation{
+		server:   s,
+		logger:   s.requestLogger(req),
+		req:      req,
+		verdicts: make(map[string]bool),
+		start:    time.Now(),
+	}
+	assoc.clientIP = addrPort(conn.RemoteAddr()).Addr().Unmap()
+	var bind *AddrSpec
+	if req.Command == UDPOverTCPCommand {
+		// Datagrams come over the control connection, the client gets no
+		// relay socket
+		assoc.stream = conn
+		assoc.client = addrPort(conn.RemoteAddr())
+		assoc.conns = make(map[netip.AddrPort]*net.UDPConn)
+		assoc.active = make(chan struct{}, 1)
+	} else {
+		// Open the relay socket
+		relay, err := s.listenUDP(s.bindIP(conn))
+		if err != nil {
+			if err := sendReply(conn, ServerFailure, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("failed to open UDP relay: %v", err)
+		}
+		defer relay.Close()
+		if err := s.setUDPBuffers(relay); err != nil {
+			s.requestLogger(req).Warnf("failed to set UDP relay buffers: %v", err)
+		}
+		assoc.relay = relay
+		bind = s.replyAddr(conn, relay.LocalAddr())
+
+		if !s.config.UDPPermissive {
+			// Only accept datagrams from the address the client declared
+			// to send from, see RFC 1928 section 6
+			if ip := req.DestAddr.IP.Unmap(); ip.IsValid() && !ip.IsUnspecified() {
+				assoc.clientIP = ip
+			}
+			assoc.clientPort = uint16(req.DestAddr.Port)
+			assoc.peers = make(map[netip.AddrPort]struct{})
+		}
+	}
+	if s.config.UDPDatagramRate > 0 {
+		assoc.limiter = newTokenBucket(s.config.UDPDatagramRate, s.config.UDPDatagramBurst)
+	}
+
+	// Send success
+	if err := sendReply(conn, SuccessReply, bind); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	s.trackAssociation(assoc, true)
+	defer s.trackAssociation(assoc, false)
+
+	// The association ends when the control connection is closed
+	if assoc.stream != nil {
+		done := make(chan struct{})
+		go func() {
+			assoc.readStream(ctx)
+			close(done)
+		}()
+		return assoc.runStream(done)
+	}
+	go func() {
+		io.Copy(io.Discard, req.bufConn)
+		assoc.relay.Close()
+	}()
+	return assoc.run(ctx)
+}
+
+// idleTimeout returns how long the association may relay no datagram
+func (a *udpAssociation) idleTimeout() time.Duration {
+	if idle := a.server.config.UDPIdleTimeout; idle > 0 {
+		return idle
+	}
+	return defaultUDPIdleTimeout
+}
+
+// maxDatagram returns the largest datagram the association accepts
+func (a *udpAssociation) maxDatagram() int {
+	if max := a.server.config.UDPMaxDatagram; max > 0 && max < maxUDPDatagram {
+		return max
+	}
+	return maxUDPDatagram
+}
+
+// setUDPBuffers applies Config.UDPReadBuffer and Config.UDPWriteBuffer
+// to a relay socket
+func (s *Server) setUDPBuffers(relay *net.UDPConn) error {
+	if size := s.config.UDPReadBuffer; size > 0 {
+		if err := relay.SetReadBuffer(size); err != nil {
+			return err
+		}
+	}
+	if size := s.config.UDPWriteBuffer; size > 0 {
+		return relay.SetWriteBuffer(size)
+	}
+	return nil
+}
+
+// readStream reads the datagrams of a UDP over TCP client from the control
+// connection. They are framed like relayed datagrams, but RSV carries the
+// length of DATA.
+func (a *udpAssociation) readStream(ctx context.Context) {
+	r := a.req.bufConn
+	header := make([]byte, 3)
+	for {
+		// LEN(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+		if _, err := io.ReadFull(r, header); err != nil {
+			return
+		}
+		dest := &AddrSpec{}
+		if err := readAddrSpec(r, dest); err != nil {
+			a.logger.Debugf("closing UDP over TCP stream of %v: %v", a.client, err)
+			return
+		}
+		data := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return
+		}
+		if len(data) > a.maxDatagram() {
+			a.drop(udpDropSize, "dropping UDP datagram from %v: larger than %d bytes", a.client, a.maxDatagram())
+			continue
+		}
+
+		a.touch()
+		a.forwardDatagram(ctx, header[2], dest, data)
+	}
+}
+
+// runStream waits until the control connection of a UDP over TCP
+// association is done or no datagram was relayed for the idle timeout,
+// closing the sockets of its destinations
+func (a *udpAssociation) runStream(done <-chan struct{}) error {
+	defer a.closeConns()
+	idle := a.idleTimeout()
+	timer := time.NewTimer(idle)
+	defer timer.Stop()
+	for {
+		select {
+		case <-a.active:
+			timer.Reset(idle)
+		case <-timer.C:
+			a.logger.Infof("closing UDP association of %v: idle for %s", a.clientIP, idle)
+			return nil
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// touch postpones the idle timeout of a UDP over TCP association
+func (a *udpAssociation) touch() {
+	select {
+	case a.active <- struct{}{}:
+	default:
+	}
+}
+
+// streamConn returns the socket of a UDP over TCP association connected
+// to target, opening it and relaying its datagrams on first use
+func (a *udpAssociation) streamConn(target netip.AddrPort) (*net.UDPConn, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if c, found := a.conns[target]; found {
+		return c, nil
+	}
+	if a.conns == nil {
+		return nil, net.ErrClosed
+	}
+	if len(a.conns) >= maxUDPRuleCache {
+		return nil, fmt.Errorf("more than %d destinations", maxUDPRuleCache)
+	}
+	c, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(target))
+	if err != nil {
+		return nil, err
+	}
+	if err := a.server.setUDPBuffers(c); err != nil {
+		a.logger.Warnf("failed to set UDP socket buffers: %v", err)
+	}
+	a.conns[target] = c
+	go a.readConn(c, target)
+	return c, nil
+}
+
+// readConn relays the datagrams received on c, connected to target, to
+// the client of a UDP over TCP association until c is closed
+func (a *udpAssociation) readConn(c *net.UDPConn, target netip.AddrPort) {
+	max := a.maxDatagram()
+	buf := make([]byte, max+1)
+	for {
+		n, err := c.Read(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// e.g. refused, reported for an earlier datagram
+			a.logger.Debugf("failed to read UDP datagram from %v: %v", target, err)
+			continue
+		}
+		if n > max {
+			a.drop(udpDropSize, "dropping UDP datagram from %v: larger than %d bytes", target, max)
+			continue
+		}
+		a.touch()
+		a.handleRemoteDatagram(target, buf[:n])
+	}
+}
+
+// closeConns closes the sockets of a UDP over TCP association
+func (a *udpAssociation) closeConns() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, c := range a.conns {
+		c.Close()
+	}
+	a.conns = nil
+}
+
+// run relays datagrams until the association is closed or idle
+func (a *udpAssociation) run(ctx context.Context) error {
+	idle := a.idleTimeout()
+
+	// Read one byte more than accepted to detect larger datagrams
+	max := a.maxDatagram()
+	buf := make([]byte, max+1)
+	for {
+		a.relay.SetReadDeadline(time.Now().Add(idle))
+		n, from, err := a.relay.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				a.logger.Infof("closing UDP association of %v: idle for %s", a.clientIP, idle)
+				return nil
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+		if n > max {
+			a.drop(udpDropSize, "dropping UDP datagram from %v: larger than %d bytes", from, max)
+			continue
+		}
+
+		if a.isClient(from) {
+			a.client = from
+			a.handleClientDatagram(ctx, buf[:n])
+		} else {
+			a.handleRemoteDatagram(from, buf[:n])
+		}
+	}
+}
+
+// isClient reports whether a datagram was sent by the associated client
+func (a *udpAssociation) isClient(from netip.AddrPort) bool {
+	if a.stream != nil {
+		return false
+	}
+	if a.client.IsValid() {
+		return from == a.client
+	}
+	if a.clientPort != 0 && from.Port() != a.clientPort {
+		return false
+	}
+	// Zones may be missing from one of the link-local addresses
+	return from.Addr().WithZone("") == a.clientIP.WithZone("")
+}
+
+// handleClientDatagram unwraps a client datagram and sends it to its destination
+func (a *udpAssociation) handleClientDatagram(ctx context.Context, msg []byte) {
+	// RSV(2) FRAG(1) ATYP DST.ADDR DST.PORT DATA
+	if len(msg) < 4 {
+		a.drop(udpDropMalformed, "dropping short UDP datagram from %v", a.client)
+		return
+	}
+	frag := msg[2]
+	r := bytes.NewReader(msg[3:])
+	dest := &AddrSpec{}
+	if err := readAddrSpec(r, dest); err != nil {
+		a.drop(udpDropMalformed, "dropping UDP datagram from %v: %v", a.client, err)
+		return
+	}
+	data := msg[len(msg)-r.Len():]
+	a.forwardDatagram(ctx, frag, dest, data)
+}
+
+// forwardDatagram sends the payload of a client datagram to its destination
+func (a *udpAssociation) forwardDatagram(ctx context.Context, frag uint8, dest *AddrSpec, data []byte) {
+	if frag != 0 {
+		var complete bool
+		a.mu.Lock()
+		dest, data, complete = a.reassemble(frag, dest, data)
+		a.mu.Unlock()
+		if !complete {
+			return
+		}
+	}
+
+	if a.limiter != nil && !a.limiter.Allow() {
+		a.drop(udpDropRateLimit, "dropping UDP datagram from %v: rate limit exceeded", a.client)
+		return
+	}
+
+	if ip, ok := parseIPLiteral(dest.FQDN); ok {
+		dest.IP = ip
+	} else if dest.FQDN != "" {
+		_, addr, err := a.server.config.Resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			a.drop(udpDropResolve, "dropping UDP datagram to %v: %v", dest.FQDN, err)
+			return
+		}
+		dest.IP = addr
+	}
+
+	if !a.allow(ctx, dest) {
+		a.drop(udpDropPolicy, "dropping UDP datagram to %v: blocked by rules", dest)
+		return
+	}
+
+	target := netip.AddrPortFrom(a.server.nat64(dest.IP.Unmap()), uint16(dest.Port))
+	if err := a.send(data, target); err != nil {
+		a.drop(udpDropSend, "failed to relay UDP datagram to %v: %v", target, err)
+		return
+	}
+	if a.peers != nil {
+		a.mu.Lock()
+		if len(a.peers) >= maxUDPRuleCache {
+			clear(a.peers)
+		}
+		a.peers[target] = struct{}{}
+		a.mu.Unlock()
+	}
+	a.relayedUp(len(data))
+}
+
+// send writes a datagram to target from the relay socket, or from the
+// socket connected to target for UDP over TCP
+func (a *udpAssociation) send(data []byte, target netip.AddrPort) error {
+	if a.stream == nil {
+		_, err := a.relay.WriteToUDPAddrPort(data, target)
+		return err
+	}
+	c, err := a.streamConn(target)
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(data)
+	return err
+}
+
+// allow passes a datagram destination through the RuleSet, caching the
+// verdict for the lifetime of the association
+func (a *udpAssociation) allow(ctx context.Context, dest *AddrSpec) bool {
+	key := dest.String()
+	a.mu.Lock()
+	allowed, found := a.verdicts[key]
+	a.mu.Unlock()
+	if found {
+		return allowed
+	}
+
+	req := &Request{
+		Version:     a.req.Version,
+		Command:     AssociateCommand,
+		AuthContext: a.req.AuthContext,
+		RemoteAddr:  a.req.RemoteAddr,
+		DestAddr:    dest,
+	}
+	_, allowed = a.server.allowRules(ctx, req)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.verdicts) >= maxUDPRuleCache {
+		clear(a.verdicts)
+	}
+	a.verdicts[key] = allowed
+	return allowed
+}
+
+// reassemble queues a fragment and returns the reassembled datagram once
+// the last fragment of the sequence arrived, with a.mu held. Without Config.UDPFragmentTimeout
+// fragments are dropped.
+func (a *udpAssociation) reassemble(frag uint8, dest *AddrSpec, data []byte) (*AddrSpec, []byte, bool) {
+	timeout := a.server.config.UDPFragmentTimeout
+	if timeout <= 0 {
+		a.dropFragments(1, "fragmentation not enabled")
+		return nil, nil, false
+	}
+
+	pos := frag & 0x7f
+	q := a.fragments
+
+	// Abandon a queue that timed out or is superseded by a new sequence
+	if q != nil {
+		if time.Since(q.started) > timeout {
+			a.dropFragments(q.count, "reassembly timed out")
+			q = nil
+		} else if pos <= q.last {
+			a.dropFragments(q.count, "fragment sequence restarted")
+			q = nil
+		}
+	}
+
+	if q == nil {
+		if pos != 1 {
+			a.fragments = nil
+			a.dropFragments(1, "missing first fragment")
+			return nil, nil, false
+		}
+		q = &udpReassembly{dest: dest, started: time.Now()}
+	} else if pos != q.last+1 {
+		a.fragments = nil
+		a.dropFragments(q.count+1, "missing fragment")
+		return nil, nil, false
+	}
+
+	if len(q.data)+len(data) > a.maxDatagram() {
+		a.fragments = nil
+		a.dropFragments(q.count+1, "reassembled datagram too large")
+		return nil, nil, false
+	}
+	q.data = append(q.data, data...)
+	q.last = pos
+	q.count++
+
+	// The high-order bit marks the end of the sequence
+	if frag&0x80 == 0 {
+		a.fragments = q
+		return nil, nil, false
+	}
+	a.fragments = nil
+	return q.dest, q.data, true
+}
+
+// dropFragments counts and logs abandoned fragments
+func (a *udpAssociation) dropFragments(n uint64, reason string) {
+	a.server.udpFragmentsDropped.Add(n)
+	a.logger.Debugf("dropping %d UDP fragments from %v: %s", n, a.client, reason)
+}
+
+// handleRemoteDatagram wraps a datagram from a destination and forwards it
+// to the client
+func (a *udpAssociation) handleRemoteDatagram(from netip.AddrPort, data []byte) {
+	if !a.client.IsValid() {
+		a.drop(udpDropNoClient, "dropping UDP datagram from %v: client address not known yet", from)
+		return
+	}
+	a.mu.Lock()
+	_, found := a.peers[from]
+	a.mu.Unlock()
+	if a.peers != nil && !found {
+		a.drop(udpDropUnsolicited, "dropping UDP datagram from %v: not a destination of the client", from)
+		return
+	}
+
+	// Report datagrams via NAT64 as from the IPv4 address the client sent to
+	ip := from.Addr()
+	if v4, ok := extractNAT64(a.server.config.NAT64Prefix, ip); ok {
+		ip = v4
+	}
+	header, err := formatAddr(&AddrSpec{IP: ip, Port: int(from.Port())})
+	if err != nil {
+		a.drop(udpDropMalformed, "dropping UDP datagram from %v: %v", from, err)
+		return
+	}
+	msg := make([]byte, 3, 3+len(header)+len(data))
+	msg = append(msg, header...)
+	msg = append(msg, data...)
+
+	if a.stream != nil {
+		binary.BigEndian.PutUint16(msg, uint16(len(data)))
+		a.streamMu.Lock()
+		_, err = a.stream.Write(msg)
+		a.streamMu.Unlock()
+	} else {
+		_, err = a.relay.WriteToUDPAddrPort(msg, a.client)
+	}
+	if err != nil {
+		a.drop(udpDropSend, "failed to relay UDP datagram to %v: %v", a.client, err)
+		return
+	}
+	a.relayedDown(len(data))
+}
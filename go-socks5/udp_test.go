@@ -0,0 +1,176 @@
+package socks5
+
+import (
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestIsClient(t *testing.T) {
+	tests := []struct {
+		name  string
+		assoc *udpAssociation
+		from  string
+		want  bool
+	}{
+		{
+			name:  "any port of the client IPv4",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("192.0.2.1")},
+			from:  "192.0.2.1:40000",
+			want:  true,
+		},
+		{
+			name:  "other IPv4",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("192.0.2.1")},
+			from:  "192.0.2.2:40000",
+		},
+		{
+			name:  "any port of the client IPv6",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("2001:db8::1")},
+			from:  "[2001:db8::1]:40000",
+			want:  true,
+		},
+		{
+			name:  "declared port",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("2001:db8::1"), clientPort: 40000},
+			from:  "[2001:db8::1]:40000",
+			want:  true,
+		},
+		{
+			name:  "other port than declared",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("2001:db8::1"), clientPort: 40000},
+			from:  "[2001:db8::1]:40001",
+		},
+		{
+			name:  "link-local address without zone",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("fe80::1%eth0")},
+			from:  "[fe80::1]:40000",
+			want:  true,
+		},
+		{
+			name:  "zoned link-local address",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("fe80::1")},
+			from:  "[fe80::1%eth0]:40000",
+			want:  true,
+		},
+		{
+			name:  "first datagram received",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("2001:db8::1"), client: netip.MustParseAddrPort("[2001:db8::1]:40000")},
+			from:  "[2001:db8::1]:40001",
+		},
+		{
+			name:  "UDP over TCP",
+			assoc: &udpAssociation{clientIP: netip.MustParseAddr("192.0.2.1"), stream: io.Discard},
+			from:  "192.0.2.1:40000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.assoc.isClient(netip.MustParseAddrPort(tt.from)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fragment is a datagram of a fragment sequence, sent after delay
+type fragment struct {
+	frag  uint8
+	data  string
+	delay time.Duration
+}
+
+func TestReassemble(t *testing.T) {
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		max         int
+		fragments   []fragment
+		want        string // the reassembled datagram, empty if none
+		wantFirst   int    // index of its first fragment
+		wantDropped uint64
+	}{
+		{
+			name:      "two fragments",
+			fragments: []fragment{{frag: 1, data: "ab"}, {frag: 0x82, data: "cd"}},
+			want:      "abcd",
+		},
+		{
+			name:      "three fragments",
+			fragments: []fragment{{frag: 1, data: "ab"}, {frag: 2, data: "cd"}, {frag: 0x83, data: "ef"}},
+			want:      "abcdef",
+		},
+		{
+			name:      "single last fragment",
+			fragments: []fragment{{frag: 0x81, data: "ab"}},
+			want:      "ab",
+		},
+		{
+			name:        "fragmentation disabled",
+			timeout:     -1,
+			fragments:   []fragment{{frag: 1, data: "ab"}, {frag: 0x82, data: "cd"}},
+			wantDropped: 2,
+		},
+		{
+			name:        "missing first fragment",
+			fragments:   []fragment{{frag: 2, data: "cd"}, {frag: 0x83, data: "ef"}},
+			wantDropped: 2,
+		},
+		{
+			name:        "missing fragment",
+			fragments:   []fragment{{frag: 1, data: "ab"}, {frag: 0x83, data: "ef"}},
+			wantDropped: 2,
+		},
+		{
+			name:        "sequence restarted",
+			fragments:   []fragment{{frag: 1, data: "ab"}, {frag: 2, data: "cd"}, {frag: 1, data: "xy"}, {frag: 0x82, data: "z"}},
+			want:        "xyz",
+			wantFirst:   2,
+			wantDropped: 2,
+		},
+		{
+			name:        "too large",
+			max:         4,
+			fragments:   []fragment{{frag: 1, data: "abc"}, {frag: 0x82, data: "de"}},
+			wantDropped: 2,
+		},
+		{
+			name:        "timed out",
+			timeout:     20 * time.Millisecond,
+			fragments:   []fragment{{frag: 1, data: "ab"}, {frag: 0x82, data: "cd", delay: 40 * time.Millisecond}},
+			wantDropped: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+			s := &Server{config: &Config{Logger: testLogger(), UDPFragmentTimeout: timeout, UDPMaxDatagram: tt.max}}
+			a := &udpAssociation{server: s, logger: s.config.Logger}
+
+			var got string
+			var gotDest *AddrSpec
+			for i, f := range tt.fragments {
+				time.Sleep(f.delay)
+				// Every fragment carries a destination, that of the first
+				// fragment is used
+				dest := &AddrSpec{IP: netip.MustParseAddr("192.0.2.1"), Port: 1000 + i}
+				if dest, data, complete := a.reassemble(f.frag, dest, []byte(f.data)); complete {
+					got, gotDest = string(data), dest
+				}
+			}
+			if got != tt.want {
+				t.Errorf("got datagram %q, want %q", got, tt.want)
+			}
+			if gotDest != nil && gotDest.Port != 1000+tt.wantFirst {
+				t.Errorf("got destination port %d, want that of fragment %d", gotDest.Port, tt.wantFirst)
+			}
+			if n := s.udpFragmentsDropped.Load(); n != tt.wantDropped {
+				t.Errorf("got %d fragments dropped, want %d", n, tt.wantDropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package socks5
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// udpDropCause indexes the counters of datagrams dropped by an association
+type udpDropCause int
+
+const (
+	udpDropPolicy udpDropCause = iota
+	udpDropSize
+	udpDropRateLimit
+	udpDropResolve
+	udpDropMalformed
+	udpDropNoClient
+	udpDropUnsolicited
+	udpDropSend
+	udpDropCauses
+)
+
+// udpDropNames are the causes reported in UDPDroppedBy
+var udpDropNames = [udpDropCauses]string{
+	udpDropPolicy:      "policy",
+	udpDropSize:        "size",
+	udpDropRateLimit:   "rate_limit",
+	udpDropResolve:     "resolve",
+	udpDropMalformed:   "malformed",
+	udpDropNoClient:    "no_client",
+	udpDropUnsolicited: "unsolicited",
+	udpDropSend:        "send",
+}
+
+// udpCounters count the datagrams relayed and dropped by an association
+// or the whole server
+type udpCounters struct {
+	datagramsUp   atomic.Uint64
+	datagramsDown atomic.Uint64
+	dropped       [udpDropCauses]atomic.Uint64
+}
+
+// droppedBy returns the non-zero drop counters by cause
+func (c *udpCounters) droppedBy() map[string]uint64 {
+	dropped := make(map[string]uint64)
+	for cause := range c.dropped {
+		if n := c.dropped[cause].Load(); n > 0 {
+			dropped[udpDropNames[cause]] = n
+		}
+	}
+	return dropped
+}
+
+// UDPAssociationStats describes an active UDP association
+type UDPAssociationStats struct {
+	// Client is the address of the control connection, User the user it
+	// authenticated as
+	Client netip.Addr `json:"client"`
+	User   string     `json:"user,omitempty"`
+	// Relay is the address of the relay socket, zero for UDP over TCP
+	Relay netip.AddrPort `json:"relay"`
+	// Start is when the association was opened
+	Start time.Time `json:"start"`
+	// DatagramsUp and BytesUp are the datagrams and payload relayed from
+	// the client to destinations, DatagramsDown and BytesDown those from
+	// destinations to the client
+	DatagramsUp   uint64 `json:"datagrams_up"`
+	DatagramsDown uint64 `json:"datagrams_down"`
+	BytesUp       uint64 `json:"bytes_up"`
+	BytesDown     uint64 `json:"bytes_down"`
+	// DroppedBy counts the datagrams dropped by cause: "policy", "size",
+	// "rate_limit", "resolve", "malformed", "no_client", "unsolicited" or
+	// "send"
+	DroppedBy map[string]uint64 `json:"dropped_by"`
+}
+
+// UDPAssociations returns the statistics of the active UDP associations
+// ordered by start
+func (s *Server) UDPAssociations() []UDPAssociationStats {
+	s.mu.Lock()
+	assocs := make([]*udpAssociation, 0, len(s.udpAssocs))
+	for a := range s.udpAssocs {
+		assocs = append(assocs, a)
+	}
+	s.mu.Unlock()
+
+	list := make([]UDPAssociationStats, len(assocs))
+	for i, a := range assocs {
+		list[i] = UDPAssociationStats{
+			Client:        a.clientIP,
+			User:          a.req.Username(),
+			Start:         a.start,
+			DatagramsUp:   a.req.datagramsUp.Load(),
+			DatagramsDown: a.req.datagramsDown.Load(),
+			BytesUp:       a.req.bytesUp.Load(),
+			BytesDown:     a.req.bytesDown.Load(),
+			DroppedBy:     a.counters.droppedBy(),
+		}
+		if a.relay != nil {
+			list[i].Relay = addrPort(a.relay.LocalAddr())
+		}
+	}
+	slices.SortFunc(list, func(a, b UDPAssociationStats) int {
+		return cmp.Compare(a.Start.UnixNano(), b.Start.UnixNano())
+	})
+	return list
+}
+
+// trackAssociation adds or removes an association from the active ones
+func (s *Server) trackAssociation(a *udpAssociation, add bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if add {
+		s.udpAssocs[a] = struct{}{}
+	} else {
+		delete(s.udpAssocs, a)
+	}
+}
+
+// relayedUp counts a datagram of n bytes relayed from the client
+func (a *udpAssociation) relayedUp(n int) {
+	a.req.datagramsUp.Add(1)
+	a.server.stats.udp.datagramsUp.Add(1)
+	a.server.countUp(a.req, uint64(n))
+}
+
+// relayedDown counts a datagram of n bytes relayed to the client
+func (a *udpAssociation) relayedDown(n int) {
+	a.req.datagramsDown.Add(1)
+	a.server.stats.udp.datagramsDown.Add(1)
+	a.server.countDown(a.req, uint64(n))
+}
+
+// drop counts and logs a datagram that is not relayed
+func (a *udpAssociation) drop(cause udpDropCause, format string, args ...any) {
+	a.counters.dropped[cause].Add(1)
+	a.server.stats.udp.dropped[cause].Add(1)
+	a.logger.Debugf(format, args...)
+}
@@ -0,0 +1,56 @@
+package socks5
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// UsernameParser is used to split usernames carrying routing parameters,
+// like alice-country-de-session-42, into the user checked against the
+// credentials and its parameters, see AuthContext.Params
+type UsernameParser interface {
+	ParseUsername(username string) (user string, params map[string]string, err error)
+}
+
+// KeyValueUsernames is a UsernameParser for usernames followed by pairs
+// of a key among Keys and a value, joined by Separator, as sold by
+// commercial proxy providers. The user ends before the first key, values
+// can't contain the separator. Usernames without parameters are valid.
+type KeyValueUsernames struct {
+	Separator string
+	Keys      []string
+}
+
+func (k KeyValueUsernames) ParseUsername(username string) (string, map[string]string, error) {
+	parts := strings.Split(username, k.Separator)
+	start := slices.IndexFunc(parts, func(part string) bool { return slices.Contains(k.Keys, part) })
+	if start <= 0 {
+		return username, nil, nil
+	}
+	user := strings.Join(parts[:start], k.Separator)
+	params := make(map[string]string)
+	for i := start; i < len(parts); i += 2 {
+		key := parts[i]
+		if !slices.Contains(k.Keys, key) {
+			return "", nil, fmt.Errorf("unknown username parameter %q", key)
+		}
+		if i+1 == len(parts) || parts[i+1] == "" {
+			return "", nil, fmt.Errorf("username parameter %q has no value", key)
+		}
+		if _, found := params[key]; found {
+			return "", nil, fmt.Errorf("duplicate username parameter %q", key)
+		}
+		params[key] = parts[i+1]
+	}
+	return user, params, nil
+}
+
+// UsernameParam returns the routing parameter key of the username the
+// request was authenticated with, or an empty string
+func (r *Request) UsernameParam(key string) string {
+	if r.AuthContext == nil {
+		return ""
+	}
+	return r.AuthContext.Params[key]
+}
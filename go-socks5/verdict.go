@@ -0,0 +1,117 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+)
+
+type denyReplyKey struct{}
+
+type bandwidthClassKey struct{}
+
+type rewriteKey struct{}
+
+type destConnectRateKey struct{}
+
+type denyReasonKey struct{}
+
+// DenyReason describes why a RuleSet denied a request
+type DenyReason struct {
+	// Rule is a short, stable name of the rule, used as metric label
+	Rule string
+	// Reason details the denial, e.g. the pattern or CIDR that matched
+	Reason string
+}
+
+// WithDenyReason returns a context recording which rule denied the
+// request and why, for the access log, the error and Stats.DeniedBy
+func WithDenyReason(ctx context.Context, rule, reason string) context.Context {
+	return context.WithValue(ctx, denyReasonKey{}, DenyReason{rule, reason})
+}
+
+// DenyReasonFromContext returns the reason attached with WithDenyReason,
+// if any
+func DenyReasonFromContext(ctx context.Context) (DenyReason, bool) {
+	reason, ok := ctx.Value(denyReasonKey{}).(DenyReason)
+	return reason, ok
+}
+
+// WithDenyReply returns a context carrying the reply code sent to the
+// client when the RuleSet denies the request, instead of "connection not
+// allowed by ruleset". Codes are defined in RFC 1928 section 6.
+func WithDenyReply(ctx context.Context, code uint8) context.Context {
+	return context.WithValue(ctx, denyReplyKey{}, code)
+}
+
+// DenyReplyFromContext returns the reply code attached with
+// WithDenyReply, if any
+func DenyReplyFromContext(ctx context.Context) (uint8, bool) {
+	code, ok := ctx.Value(denyReplyKey{}).(uint8)
+	return code, ok
+}
+
+// WithBandwidthClass returns a context carrying the name of the entry of
+// Config.BandwidthClasses shaping the tunnel of an allowed request
+func WithBandwidthClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, bandwidthClassKey{}, class)
+}
+
+// BandwidthClassFromContext returns the class attached with
+// WithBandwidthClass, if any
+func BandwidthClassFromContext(ctx context.Context) (string, bool) {
+	class, ok := ctx.Value(bandwidthClassKey{}).(string)
+	return class, ok
+}
+
+// WithRewrite returns a context carrying the destination an allowed
+// CONNECT is sent to instead of the requested one. It takes precedence
+// over Config.Rewriter.
+func WithRewrite(ctx context.Context, dest *AddrSpec) context.Context {
+	return context.WithValue(ctx, rewriteKey{}, dest)
+}
+
+// RewriteFromContext returns the destination attached with WithRewrite,
+// if any
+func RewriteFromContext(ctx context.Context) (*AddrSpec, bool) {
+	dest, ok := ctx.Value(rewriteKey{}).(*AddrSpec)
+	return dest, ok && dest != nil
+}
+
+// WithDestConnectRate returns a context carrying the rate of new tunnels
+// per second to the destination of an allowed CONNECT, enforced by
+// Config.DestRateLimiter instead of its rate for the destination. Zero
+// means unlimited.
+func WithDestConnectRate(ctx context.Context, rate float64) context.Context {
+	return context.WithValue(ctx, destConnectRateKey{}, rate)
+}
+
+// DestConnectRateFromContext returns the rate attached with
+// WithDestConnectRate, if any
+func DestConnectRateFromContext(ctx context.Context) (float64, bool) {
+	rate, ok := ctx.Value(destConnectRateKey{}).(float64)
+	return rate, ok
+}
+
+// deny records a request denied by the RuleSet and returns the reply code
+// to send
+func (s *Server) deny(ctx context.Context, req *Request) uint8 {
+	reason, ok := DenyReasonFromContext(ctx)
+	if !ok {
+		reason = DenyReason{Rule: "ruleset"}
+	}
+	req.denyReason = &reason
+	s.countDenial(reason.Rule)
+
+	if code, ok := DenyReplyFromContext(ctx); ok && code != SuccessReply {
+		return code
+	}
+	return RuleFailure
+}
+
+// denyError describes a request denied by the RuleSet
+func denyError(action string, req *Request) error {
+	if r := req.denyReason; r != nil && r.Reason != "" {
+		return fmt.Errorf("%s to %v %w: %s: %s", action, req.DestAddr, ErrNotAllowedByRuleset, r.Rule, r.Reason)
+	}
+	return fmt.Errorf("%s to %v %w", action, req.DestAddr, ErrNotAllowedByRuleset)
+}
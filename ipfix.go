@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ipfixVersion is the version of IPFIX messages, NetFlow v10
+	ipfixVersion = 10
+
+	// ipfixTemplateBase is the ID of the first template, others add 1 for
+	// IPv6 clients and 2 for IPv6 destinations
+	ipfixTemplateBase = 256
+
+	// maxIPFIXMessage bounds the size of messages to fit the MTU
+	maxIPFIXMessage = 1400
+
+	// ipfixTemplateRefresh is how often templates are resent, since UDP
+	// collectors may have missed or forgotten them
+	ipfixTemplateRefresh = 10 * time.Minute
+
+	// ipfixFlushInterval is how long records wait to be batched
+	ipfixFlushInterval = time.Second
+
+	// ipfixQueue is the number of records waiting to be exported, further
+	// ones are dropped
+	ipfixQueue = 4096
+)
+
+// Layout of IPFIX messages, see RFC 7011
+const (
+	ipfixHeaderLength        = 16
+	ipfixSetHeaderLength     = 4
+	ipfixTemplateSetID       = 2
+	ipfixTemplateHeaderLen   = 4
+	ipfixFieldSpecifierLen   = 4
+	ipfixTemplateFieldCount  = 16
+	ipfixVariableLength      = 65535
+	ipfixShortVariableLength = 255
+
+	// ipfixTemplatesLength is the size of the set of all four templates
+	ipfixTemplatesLength = ipfixSetHeaderLength + 4*(ipfixTemplateHeaderLen+ipfixTemplateFieldCount*ipfixFieldSpecifierLen)
+)
+
+// IPFIX information elements, see the IANA IPFIX registry
+const (
+	ieProtocolIdentifier    = 4
+	ieSourceTransportPort   = 7
+	ieSourceIPv4Address     = 8
+	ieDestTransportPort     = 11
+	ieDestIPv4Address       = 12
+	ieSourceIPv6Address     = 27
+	ieDestIPv6Address       = 28
+	ieFlowStartMilliseconds = 152
+	ieFlowEndMilliseconds   = 153
+	iePostNATSourceIPv4     = 225
+	iePostNATDestIPv4       = 226
+	iePostNAPTSourcePort    = 227
+	iePostNAPTDestPort      = 228
+	ieInitiatorOctets       = 231
+	ieResponderOctets       = 232
+	iePostNATSourceIPv6     = 281
+	iePostNATDestIPv6       = 282
+	ieInitiatorPackets      = 298
+	ieResponderPackets      = 299
+	ieUserName              = 371
+)
+
+// flowRecord is the IPFIX data record of a session. The client leg is
+// reported as the flow, the leg to the destination as its post-NAT
+// addresses.
+type flowRecord struct {
+	start, end             time.Time
+	protocol               uint8
+	client, local          netip.AddrPort
+	outbound, remote       netip.AddrPort
+	octetsUp, octetsDown   uint64
+	packetsUp, packetsDown uint64
+	user                   string
+}
+
+// IPFIXExporter exports a flow record per session to an IPFIX collector
+// over UDP. Packet counts are only known for UDP associations.
+type IPFIXExporter struct {
+	conn    net.Conn
+	domain  uint32
+	records chan flowRecord
+	flushes chan chan error
+	dropped atomic.Uint64
+
+	sequence     uint32
+	templateSent time.Time
+}
+
+// NewIPFIXExporter creates an IPFIXExporter sending to collector with the
+// observation domain ID domain and starts exporting
+func NewIPFIXExporter(collector string, domain uint32) (*IPFIXExporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	e := &IPFIXExporter{conn: conn, domain: domain, records: make(chan flowRecord, ipfixQueue), flushes: make(chan chan error)}
+	go e.run()
+	return e, nil
+}
+
+// Record queues the flow record of a finished session, it is a
+// socks5.Config.OnSessionEnd callback
+func (e *IPFIXExporter) Record(info socks5.SessionInfo) {
+	r := flowRecord{
+		start:       info.Start,
+		end:         time.Now(),
+		protocol:    6,
+		client:      info.Client,
+		local:       info.Local,
+		outbound:    info.Outbound,
+		remote:      info.Remote,
+		octetsUp:    info.BytesUp,
+		octetsDown:  info.BytesDown,
+		packetsUp:   info.DatagramsUp,
+		packetsDown: info.DatagramsDown,
+		user:        info.User,
+	}
+	if info.Command == "associate" {
+		r.protocol = 17
+	}
+	select {
+	case e.records <- r:
+	default:
+		if e.dropped.Add(1)%1000 == 1 {
+			logrus.Warnf("IPFIX export queue full, dropped %d flow records", e.dropped.Load())
+		}
+	}
+}
+
+// Flush exports the queued records, returning once they are sent or when
+// ctx is done
+func (e *IPFIXExporter) Flush(ctx context.Context) error {
+	return requestFlush(ctx, e.flushes)
+}
+
+// run batches queued records into messages, sent once full or after
+// ipfixFlushInterval
+func (e *IPFIXExporter) run() {
+	ticker := time.NewTicker(ipfixFlushInterval)
+	defer ticker.Stop()
+
+	sets := make(map[uint16][]byte)
+	size, count := 0, 0
+	flush := func() {
+		if count > 0 {
+			e.send(sets, count)
+			clear(sets)
+			size, count = 0, 0
+		}
+	}
+	add := func(r flowRecord) {
+		template := r.template()
+		data := r.appendData(nil)
+		if size+len(data)+ipfixSetHeaderLength > maxIPFIXMessage-ipfixHeaderLength-ipfixTemplatesLength {
+			flush()
+		}
+		if len(sets[template]) == 0 {
+			size += ipfixSetHeaderLength
+		}
+		sets[template] = append(sets[template], data...)
+		size += len(data)
+		count++
+	}
+	for {
+		select {
+		case r := <-e.records:
+			add(r)
+		case <-ticker.C:
+			flush()
+		case done := <-e.flushes:
+			for n := len(e.records); n > 0; n-- {
+				add(<-e.records)
+			}
+			flush()
+			done <- nil
+		}
+	}
+}
+
+// send writes a message of data sets holding count records, preceded by
+// the templates if they are due
+func (e *IPFIXExporter) send(sets map[uint16][]byte, count int) {
+	now := time.Now()
+	msg := make([]byte, ipfixHeaderLength, maxIPFIXMessage)
+	binary.BigEndian.PutUint16(msg[0:], ipfixVersion)
+	binary.BigEndian.PutUint32(msg[4:], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:], e.sequence)
+	binary.BigEndian.PutUint32(msg[12:], e.domain)
+
+	if now.Sub(e.templateSent) >= ipfixTemplateRefresh {
+		msg = appendTemplates(msg)
+		e.templateSent = now
+	}
+	for template, data := range sets {
+		msg = binary.BigEndian.AppendUint16(msg, template)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(ipfixSetHeaderLength+len(data)))
+		msg = append(msg, data...)
+	}
+	binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+
+	e.sequence += uint32(count)
+	if _, err := e.conn.Write(msg); err != nil {
+		logrus.Debugf("failed to export IPFIX flow records: %v", err)
+	}
+}
+
+// appendTemplates appends the template set of the four combinations of
+// IPv4 and IPv6 legs
+func appendTemplates(msg []byte) []byte {
+	msg = binary.BigEndian.AppendUint16(msg, ipfixTemplateSetID)
+	msg = binary.BigEndian.AppendUint16(msg, ipfixTemplatesLength)
+	for variant := uint16(0); variant < 4; variant++ {
+		clientV6, remoteV6 := variant&1 != 0, variant&2 != 0
+		msg = binary.BigEndian.AppendUint16(msg, ipfixTemplateBase+variant)
+		msg = binary.BigEndian.AppendUint16(msg, ipfixTemplateFieldCount)
+
+		clientAddr, clientLen := uint16(ieSourceIPv4Address), uint16(4)
+		localAddr := uint16(ieDestIPv4Address)
+		if clientV6 {
+			clientAddr, clientLen, localAddr = ieSourceIPv6Address, 16, ieDestIPv6Address
+		}
+		outboundAddr, remoteLen := uint16(iePostNATSourceIPv4), uint16(4)
+		remoteAddr := uint16(iePostNATDestIPv4)
+		if remoteV6 {
+			outboundAddr, remoteLen, remoteAddr = iePostNATSourceIPv6, 16, iePostNATDestIPv6
+		}
+		for _, field := range [ipfixTemplateFieldCount][2]uint16{
+			{ieFlowStartMilliseconds, 8},
+			{ieFlowEndMilliseconds, 8},
+			{ieProtocolIdentifier, 1},
+			{clientAddr, clientLen},
+			{ieSourceTransportPort, 2},
+			{localAddr, clientLen},
+			{ieDestTransportPort, 2},
+			{outboundAddr, remoteLen},
+			{iePostNAPTSourcePort, 2},
+			{remoteAddr, remoteLen},
+			{iePostNAPTDestPort, 2},
+			{ieInitiatorOctets, 8},
+			{ieResponderOctets, 8},
+			{ieInitiatorPackets, 8},
+			{ieResponderPackets, 8},
+			{ieUserName, ipfixVariableLength},
+		} {
+			msg = binary.BigEndian.AppendUint16(msg, field[0])
+			msg = binary.BigEndian.AppendUint16(msg, field[1])
+		}
+	}
+	return msg
+}
+
+// template returns the ID of the template matching the address families
+// of the record. Missing legs take the family of the client.
+func (r *flowRecord) template() uint16 {
+	template := uint16(ipfixTemplateBase)
+	clientV6 := !r.client.Addr().Unmap().Is4()
+	if clientV6 {
+		template++
+	}
+	if r.remote.IsValid() && !r.remote.Addr().Unmap().Is4() || !r.remote.IsValid() && clientV6 {
+		template += 2
+	}
+	return template
+}
+
+// appendData appends the data record of the template of r
+func (r *flowRecord) appendData(b []byte) []byte {
+	clientV6 := !r.client.Addr().Unmap().Is4()
+	remoteV6 := r.template()&2 != 0
+
+	b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	b = append(b, r.protocol)
+	b = appendFlowAddr(b, r.client, clientV6)
+	b = appendFlowAddr(b, r.local, clientV6)
+	b = appendFlowAddr(b, r.outbound, remoteV6)
+	b = appendFlowAddr(b, r.remote, remoteV6)
+	b = binary.BigEndian.AppendUint64(b, r.octetsUp)
+	b = binary.BigEndian.AppendUint64(b, r.octetsDown)
+	b = binary.BigEndian.AppendUint64(b, r.packetsUp)
+	b = binary.BigEndian.AppendUint64(b, r.packetsDown)
+
+	user := r.user
+	if len(user) >= ipfixShortVariableLength {
+		user = user[:ipfixShortVariableLength-1]
+	}
+	b = append(b, byte(len(user)))
+	return append(b, user...)
+}
+
+// appendFlowAddr appends the address and port of ap, zero if unknown
+func appendFlowAddr(b []byte, ap netip.AddrPort, v6 bool) []byte {
+	ip := ap.Addr().Unmap()
+	switch {
+	case v6 && ip.IsValid():
+		addr := ip.As16()
+		b = append(b, addr[:]...)
+	case v6:
+		b = append(b, make([]byte, 16)...)
+	case ip.Is4():
+		addr := ip.As4()
+		b = append(b, addr[:]...)
+	default:
+		b = append(b, make([]byte, 4)...)
+	}
+	return binary.BigEndian.AppendUint16(b, ap.Port())
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exit codes of an orderly shutdown, errors at startup exit with 1
+const (
+	exitOK = 0
+	// exitDrainTimeout means connections were closed by force, after
+	// DRAIN_TIMEOUT or a second signal
+	exitDrainTimeout = 3
+	// exitFlushFailed means accounting records or state may be lost
+	exitFlushFailed = 4
+)
+
+// lifecycle shuts the process down in order: on SIGTERM, SIGINT, a stop
+// of the Windows service or once an upgraded process took over, it
+// drains the connections for up to the drain timeout, then flushes the
+// accounting state and the queued records within the flush timeout. A
+// second signal closes the remaining connections at once.
+type lifecycle struct {
+	server       *socks5.Server
+	drainTimeout time.Duration
+	flushTimeout time.Duration
+
+	mu       sync.Mutex
+	flushers []flusher
+
+	// saving is closed once the state is no longer saved periodically
+	saving     chan struct{}
+	done       chan struct{}
+	handedOver bool
+	code       int
+}
+
+// flusher is a step of the shutdown, state marks those belonging to an
+// upgraded process once it took over
+type flusher struct {
+	name  string
+	flush func(ctx context.Context) error
+	state bool
+}
+
+// newLifecycle returns a lifecycle draining for up to drainTimeout and
+// flushing within flushTimeout
+func newLifecycle(drainTimeout, flushTimeout time.Duration) *lifecycle {
+	return &lifecycle{
+		drainTimeout: drainTimeout,
+		flushTimeout: flushTimeout,
+		saving:       make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// onShutdown adds flush to the steps run once the connections are
+// drained, in the reverse order, so that sinks added first like the log
+// shipper are flushed last
+func (lc *lifecycle) onShutdown(name string, flush func(ctx context.Context) error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.flushers = append(lc.flushers, flusher{name: name, flush: flush})
+}
+
+// onShutdownState is onShutdown for state an upgraded process takes
+// over, skipped then
+func (lc *lifecycle) onShutdownState(name string, flush func(ctx context.Context) error) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.flushers = append(lc.flushers, flusher{name: name, flush: flush, state: true})
+}
+
+// run waits for the shutdown of server in the background
+func (lc *lifecycle) run(server *socks5.Server, serviceStop <-chan struct{}, upgraded <-chan int) {
+	lc.server = server
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		var reason string
+		select {
+		case s := <-sig:
+			reason = fmt.Sprintf("Received %v", s)
+		case <-serviceStop:
+			reason = "Service stop requested"
+		case pid := <-upgraded:
+			reason = fmt.Sprintf("Upgraded to process %d", pid)
+			lc.handedOver = true
+			close(lc.saving)
+		}
+		lc.shutdown(reason, sig)
+		close(lc.done)
+	}()
+}
+
+// shutdown drains and flushes, sig interrupting the drain
+func (lc *lifecycle) shutdown(reason string, sig <-chan os.Signal) {
+	logrus.Infof("%s, draining connections for up to %s", reason, lc.drainTimeout)
+	drained := make(chan error, 1)
+	go func() { drained <- lc.server.Drain(lc.drainTimeout) }()
+	select {
+	case err := <-drained:
+		if err != nil {
+			logrus.Warn(err)
+			lc.code = exitDrainTimeout
+		}
+	case s := <-sig:
+		logrus.Warnf("Received %v again, closing connections", s)
+		lc.server.Drain(0)
+		<-drained
+		lc.code = exitDrainTimeout
+	}
+	if !lc.handedOver {
+		close(lc.saving)
+	}
+
+	lc.mu.Lock()
+	flushers := lc.flushers
+	lc.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), lc.flushTimeout)
+	defer cancel()
+	for _, f := range slices.Backward(flushers) {
+		if f.state && lc.handedOver {
+			continue
+		}
+		if err := f.flush(ctx); err != nil {
+			logrus.Errorf("failed to flush %s: %v", f.name, err)
+			if lc.code == exitOK {
+				lc.code = exitFlushFailed
+			}
+		}
+	}
+	logrus.Infof("Shutdown complete")
+}
+
+// wait returns the exit code once the shutdown is complete
+func (lc *lifecycle) wait() int {
+	<-lc.done
+	return lc.code
+}
+
+// requestFlush asks the goroutine of a sink reading requests to flush its
+// queue, waiting for the result it sends on the channel of the request
+func requestFlush(ctx context.Context, requests chan<- chan error) error {
+	done := make(chan error, 1)
+	select {
+	case requests <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
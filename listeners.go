@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/sirupsen/logrus"
+)
+
+// listenerProfileVars are the settings of a listener profile file besides
+// those of shadowPolicyVars, which apply in addition to the policy of the
+// environment
+var listenerProfileVars = map[string]bool{
+	"LISTENER_AUTH":             true,
+	"LISTENER_TLS":              true,
+	"LISTENER_DIALER":           true,
+	"ALLOW_UNTRUSTED_WITH_AUTH": true,
+	"USER_DIALERS":              true,
+}
+
+// ListenerProfile is a listener of LISTENERS, served with the overrides
+// of its profile
+type ListenerProfile struct {
+	Port    string
+	TLS     bool
+	Profile *socks5.Profile
+}
+
+// loadListenerProfiles parses the LISTENERS entries "name=port:file",
+// whose files of KEY=VALUE lines override settings of environ, see
+// loadListenerProfile. authenticates reports whether clients can
+// authenticate with the credentials of the environment and passwords
+// holds those of upstream proxies, see parseDialer.
+func loadListenerProfiles(specs map[string]string, environ map[string]string, authenticates bool, passwords socks5.SecretStore) ([]ListenerProfile, error) {
+	var profiles []ListenerProfile
+	for _, name := range slices.Sorted(maps.Keys(specs)) {
+		port, path, found := strings.Cut(specs[name], ":")
+		if !found {
+			return nil, fmt.Errorf("invalid listener %q: want port:file", name)
+		}
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid listener %q: invalid port %q", name, port)
+		}
+		lp, err := loadListenerProfile(name, path, environ, authenticates, passwords)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener %q: %v", name, err)
+		}
+		lp.Port = port
+		profiles = append(profiles, lp)
+	}
+	return profiles, nil
+}
+
+// loadListenerProfile reads the profile of the listener name from path.
+// LISTENER_AUTH is "none" to offer no authentication or "required" to
+// make trusted clients authenticate too, LISTENER_TLS serves SOCKS over
+// TLS and LISTENER_DIALER is the dialer of its CONNECTs, in the format of
+// USER_DIALERS, which takes precedence for its users.
+func loadListenerProfile(name, path string, environ map[string]string, authenticates bool, passwords socks5.SecretStore) (ListenerProfile, error) {
+	allowed := maps.Clone(shadowPolicyVars)
+	maps.Copy(allowed, listenerProfileVars)
+	settings, err := readSettingsFile(path, allowed)
+	if err != nil {
+		return ListenerProfile{}, err
+	}
+
+	lp := ListenerProfile{Profile: &socks5.Profile{Name: name}}
+	switch auth := settings["LISTENER_AUTH"]; auth {
+	case "":
+	case "none":
+		lp.Profile.AuthMethods = []socks5.Authenticator{socks5.NoAuthAuthenticator{}}
+	case "required":
+		if !authenticates {
+			return lp, fmt.Errorf("LISTENER_AUTH required needs PROXY_USER and PROXY_PASSWORD or a credential store")
+		}
+		lp.Profile.RequireAuth = true
+	default:
+		return lp, fmt.Errorf("invalid LISTENER_AUTH %q: must be none or required", auth)
+	}
+	if value, found := settings["LISTENER_TLS"]; found {
+		if lp.TLS, err = strconv.ParseBool(value); err != nil {
+			return lp, fmt.Errorf("invalid LISTENER_TLS %q", value)
+		}
+	}
+	if value, found := settings["ALLOW_UNTRUSTED_WITH_AUTH"]; found {
+		if lp.Profile.AllowUntrustedWithAuth, err = strconv.ParseBool(value); err != nil {
+			return lp, fmt.Errorf("invalid ALLOW_UNTRUSTED_WITH_AUTH %q", value)
+		}
+		if lp.Profile.AllowUntrustedWithAuth && (!authenticates || settings["LISTENER_AUTH"] == "none") {
+			return lp, fmt.Errorf("ALLOW_UNTRUSTED_WITH_AUTH requires clients to be able to authenticate")
+		}
+	}
+
+	// The policy of the file only, the environment's is enforced anyway
+	environ = maps.Clone(environ)
+	for key := range shadowPolicyVars {
+		delete(environ, key)
+	}
+	delete(environ, "USER_DIALERS")
+	delete(environ, "PROXY_USERS_JSON")
+	for key, value := range settings {
+		if !listenerProfileVars[key] || key == "USER_DIALERS" {
+			environ[key] = value
+		}
+	}
+	var cfg params
+	if err := env.ParseWithOptions(&cfg, env.Options{Environment: environ}); err != nil {
+		return lp, err
+	}
+	if lp.Profile.Rules, err = policyRules(cfg); err != nil {
+		return lp, err
+	}
+
+	var dialers ListenerDialers
+	if len(cfg.UserDialers) > 0 {
+		if dialers.Users, err = parseUserDialers(cfg.UserDialers, passwords); err != nil {
+			return lp, fmt.Errorf("invalid USER_DIALERS: %v", err)
+		}
+	}
+	if spec := settings["LISTENER_DIALER"]; spec != "" {
+		if dialers.Dial, err = parseDialer(spec, passwords); err != nil {
+			return lp, fmt.Errorf("invalid LISTENER_DIALER: %v", err)
+		}
+	}
+	if dialers.Users != nil || dialers.Dial != nil {
+		lp.Profile.DialerSelector = dialers
+	}
+	return lp, nil
+}
+
+// ListenerDialers is a socks5.DialerSelector connecting the CONNECTs of a
+// listener with the dialers of its users, or its own
+type ListenerDialers struct {
+	Users UserDialers
+	Dial  socks5.DialFunc
+}
+
+func (d ListenerDialers) SelectDialer(ctx context.Context, auth *socks5.AuthContext, req *socks5.Request) socks5.DialFunc {
+	if dial := d.Users.SelectDialer(ctx, auth, req); dial != nil {
+		return dial
+	}
+	return d.Dial
+}
+
+// serveListenerProfiles opens the listeners of profiles and serves them
+// through server, those with TLS with conf
+func serveListenerProfiles(server *socks5.Server, profiles []ListenerProfile, conf *tls.Config) error {
+	for _, lp := range profiles {
+		l, err := upgrades.listen("tcp", ":"+lp.Port, net.Listen)
+		if err != nil {
+			return err
+		}
+		over := ""
+		if lp.TLS {
+			l = tls.NewListener(l, conf)
+			over = " over TLS"
+		}
+		logrus.Infof("Start listening proxy service %s%s on port %s", lp.Profile.Name, over, lp.Port)
+		go func() {
+			if err := server.ServeProfile(l, lp.Profile); err != nil && err != socks5.ErrServerClosed {
+				logrus.Errorf("proxy service %s stopped: %v", lp.Profile.Name, err)
+			}
+		}()
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// lokiPushPath is the path of the push API, appended to URLs without
+	// a path
+	lokiPushPath = "/loki/api/v1/push"
+
+	// lokiQueue is the number of entries waiting to be pushed, further
+	// ones are dropped
+	lokiQueue = 10000
+
+	// lokiBatch and lokiFlushInterval bound how many entries are pushed
+	// together and how long they wait to be batched
+	lokiBatch         = 1000
+	lokiFlushInterval = time.Second
+
+	// lokiTimeout bounds a push
+	lokiTimeout = 10 * time.Second
+)
+
+// LokiShipper is a logrus hook pushing log entries at or above a level to
+// a Grafana Loki endpoint in batches, as JSON lines labeled with the
+// instance, the level and the kind of entry. Access log entries are also
+// labeled with the user and the result: ok, error or denied. Entries are
+// pushed in the background, entries beyond a full queue are dropped.
+type LokiShipper struct {
+	url    string
+	auth   string
+	tenant string
+	level  logrus.Level
+	labels map[string]string
+
+	formatter logrus.JSONFormatter
+	entries   chan lokiEntry
+	flushes   chan chan error
+	dropped   atomic.Uint64
+}
+
+// lokiEntry is a formatted log line and its labels
+type lokiEntry struct {
+	labels map[string]string
+	time   time.Time
+	line   string
+}
+
+// lokiStream is a stream of the push API
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// NewLokiShipper creates a LokiShipper pushing to rawURL, with the basic
+// auth credentials it contains, as tenant if set. The labels are added to
+// every stream, instance defaults to the hostname.
+func NewLokiShipper(rawURL, tenant string, labels map[string]string, level logrus.Level) (*LokiShipper, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid URL %q: must be http or https", u.Redacted())
+	}
+	if u.Path == "" || u.Path == "/" {
+		u.Path = lokiPushPath
+	}
+	l := &LokiShipper{
+		tenant:  tenant,
+		level:   level,
+		labels:  map[string]string{},
+		entries: make(chan lokiEntry, lokiQueue),
+		flushes: make(chan chan error),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		req, _ := http.NewRequest(http.MethodPost, "/", nil)
+		req.SetBasicAuth(u.User.Username(), password)
+		l.auth = req.Header.Get("Authorization")
+		u.User = nil
+	}
+	l.url = u.String()
+	if hostname, err := os.Hostname(); err == nil {
+		l.labels["instance"] = hostname
+	}
+	maps.Copy(l.labels, labels)
+	go l.run()
+	return l, nil
+}
+
+// Levels makes LokiShipper a logrus.Hook
+func (l *LokiShipper) Levels() []logrus.Level {
+	return logrus.AllLevels[:l.level+1]
+}
+
+// Fire queues a log entry, except entries about failing to push
+func (l *LokiShipper) Fire(entry *logrus.Entry) error {
+	if _, found := entry.Data["loki"]; found {
+		return nil
+	}
+	line, err := l.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+
+	labels := maps.Clone(l.labels)
+	labels["level"] = entry.Level.String()
+	labels["kind"] = "log"
+	if entry.Message == "access" {
+		labels["kind"] = "access"
+		labels["result"] = "ok"
+		if _, found := entry.Data["deny_rule"]; found {
+			labels["result"] = "denied"
+		} else if _, found := entry.Data["error"]; found {
+			labels["result"] = "error"
+		}
+		if user, ok := entry.Data["user"].(string); ok {
+			labels["user"] = user
+		}
+	}
+
+	select {
+	case l.entries <- lokiEntry{labels: labels, time: entry.Time, line: string(bytes.TrimSpace(line))}:
+	default:
+		if l.dropped.Add(1)%1000 == 1 {
+			logrus.WithField("loki", true).Warnf("Loki queue full, dropped %d log entries so far", l.dropped.Load())
+		}
+	}
+	return nil
+}
+
+// Flush pushes the queued entries, returning once they are or when ctx
+// is done
+func (l *LokiShipper) Flush(ctx context.Context) error {
+	return requestFlush(ctx, l.flushes)
+}
+
+// run pushes the queued entries in batches
+func (l *LokiShipper) run() {
+	ticker := time.NewTicker(lokiFlushInterval)
+	defer ticker.Stop()
+	var batch []lokiEntry
+	push := func() error {
+		err := l.push(batch)
+		if err != nil {
+			logrus.WithField("loki", true).Warnf("failed to push %d log entries to Loki: %v", len(batch), err)
+		}
+		batch = batch[:0]
+		return err
+	}
+	for {
+		select {
+		case e := <-l.entries:
+			if batch = append(batch, e); len(batch) < lokiBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done := <-l.flushes:
+			var err error
+			for n := len(l.entries); n > 0; n-- {
+				if batch = append(batch, <-l.entries); len(batch) == lokiBatch {
+					err = cmp.Or(push(), err)
+				}
+			}
+			if len(batch) > 0 {
+				err = cmp.Or(push(), err)
+			}
+			done <- err
+			continue
+		}
+		push()
+	}
+}
+
+// push sends a batch grouped by streams
+func (l *LokiShipper) push(batch []lokiEntry) error {
+	streams := make(map[string]*lokiStream)
+	var keys []string
+	for _, e := range batch {
+		key := streamKey(e.labels)
+		s, found := streams[key]
+		if !found {
+			s = &lokiStream{Stream: e.labels}
+			streams[key] = s
+			keys = append(keys, key)
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(e.time.UnixNano(), 10), e.line})
+	}
+	body := struct {
+		Streams []*lokiStream `json:"streams"`
+	}{}
+	for _, key := range keys {
+		body.Streams = append(body.Streams, streams[key])
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lokiTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if l.auth != "" {
+		req.Header.Set("Authorization", l.auth)
+	}
+	if l.tenant != "" {
+		req.Header.Set("X-Scope-OrgID", l.tenant)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// streamKey identifies the stream of a label set
+func streamKey(labels map[string]string) string {
+	var key strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		key.WriteString(name + "=" + strconv.Quote(labels[name]) + ",")
+	}
+	return key.String()
+}
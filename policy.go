@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+// Policy restricts the destinations an authenticated user may reach and
+// when. An empty list of destinations, ports or windows leaves them
+// unrestricted.
+type Policy struct {
+	// Domains are host names, or "*.domain" to match any subdomain
+	Domains []string
+	// Networks are the destination IP ranges
+	Networks []netip.Prefix
+	// Ports are the destination port ranges
+	Ports []socks5.PortRange
+	// Schedule are the time windows requests are allowed in
+	Schedule []TimeWindow
+	// BandwidthClass shapes the tunnels of the user if set
+	BandwidthClass string
+	// Quota overrides the default traffic quota if set
+	Quota *uint64
+}
+
+// policyEntries are the raw settings policies are built from, keyed by
+// user or group name
+type policyEntries struct {
+	Destinations     map[string]string
+	Ports            map[string]string
+	Schedules        map[string]string
+	BandwidthClasses map[string]string
+	Quotas           map[string]uint64
+}
+
+// parseDestinations adds destinations separated by "," which are either
+// host names, "*.domain" wildcards, IP addresses or CIDRs
+func (p *Policy) parseDestinations(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		switch {
+		case entry == "":
+		case strings.Contains(entry, "/"):
+			prefix, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return fmt.Errorf("invalid destination %q: %v", entry, err)
+			}
+			p.Networks = append(p.Networks, prefix.Masked())
+		default:
+			if ip, err := netip.ParseAddr(entry); err == nil {
+				p.Networks = append(p.Networks, netip.PrefixFrom(ip, ip.BitLen()))
+				continue
+			}
+			if !hostnamePattern.MatchString(strings.TrimPrefix(entry, "*.")) {
+				return fmt.Errorf("invalid destination %q", entry)
+			}
+			p.Domains = append(p.Domains, strings.TrimSuffix(entry, "."))
+		}
+	}
+	return nil
+}
+
+// parsePorts adds ports or "min-max" port ranges separated by ","
+func (p *Policy) parsePorts(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		first, last, found := strings.Cut(entry, "-")
+		if !found {
+			last = first
+		}
+		lo, errMin := strconv.ParseUint(first, 10, 16)
+		hi, errMax := strconv.ParseUint(last, 10, 16)
+		if errMin != nil || errMax != nil || lo == 0 || lo > hi {
+			return fmt.Errorf("invalid port range %q", entry)
+		}
+		p.Ports = append(p.Ports, socks5.PortRange{Min: uint16(lo), Max: uint16(hi)})
+	}
+	return nil
+}
+
+// parseSchedule adds time windows separated by ","
+func (p *Policy) parseSchedule(s string) error {
+	for _, entry := range strings.Split(s, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		w, err := parseTimeWindow(entry)
+		if err != nil {
+			return err
+		}
+		p.Schedule = append(p.Schedule, w)
+	}
+	return nil
+}
+
+// parsePolicies builds the policy of every user or group from its
+// entries
+func parsePolicies(entries policyEntries) (map[string]*Policy, error) {
+	policies := make(map[string]*Policy)
+	policy := func(name string) *Policy {
+		if policies[name] == nil {
+			policies[name] = &Policy{}
+		}
+		return policies[name]
+	}
+	parsers := []struct {
+		values map[string]string
+		parse  func(*Policy, string) error
+	}{
+		{entries.Destinations, (*Policy).parseDestinations},
+		{entries.Ports, (*Policy).parsePorts},
+		{entries.Schedules, (*Policy).parseSchedule},
+	}
+	for _, parser := range parsers {
+		for name, entry := range parser.values {
+			if err := parser.parse(policy(name), entry); err != nil {
+				return nil, fmt.Errorf("policy of %q: %v", name, err)
+			}
+		}
+	}
+	for name, class := range entries.BandwidthClasses {
+		policy(name).BandwidthClass = strings.TrimSpace(class)
+	}
+	for name, quota := range entries.Quotas {
+		policy(name).Quota = &quota
+	}
+	return policies, nil
+}
+
+// inheritPolicies completes the policy of each user with those of the
+// groups they belong to, members mapping users to "," separated groups.
+// Destinations, ports and schedules the user has no entries for are
+// combined from all their groups, the bandwidth class is that of the
+// first group with one and the quota, unless the user has one, is the
+// largest of their groups.
+func inheritPolicies(users, groups map[string]*Policy, members map[string]string) error {
+	for user, list := range members {
+		var inherited []*Policy
+		for _, group := range strings.Split(list, ",") {
+			group = strings.TrimSpace(group)
+			if group == "" {
+				continue
+			}
+			p, found := groups[group]
+			if !found {
+				return fmt.Errorf("user %q belongs to unknown group %q", user, group)
+			}
+			inherited = append(inherited, p)
+		}
+
+		own := users[user]
+		if own == nil {
+			own = &Policy{}
+			users[user] = own
+		}
+		domains, networks, ports, schedule := own.Domains, own.Networks, own.Ports, own.Schedule
+		ownHosts := len(domains) > 0 || len(networks) > 0
+		ownQuota := own.Quota != nil
+		for _, p := range inherited {
+			if !ownHosts {
+				domains = append(domains, p.Domains...)
+				networks = append(networks, p.Networks...)
+			}
+			if len(own.Ports) == 0 {
+				ports = append(ports, p.Ports...)
+			}
+			if len(own.Schedule) == 0 {
+				schedule = append(schedule, p.Schedule...)
+			}
+			if own.BandwidthClass == "" {
+				own.BandwidthClass = p.BandwidthClass
+			}
+			if !ownQuota && p.Quota != nil && (own.Quota == nil || *own.Quota != 0 && (*p.Quota == 0 || *p.Quota > *own.Quota)) {
+				own.Quota = p.Quota
+			}
+		}
+		own.Domains, own.Networks, own.Ports, own.Schedule = domains, networks, ports, schedule
+	}
+	return nil
+}
+
+// check returns why the policy denies dest, or an empty string if it
+// allows it
+func (p *Policy) check(dest *socks5.AddrSpec, now time.Time) string {
+	if !p.allowsTime(now) {
+		return "outside the allowed hours"
+	}
+	if !p.allowsPort(dest.Port) {
+		return fmt.Sprintf("port %d not allowed", dest.Port)
+	}
+	if !p.allowsHost(dest) {
+		return fmt.Sprintf("destination %v not allowed", dest)
+	}
+	return ""
+}
+
+// allowsTime reports whether the schedule of the policy includes t
+func (p *Policy) allowsTime(t time.Time) bool {
+	if len(p.Schedule) == 0 {
+		return true
+	}
+	for _, w := range p.Schedule {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPort reports whether the policy permits port
+func (p *Policy) allowsPort(port int) bool {
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, r := range p.Ports {
+		if port >= int(r.Min) && port <= int(r.Max) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsHost reports whether the policy permits dest, by its requested
+// host name or its IP address
+func (p *Policy) allowsHost(dest *socks5.AddrSpec) bool {
+	if len(p.Domains) == 0 && len(p.Networks) == 0 {
+		return true
+	}
+	if dest.FQDN != "" {
+		for _, domain := range p.Domains {
+			if matchDomain(domain, dest.FQDN) {
+				return true
+			}
+		}
+	}
+	if dest.IP.IsValid() {
+		ip := dest.IP.Unmap()
+		for _, prefix := range p.Networks {
+			if prefix.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchDomain reports whether host matches a domain or "*.domain" pattern
+func matchDomain(pattern, host string) bool {
+	if suffix, found := strings.CutPrefix(pattern, "*"); found {
+		return strings.HasSuffix(host, suffix)
+	}
+	return host == pattern
+}
+
+// UserPolicies returns a RuleSet which restricts the destinations, ports
+// and hours of users with a policy and assigns their bandwidth class. Other users and unauthenticated clients
+// are only subject to rules.
+func UserPolicies(rules socks5.RuleSet, policies map[string]*Policy) socks5.RuleSet {
+	return &UserPolicyRuleSet{rules, policies}
+}
+
+// UserPolicyRuleSet is an implementation of the RuleSet which gives each
+// tenant of a shared proxy access to their own backends only
+type UserPolicyRuleSet struct {
+	Rules    socks5.RuleSet
+	Policies map[string]*Policy
+}
+
+func (u *UserPolicyRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := u.Rules.Allow(ctx, req)
+	if !ok || req.Username() == "" {
+		return ctx, ok
+	}
+	p, found := u.Policies[req.Username()]
+	if !found {
+		return ctx, ok
+	}
+	if reason := p.check(req.DestAddr, time.Now()); reason != "" {
+		return socks5.WithDenyReason(ctx, "user_policy", fmt.Sprintf("%s for user %q", reason, req.Username())), false
+	}
+	if p.BandwidthClass != "" {
+		ctx = socks5.WithBandwidthClass(ctx, p.BandwidthClass)
+	}
+	return ctx, ok
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInheritPolicies(t *testing.T) {
+	tests := []struct {
+		name    string
+		users   policyEntries
+		groups  policyEntries
+		members string
+		want    policyEntries // the policy of the user
+		wantErr bool
+	}{
+		{
+			name:    "no own policy",
+			groups:  policyEntries{Destinations: map[string]string{"dev": "*.corp.example"}, Ports: map[string]string{"dev": "443"}},
+			members: "dev",
+			want:    policyEntries{Destinations: map[string]string{"alice": "*.corp.example"}, Ports: map[string]string{"alice": "443"}},
+		},
+		{
+			name:    "own destinations kept",
+			users:   policyEntries{Destinations: map[string]string{"alice": "a.example"}},
+			groups:  policyEntries{Destinations: map[string]string{"dev": "b.example"}, Ports: map[string]string{"dev": "443"}},
+			members: "dev",
+			want:    policyEntries{Destinations: map[string]string{"alice": "a.example"}, Ports: map[string]string{"alice": "443"}},
+		},
+		{
+			name:    "destinations of all groups",
+			groups:  policyEntries{Destinations: map[string]string{"dev": "a.example", "ops": "10.0.0.0/8"}},
+			members: "dev, ops",
+			want:    policyEntries{Destinations: map[string]string{"alice": "a.example,10.0.0.0/8"}},
+		},
+		{
+			name:    "bandwidth class of the first group",
+			groups:  policyEntries{BandwidthClasses: map[string]string{"dev": "slow", "ops": "fast"}},
+			members: "dev,ops",
+			want:    policyEntries{BandwidthClasses: map[string]string{"alice": "slow"}},
+		},
+		{
+			name:    "own bandwidth class kept",
+			users:   policyEntries{BandwidthClasses: map[string]string{"alice": "vip"}},
+			groups:  policyEntries{BandwidthClasses: map[string]string{"dev": "slow"}},
+			members: "dev",
+			want:    policyEntries{BandwidthClasses: map[string]string{"alice": "vip"}},
+		},
+		{
+			name:    "largest quota of the groups",
+			groups:  policyEntries{Quotas: map[string]uint64{"dev": 100, "ops": 200}},
+			members: "dev,ops",
+			want:    policyEntries{Quotas: map[string]uint64{"alice": 200}},
+		},
+		{
+			name:    "unlimited quota of a group",
+			groups:  policyEntries{Quotas: map[string]uint64{"dev": 100, "ops": 0}},
+			members: "ops,dev",
+			want:    policyEntries{Quotas: map[string]uint64{"alice": 0}},
+		},
+		{
+			name:    "own quota kept",
+			users:   policyEntries{Quotas: map[string]uint64{"alice": 50}},
+			groups:  policyEntries{Quotas: map[string]uint64{"dev": 200}},
+			members: "dev",
+			want:    policyEntries{Quotas: map[string]uint64{"alice": 50}},
+		},
+		{
+			name:    "own unlimited quota kept",
+			users:   policyEntries{Quotas: map[string]uint64{"alice": 0}},
+			groups:  policyEntries{Quotas: map[string]uint64{"dev": 200}},
+			members: "dev",
+			want:    policyEntries{Quotas: map[string]uint64{"alice": 0}},
+		},
+		{
+			name:    "unknown group",
+			groups:  policyEntries{Quotas: map[string]uint64{"dev": 200}},
+			members: "dev,ops",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := parsePolicies(tt.users)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, err := parsePolicies(tt.groups)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = inheritPolicies(users, groups, map[string]string{"alice": tt.members})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("unknown group accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := parsePolicies(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := users["alice"]; !reflect.DeepEqual(got, want["alice"]) {
+				t.Errorf("got policy %+v, want %+v", got, want["alice"])
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// dropPrivileges fails on platforms without Unix accounts
+func dropPrivileges(userName, groupName string) error {
+	return fmt.Errorf("RUN_AS_USER is only supported on Unix systems")
+}
@@ -0,0 +1,82 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the account userName and the
+// group groupName, by default the primary group of the account. Both can
+// be names or numeric IDs. Supplementary groups are dropped.
+func dropPrivileges(userName, groupName string) error {
+	u, err := lookupUser(userName)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid RUN_AS_USER %q: non-numeric uid %s", userName, u.Uid)
+	}
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := lookupGroup(groupName)
+		if err != nil {
+			return err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return fmt.Errorf("invalid RUN_AS_GROUP %q: non-numeric gid %s", groupName, gidStr)
+	}
+
+	// Processes started by an upgrade inherit the dropped privileges
+	if uid != 0 && syscall.Getuid() == uid && syscall.Geteuid() == uid && syscall.Getgid() == gid {
+		return nil
+	}
+
+	// Groups are changed first, the account has no right to
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set group %d: %v", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set user %d: %v", uid, err)
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return fmt.Errorf("privileges were not dropped: root can still be regained")
+	}
+	return nil
+}
+
+// lookupUser finds an account by name or numeric ID
+func lookupUser(name string) (*user.User, error) {
+	lookup := user.Lookup
+	if _, err := strconv.Atoi(name); err == nil {
+		lookup = user.LookupId
+	}
+	u, err := lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RUN_AS_USER %q: %v", name, err)
+	}
+	return u, nil
+}
+
+// lookupGroup finds a group by name or numeric ID
+func lookupGroup(name string) (*user.Group, error) {
+	lookup := user.LookupGroup
+	if _, err := strconv.Atoi(name); err == nil {
+		lookup = user.LookupGroupId
+	}
+	g, err := lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RUN_AS_GROUP %q: %v", name, err)
+	}
+	return g, nil
+}
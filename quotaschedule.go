@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// QuotaSchedule defines the periods after which quotas are reset: every
+// day, week or month at a time of day of Location. Day is the weekday of
+// weekly periods or the day of month, 1 to 28, of monthly ones.
+type QuotaSchedule struct {
+	Period   string
+	Day      int
+	Hour     int
+	Minute   int
+	Location *time.Location
+}
+
+// parseQuotaSchedule parses a daily, weekly or monthly period reset at
+// "HH:MM", "weekday HH:MM" or "day HH:MM" of timezone, which defaults to
+// the local time. An empty at resets at midnight, on Mondays or on the
+// first of the month.
+func parseQuotaSchedule(period, at, timezone string) (*QuotaSchedule, error) {
+	s := &QuotaSchedule{Period: period, Location: time.Local}
+	if timezone != "" {
+		loc, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+		s.Location = loc
+	}
+
+	fields := strings.Fields(at)
+	switch period {
+	case "daily":
+		if len(fields) == 0 {
+			fields = []string{"00:00"}
+		}
+		if len(fields) != 1 {
+			return nil, fmt.Errorf("invalid daily reset time %q: want HH:MM", at)
+		}
+	case "weekly":
+		if len(fields) == 0 {
+			fields = []string{"mon", "00:00"}
+		}
+		day, found := weekdays[strings.ToLower(fields[0])]
+		if len(fields) != 2 || !found {
+			return nil, fmt.Errorf("invalid weekly reset time %q: want weekday HH:MM", at)
+		}
+		s.Day = int(day)
+	case "monthly":
+		if len(fields) == 0 {
+			fields = []string{"1", "00:00"}
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid monthly reset time %q: want day HH:MM", at)
+		}
+		day, err := strconv.Atoi(fields[0])
+		if err != nil || day < 1 || day > 28 {
+			return nil, fmt.Errorf("invalid monthly reset day %q: must be 1-28", fields[0])
+		}
+		s.Day = day
+	default:
+		return nil, fmt.Errorf("invalid period %q: must be daily, weekly or monthly", period)
+	}
+
+	t, err := time.Parse("15:04", fields[len(fields)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid reset time %q: want HH:MM", at)
+	}
+	s.Hour, s.Minute = t.Hour(), t.Minute()
+	return s, nil
+}
+
+// Start returns the beginning of the period containing t
+func (s *QuotaSchedule) Start(t time.Time) time.Time {
+	t = t.In(s.Location)
+	start := time.Date(t.Year(), t.Month(), t.Day(), s.Hour, s.Minute, 0, 0, s.Location)
+	switch s.Period {
+	case "weekly":
+		start = start.AddDate(0, 0, -(int(t.Weekday())-s.Day+7)%7)
+		if start.After(t) {
+			start = start.AddDate(0, 0, -7)
+		}
+	case "monthly":
+		start = time.Date(t.Year(), t.Month(), s.Day, s.Hour, s.Minute, 0, 0, s.Location)
+		if start.After(t) {
+			start = start.AddDate(0, -1, 0)
+		}
+	default:
+		if start.After(t) {
+			start = start.AddDate(0, 0, -1)
+		}
+	}
+	return start
+}
+
+// Next returns the beginning of the period following the one containing t
+func (s *QuotaSchedule) Next(t time.Time) time.Time {
+	start := s.Start(t)
+	switch s.Period {
+	case "weekly":
+		return start.AddDate(0, 0, 7)
+	case "monthly":
+		return start.AddDate(0, 1, 0)
+	default:
+		return start.AddDate(0, 0, 1)
+	}
+}
+
+// Run calls reset at the beginning of every period until ctx is done
+func (s *QuotaSchedule) Run(ctx context.Context, reset func()) {
+	for {
+		next := s.Next(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+		reset()
+		logrus.Infof("Reset quotas for the %s period starting %s", s.Period, next.Format(time.RFC3339))
+	}
+}
+
+// resetQuotas returns the reset function of quotas, sharing the reset
+// with the fleet through shared if set
+func resetQuotas(quotas *socks5.Quotas, shared *RedisQuotas, rollover bool) func() {
+	if shared != nil {
+		return func() { shared.Reset(context.Background(), rollover) }
+	}
+	return func() { quotas.ResetAll(rollover) }
+}
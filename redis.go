@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+// RedisCredentials is an implementation of the ContextCredentialStore
+// reading passwords from a Redis hash of usernames to passwords, shared by
+// a fleet of proxies. Lookups are cached for CacheTTL, and cached entries
+// keep being used for up to StaleTTL while Redis is unavailable.
+type RedisCredentials struct {
+	Client   *redis.Client
+	Key      string
+	CacheTTL time.Duration
+	StaleTTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]redisCredential
+}
+
+// redisCredential is a cached lookup, found is false for unknown users
+type redisCredential struct {
+	password string
+	found    bool
+	fetched  time.Time
+}
+
+// NewRedisCredentials creates a RedisCredentials reading the hash key
+func NewRedisCredentials(client *redis.Client, key string, cacheTTL, staleTTL time.Duration) *RedisCredentials {
+	return &RedisCredentials{
+		Client:   client,
+		Key:      key,
+		CacheTTL: cacheTTL,
+		StaleTTL: staleTTL,
+		cache:    make(map[string]redisCredential),
+	}
+}
+
+func (r *RedisCredentials) Valid(user, password string) bool {
+	return r.ValidContext(context.Background(), user, password, netip.AddrPort{})
+}
+
+func (r *RedisCredentials) ValidContext(ctx context.Context, user, password string, client netip.AddrPort) bool {
+	pass, found := r.lookup(ctx, user)
+	return found && subtle.ConstantTimeCompare([]byte(password), []byte(pass)) == 1
+}
+
+func (r *RedisCredentials) Secret(user string) (string, bool) {
+	return r.lookup(context.Background(), user)
+}
+
+// lookup returns the password of user, from the cache if fresh
+func (r *RedisCredentials) lookup(ctx context.Context, user string) (string, bool) {
+	r.mu.Lock()
+	cached, inCache := r.cache[user]
+	r.mu.Unlock()
+	if inCache && time.Since(cached.fetched) < r.CacheTTL {
+		return cached.password, cached.found
+	}
+
+	entry := redisCredential{fetched: time.Now()}
+	pass, err := r.Client.HGet(ctx, r.Key, user).Result()
+	switch {
+	case err == nil:
+		entry.password, entry.found = pass, true
+	case err == redis.Nil:
+	case inCache && time.Since(cached.fetched) < r.StaleTTL:
+		logrus.Warnf("failed to look up user %q in Redis, using cached entry: %v", user, err)
+		return cached.password, cached.found
+	default:
+		logrus.Errorf("failed to look up user %q in Redis: %v", user, err)
+		return "", false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.purge()
+	r.cache[user] = entry
+	return entry.password, entry.found
+}
+
+// purge drops entries too old to be used, the caller must hold the lock
+func (r *RedisCredentials) purge() {
+	maxAge := max(r.CacheTTL, r.StaleTTL)
+	for user, entry := range r.cache {
+		if time.Since(entry.fetched) >= maxAge {
+			delete(r.cache, user)
+		}
+	}
+}
+
+// RedisQuotas shares the usage of Quotas between a fleet of proxies
+// through a Redis hash of usernames to bytes used. With a Schedule each
+// period has its own hash, named after Key and the start of the period,
+// which expires one period after it ends.
+type RedisQuotas struct {
+	Client   *redis.Client
+	Key      string
+	Quotas   *socks5.Quotas
+	Schedule *QuotaSchedule
+
+	mu sync.Mutex
+	// synced is the usage last read from Redis
+	synced map[string]uint64
+	// period is the start of the current period if scheduled
+	period time.Time
+}
+
+// NewRedisQuotas creates a RedisQuotas sharing the usage of quotas in the
+// hash key, reset by schedule if set
+func NewRedisQuotas(client *redis.Client, key string, quotas *socks5.Quotas, schedule *QuotaSchedule) *RedisQuotas {
+	r := &RedisQuotas{Client: client, Key: key, Quotas: quotas, Schedule: schedule}
+	if schedule != nil {
+		r.period = schedule.Start(time.Now())
+	}
+	return r
+}
+
+// key returns the hash of the current period
+func (r *RedisQuotas) key() string {
+	if r.Schedule == nil {
+		return r.Key
+	}
+	return r.Key + ":" + r.period.UTC().Format("2006-01-02T15:04")
+}
+
+// Sync adds the usage counted since the previous Sync to Redis and
+// replaces it by the totals of the fleet. After an error the usage is
+// added again by the next Sync.
+func (r *RedisQuotas) Sync(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sync(ctx)
+}
+
+// sync implements Sync, the caller must hold the lock
+func (r *RedisQuotas) sync(ctx context.Context) error {
+	usage := r.Quotas.Usage()
+
+	key := r.key()
+	var totals *redis.MapStringStringCmd
+	_, err := r.Client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for user, n := range usage {
+			if n > r.synced[user] {
+				pipe.HIncrBy(ctx, key, user, int64(n-r.synced[user]))
+			}
+		}
+		if r.Schedule != nil {
+			next := r.Schedule.Next(r.period)
+			pipe.ExpireAt(ctx, key, next.Add(next.Sub(r.period)))
+		}
+		totals = pipe.HGetAll(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	synced := make(map[string]uint64, len(totals.Val()))
+	for user, v := range totals.Val() {
+		if n, err := strconv.ParseUint(v, 10, 64); err == nil {
+			synced[user] = n
+		}
+	}
+	r.Quotas.Rebase(usage, synced)
+	r.synced = synced
+	return nil
+}
+
+// Reset syncs the usage of the ending period and starts the next one,
+// rolling unused allowance over if rollover is set
+func (r *RedisQuotas) Reset(ctx context.Context, rollover bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.sync(ctx); err != nil {
+		logrus.Errorf("failed to sync quotas with Redis before reset: %v", err)
+	}
+	r.Quotas.ResetAll(rollover)
+	r.synced = nil
+	if r.Schedule != nil {
+		r.period = r.Schedule.Start(time.Now())
+	}
+}
+
+// Run syncs the usage every interval until ctx is done
+func (r *RedisQuotas) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := r.Sync(ctx); err != nil {
+			logrus.Errorf("failed to sync quotas with Redis: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
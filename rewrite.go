@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+// RewriteRule redirects destinations whose host and port match the
+// patterns. Host may reference submatches of HostPattern as $1, an empty
+// Host or zero Port keeps the requested one.
+type RewriteRule struct {
+	HostPattern *regexp.Regexp
+	PortPattern *regexp.Regexp
+	Host        string
+	Port        int
+}
+
+// Rewriter is an implementation of the AddressRewriter applying the first
+// matching rule
+type Rewriter struct {
+	Rules []RewriteRule
+}
+
+func (r *Rewriter) Rewrite(ctx context.Context, req *socks5.Request) (context.Context, *socks5.AddrSpec) {
+	dest := req.DestAddr
+	host := dest.FQDN
+	if host == "" {
+		host = dest.IP.String()
+	}
+	port := strconv.Itoa(dest.Port)
+
+	for _, rule := range r.Rules {
+		match := rule.HostPattern.FindStringSubmatchIndex(host)
+		if match == nil || !rule.PortPattern.MatchString(port) {
+			continue
+		}
+
+		rewritten := &socks5.AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: dest.Port}
+		if rule.Host != "" {
+			target := string(rule.HostPattern.ExpandString(nil, rule.Host, host, match))
+			if ip, err := netip.ParseAddr(target); err == nil {
+				rewritten.FQDN, rewritten.IP = "", ip
+			} else {
+				rewritten.FQDN, rewritten.IP = target, netip.Addr{}
+			}
+		}
+		if rule.Port != 0 {
+			rewritten.Port = rule.Port
+		}
+		requestLog(req).Infof("rewriting destination %v to %v", dest, rewritten)
+		return ctx, rewritten
+	}
+	return ctx, dest
+}
+
+// parseRewriteRule parses a "host-pattern port-pattern host port" rule.
+// Patterns match the whole host or port, "-" keeps the requested host or
+// port.
+func parseRewriteRule(s string) (RewriteRule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 4 {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q: want host-pattern port-pattern host port", s)
+	}
+
+	var rule RewriteRule
+	var err error
+	if rule.HostPattern, err = regexp.Compile("^(?:" + fields[0] + ")$"); err != nil {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q: %v", s, err)
+	}
+	if rule.PortPattern, err = regexp.Compile("^(?:" + fields[1] + ")$"); err != nil {
+		return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q: %v", s, err)
+	}
+	if fields[2] != "-" {
+		rule.Host = fields[2]
+	}
+	if fields[3] != "-" {
+		port, err := strconv.Atoi(fields[3])
+		if err != nil || port < 1 || port > 65535 {
+			return RewriteRule{}, fmt.Errorf("invalid rewrite rule %q: invalid port %q", s, fields[3])
+		}
+		rule.Port = port
+	}
+	return rule, nil
+}
+
+// parseRewriteRules reads one rule per line, skipping blank lines and
+// comments
+func parseRewriteRules(r io.Reader) ([]RewriteRule, error) {
+	var rules []RewriteRule
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseRewriteRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// loadRewriteRules builds the rewrite rules from inline entries followed
+// by the rules of the file at path, if set
+func loadRewriteRules(entries []string, path string) ([]RewriteRule, error) {
+	var rules []RewriteRule
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		rule, err := parseRewriteRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		fileRules, err := parseRewriteRules(f)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		rules = append(rules, fileRules...)
+	}
+	return rules, nil
+}
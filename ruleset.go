@@ -1,13 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"strings"
+	"time"
 
 	"context"
 
 	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
 )
 
+// requestLog returns a logger annotated with the user of the request
+func requestLog(req *socks5.Request) logrus.FieldLogger {
+	if user := req.Username(); user != "" {
+		return logrus.WithField("user", user)
+	}
+	return logrus.StandardLogger()
+}
+
 // PermitDestAddrPattern returns a RuleSet which selectively allows addresses
 func PermitDestAddrPattern(pattern string) socks5.RuleSet {
 	return &PermitDestAddrPatternRuleSet{pattern}
@@ -21,5 +34,92 @@ type PermitDestAddrPatternRuleSet struct {
 
 func (p *PermitDestAddrPatternRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
 	match, _ := regexp.MatchString(p.AllowedFqdnPattern, req.DestAddr.FQDN)
-	return ctx, match
+	if !match {
+		return socks5.WithDenyReason(ctx, "dest_pattern", fmt.Sprintf("%q does not match %q", req.DestAddr.FQDN, p.AllowedFqdnPattern)), false
+	}
+	return ctx, true
+}
+
+// UserTunnelDuration returns a RuleSet which attaches a per-user maximum
+// tunnel lifetime to requests allowed by rules
+func UserTunnelDuration(rules socks5.RuleSet, durations map[string]time.Duration) socks5.RuleSet {
+	return &UserTunnelDurationRuleSet{rules, durations}
+}
+
+// UserTunnelDurationRuleSet is an implementation of the RuleSet which
+// limits the tunnel lifetime of authenticated users
+type UserTunnelDurationRuleSet struct {
+	Rules     socks5.RuleSet
+	Durations map[string]time.Duration
+}
+
+func (u *UserTunnelDurationRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := u.Rules.Allow(ctx, req)
+	if !ok || req.Username() == "" {
+		return ctx, ok
+	}
+	if d, found := u.Durations[req.Username()]; found {
+		ctx = socks5.WithMaxTunnelDuration(ctx, d)
+	}
+	return ctx, ok
+}
+
+// UserDSCP returns a RuleSet which marks the outbound connections of
+// requests allowed by rules with a per-user DSCP value
+func UserDSCP(rules socks5.RuleSet, dscp map[string]uint8) socks5.RuleSet {
+	return &UserDSCPRuleSet{rules, dscp}
+}
+
+// UserDSCPRuleSet is an implementation of the RuleSet which classifies
+// the traffic of authenticated users for downstream QoS
+type UserDSCPRuleSet struct {
+	Rules socks5.RuleSet
+	DSCP  map[string]uint8
+}
+
+func (u *UserDSCPRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	ctx, ok := u.Rules.Allow(ctx, req)
+	if !ok || req.Username() == "" {
+		return ctx, ok
+	}
+	if dscp, found := u.DSCP[req.Username()]; found {
+		ctx = socks5.WithDSCP(ctx, dscp)
+	}
+	return ctx, ok
+}
+
+// UserTags returns a RuleSet which tags the sessions of authenticated
+// users, e.g. with their tenant, for the access log and labeled metrics
+func UserTags(rules socks5.RuleSet, tags map[string]map[string]string) socks5.RuleSet {
+	return &UserTagsRuleSet{rules, tags}
+}
+
+// UserTagsRuleSet is an implementation of the RuleSet which slices the
+// traffic of a multi-tenant proxy by user tags
+type UserTagsRuleSet struct {
+	Rules socks5.RuleSet
+	Tags  map[string]map[string]string
+}
+
+func (u *UserTagsRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if tags, found := u.Tags[req.Username()]; found {
+		ctx = socks5.WithTags(ctx, tags)
+	}
+	return u.Rules.Allow(ctx, req)
+}
+
+// parseUserTags parses "key:value,key:value" tags of each user
+func parseUserTags(entries map[string]string) (map[string]map[string]string, error) {
+	tags := make(map[string]map[string]string, len(entries))
+	for user, entry := range entries {
+		tags[user] = make(map[string]string)
+		for _, tag := range strings.Split(entry, ",") {
+			key, value, found := strings.Cut(strings.TrimSpace(tag), ":")
+			if !found || key == "" {
+				return nil, fmt.Errorf("invalid tag %q of %q: want key:value", tag, user)
+			}
+			tags[user][key] = value
+		}
+	}
+	return tags, nil
 }
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// enterSandbox restricts the process to the system calls and the files
+// serving needs, see sandbox. It is called once the server is set up:
+// files opened before, like the listeners and databases, remain usable.
+func enterSandbox(cfg params) error {
+	// Load the system roots while /etc/ssl and the like are reachable
+	x509.SystemCertPool()
+
+	read, write := sandboxPaths(cfg)
+	for _, dir := range write {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	return sandbox(read, write)
+}
+
+// sandboxPaths returns the directories the server reads from, and those
+// it writes to, while serving. Files are reloaded from their directory
+// since they are often replaced by renames or symlink swaps, e.g. with
+// Kubernetes secrets.
+func sandboxPaths(cfg params) (read, write []string) {
+	// The resolver rereads resolv.conf, hosts and nsswitch.conf
+	read = []string{"/etc"}
+	for _, file := range []string{
+		cfg.AllowedIPsFile, cfg.DestAllowFile, cfg.DestDenyFile, cfg.ShadowPolicyFile,
+		cfg.RewriteRulesFile, cfg.TLSCertFile, cfg.TLSKeyFile,
+	} {
+		if file != "" {
+			read = append(read, filepath.Dir(file))
+		}
+	}
+
+	// Vault logins read the service account token again
+	if cfg.VaultUsersPath != "" && cfg.VaultToken == "" {
+		read = append(read, filepath.Dir(cfg.VaultJWTPath))
+	}
+
+	for _, file := range []string{cfg.StateFile, cfg.BanListFile} {
+		if file != "" {
+			write = append(write, filepath.Dir(file))
+		}
+	}
+	for _, dir := range []string{cfg.CaptureDir, cfg.ElasticSpoolDir} {
+		if dir != "" {
+			write = append(write, dir)
+		}
+	}
+	if len(cfg.ACMEDomains) > 0 {
+		write = append(write, cfg.ACMECacheDir)
+	}
+	// SQLite creates its journal next to the database
+	if cfg.SQLDriver == "sqlite" {
+		path, _, _ := strings.Cut(strings.TrimPrefix(cfg.SQLDSN, "file:"), "?")
+		if path != "" && path != ":memory:" {
+			write = append(write, filepath.Dir(path))
+		}
+	}
+	return read, write
+}
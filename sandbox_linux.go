@@ -0,0 +1,202 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// sandboxDeniedSyscalls fail with EPERM in the sandbox: running programs,
+// inspecting other processes, changing credentials, namespaces, mounts
+// or the kernel, and io_uring which bypasses the filter
+var sandboxDeniedSyscalls = []uintptr{
+	unix.SYS_EXECVE, unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE, unix.SYS_PROCESS_VM_READV, unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_SETUID, unix.SYS_SETGID, unix.SYS_SETREUID, unix.SYS_SETREGID,
+	unix.SYS_SETRESUID, unix.SYS_SETRESGID, unix.SYS_SETGROUPS, unix.SYS_CAPSET,
+	unix.SYS_UNSHARE, unix.SYS_SETNS,
+	unix.SYS_MOUNT, unix.SYS_UMOUNT2, unix.SYS_PIVOT_ROOT, unix.SYS_CHROOT,
+	unix.SYS_OPEN_TREE, unix.SYS_MOVE_MOUNT, unix.SYS_FSOPEN, unix.SYS_FSCONFIG,
+	unix.SYS_FSMOUNT, unix.SYS_FSPICK, unix.SYS_MOUNT_SETATTR,
+	unix.SYS_OPEN_BY_HANDLE_AT, unix.SYS_NAME_TO_HANDLE_AT,
+	unix.SYS_INIT_MODULE, unix.SYS_FINIT_MODULE, unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD, unix.SYS_REBOOT, unix.SYS_SWAPON, unix.SYS_SWAPOFF,
+	unix.SYS_BPF, unix.SYS_PERF_EVENT_OPEN, unix.SYS_USERFAULTFD, unix.SYS_PERSONALITY,
+	unix.SYS_KEYCTL, unix.SYS_ADD_KEY, unix.SYS_REQUEST_KEY,
+	unix.SYS_ACCT, unix.SYS_QUOTACTL, unix.SYS_SETHOSTNAME, unix.SYS_SETDOMAINNAME,
+	unix.SYS_SETTIMEOFDAY, unix.SYS_CLOCK_SETTIME, unix.SYS_CLOCK_ADJTIME, unix.SYS_ADJTIMEX,
+	unix.SYS_IO_URING_SETUP, unix.SYS_IO_URING_ENTER, unix.SYS_IO_URING_REGISTER,
+}
+
+// sandboxAuditArchs are the seccomp architectures of the GOARCH values
+var sandboxAuditArchs = map[string]uint32{
+	"386":     unix.AUDIT_ARCH_I386,
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm":     unix.AUDIT_ARCH_ARM,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"loong64": unix.AUDIT_ARCH_LOONGARCH64,
+	"ppc64":   unix.AUDIT_ARCH_PPC64,
+	"ppc64le": unix.AUDIT_ARCH_PPC64LE,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+	"s390x":   unix.AUDIT_ARCH_S390X,
+}
+
+// sandbox restricts the filesystem to reading the read directories and
+// writing the write ones with Landlock, and installs a seccomp filter
+// denying the system calls the server has no use for. Without Landlock,
+// on kernels before 5.13 or in binaries built with cgo, only the filter
+// applies.
+func sandbox(read, write []string) error {
+	if err := landlock(read, write); err != nil {
+		var unavailable landlockUnavailable
+		if !errors.As(err, &unavailable) {
+			return err
+		}
+		logrus.Warnf("filesystem not sandboxed: %v", err)
+	}
+	return seccompFilter()
+}
+
+// landlockUnavailable is returned when Landlock cannot be enforced
+type landlockUnavailable struct {
+	err error
+}
+
+func (e landlockUnavailable) Error() string {
+	return e.err.Error()
+}
+
+// landlockReadAccess and landlockWriteAccess are the rights granted
+// beneath the read and write directories
+const (
+	landlockReadAccess  = unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR
+	landlockWriteAccess = landlockReadAccess | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE | unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE
+)
+
+// landlock restricts all threads to the read and write directories
+func landlock(read, write []string) error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return landlockUnavailable{fmt.Errorf("landlock is not supported by the kernel: %v", errno)}
+	}
+
+	// Handle every right the kernel knows of, so that all are denied
+	// outside of the rules
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR | unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR | unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG | unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO | unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("failed to create landlock ruleset: %v", errno)
+	}
+	defer unix.Close(int(fd))
+
+	rules := make(map[string]uint64)
+	for _, dir := range read {
+		rules[dir] |= landlockReadAccess
+	}
+	for _, dir := range write {
+		rules[dir] |= landlockWriteAccess
+	}
+	for dir, access := range rules {
+		dirFd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			logrus.Debugf("not allowing %s in the sandbox: %v", dir, err)
+			continue
+		}
+		rule := unix.LandlockPathBeneathAttr{Allowed_access: access & handled, Parent_fd: int32(dirFd)}
+		_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, fd, unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+		unix.Close(dirFd)
+		if errno != 0 {
+			return fmt.Errorf("failed to allow %s: %v", dir, errno)
+		}
+	}
+
+	// Landlock applies to the calling thread only, the runtime can apply
+	// it to all of them unless cgo created threads it does not know of
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		if errno == unix.ENOTSUP {
+			return landlockUnavailable{fmt.Errorf("landlock requires a binary built with CGO_ENABLED=0")}
+		}
+		return fmt.Errorf("failed to set no_new_privs: %v", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to enforce landlock ruleset: %v", errno)
+	}
+	return nil
+}
+
+// seccompFilter installs the filter denying sandboxDeniedSyscalls on all
+// threads. System calls of other architectures kill the process.
+func seccompFilter() error {
+	arch, found := sandboxAuditArchs[runtime.GOARCH]
+	if !found {
+		return fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+
+	const (
+		archOffset = 4 // offsetof(struct seccomp_data, arch)
+		nrOffset   = 0 // offsetof(struct seccomp_data, nr)
+		x32Bit     = 0x40000000
+	)
+	deny := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)}
+	// clone3 looks unimplemented rather than denied, so that the C
+	// library falls back to clone to create threads
+	unimplemented := unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)}
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: archOffset},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jt: 1, K: arch},
+		{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_KILL_PROCESS},
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: nrOffset},
+		// The x32 ABI of amd64 shares the architecture with other numbers
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jf: 1, K: x32Bit},
+		deny,
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: unix.SYS_CLONE3},
+		unimplemented,
+	}
+	for _, nr := range sandboxDeniedSyscalls {
+		filter = append(filter,
+			unix.SockFilter{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 1, K: uint32(nr)},
+			deny,
+		)
+	}
+	filter = append(filter, unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: unix.SECCOMP_RET_ALLOW})
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+
+	// no_new_privs is copied to the other threads along with the filter
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return os.NewSyscallError("prctl", err)
+	}
+	tid, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&prog)))
+	if errno != 0 {
+		return fmt.Errorf("failed to install seccomp filter: %v", errno)
+	}
+	if tid != 0 {
+		return fmt.Errorf("failed to install seccomp filter: thread %d has a conflicting filter", tid)
+	}
+	return nil
+}
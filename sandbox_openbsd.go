@@ -0,0 +1,34 @@
+//go:build openbsd
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+
+	"golang.org/x/sys/unix"
+)
+
+// sandboxPromises are the pledge(2) promises of the server: networking,
+// name resolution and reading and writing files
+const sandboxPromises = "stdio rpath wpath cpath flock inet dns unix"
+
+// sandbox hides the filesystem except the read and write directories
+// with unveil(2) and restricts the process to sandboxPromises with
+// pledge(2)
+func sandbox(read, write []string) error {
+	for _, dir := range read {
+		if err := unix.Unveil(dir, "r"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	for _, dir := range write {
+		if err := unix.Unveil(dir, "rwc"); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := unix.UnveilBlock(); err != nil {
+		return err
+	}
+	return unix.PledgePromises(sandboxPromises)
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !openbsd
+
+package main
+
+import "fmt"
+
+// sandbox fails on platforms without a supported sandbox
+func sandbox(read, write []string) error {
+	return fmt.Errorf("SANDBOX is only supported on Linux and OpenBSD")
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// weekdays maps day abbreviations to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// TimeWindow is a daily window of local time from Start to End, minutes
+// since midnight, on the days set in Days. Windows ending before they
+// start run past midnight.
+type TimeWindow struct {
+	Days  [7]bool
+	Start int
+	End   int
+}
+
+// parseTimeWindow parses a "[day[-day]] HH:MM-HH:MM" window, e.g.
+// "Mon-Fri 08:00-18:00". Without days the window applies every day.
+func parseTimeWindow(s string) (TimeWindow, error) {
+	var w TimeWindow
+	fields := strings.Fields(s)
+	switch len(fields) {
+	case 1:
+		for day := range w.Days {
+			w.Days[day] = true
+		}
+	case 2:
+		first, last, found := strings.Cut(strings.ToLower(fields[0]), "-")
+		if !found {
+			last = first
+		}
+		from, okFrom := weekdays[first]
+		to, okTo := weekdays[last]
+		if !okFrom || !okTo {
+			return w, fmt.Errorf("invalid days in time window %q", s)
+		}
+		for day := from; ; day = (day + 1) % 7 {
+			w.Days[day] = true
+			if day == to {
+				break
+			}
+		}
+	default:
+		return w, fmt.Errorf("invalid time window %q: want [day[-day]] HH:MM-HH:MM", s)
+	}
+
+	start, end, found := strings.Cut(fields[len(fields)-1], "-")
+	from, errStart := time.Parse("15:04", start)
+	to, errEnd := time.Parse("15:04", end)
+	if !found || errStart != nil || errEnd != nil || from.Equal(to) {
+		return w, fmt.Errorf("invalid hours in time window %q", s)
+	}
+	w.Start = from.Hour()*60 + from.Minute()
+	w.End = to.Hour()*60 + to.Minute()
+	return w, nil
+}
+
+// Contains reports whether t falls within the window
+func (w TimeWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return w.Days[t.Weekday()] && minute >= w.Start && minute < w.End
+	}
+	// The part after midnight belongs to the window of the previous day
+	if minute >= w.Start {
+		return w.Days[t.Weekday()]
+	}
+	return minute < w.End && w.Days[(t.Weekday()+6)%7]
+}
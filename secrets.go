@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// secretVars are the variables which can be read from the file named by
+// the same variable with a _FILE suffix, such as a Docker or Kubernetes
+// secret, keeping them out of the process environment
+var secretVars = []string{
+	"PROXY_USER",
+	"PROXY_PASSWORD",
+	"PROXY_PASSWORD_HASH",
+	"PROXY_USERS_JSON",
+	"ELASTIC_API_KEY",
+	"REDIS_URL",
+	"SQL_DSN",
+	"VAULT_TOKEN",
+	"ADMIN_TOKEN",
+}
+
+// secretEnvironment returns the environment with secretVars read from
+// their _FILE variables
+func secretEnvironment() (map[string]string, error) {
+	environ := env.ToMap(os.Environ())
+	for _, name := range secretVars {
+		path, found := environ[name+"_FILE"]
+		if !found {
+			continue
+		}
+		if _, set := environ[name]; set {
+			return nil, fmt.Errorf("%s and %s_FILE are mutually exclusive", name, name)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s_FILE: %v", name, err)
+		}
+		environ[name] = strings.TrimRight(string(data), "\r\n")
+	}
+	return environ, nil
+}
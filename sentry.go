@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sentryTimeout bounds the delivery of an event
+	sentryTimeout = 5 * time.Second
+
+	// sentryQueue is the number of events waiting to be sent, further
+	// ones are dropped
+	sentryQueue = 100
+
+	// sentryMaxEvents is the number of events sent per sentryWindow,
+	// sentryWindow also being how long repeated messages are suppressed
+	sentryMaxEvents = 30
+	sentryWindow    = time.Minute
+)
+
+// sentryLevels maps logrus levels to Sentry levels
+var sentryLevels = map[logrus.Level]string{
+	logrus.PanicLevel: "fatal",
+	logrus.FatalLevel: "fatal",
+	logrus.ErrorLevel: "error",
+	logrus.WarnLevel:  "warning",
+}
+
+// SentryReporter sends panics recovered while serving connections and
+// log entries at or above a level as events to a Sentry-compatible error
+// tracker. It is a logrus hook and its CapturePanic a socks5.Config.OnPanic
+// callback. Events are sent in the background, except for fatal entries
+// which are followed by the exit of the process. Repeated messages are
+// reported once per minute and at most 30 events are sent per minute.
+type SentryReporter struct {
+	endpoint    string
+	auth        string
+	dsn         string
+	level       logrus.Level
+	environment string
+	release     string
+	serverName  string
+
+	events chan *sentryEvent
+	recent map[string]time.Time
+}
+
+// sentryEvent is the subset of the Sentry event payload reported
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger"`
+	Message     string            `json:"message,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Exception   *sentryExceptions `json:"exception,omitempty"`
+	User        *sentryUser       `json:"user,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryUser struct {
+	Username  string `json:"username,omitempty"`
+	IPAddress string `json:"ip_address,omitempty"`
+}
+
+// NewSentryReporter creates a SentryReporter for the project of dsn, like
+// https://key@sentry.example.com/42, reporting log entries at level or
+// above as occurring in environment
+func NewSentryReporter(dsn, environment string, level logrus.Level) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	// The project is the last segment of the path, optionally preceded by
+	// the path of the tracker
+	path := strings.TrimSuffix(u.Path, "/")
+	i := strings.LastIndex(path, "/")
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User.Username() == "" || i < 0 || i == len(path)-1 {
+		return nil, fmt.Errorf("invalid DSN, must be like https://key@host/project")
+	}
+	prefix, project := path[:i], path[i+1:]
+
+	r := &SentryReporter{
+		endpoint:    fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, project),
+		auth:        "Sentry sentry_version=7, sentry_client=socks5-server, sentry_key=" + u.User.Username(),
+		dsn:         dsn,
+		level:       level,
+		environment: environment,
+		release:     buildRelease(),
+		events:      make(chan *sentryEvent, sentryQueue),
+		recent:      make(map[string]time.Time),
+	}
+	r.serverName, _ = os.Hostname()
+	go r.run()
+	return r, nil
+}
+
+// Levels makes SentryReporter a logrus.Hook
+func (r *SentryReporter) Levels() []logrus.Level {
+	var levels []logrus.Level
+	for level := range sentryLevels {
+		if level <= r.level {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// Fire reports a log entry, except entries of recovered panics reported
+// by CapturePanic and entries about failing to report
+func (r *SentryReporter) Fire(entry *logrus.Entry) error {
+	if _, found := entry.Data["panic"]; found {
+		return nil
+	}
+	if _, found := entry.Data["sentry"]; found {
+		return nil
+	}
+	e := r.newEvent(sentryLevels[entry.Level], entry.Time)
+	e.Message = entry.Message
+	for key, value := range entry.Data {
+		if e.Extra == nil {
+			e.Extra = make(map[string]any)
+		}
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		e.Extra[key] = value
+	}
+	if user, ok := entry.Data["user"].(string); ok {
+		e.User = &sentryUser{Username: user}
+	}
+	if entry.Level <= logrus.FatalLevel {
+		// The process exits once the hooks returned
+		r.send(e)
+		return nil
+	}
+	r.queue(e)
+	return nil
+}
+
+// CapturePanic reports a panic recovered while serving sess, it is a
+// socks5.Config.OnPanic callback
+func (r *SentryReporter) CapturePanic(sess socks5.Session, v any, stack []byte) {
+	e := r.newEvent("fatal", time.Now())
+	e.Exception = &sentryExceptions{Values: []sentryException{{
+		Type:       fmt.Sprintf("panic %T", v),
+		Value:      fmt.Sprint(v),
+		Stacktrace: &sentryStacktrace{Frames: parseStack(stack)},
+	}}}
+	e.User = &sentryUser{Username: sess.User, IPAddress: sess.Client.Addr().String()}
+	e.Tags = map[string]string{}
+	if sess.Command != "" {
+		e.Tags["command"] = sess.Command
+	}
+	for key, value := range sess.Tags {
+		e.Tags["tag_"+key] = value
+	}
+	e.Extra = map[string]any{"session": sess.ID, "client": sess.Client.String()}
+	if sess.Dest != nil {
+		e.Extra["destination"] = sess.Dest.String()
+	}
+	r.queue(e)
+}
+
+// newEvent returns an event of this process
+func (r *SentryReporter) newEvent(level string, t time.Time) *sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   t.UTC().Format(time.RFC3339Nano),
+		Platform:    "go",
+		Level:       level,
+		Logger:      "socks5-server",
+		ServerName:  r.serverName,
+		Release:     r.release,
+		Environment: r.environment,
+	}
+}
+
+// queue sends e in the background unless the queue is full
+func (r *SentryReporter) queue(e *sentryEvent) {
+	select {
+	case r.events <- e:
+	default:
+	}
+}
+
+// run sends the queued events, dropping repeated messages and events
+// beyond the budget of the window
+func (r *SentryReporter) run() {
+	window := time.Now()
+	sent := 0
+	for e := range r.events {
+		now := time.Now()
+		if now.Sub(window) >= sentryWindow {
+			window, sent = now, 0
+			for key, t := range r.recent {
+				if now.Sub(t) >= sentryWindow {
+					delete(r.recent, key)
+				}
+			}
+		}
+		key := e.Message
+		if e.Exception != nil {
+			key = e.Exception.Values[0].Value
+		}
+		if _, found := r.recent[key]; found || sent >= sentryMaxEvents {
+			continue
+		}
+		r.recent[key] = now
+		sent++
+		r.send(e)
+	}
+}
+
+// send delivers e in an envelope
+func (r *SentryReporter) send(e *sentryEvent) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		logrus.WithField("sentry", true).Warnf("failed to encode Sentry event: %v", err)
+		return
+	}
+	header, _ := json.Marshal(map[string]string{"event_id": e.EventID, "dsn": r.dsn, "sent_at": time.Now().UTC().Format(time.RFC3339Nano)})
+	item, _ := json.Marshal(map[string]any{"type": "event", "length": len(payload)})
+	body := bytes.Join([][]byte{header, item, payload}, []byte("\n"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), sentryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, bytes.NewReader(body))
+	if err != nil {
+		logrus.WithField("sentry", true).Warnf("failed to send Sentry event: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logrus.WithField("sentry", true).Warnf("failed to send Sentry event: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		logrus.WithField("sentry", true).Warnf("failed to send Sentry event: %s", resp.Status)
+	}
+}
+
+// parseStack returns the frames of a stack as formatted by debug.Stack,
+// outermost first as expected by Sentry. Frames of the recovery, up to
+// the call of panic, are dropped.
+func parseStack(stack []byte) []sentryFrame {
+	var frames []sentryFrame
+	lines := strings.Split(string(stack), "\n")
+	for i := 1; i+1 < len(lines); i += 2 {
+		function := lines[i]
+		if created, found := strings.CutPrefix(function, "created by "); found {
+			function, _, _ = strings.Cut(created, " in goroutine ")
+		} else if j := strings.LastIndex(function, "("); j > 0 && strings.HasSuffix(function, ")") {
+			function = function[:j]
+		}
+		if function == "panic" {
+			frames = frames[:0]
+			continue
+		}
+		location, _, _ := strings.Cut(strings.TrimSpace(lines[i+1]), " ")
+		j := strings.LastIndex(location, ":")
+		if j < 0 {
+			continue
+		}
+		lineno, _ := strconv.Atoi(location[j+1:])
+		frames = append(frames, sentryFrame{
+			Function: function,
+			Filename: location[:j],
+			Lineno:   lineno,
+			InApp:    strings.HasPrefix(function, "main.") || strings.HasPrefix(function, "jumoog/socks5-server"),
+		})
+	}
+	slices.Reverse(frames)
+	return frames
+}
+
+// buildRelease returns the version or VCS revision the binary was built
+// from, if known
+func buildRelease() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if v := info.Main.Version; v != "" && v != "(devel)" {
+		return v
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
+}
@@ -1,62 +1,973 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
 	"net/netip"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"jumoog/socks5-server/go-socks5"
 
 	"github.com/caarlos0/env/v11"
+	"github.com/redis/go-redis/v9"
 	"github.com/sirupsen/logrus"
 )
 
 type params struct {
-	User            string   `env:"PROXY_USER" envDefault:""`
-	Password        string   `env:"PROXY_PASSWORD" envDefault:""`
-	Port            string   `env:"PROXY_PORT" envDefault:"1080"`
-	AllowedDestFqdn string   `env:"ALLOWED_DEST_FQDN" envDefault:""`
-	AllowedIPs      []string `env:"ALLOWED_IPS" envSeparator:"," envDefault:""`
+	User               string                   `env:"PROXY_USER" envDefault:""`
+	Password           string                   `env:"PROXY_PASSWORD" envDefault:""`
+	PasswordHash       string                   `env:"PROXY_PASSWORD_HASH" envDefault:""`
+	UsersJSON          string                   `env:"PROXY_USERS_JSON" envDefault:""`
+	AuthMethods        []string                 `env:"PROXY_AUTH_METHODS" envSeparator:"," envDefault:"userpass"`
+	AuthTimeout        time.Duration            `env:"AUTH_TIMEOUT" envDefault:"5s"`
+	AuthFailureTTL     time.Duration            `env:"AUTH_FAILURE_CACHE_TTL" envDefault:"0"`
+	AuthFailureSize    int                      `env:"AUTH_FAILURE_CACHE_SIZE" envDefault:"10000"`
+	Port               string                   `env:"PROXY_PORT" envDefault:"1080"`
+	AllowedDestFqdn    string                   `env:"ALLOWED_DEST_FQDN" envDefault:""`
+	DestAllowFile      string                   `env:"DEST_ALLOW_FILE" envDefault:""`
+	DestDenyFile       string                   `env:"DEST_DENY_FILE" envDefault:""`
+	AllowedIPs         []string                 `env:"ALLOWED_IPS" envSeparator:"," envDefault:""`
+	AllowedIPsFile     string                   `env:"ALLOWED_IPS_FILE" envDefault:""`
+	AllowedIPsURL      string                   `env:"ALLOWED_IPS_URL" envDefault:""`
+	AllowedIPsRefresh  time.Duration            `env:"ALLOWED_IPS_REFRESH" envDefault:"5m"`
+	DockerNetworks     []string                 `env:"DOCKER_NETWORKS" envSeparator:","`
+	AllowUntrustedAuth bool                     `env:"ALLOW_UNTRUSTED_WITH_AUTH" envDefault:"false"`
+	DrainTimeout       time.Duration            `env:"DRAIN_TIMEOUT" envDefault:"30s"`
+	FlushTimeout       time.Duration            `env:"SHUTDOWN_FLUSH_TIMEOUT" envDefault:"10s"`
+	NegotiationTimeout time.Duration            `env:"NEGOTIATION_TIMEOUT" envDefault:"30s"`
+	DialTimeout        time.Duration            `env:"DIAL_TIMEOUT" envDefault:"10s"`
+	MaxTunnelDuration  time.Duration            `env:"MAX_TUNNEL_DURATION" envDefault:"0"`
+	UserTunnelDuration map[string]time.Duration `env:"USER_MAX_TUNNEL_DURATION" envSeparator:"," envKeyValSeparator:":"`
+	IdleTimeout        time.Duration            `env:"IDLE_TIMEOUT" envDefault:"0"`
+	EventLoopRelay     bool                     `env:"EVENT_LOOP_RELAY" envDefault:"false"`
+	NegotiationBytes   int                      `env:"NEGOTIATION_MIN_BYTES" envDefault:"3"`
+	NegotiationWindow  time.Duration            `env:"NEGOTIATION_WINDOW" envDefault:"10s"`
+	UDPIdleTimeout     time.Duration            `env:"UDP_IDLE_TIMEOUT" envDefault:"2m"`
+	UDPMaxAssociations int                      `env:"UDP_MAX_ASSOCIATIONS" envDefault:"0"`
+	UDPDatagramRate    float64                  `env:"UDP_DATAGRAM_RATE" envDefault:"0"`
+	UDPDatagramBurst   int                      `env:"UDP_DATAGRAM_BURST" envDefault:"0"`
+	UDPFragmentTimeout time.Duration            `env:"UDP_FRAGMENT_TIMEOUT" envDefault:"0"`
+	UDPMaxDatagram     int                      `env:"UDP_MAX_DATAGRAM" envDefault:"65535"`
+	UDPReadBuffer      int                      `env:"UDP_READ_BUFFER" envDefault:"0"`
+	UDPWriteBuffer     int                      `env:"UDP_WRITE_BUFFER" envDefault:"0"`
+	UDPOverTCP         bool                     `env:"UDP_OVER_TCP" envDefault:"false"`
+	UDPPermissive      bool                     `env:"UDP_PERMISSIVE" envDefault:"false"`
+	PortRange          string                   `env:"PORT_RANGE" envDefault:""`
+	PublicIP           netip.Addr               `env:"PUBLIC_IP"`
+	BindIP             netip.Addr               `env:"BIND_IP"`
+	ReverseLookup      bool                     `env:"REVERSE_DNS" envDefault:"false"`
+	LogSuppressWindow  time.Duration            `env:"LOG_SUPPRESS_WINDOW" envDefault:"1m"`
+	AccessLogSample    int                      `env:"ACCESS_LOG_SAMPLE_RATE" envDefault:"1"`
+	TraceClients       []string                 `env:"TRACE_CLIENTS" envSeparator:","`
+	GeoIPCountryDB     string                   `env:"GEOIP_COUNTRY_DB" envDefault:""`
+	GeoIPASNDB         string                   `env:"GEOIP_ASN_DB" envDefault:""`
+	DNSBLZones         []string                 `env:"DNSBL_ZONES" envSeparator:","`
+	ReputationFeed     string                   `env:"REPUTATION_FEED" envDefault:""`
+	DNSBLFlagOnly      bool                     `env:"DNSBL_FLAG_ONLY" envDefault:"false"`
+	DNSBLCacheTTL      time.Duration            `env:"DNSBL_CACHE_TTL" envDefault:"10m"`
+	BlocklistURLs      []string                 `env:"BLOCKLIST_URLS" envSeparator:","`
+	BlocklistRefresh   time.Duration            `env:"BLOCKLIST_REFRESH" envDefault:"1h"`
+	BlocklistPublicKey string                   `env:"BLOCKLIST_PUBLIC_KEY" envDefault:""`
+	BlocklistChecksums bool                     `env:"BLOCKLIST_CHECKSUMS" envDefault:"false"`
+	FanoutMaxDests     int                      `env:"FANOUT_MAX_DESTINATIONS" envDefault:"0"`
+	FanoutWindow       time.Duration            `env:"FANOUT_WINDOW" envDefault:"1m"`
+	FanoutAction       string                   `env:"FANOUT_ACTION" envDefault:"throttle"`
+	FanoutBanDuration  time.Duration            `env:"FANOUT_BAN_DURATION" envDefault:"10m"`
+	BanListFile        string                   `env:"BAN_LIST_FILE" envDefault:""`
+	BlockCloudMetadata bool                     `env:"BLOCK_CLOUD_METADATA" envDefault:"true"`
+	MaxTunnelsPerDest  int                      `env:"MAX_TUNNELS_PER_DEST" envDefault:"0"`
+	DestTunnelLimits   map[string]int           `env:"DEST_TUNNEL_LIMITS" envSeparator:"," envKeyValSeparator:"="`
+	DestConnectRate    float64                  `env:"DEST_CONNECT_RATE" envDefault:"0"`
+	DestConnectBurst   int                      `env:"DEST_CONNECT_BURST" envDefault:"0"`
+	DestConnectRates   map[string]float64       `env:"DEST_CONNECT_RATES" envSeparator:"," envKeyValSeparator:"="`
+	AcceptRate         float64                  `env:"ACCEPT_RATE" envDefault:"0"`
+	AcceptBurst        int                      `env:"ACCEPT_BURST" envDefault:"0"`
+	AcceptRatePerIP    float64                  `env:"ACCEPT_RATE_PER_IP" envDefault:"0"`
+	AcceptBurstPerIP   int                      `env:"ACCEPT_BURST_PER_IP" envDefault:"0"`
+	OverloadMaxMemory  uint64                   `env:"OVERLOAD_MAX_MEMORY" envDefault:"0"`
+	OverloadMaxFDs     int                      `env:"OVERLOAD_MAX_FDS" envDefault:"0"`
+	OverloadMaxQueue   int                      `env:"OVERLOAD_MAX_ACCEPT_QUEUE" envDefault:"0"`
+	ListenMPTCP        bool                     `env:"MPTCP_LISTEN" envDefault:"false"`
+	DialMPTCP          bool                     `env:"MPTCP_DIAL" envDefault:"false"`
+	ListenFastOpen     bool                     `env:"TFO_LISTEN" envDefault:"false"`
+	DialFastOpen       bool                     `env:"TFO_DIAL" envDefault:"false"`
+	ListenReusePort    bool                     `env:"LISTEN_REUSEPORT" envDefault:"false"`
+	ListenFreeBind     bool                     `env:"LISTEN_FREEBIND" envDefault:"false"`
+	RunAsUser          string                   `env:"RUN_AS_USER" envDefault:""`
+	RunAsGroup         string                   `env:"RUN_AS_GROUP" envDefault:""`
+	Sandbox            bool                     `env:"SANDBOX" envDefault:"false"`
+	PidFile            string                   `env:"PID_FILE" envDefault:""`
+	UserDestinations   map[string]string        `env:"USER_DESTINATIONS" envSeparator:";" envKeyValSeparator:"="`
+	UserPorts          map[string]string        `env:"USER_PORTS" envSeparator:";" envKeyValSeparator:"="`
+	UserGroups         map[string]string        `env:"USER_GROUPS" envSeparator:";" envKeyValSeparator:"="`
+	GroupDestinations  map[string]string        `env:"GROUP_DESTINATIONS" envSeparator:";" envKeyValSeparator:"="`
+	GroupPorts         map[string]string        `env:"GROUP_PORTS" envSeparator:";" envKeyValSeparator:"="`
+	GroupSchedules     map[string]string        `env:"GROUP_SCHEDULES" envSeparator:";" envKeyValSeparator:"="`
+	GroupBandwidth     map[string]string        `env:"GROUP_BANDWIDTH_CLASSES" envSeparator:"," envKeyValSeparator:"="`
+	GroupQuotas        map[string]uint64        `env:"GROUP_QUOTAS" envSeparator:"," envKeyValSeparator:":"`
+	ShadowPolicyFile   string                   `env:"SHADOW_POLICY_FILE" envDefault:""`
+	DSCP               uint8                    `env:"DSCP" envDefault:"0"`
+	UserDSCP           map[string]uint8         `env:"USER_DSCP" envSeparator:"," envKeyValSeparator:":"`
+	UserDialers        map[string]string        `env:"USER_DIALERS" envSeparator:";" envKeyValSeparator:"="`
+	UsernameParams     []string                 `env:"USERNAME_PARAMS" envSeparator:","`
+	UsernameSeparator  string                   `env:"USERNAME_PARAM_SEPARATOR" envDefault:"-"`
+	UsernameSession    string                   `env:"USERNAME_SESSION_PARAM" envDefault:"session"`
+	ParamDialers       map[string]string        `env:"PARAM_DIALERS" envSeparator:";" envKeyValSeparator:"="`
+	UserTags           map[string]string        `env:"USER_TAGS" envSeparator:";" envKeyValSeparator:"="`
+	RewriteRules       []string                 `env:"REWRITE_RULES" envSeparator:";"`
+	RewriteRulesFile   string                   `env:"REWRITE_RULES_FILE" envDefault:""`
+	Forwards           []string                 `env:"FORWARDS" envSeparator:","`
+	Listeners          map[string]string        `env:"LISTENERS" envSeparator:";" envKeyValSeparator:"="`
+	TransparentPort    string                   `env:"TRANSPARENT_PORT" envDefault:""`
+	TransparentTProxy  bool                     `env:"TRANSPARENT_TPROXY" envDefault:"false"`
+	DNSPort            string                   `env:"DNS_PORT" envDefault:""`
+	DNSCacheTTL        time.Duration            `env:"DNS_CACHE_TTL" envDefault:"0"`
+	DNSCacheStale      time.Duration            `env:"DNS_CACHE_STALE" envDefault:"0"`
+	DNSCacheSize       int                      `env:"DNS_CACHE_SIZE" envDefault:"10000"`
+	NAT64Prefix        string                   `env:"NAT64_PREFIX" envDefault:""`
+	AdminAddr          string                   `env:"ADMIN_ADDR" envDefault:""`
+	AdminTLS           bool                     `env:"ADMIN_TLS" envDefault:"false"`
+	AdminToken         string                   `env:"ADMIN_TOKEN" envDefault:""`
+	CaptureDir         string                   `env:"CAPTURE_DIR" envDefault:""`
+	CaptureMaxBytes    int64                    `env:"CAPTURE_MAX_BYTES" envDefault:"104857600"`
+	CaptureMaxDuration time.Duration            `env:"CAPTURE_MAX_DURATION" envDefault:"10m"`
+	TLSPort            string                   `env:"TLS_PORT" envDefault:""`
+	TLSCertFile        string                   `env:"TLS_CERT_FILE" envDefault:""`
+	TLSKeyFile         string                   `env:"TLS_KEY_FILE" envDefault:""`
+	ACMEDomains        []string                 `env:"ACME_DOMAINS" envSeparator:","`
+	ACMECacheDir       string                   `env:"ACME_CACHE_DIR" envDefault:"/var/cache/socks5/acme"`
+	ACMEEmail          string                   `env:"ACME_EMAIL" envDefault:""`
+	ACMEDirectory      string                   `env:"ACME_DIRECTORY" envDefault:""`
+	ACMEHTTPPort       string                   `env:"ACME_HTTP_PORT" envDefault:""`
+	UserQuotas         map[string]uint64        `env:"USER_QUOTAS" envSeparator:"," envKeyValSeparator:":"`
+	DefaultUserQuota   uint64                   `env:"DEFAULT_USER_QUOTA" envDefault:"0"`
+	QuotaPeriod        string                   `env:"QUOTA_PERIOD" envDefault:""`
+	QuotaResetAt       string                   `env:"QUOTA_RESET_AT" envDefault:""`
+	QuotaTimezone      string                   `env:"QUOTA_TIMEZONE" envDefault:""`
+	QuotaRollover      bool                     `env:"QUOTA_ROLLOVER" envDefault:"false"`
+	BandwidthClasses   map[string]string        `env:"BANDWIDTH_CLASSES" envSeparator:"," envKeyValSeparator:"="`
+	BandwidthRules     []string                 `env:"BANDWIDTH_RULES" envSeparator:";"`
+	DefaultBandwidth   string                   `env:"DEFAULT_BANDWIDTH_CLASS" envDefault:""`
+	LinkBandwidth      string                   `env:"LINK_BANDWIDTH" envDefault:""`
+	RedisURL           string                   `env:"REDIS_URL" envDefault:""`
+	RedisUsersKey      string                   `env:"REDIS_USERS_KEY" envDefault:"socks5:users"`
+	RedisUsageKey      string                   `env:"REDIS_USAGE_KEY" envDefault:"socks5:usage"`
+	RedisCacheTTL      time.Duration            `env:"REDIS_CACHE_TTL" envDefault:"1m"`
+	RedisStaleTTL      time.Duration            `env:"REDIS_STALE_TTL" envDefault:"10m"`
+	RedisSyncInterval  time.Duration            `env:"REDIS_SYNC_INTERVAL" envDefault:"10s"`
+	VaultAddr          string                   `env:"VAULT_ADDR" envDefault:""`
+	VaultToken         string                   `env:"VAULT_TOKEN" envDefault:""`
+	VaultRole          string                   `env:"VAULT_K8S_ROLE" envDefault:""`
+	VaultAuthMount     string                   `env:"VAULT_K8S_MOUNT" envDefault:"kubernetes"`
+	VaultJWTPath       string                   `env:"VAULT_K8S_TOKEN_PATH" envDefault:"/var/run/secrets/kubernetes.io/serviceaccount/token"`
+	VaultCACert        string                   `env:"VAULT_CACERT" envDefault:""`
+	VaultUsersPath     string                   `env:"VAULT_USERS_PATH" envDefault:""`
+	VaultTLSPath       string                   `env:"VAULT_TLS_PATH" envDefault:""`
+	VaultUpstreamPath  string                   `env:"VAULT_UPSTREAM_PATH" envDefault:""`
+	VaultRefresh       time.Duration            `env:"VAULT_REFRESH" envDefault:"5m"`
+	SQLDriver          string                   `env:"SQL_DRIVER" envDefault:""`
+	SQLDSN             string                   `env:"SQL_DSN" envDefault:""`
+	SQLQuery           string                   `env:"SQL_QUERY" envDefault:""`
+	SQLMaxOpenConns    int                      `env:"SQL_MAX_OPEN_CONNS" envDefault:"10"`
+	SQLMaxIdleConns    int                      `env:"SQL_MAX_IDLE_CONNS" envDefault:"2"`
+	SQLConnMaxLifetime time.Duration            `env:"SQL_CONN_MAX_LIFETIME" envDefault:"5m"`
+	TopTalkersWindow   time.Duration            `env:"TOP_TALKERS_WINDOW" envDefault:"1h"`
+	UsageRetention     time.Duration            `env:"USAGE_RETENTION" envDefault:"720h"`
+	IPFIXCollector     string                   `env:"IPFIX_COLLECTOR"`
+	IPFIXDomainID      uint32                   `env:"IPFIX_DOMAIN_ID" envDefault:"1"`
+	EventBusURL        string                   `env:"EVENT_BUS_URL" envDefault:""`
+	EventBusPrefix     string                   `env:"EVENT_BUS_PREFIX" envDefault:"socks5"`
+	EventBusFormat     string                   `env:"EVENT_BUS_FORMAT" envDefault:"json"`
+	ElasticURL         string                   `env:"ELASTIC_URL" envDefault:""`
+	ElasticAPIKey      string                   `env:"ELASTIC_API_KEY" envDefault:""`
+	ElasticIndex       string                   `env:"ELASTIC_INDEX" envDefault:"socks5-audit"`
+	ElasticSpoolDir    string                   `env:"ELASTIC_SPOOL_DIR" envDefault:""`
+	LokiURL            string                   `env:"LOKI_URL" envDefault:""`
+	LokiTenant         string                   `env:"LOKI_TENANT" envDefault:""`
+	LokiLabels         map[string]string        `env:"LOKI_LABELS" envSeparator:"," envKeyValSeparator:"="`
+	LokiLevel          string                   `env:"LOKI_LEVEL" envDefault:"info"`
+	SentryDSN          string                   `env:"SENTRY_DSN" envDefault:""`
+	SentryEnvironment  string                   `env:"SENTRY_ENVIRONMENT" envDefault:""`
+	SentryLevel        string                   `env:"SENTRY_LEVEL" envDefault:"error"`
+	StateFile          string                   `env:"STATE_FILE" envDefault:""`
+	StateSaveInterval  time.Duration            `env:"STATE_SAVE_INTERVAL" envDefault:"1m"`
 }
 
 func main() {
+	runSubcommand(os.Args[1:])
+
 	// Working with app params
 	cfg := params{}
-	err := env.Parse(&cfg)
+	environ, err := secretEnvironment()
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	err = env.ParseWithOptions(&cfg, env.Options{Environment: environ})
 	if err != nil {
 		logrus.Fatalf("%+v\n", err)
 	}
 
+	// Report to the service manager when run as a Windows service
+	serviceStop, serviceStopped := startService(cfg.DrainTimeout + cfg.FlushTimeout)
+
+	// Drain and flush on shutdown, sinks add their steps as they start
+	lc := newLifecycle(cfg.DrainTimeout, cfg.FlushTimeout)
+
 	//Initialize socks5 config
 	socks5conf := &socks5.Config{}
 
-	if cfg.User+cfg.Password != "" {
-		creds := socks5.StaticCredentials{
-			os.Getenv("PROXY_USER"): os.Getenv("PROXY_PASSWORD"),
+	// Ship logs to Loki without a sidecar
+	if cfg.LokiURL != "" {
+		level, err := logrus.ParseLevel(cfg.LokiLevel)
+		if err != nil {
+			logrus.Fatalf("invalid LOKI_LEVEL: %v", err)
+		}
+		loki, err := NewLokiShipper(cfg.LokiURL, cfg.LokiTenant, cfg.LokiLabels, level)
+		if err != nil {
+			logrus.Fatalf("invalid LOKI_URL: %v", err)
+		}
+		logrus.AddHook(loki)
+		lc.onShutdown("Loki log entries", loki.Flush)
+	}
+
+	// Report panics and errors to an error tracker
+	if cfg.SentryDSN != "" {
+		level, err := logrus.ParseLevel(cfg.SentryLevel)
+		if err != nil || level < logrus.ErrorLevel || level > logrus.WarnLevel {
+			logrus.Fatalf("invalid SENTRY_LEVEL %q: must be error or warning", cfg.SentryLevel)
+		}
+		sentry, err := NewSentryReporter(cfg.SentryDSN, cfg.SentryEnvironment, level)
+		if err != nil {
+			logrus.Fatalf("invalid SENTRY_DSN: %v", err)
+		}
+		logrus.AddHook(sentry)
+		socks5conf.OnPanic = sentry.CapturePanic
+	}
+
+	// Shared Redis database of users and quotas
+	var redisClient *redis.Client
+	if cfg.RedisURL != "" {
+		opts, err := redis.ParseURL(cfg.RedisURL)
+		if err != nil {
+			logrus.Fatalf("invalid REDIS_URL: %v", err)
+		}
+		redisClient = redis.NewClient(opts)
+	}
+
+	// Secrets read from Vault
+	var vault *VaultClient
+	if cfg.VaultUsersPath != "" || cfg.VaultTLSPath != "" || cfg.VaultUpstreamPath != "" {
+		if cfg.VaultRefresh <= 0 {
+			logrus.Fatalf("invalid VAULT_REFRESH %v: must be positive", cfg.VaultRefresh)
+		}
+		if vault, err = NewVaultClient(cfg.VaultAddr, cfg.VaultToken, cfg.VaultRole, cfg.VaultAuthMount, cfg.VaultJWTPath, cfg.VaultCACert); err != nil {
+			logrus.Fatalf("invalid Vault configuration: %v", err)
+		}
+	}
+	var upstreamPasswords socks5.SecretStore
+	if cfg.VaultUpstreamPath != "" {
+		passwords, next, err := NewVaultCredentials(context.Background(), vault, cfg.VaultUpstreamPath, cfg.VaultRefresh)
+		if err != nil {
+			logrus.Fatalf("failed to read upstream proxy passwords from Vault: %v", err)
+		}
+		go passwords.Run(context.Background(), next)
+		upstreamPasswords = passwords
+	}
+
+	// Credentials of authenticating clients
+	var creds socks5.CredentialStore
+	var jsonUsers map[string]*UserEntry
+	switch {
+	case cfg.VaultUsersPath != "":
+		users, next, err := NewVaultCredentials(context.Background(), vault, cfg.VaultUsersPath, cfg.VaultRefresh)
+		if err != nil {
+			logrus.Fatalf("failed to read users from Vault: %v", err)
+		}
+		go users.Run(context.Background(), next)
+		creds = users
+	case cfg.SQLDriver != "":
+		pool := SQLPool{MaxOpen: cfg.SQLMaxOpenConns, MaxIdle: cfg.SQLMaxIdleConns, MaxLifetime: cfg.SQLConnMaxLifetime}
+		if creds, err = NewSQLCredentials(cfg.SQLDriver, cfg.SQLDSN, cfg.SQLQuery, pool); err != nil {
+			logrus.Fatalf("failed to open user database: %v", err)
+		}
+	case redisClient != nil && cfg.RedisUsersKey != "":
+		creds = NewRedisCredentials(redisClient, cfg.RedisUsersKey, cfg.RedisCacheTTL, cfg.RedisStaleTTL)
+	case cfg.UsersJSON != "":
+		if cfg.User+cfg.Password+cfg.PasswordHash != "" {
+			logrus.Fatal("PROXY_USERS_JSON and PROXY_USER, PROXY_PASSWORD or PROXY_PASSWORD_HASH are mutually exclusive")
+		}
+		if jsonUsers, err = parseUsersJSON(cfg.UsersJSON); err != nil {
+			logrus.Fatal(err)
+		}
+		creds = JSONCredentials(jsonUsers)
+	case cfg.PasswordHash != "":
+		if cfg.Password != "" {
+			logrus.Fatal("PROXY_PASSWORD and PROXY_PASSWORD_HASH are mutually exclusive")
+		}
+		if err := socks5.ValidPasswordHash(cfg.PasswordHash); err != nil {
+			logrus.Fatalf("invalid PROXY_PASSWORD_HASH: %v", err)
+		}
+		creds = socks5.HashedCredentials{
+			cfg.User: cfg.PasswordHash,
+		}
+	case cfg.User+cfg.Password != "":
+		creds = socks5.StaticCredentials{
+			cfg.User: cfg.Password,
+		}
+	}
+	if creds != nil {
+		// Remember failed logins so retrying clients don't hammer the store
+		passwords := creds
+		if cfg.AuthFailureTTL > 0 {
+			passwords = socks5.NewFailureCache(creds, cfg.AuthFailureTTL, cfg.AuthFailureSize)
+		}
+		// Routing parameters embedded in usernames
+		var usernames socks5.UsernameParser
+		if len(cfg.UsernameParams) > 0 {
+			if cfg.UsernameSeparator == "" {
+				logrus.Fatal("USERNAME_PARAM_SEPARATOR must not be empty")
+			}
+			usernames = socks5.KeyValueUsernames{Separator: cfg.UsernameSeparator, Keys: cfg.UsernameParams}
+		}
+		for _, method := range cfg.AuthMethods {
+			switch method {
+			case "userpass":
+				socks5conf.AuthMethods = append(socks5conf.AuthMethods, socks5.UserPassAuthenticator{Credentials: passwords, Usernames: usernames})
+			case "chap":
+				secrets, ok := creds.(socks5.SecretStore)
+				if !ok {
+					logrus.Fatal("PROXY_AUTH_METHODS chap is not supported by the credential store")
+				}
+				socks5conf.AuthMethods = append(socks5conf.AuthMethods, socks5.CHAPAuthenticator{Secrets: secrets})
+			default:
+				logrus.Fatalf("invalid PROXY_AUTH_METHODS entry %q: must be userpass or chap", method)
+			}
+		}
+	}
+
+	socks5conf.AuthTimeout = cfg.AuthTimeout
+
+	// Let clients outside the whitelist authenticate
+	if cfg.AllowUntrustedAuth {
+		if creds == nil {
+			logrus.Fatal("ALLOW_UNTRUSTED_WITH_AUTH requires PROXY_USER and PROXY_PASSWORD or a credential store")
+		}
+		socks5conf.AllowUntrustedWithAuth = true
+	}
+
+	// Docker networks allowed to connect
+	socks5conf.DockerNetworks, err = dockerNetworks(cfg.DockerNetworks)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	logrus.Infof("Allowing connections from Docker networks: %v", socks5conf.DockerNetworks)
+
+	// Clients whose negotiation is hex-dumped
+	for _, v := range cfg.TraceClients {
+		prefix, err := parsePrefix(strings.TrimSpace(v))
+		if err != nil {
+			logrus.Fatalf("invalid TRACE_CLIENTS: %v", err)
 		}
-		cator := socks5.UserPassAuthenticator{Credentials: creds}
-		socks5conf.AuthMethods = []socks5.Authenticator{cator}
+		socks5conf.TraceClients = append(socks5conf.TraceClients, prefix.Masked())
+	}
+	if len(socks5conf.TraceClients) > 0 {
+		logrus.Warnf("Tracing the negotiation of clients from %v", socks5conf.TraceClients)
 	}
 
+	// Ban list consulted before the IP whitelist
+	bans, err := socks5.NewBanList(cfg.BanListFile)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	socks5conf.BanList = bans
+
+	rules := socks5.PermitAll()
 	if cfg.AllowedDestFqdn != "" {
-		socks5conf.Rules = PermitDestAddrPattern(cfg.AllowedDestFqdn)
+		rules = PermitDestAddrPattern(cfg.AllowedDestFqdn)
+	}
+
+	// Check destinations against plain allow and deny lists
+	if cfg.DestAllowFile != "" || cfg.DestDenyFile != "" {
+		if rules, err = DestLists(rules, cfg.DestAllowFile, cfg.DestDenyFile); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	// Protect cloud instance metadata endpoints
+	if cfg.BlockCloudMetadata {
+		rules = socks5.DenyCloudMetadata(rules)
+	}
+
+	// Check destinations against blocklists
+	if len(cfg.DNSBLZones) > 0 || cfg.ReputationFeed != "" {
+		var feed []netip.Prefix
+		if cfg.ReputationFeed != "" {
+			if feed, err = loadReputationFeed(cfg.ReputationFeed); err != nil {
+				logrus.Fatal(err)
+			}
+		}
+		rules = DenyListedDest(rules, cfg.DNSBLZones, feed, cfg.DNSBLFlagOnly, cfg.DNSBLCacheTTL)
+	}
+	if len(cfg.BlocklistURLs) > 0 {
+		var publicKey ed25519.PublicKey
+		if cfg.BlocklistPublicKey != "" {
+			key, err := base64.StdEncoding.DecodeString(cfg.BlocklistPublicKey)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				logrus.Fatal("invalid BLOCKLIST_PUBLIC_KEY, must be a base64 ed25519 public key")
+			}
+			publicKey = key
+		}
+		blocklist := RemoteBlocklist(rules, cfg.BlocklistURLs, publicKey, cfg.BlocklistChecksums)
+		blocklist.Refresh(context.Background())
+		if cfg.BlocklistRefresh > 0 {
+			go blocklist.Run(context.Background(), cfg.BlocklistRefresh)
+		}
+		rules = blocklist
+	}
+
+	// Detect clients scanning through the proxy
+	if cfg.FanoutMaxDests > 0 {
+		if cfg.FanoutAction != "throttle" && cfg.FanoutAction != "ban" {
+			logrus.Fatalf("invalid FANOUT_ACTION %q, must be throttle or ban", cfg.FanoutAction)
+		}
+		var fanoutBans *socks5.BanList
+		if cfg.FanoutAction == "ban" {
+			fanoutBans = bans
+		}
+		rules = LimitDestFanout(rules, cfg.FanoutMaxDests, cfg.FanoutWindow, fanoutBans, cfg.FanoutBanDuration)
+	}
+
+	// Limit simultaneous tunnels per destination
+	if cfg.MaxTunnelsPerDest > 0 || len(cfg.DestTunnelLimits) > 0 {
+		socks5conf.DestLimiter = socks5.NewDestLimiter(cfg.MaxTunnelsPerDest, cfg.DestTunnelLimits)
+	}
+
+	// Limit the rate of new tunnels per destination
+	if cfg.DestConnectRate > 0 || len(cfg.DestConnectRates) > 0 {
+		socks5conf.DestRateLimiter = socks5.NewDestRateLimiter(cfg.DestConnectRate, cfg.DestConnectBurst, cfg.DestConnectRates)
+	}
+
+	// Cache resolved destination names
+	if cfg.DNSCacheTTL > 0 {
+		socks5conf.Resolver = socks5.NewCachingResolver(socks5.DNSResolver{}, cfg.DNSCacheTTL, cfg.DNSCacheStale, cfg.DNSCacheSize)
+	}
+
+	// Reach IPv4 destinations through NAT64 from IPv6-only networks
+	switch cfg.NAT64Prefix {
+	case "":
+	case "auto":
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		prefix, err := socks5.DiscoverNAT64Prefix(ctx)
+		cancel()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("using NAT64 prefix %v", prefix)
+		socks5conf.NAT64Prefix = prefix
+	default:
+		prefix, err := netip.ParsePrefix(cfg.NAT64Prefix)
+		if err != nil {
+			logrus.Fatalf("invalid NAT64_PREFIX: %v", err)
+		}
+		socks5conf.NAT64Prefix = prefix
+	}
+
+	// Limit the rate of new connections, overall and per client
+	socks5conf.AcceptRate = cfg.AcceptRate
+	socks5conf.AcceptBurst = cfg.AcceptBurst
+	socks5conf.AcceptRatePerIP = cfg.AcceptRatePerIP
+	socks5conf.AcceptBurstPerIP = cfg.AcceptBurstPerIP
+
+	// Reject new connections under memory or descriptor pressure
+	socks5conf.Overload = socks5.OverloadLimits{
+		MaxMemory:      cfg.OverloadMaxMemory,
+		MaxFDs:         cfg.OverloadMaxFDs,
+		MaxAcceptQueue: cfg.OverloadMaxQueue,
+	}
+
+	// Restrict the destinations, ports and hours of each user, inherited
+	// from their groups
+	var policies map[string]*Policy
+	if hasPolicies(cfg) {
+		if policies, err = buildPolicies(cfg); err != nil {
+			logrus.Fatal(err)
+		}
+		rules = UserPolicies(rules, policies)
+	}
+
+	// Limit tunnel lifetime, globally and per user
+	socks5conf.Timeouts = socks5.Timeouts{
+		Negotiation: cfg.NegotiationTimeout,
+		Dial:        cfg.DialTimeout,
+		Idle:        cfg.IdleTimeout,
+		Max:         cfg.MaxTunnelDuration,
+	}
+	socks5conf.NegotiationMinBytes = cfg.NegotiationBytes
+	socks5conf.NegotiationWindow = cfg.NegotiationWindow
+	if len(cfg.UserTunnelDuration) > 0 {
+		rules = UserTunnelDuration(rules, cfg.UserTunnelDuration)
+	}
+
+	// Mark outbound traffic for downstream QoS, globally and per user
+	socks5conf.DSCP = cfg.DSCP
+	if len(cfg.UserDSCP) > 0 {
+		for user, dscp := range cfg.UserDSCP {
+			if dscp > 63 {
+				logrus.Fatalf("invalid USER_DSCP value %d of %q: must be 0-63", dscp, user)
+			}
+		}
+		rules = UserDSCP(rules, cfg.UserDSCP)
+	}
+
+	// Egress addresses, routing marks or upstream proxies per user or
+	// username parameter
+	if len(cfg.UserDialers) > 0 {
+		dialers, err := parseUserDialers(cfg.UserDialers, upstreamPasswords)
+		if err != nil {
+			logrus.Fatalf("invalid USER_DIALERS: %v", err)
+		}
+		socks5conf.DialerSelector = dialers
+	}
+	if len(cfg.ParamDialers) > 0 {
+		pools, err := parseParamDialers(cfg.ParamDialers, cfg.UsernameParams, upstreamPasswords)
+		if err != nil {
+			logrus.Fatalf("invalid PARAM_DIALERS: %v", err)
+		}
+		socks5conf.DialerSelector = &ParamDialers{Pools: pools, Session: cfg.UsernameSession, Next: socks5conf.DialerSelector}
+	}
+
+	// Tag sessions for slicing logs and metrics by tenant
+	if len(cfg.UserTags) > 0 {
+		tags, err := parseUserTags(cfg.UserTags)
+		if err != nil {
+			logrus.Fatalf("invalid USER_TAGS: %v", err)
+		}
+		rules = UserTags(rules, tags)
+	}
+
+	// Shape tunnels by bandwidth class
+	if len(cfg.BandwidthClasses) > 0 {
+		if socks5conf.BandwidthClasses, err = parseBandwidthClasses(cfg.BandwidthClasses); err != nil {
+			logrus.Fatal(err)
+		}
+		var classRules []BandwidthRule
+		for _, entry := range cfg.BandwidthRules {
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			rule, err := parseBandwidthRule(entry, socks5conf.BandwidthClasses)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			classRules = append(classRules, rule)
+		}
+		if _, found := socks5conf.BandwidthClasses[cfg.DefaultBandwidth]; cfg.DefaultBandwidth != "" && !found {
+			logrus.Fatalf("invalid DEFAULT_BANDWIDTH_CLASS: unknown class %q", cfg.DefaultBandwidth)
+		}
+		rules = AssignBandwidthClass(rules, classRules, cfg.DefaultBandwidth)
+	}
+	for group, class := range cfg.GroupBandwidth {
+		if _, found := socks5conf.BandwidthClasses[class]; !found {
+			logrus.Fatalf("invalid GROUP_BANDWIDTH_CLASSES entry of %q: unknown class %q", group, class)
+		}
+	}
+	for user, u := range jsonUsers {
+		if _, found := socks5conf.BandwidthClasses[u.BandwidthClass]; u.BandwidthClass != "" && !found {
+			logrus.Fatalf("invalid PROXY_USERS_JSON bandwidth_class of %q: unknown class %q", user, u.BandwidthClass)
+		}
+	}
+	if cfg.LinkBandwidth != "" {
+		if socks5conf.LinkBandwidth, err = parseBandwidth(cfg.LinkBandwidth); err != nil {
+			logrus.Fatalf("invalid LINK_BANDWIDTH: %v", err)
+		}
+	}
+	socks5conf.Rules = rules
+
+	// Log the requests a candidate policy would decide differently
+	if cfg.ShadowPolicyFile != "" {
+		candidate, err := loadShadowPolicy(cfg.ShadowPolicyFile, environ)
+		if err != nil {
+			logrus.Fatalf("invalid SHADOW_POLICY_FILE: %v", err)
+		}
+		active, err := policyRules(cfg)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		socks5conf.Rules = ShadowPolicy(rules, active, candidate)
+		logrus.Infof("Evaluating shadow policy from %s", cfg.ShadowPolicyFile)
+	}
+
+	// Redirect destinations
+	if len(cfg.RewriteRules) > 0 || cfg.RewriteRulesFile != "" {
+		rewrites, err := loadRewriteRules(cfg.RewriteRules, cfg.RewriteRulesFile)
+		if err != nil {
+			logrus.Fatalf("failed to load rewrite rules: %v", err)
+		}
+		socks5conf.Rewriter = &Rewriter{Rules: rewrites}
+	}
+
+	// Summarize repeated warnings about rejected clients
+	socks5conf.LogSuppressWindow = cfg.LogSuppressWindow
+
+	// Sample the access log of successful requests
+	socks5conf.AccessLogSampleRate = cfg.AccessLogSample
+
+	// Enrich access logs with client host names
+	socks5conf.ReverseLookup = cfg.ReverseLookup
+
+	// Enrich access logs with GeoIP data
+	if cfg.GeoIPCountryDB+cfg.GeoIPASNDB != "" {
+		enricher, err := NewGeoIPEnricher(cfg.GeoIPCountryDB, cfg.GeoIPASNDB)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		socks5conf.AccessLogEnricher = enricher
+	}
+
+	// Multipath TCP on both legs
+	socks5conf.ListenMPTCP = cfg.ListenMPTCP
+	socks5conf.DialMPTCP = cfg.DialMPTCP
+
+	// TCP Fast Open on both legs
+	socks5conf.ListenFastOpen = cfg.ListenFastOpen
+	socks5conf.DialFastOpen = cfg.DialFastOpen
+
+	// Socket options of the proxy listener
+	socks5conf.ListenControl = listenControl(cfg.ListenReusePort, cfg.ListenFreeBind)
+
+	// Address reported to clients in replies
+	socks5conf.PublicIP = cfg.PublicIP
+
+	// Address listened on for BIND and UDP ASSOCIATE
+	socks5conf.BindIP = cfg.BindIP
+
+	// Restrict ports used for BIND and UDP ASSOCIATE
+	if cfg.PortRange != "" {
+		socks5conf.PortRange, err = parsePortRange(cfg.PortRange)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	// UDP associate limits
+	socks5conf.UDPIdleTimeout = cfg.UDPIdleTimeout
+	socks5conf.MaxUDPAssociations = cfg.UDPMaxAssociations
+	socks5conf.UDPDatagramRate = cfg.UDPDatagramRate
+	socks5conf.UDPDatagramBurst = cfg.UDPDatagramBurst
+	socks5conf.UDPFragmentTimeout = cfg.UDPFragmentTimeout
+	socks5conf.UDPMaxDatagram = cfg.UDPMaxDatagram
+	socks5conf.UDPReadBuffer = cfg.UDPReadBuffer
+	socks5conf.UDPWriteBuffer = cfg.UDPWriteBuffer
+	socks5conf.UDPOverTCP = cfg.UDPOverTCP
+	socks5conf.UDPPermissive = cfg.UDPPermissive
+	socks5conf.EventLoopRelay = cfg.EventLoopRelay
+
+	// Captures of sessions are started on the admin endpoint
+	if cfg.CaptureDir != "" && cfg.AdminAddr == "" {
+		logrus.Fatal("CAPTURE_DIR requires ADMIN_ADDR")
+	}
+	if cfg.CaptureDir != "" && cfg.AdminToken == "" {
+		logrus.Fatal("CAPTURE_DIR requires ADMIN_TOKEN")
+	}
+	if cfg.AdminAddr != "" {
+		if cfg.AdminAddr, err = adminListenAddr(cfg.AdminAddr, cfg.AdminToken != ""); err != nil {
+			logrus.Fatalf("invalid ADMIN_ADDR: %v", err)
+		}
+	}
+	socks5conf.Capture = cfg.CaptureDir != ""
+
+	// Cap the traffic of authenticated users, sharing usage through Redis
+	// and resetting it every period
+	var quotaSchedule *QuotaSchedule
+	var shared *RedisQuotas
+	if cfg.QuotaPeriod != "" {
+		if quotaSchedule, err = parseQuotaSchedule(cfg.QuotaPeriod, cfg.QuotaResetAt, cfg.QuotaTimezone); err != nil {
+			logrus.Fatalf("invalid quota schedule: %v", err)
+		}
+	}
+	_, jsonQuotas := usersPolicyEntries(jsonUsers)
+	if cfg.DefaultUserQuota > 0 || len(cfg.UserQuotas) > 0 || len(cfg.GroupQuotas) > 0 || len(jsonQuotas) > 0 {
+		limits := make(map[string]uint64, len(cfg.UserQuotas))
+		for user, p := range policies {
+			if p.Quota != nil {
+				limits[user] = *p.Quota
+			}
+		}
+		for user, limit := range cfg.UserQuotas {
+			limits[user] = limit
+		}
+		socks5conf.Quotas = socks5.NewQuotas(cfg.DefaultUserQuota, limits)
+		if redisClient != nil && cfg.RedisUsageKey != "" {
+			shared = NewRedisQuotas(redisClient, cfg.RedisUsageKey, socks5conf.Quotas, quotaSchedule)
+			go shared.Run(context.Background(), cfg.RedisSyncInterval)
+			lc.onShutdown("quota usage to Redis", shared.Sync)
+		}
+		if quotaSchedule != nil {
+			go quotaSchedule.Run(context.Background(), resetQuotas(socks5conf.Quotas, shared, cfg.QuotaRollover))
+		}
+	}
+
+	// Rank users, clients and destinations by traffic and keep their
+	// usage history for the admin endpoint
+	var top *TopTalkers
+	var usage *UsageHistory
+	var sessionEnd []func(socks5.SessionInfo)
+	if cfg.AdminAddr != "" && cfg.TopTalkersWindow > 0 {
+		if cfg.TopTalkersWindow < time.Minute {
+			logrus.Fatal("TOP_TALKERS_WINDOW must be at least 1m")
+		}
+		top = NewTopTalkers(cfg.TopTalkersWindow)
+		sessionEnd = append(sessionEnd, top.Record)
+	}
+	if cfg.AdminAddr != "" && cfg.UsageRetention > 0 {
+		usage = NewUsageHistory(cfg.UsageRetention)
+		sessionEnd = append(sessionEnd, usage.Record)
+	}
+	if cfg.IPFIXCollector != "" {
+		exporter, err := NewIPFIXExporter(cfg.IPFIXCollector, cfg.IPFIXDomainID)
+		if err != nil {
+			logrus.Fatalf("invalid IPFIX_COLLECTOR: %v", err)
+		}
+		sessionEnd = append(sessionEnd, exporter.Record)
+		lc.onShutdown("IPFIX flow records", exporter.Flush)
+	}
+	if cfg.EventBusURL != "" {
+		bus, err := NewEventBus(cfg.EventBusURL, cfg.EventBusPrefix, cfg.EventBusFormat)
+		if err != nil {
+			logrus.Fatalf("invalid EVENT_BUS_URL: %v", err)
+		}
+		socks5conf.OnSessionStart = bus.SessionStart
+		sessionEnd = append(sessionEnd, bus.SessionEnd)
+		socks5conf.OnAuthFailure = bus.AuthFailure
+		bans.OnBan = bus.Ban
+		lc.onShutdown("events", bus.Flush)
+	}
+	if cfg.ElasticURL != "" {
+		sink, err := NewElasticSink(cfg.ElasticURL, cfg.ElasticAPIKey, cfg.ElasticIndex, cfg.ElasticSpoolDir)
+		if err != nil {
+			logrus.Fatalf("invalid ELASTIC_URL: %v", err)
+		}
+		sessionEnd = append(sessionEnd, sink.Record)
+		lc.onShutdown("audit records", sink.Flush)
+	}
+	if len(sessionEnd) > 0 {
+		socks5conf.OnSessionEnd = func(info socks5.SessionInfo) {
+			for _, record := range sessionEnd {
+				record(info)
+			}
+		}
 	}
 
+	// Listeners with their own authentication, rules and egress
+	profiles, err := loadListenerProfiles(cfg.Listeners, environ, len(socks5conf.AuthMethods) > 0, upstreamPasswords)
+	if err != nil {
+		logrus.Fatal(err)
+	}
+	profilesTLS := slices.ContainsFunc(profiles, func(lp ListenerProfile) bool { return lp.TLS })
+
 	server, err := socks5.New(socks5conf)
 	if err != nil {
 		logrus.Fatal(err)
 	}
 
-	// Set IP whitelist
-	if len(cfg.AllowedIPs) > 0 {
-		whitelist := make([]netip.Addr, len(cfg.AllowedIPs))
-		for i, ip := range cfg.AllowedIPs {
-			whitelist[i], _ = netip.ParseAddr(ip)
+	// Restore counters, quotas and bans saved before the last restart
+	var store *StateStore
+	if cfg.StateFile != "" {
+		store = &StateStore{Path: cfg.StateFile, Server: server, Quotas: socks5conf.Quotas, BanList: bans, History: usage}
+		if shared != nil {
+			// Usage is persisted by Redis
+			store.Quotas = nil
+		}
+		if err := store.Load(); err != nil {
+			logrus.Fatalf("failed to load state: %v", err)
+		}
+
+		// Start a new period if one began while stopped
+		if store.Quotas != nil && quotaSchedule != nil && !store.Saved.IsZero() && store.Saved.Before(quotaSchedule.Start(time.Now())) {
+			store.Quotas.ResetAll(cfg.QuotaRollover)
+			logrus.Infof("Reset quotas saved before the current %s period", cfg.QuotaPeriod)
+		}
+	}
+
+	// Set IP whitelist, refreshing host names, file and URL periodically
+	if len(cfg.AllowedIPs) > 0 || cfg.AllowedIPsFile != "" || cfg.AllowedIPsURL != "" {
+		allowlist := NewAllowlist(server, cfg.AllowedIPs, cfg.AllowedIPsFile, cfg.AllowedIPsURL)
+		allowlist.Refresh(context.Background())
+		if allowlist.Dynamic() {
+			go allowlist.Run(context.Background(), cfg.AllowedIPsRefresh)
+		}
+	}
+
+	// Open static TCP forwards
+	if err := serveForwards(server, cfg.Forwards); err != nil {
+		logrus.Fatalf("failed to open forwards: %v", err)
+	}
+
+	// Proxy connections redirected by the firewall
+	if cfg.TransparentPort != "" {
+		l, err := upgrades.listen("tcp", ":"+cfg.TransparentPort, func(network, addr string) (net.Listener, error) {
+			return socks5.ListenTransparent(addr, cfg.TransparentTProxy)
+		})
+		if err != nil {
+			logrus.Fatalf("failed to open transparent proxy: %v", err)
 		}
-		server.SetIPWhitelist(whitelist)
+		logrus.Infof("Start listening transparent proxy on port %s", cfg.TransparentPort)
+		go func() {
+			if err := server.ServeTransparent(l); err != nil && err != socks5.ErrServerClosed {
+				logrus.Errorf("transparent proxy stopped: %v", err)
+			}
+		}()
+	}
+
+	// Answer DNS queries with the proxy's resolver
+	if cfg.DNSPort != "" {
+		if err := serveDNS(server, cfg.DNSPort); err != nil {
+			logrus.Fatalf("failed to open DNS forwarder: %v", err)
+		}
+	}
+
+	// Certificates of the TLS listeners
+	acmeConf := ACME{
+		Domains:   cfg.ACMEDomains,
+		CacheDir:  cfg.ACMECacheDir,
+		Email:     cfg.ACMEEmail,
+		Directory: cfg.ACMEDirectory,
+		HTTPPort:  cfg.ACMEHTTPPort,
+	}
+	var tlsConf *tls.Config
+	if cfg.TLSPort != "" || cfg.AdminTLS || profilesTLS {
+		// Reload certificate files on SIGHUP
+		reload := make(chan struct{}, 1)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				select {
+				case reload <- struct{}{}:
+				default:
+				}
+			}
+		}()
+		if cfg.VaultTLSPath != "" && len(cfg.ACMEDomains) == 0 {
+			certs, next, err := NewVaultCertificate(context.Background(), vault, cfg.VaultTLSPath, cfg.VaultRefresh)
+			if err != nil {
+				logrus.Fatalf("failed to read TLS certificate from Vault: %v", err)
+			}
+			go certs.Run(context.Background(), next)
+			tlsConf = &tls.Config{GetCertificate: certs.GetCertificate}
+		} else if tlsConf, err = tlsConfig(acmeConf, cfg.TLSCertFile, cfg.TLSKeyFile, reload); err != nil {
+			logrus.Fatal(err)
+		}
+		if tlsConf == nil {
+			logrus.Fatal("TLS_PORT, ADMIN_TLS and LISTENER_TLS require ACME_DOMAINS, VAULT_TLS_PATH or TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+	}
+
+	// Accept SOCKS over TLS
+	if cfg.TLSPort != "" {
+		if err := serveTLS(server, cfg.TLSPort, tlsConf); err != nil {
+			logrus.Fatalf("failed to open TLS listener: %v", err)
+		}
+	}
+
+	// Serve the listener profiles
+	if err := serveListenerProfiles(server, profiles, tlsConf); err != nil {
+		logrus.Fatalf("failed to open listener: %v", err)
 	}
 
-	logrus.Infof("Start listening proxy service on port %s", cfg.Port)
-	if err := server.ListenAndServe("tcp", ":"+cfg.Port); err != nil {
+	// Publish runtime stats
+	if cfg.AdminAddr != "" {
+		var adminTLS *tls.Config
+		if cfg.AdminTLS {
+			adminTLS = tlsConf
+		}
+		var captures *Captures
+		if cfg.CaptureDir != "" {
+			if captures, err = NewCaptures(server, cfg.CaptureDir, cfg.CaptureMaxBytes, cfg.CaptureMaxDuration); err != nil {
+				logrus.Fatalf("invalid CAPTURE_DIR: %v", err)
+			}
+		}
+		if err := serveAdmin(cfg.AdminAddr, cfg.AdminToken, server, bans, top, usage, captures, adminTLS); err != nil {
+			logrus.Fatalf("admin endpoint: %v", err)
+		}
+	}
+
+	// Hand the listeners over to a new binary on SIGUSR2, with the state
+	// saved for it to load
+	upgraded := upgrades.run(cfg.Sandbox, func() {
+		if store != nil {
+			if err := store.Save(); err != nil {
+				logrus.Errorf("failed to save state: %v", err)
+			}
+		}
+	})
+
+	// Drain connections on SIGTERM or SIGINT, when the service is stopped
+	// or once an upgraded process took over, then checkpoint the state.
+	// The state of an upgraded process is its own.
+	if store != nil {
+		go store.Run(cfg.StateSaveInterval, lc.saving)
+		lc.onShutdownState("state", func(context.Context) error { return store.Save() })
+	}
+	lc.run(server, serviceStop, upgraded)
+
+	l, err := upgrades.listen("tcp", ":"+cfg.Port, server.Listen)
+	if err != nil {
 		logrus.Fatal(err)
 	}
+
+	// Let the process upgraded from drain, every port is served
+	upgrades.started()
+	if cfg.PidFile != "" {
+		if err := os.WriteFile(cfg.PidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+			logrus.Errorf("failed to write PID_FILE: %v", err)
+		}
+	}
+
+	// Give up root once every port is bound
+	if cfg.RunAsUser != "" {
+		if err := dropPrivileges(cfg.RunAsUser, cfg.RunAsGroup); err != nil {
+			logrus.Fatal(err)
+		}
+		logrus.Infof("Running as user %s", cfg.RunAsUser)
+	} else if cfg.RunAsGroup != "" {
+		logrus.Fatal("RUN_AS_GROUP requires RUN_AS_USER")
+	}
+
+	// Restrict the process to what serving needs
+	if cfg.Sandbox {
+		if err := enterSandbox(cfg); err != nil {
+			logrus.Fatalf("failed to enter sandbox: %v", err)
+		}
+		logrus.Info("Entered sandbox")
+	}
+	logrus.Infof("Start listening proxy service on %v", l.Addr())
+	if err := server.Serve(l); err != nil && err != socks5.ErrServerClosed {
+		logrus.Fatal(err)
+	}
+	code := lc.wait()
+	serviceStopped()
+	os.Exit(code)
+}
+
+// parsePortRange parses a "min-max" port range
+func parsePortRange(s string) (socks5.PortRange, error) {
+	var r socks5.PortRange
+	if _, err := fmt.Sscanf(s, "%d-%d", &r.Min, &r.Max); err != nil {
+		return r, fmt.Errorf("invalid PORT_RANGE %q: %v", s, err)
+	}
+	if r.Min == 0 || r.Min > r.Max {
+		return r, fmt.Errorf("invalid PORT_RANGE %q", s)
+	}
+	return r, nil
 }
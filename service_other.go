@@ -0,0 +1,20 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// serviceCommand fails on platforms without Windows services
+func serviceCommand(args []string) {
+	fmt.Fprintln(os.Stderr, "service: Windows services are only supported on Windows")
+	os.Exit(2)
+}
+
+// startService is a no-op on platforms without Windows services
+func startService(drainTimeout time.Duration) (stop <-chan struct{}, stopped func()) {
+	return nil, func() {}
+}
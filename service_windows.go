@@ -0,0 +1,256 @@
+//go:build windows
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name the service is installed and runs as, also
+// used as its event log source
+var serviceName = "socks5-server"
+
+// serviceRestartDelay is how long the service manager waits before
+// restarting a failed service
+const serviceRestartDelay = 5 * time.Second
+
+// serviceCommand implements the service subcommand. install registers
+// the binary as a Windows service started at boot, with the configuration
+// variables of the environment, and uninstall removes it. run serves as
+// the service, it is the command the service manager starts: it returns
+// to serve, the other commands exit with their code.
+func serviceCommand(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "usage: service install|uninstall|run [--name NAME]")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("service "+args[0], flag.ContinueOnError)
+	flags.StringVar(&serviceName, "name", serviceName, "name of the service")
+	if err := flags.Parse(args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "install":
+		err = installService(serviceName)
+	case "uninstall":
+		err = uninstallService(serviceName)
+	case "run":
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "service: unknown command %q\n", args[0])
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "service %s: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// installService creates the service name and its event log source
+func installService(name string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	vars, err := serviceEnvironment()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(name); err == nil {
+		s.Close()
+		return fmt.Errorf("service %s already exists", name)
+	}
+
+	s, err := m.CreateService(name, exe, mgr.Config{
+		DisplayName: "SOCKS5 proxy server",
+		Description: "SOCKS5 proxy server " + name,
+		StartType:   mgr.StartAutomatic,
+	}, "service", "run", "--name", name)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	undo := func(err error) error {
+		s.Delete()
+		return err
+	}
+	restart := []mgr.RecoveryAction{{Type: mgr.ServiceRestart, Delay: serviceRestartDelay}}
+	if err := s.SetRecoveryActions(restart, uint32((24 * time.Hour).Seconds())); err != nil {
+		return undo(fmt.Errorf("failed to set recovery actions: %v", err))
+	}
+	if len(vars) > 0 {
+		k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+name, registry.SET_VALUE)
+		if err != nil {
+			return undo(fmt.Errorf("failed to open service key: %v", err))
+		}
+		err = k.SetStringsValue("Environment", vars)
+		k.Close()
+		if err != nil {
+			return undo(fmt.Errorf("failed to set service environment: %v", err))
+		}
+	}
+	if err := eventlog.InstallAsEventCreate(name, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+		return undo(fmt.Errorf("failed to register event log source: %v", err))
+	}
+	fmt.Printf("installed service %s with %d configuration variables\n", name, len(vars))
+	return nil
+}
+
+// uninstallService stops and deletes the service name
+func uninstallService(name string) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(name)
+	if err != nil {
+		return fmt.Errorf("service %s is not installed", name)
+	}
+	defer s.Close()
+	if status, err := s.Query(); err == nil && status.State != svc.Stopped {
+		s.Control(svc.Stop)
+	}
+	if err := s.Delete(); err != nil {
+		return err
+	}
+	if err := eventlog.Remove(name); err != nil {
+		return fmt.Errorf("failed to remove event log source: %v", err)
+	}
+	fmt.Printf("uninstalled service %s\n", name)
+	return nil
+}
+
+// serviceEnvironment returns the configuration variables set in the
+// environment, and the _FILE variables of secrets, as KEY=VALUE
+func serviceEnvironment() ([]string, error) {
+	fields, err := env.GetFieldParams(&params{})
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, f := range fields {
+		known[f.Key] = true
+	}
+	for _, name := range secretVars {
+		known[name+"_FILE"] = true
+	}
+	var vars []string
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); known[name] {
+			vars = append(vars, kv)
+		}
+	}
+	slices.Sort(vars)
+	return vars, nil
+}
+
+// startService reports to the service manager if the process runs as a
+// Windows service, logging to the event log. The returned channel is
+// closed when the service is asked to stop, the service should then
+// finish within drainTimeout and call stopped.
+func startService(drainTimeout time.Duration) (stop <-chan struct{}, stopped func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		logrus.Fatalf("failed to detect Windows service: %v", err)
+	}
+	if !isService {
+		return nil, func() {}
+	}
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		logrus.AddHook(&eventLogHook{elog})
+	}
+
+	h := &serviceHandler{
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		waitHint: drainTimeout + 5*time.Second,
+	}
+	exited := make(chan struct{})
+	go func() {
+		if err := svc.Run(serviceName, h); err != nil {
+			logrus.Errorf("failed to run as service %s: %v", serviceName, err)
+		}
+		close(exited)
+	}()
+	return h.stop, func() {
+		close(h.done)
+		<-exited
+	}
+}
+
+// serviceHandler answers the control requests of the service manager
+type serviceHandler struct {
+	stop     chan struct{}
+	done     chan struct{}
+	waitHint time.Duration
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending, WaitHint: uint32(h.waitHint.Milliseconds())}
+				close(h.stop)
+				<-h.done
+				return false, 0
+			}
+		case <-h.done:
+			return false, 0
+		}
+	}
+}
+
+// eventLogHook is a logrus hook writing log entries at or above the info
+// level to the event log. Access log entries are left to the other sinks.
+type eventLogHook struct {
+	log *eventlog.Log
+}
+
+// Levels makes eventLogHook a logrus.Hook
+func (h *eventLogHook) Levels() []logrus.Level {
+	return logrus.AllLevels[:logrus.InfoLevel+1]
+}
+
+// Fire writes an entry with the event ID 1
+func (h *eventLogHook) Fire(entry *logrus.Entry) error {
+	if entry.Message == "access" {
+		return nil
+	}
+	line, err := entry.String()
+	if err != nil {
+		return err
+	}
+	switch entry.Level {
+	case logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel:
+		return h.log.Error(1, line)
+	case logrus.WarnLevel:
+		return h.log.Warning(1, line)
+	}
+	return h.log.Info(1, line)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/caarlos0/env/v11"
+)
+
+// shadowPolicyVars are the settings a shadow policy file can override
+var shadowPolicyVars = map[string]bool{
+	"ALLOWED_DEST_FQDN":    true,
+	"DEST_ALLOW_FILE":      true,
+	"DEST_DENY_FILE":       true,
+	"BLOCK_CLOUD_METADATA": true,
+	"USER_DESTINATIONS":    true,
+	"USER_PORTS":           true,
+	"USER_GROUPS":          true,
+	"GROUP_DESTINATIONS":   true,
+	"GROUP_PORTS":          true,
+	"GROUP_SCHEDULES":      true,
+}
+
+// hasPolicies reports whether cfg restricts users or groups
+func hasPolicies(cfg params) bool {
+	return len(cfg.UserDestinations) > 0 || len(cfg.UserPorts) > 0 || len(cfg.UserGroups) > 0 || cfg.UsersJSON != ""
+}
+
+// buildPolicies parses the user policies of cfg, inherited from their
+// groups
+func buildPolicies(cfg params) (map[string]*Policy, error) {
+	users, err := parseUsersJSON(cfg.UsersJSON)
+	if err != nil {
+		return nil, err
+	}
+	classes, quotas := usersPolicyEntries(users)
+	policies, err := parsePolicies(policyEntries{
+		Destinations:     cfg.UserDestinations,
+		Ports:            cfg.UserPorts,
+		BandwidthClasses: classes,
+		Quotas:           quotas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid user policies: %v", err)
+	}
+	groups, err := parsePolicies(policyEntries{
+		Destinations:     cfg.GroupDestinations,
+		Ports:            cfg.GroupPorts,
+		Schedules:        cfg.GroupSchedules,
+		BandwidthClasses: cfg.GroupBandwidth,
+		Quotas:           cfg.GroupQuotas,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid group policies: %v", err)
+	}
+	if err := inheritPolicies(policies, groups, cfg.UserGroups); err != nil {
+		return nil, fmt.Errorf("invalid USER_GROUPS: %v", err)
+	}
+	return policies, nil
+}
+
+// policyRules returns the RuleSet of the destination pattern and lists,
+// cloud metadata and user policy settings of cfg, which have no side effects
+// and can be evaluated in shadow mode
+func policyRules(cfg params) (socks5.RuleSet, error) {
+	rules := socks5.PermitAll()
+	if cfg.AllowedDestFqdn != "" {
+		rules = PermitDestAddrPattern(cfg.AllowedDestFqdn)
+	}
+	if cfg.DestAllowFile != "" || cfg.DestDenyFile != "" {
+		var err error
+		if rules, err = DestLists(rules, cfg.DestAllowFile, cfg.DestDenyFile); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.BlockCloudMetadata {
+		rules = socks5.DenyCloudMetadata(rules)
+	}
+	if hasPolicies(cfg) {
+		policies, err := buildPolicies(cfg)
+		if err != nil {
+			return nil, err
+		}
+		rules = UserPolicies(rules, policies)
+	}
+	return rules, nil
+}
+
+// loadShadowPolicy reads a candidate policy from a file of KEY=VALUE
+// lines overriding the settings in shadowPolicyVars of environ, see
+// readSettingsFile
+func loadShadowPolicy(path string, environ map[string]string) (socks5.RuleSet, error) {
+	settings, err := readSettingsFile(path, shadowPolicyVars)
+	if err != nil {
+		return nil, err
+	}
+	environ = maps.Clone(environ)
+	maps.Copy(environ, settings)
+
+	var cfg params
+	if err := env.ParseWithOptions(&cfg, env.Options{Environment: environ}); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	rules, err := policyRules(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// readSettingsFile reads the settings of a file of KEY=VALUE lines, whose
+// keys must be in allowed. Empty lines and lines starting with # are
+// ignored.
+func readSettingsFile(path string, allowed map[string]bool) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	settings := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !allowed[key] {
+			return nil, fmt.Errorf("%s:%d: unsupported setting %q", path, n, key)
+		}
+		settings[key] = strings.TrimSpace(value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// ShadowPolicy returns a RuleSet which enforces rules and evaluates a
+// candidate policy alongside the active one, logging the requests they
+// decide differently
+func ShadowPolicy(rules, active, candidate socks5.RuleSet) socks5.RuleSet {
+	return &ShadowPolicyRuleSet{rules, active, candidate}
+}
+
+// ShadowPolicyRuleSet is an implementation of the RuleSet which validates
+// new policies against live traffic before they are switched to
+type ShadowPolicyRuleSet struct {
+	Rules     socks5.RuleSet
+	Active    socks5.RuleSet
+	Candidate socks5.RuleSet
+}
+
+func (s *ShadowPolicyRuleSet) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	activeCtx, activeOK := s.Active.Allow(ctx, req)
+	candidateCtx, candidateOK := s.Candidate.Allow(ctx, req)
+	if activeOK != candidateOK {
+		log := requestLog(req).WithField("dest", req.DestAddr.String())
+		if candidateOK {
+			reason, _ := socks5.DenyReasonFromContext(activeCtx)
+			log.WithField("rule", reason.Rule).Infof("shadow policy would allow request denied by active policy: %s", reason.Reason)
+		} else {
+			reason, _ := socks5.DenyReasonFromContext(candidateCtx)
+			log.WithField("rule", reason.Rule).Infof("shadow policy would deny request allowed by active policy: %s", reason.Reason)
+		}
+	}
+	return s.Rules.Allow(ctx, req)
+}
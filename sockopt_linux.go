@@ -0,0 +1,50 @@
+//go:build linux
+
+package main
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenControl returns a ListenControl setting SO_REUSEPORT, letting
+// several processes share the port, and IP_FREEBIND, allowing to bind
+// addresses not yet assigned to the host
+func listenControl(reusePort, freeBind bool) func(network, address string, c syscall.RawConn) error {
+	if !reusePort && !freeBind {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			if reusePort {
+				if sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); sockErr != nil {
+					return
+				}
+			}
+			if freeBind {
+				sockErr = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_FREEBIND, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// markControl returns a dialer Control setting SO_MARK, the firewall mark
+// selecting a policy routing table for outbound connections
+func markControl(mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MARK, mark)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}, nil
+}
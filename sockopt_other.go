@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// listenControl is a no-op on platforms other than Linux
+func listenControl(reusePort, freeBind bool) func(network, address string, c syscall.RawConn) error {
+	if reusePort || freeBind {
+		logrus.Warn("LISTEN_REUSEPORT and LISTEN_FREEBIND are only supported on Linux")
+	}
+	return nil
+}
+
+// markControl fails on platforms other than Linux, which have no fwmark
+func markControl(mark int) (func(network, address string, c syscall.RawConn) error, error) {
+	return nil, fmt.Errorf("fwmark is only supported on Linux")
+}
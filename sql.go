@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/sirupsen/logrus"
+	_ "modernc.org/sqlite"
+)
+
+// sqlDrivers maps SQL_DRIVER values to database/sql driver names and the
+// default query of each
+var sqlDrivers = map[string]struct{ name, query string }{
+	"postgres": {"pgx", "SELECT password FROM users WHERE username = $1"},
+	"mysql":    {"mysql", "SELECT password FROM users WHERE username = ?"},
+	"sqlite":   {"sqlite", "SELECT password FROM users WHERE username = ?"},
+}
+
+// SQLPool configures the connection pool of an SQL credential database
+type SQLPool struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxLifetime time.Duration
+}
+
+// SQLCredentials is an implementation of the ContextCredentialStore
+// looking up password hashes with Query, which takes the username as only
+// parameter and returns a single column
+type SQLCredentials struct {
+	DB    *sql.DB
+	Query string
+}
+
+// NewSQLCredentials opens the database of a postgres, mysql or sqlite
+// driver. An empty query selects the password column of the users table.
+func NewSQLCredentials(driver, dsn, query string, pool SQLPool) (*SQLCredentials, error) {
+	d, found := sqlDrivers[driver]
+	if !found {
+		return nil, fmt.Errorf("unsupported SQL driver %q: must be postgres, mysql or sqlite", driver)
+	}
+	if query == "" {
+		query = d.query
+	}
+
+	db, err := sql.Open(d.name, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(pool.MaxOpen)
+	db.SetMaxIdleConns(pool.MaxIdle)
+	db.SetConnMaxLifetime(pool.MaxLifetime)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLCredentials{DB: db, Query: query}, nil
+}
+
+func (s *SQLCredentials) Valid(user, password string) bool {
+	return s.ValidContext(context.Background(), user, password, netip.AddrPort{})
+}
+
+func (s *SQLCredentials) ValidContext(ctx context.Context, user, password string, client netip.AddrPort) bool {
+	var hash string
+	err := s.DB.QueryRowContext(ctx, s.Query, user).Scan(&hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false
+	} else if err != nil {
+		logrus.Errorf("failed to look up user %q in the database: %v", user, err)
+		return false
+	}
+	return checkPassword(hash, password)
+}
+
+// checkPassword compares password to a bcrypt or argon2 hash, see
+// socks5.CheckPasswordHash, or to a plaintext password stored with the
+// "{plain}" prefix
+func checkPassword(hash, password string) bool {
+	if plain, found := strings.CutPrefix(hash, "{plain}"); found {
+		return subtle.ConstantTimeCompare([]byte(plain), []byte(password)) == 1
+	}
+	return socks5.CheckPasswordHash(hash, password)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// state is the content of STATE_FILE, checkpointed so restarts don't reset
+// counters, quotas and bans
+type state struct {
+	Saved time.Time         `json:"saved"`
+	Stats socks5.Stats      `json:"stats"`
+	Usage map[string]uint64 `json:"usage,omitempty"`
+	// Credit is the quota allowance rolled over from the previous period
+	Credit map[string]uint64 `json:"credit,omitempty"`
+	Bans   []socks5.Ban      `json:"bans,omitempty"`
+	// History is the hourly traffic of users and destinations
+	History *UsageHourly `json:"history,omitempty"`
+}
+
+// StateStore checkpoints the counters of Server, the usage of Quotas, the
+// bans of BanList and the traffic of History to Path
+type StateStore struct {
+	Path    string
+	Server  *socks5.Server
+	Quotas  *socks5.Quotas
+	BanList *socks5.BanList
+	History *UsageHistory
+
+	// Saved is when the state restored by Load was saved
+	Saved time.Time
+}
+
+// Load restores the state saved to Path, if any
+func (s *StateStore) Load() error {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+
+	s.Server.RestoreStats(st.Stats)
+	if s.Quotas != nil {
+		s.Quotas.Restore(st.Usage)
+		s.Quotas.RestoreCredits(st.Credit)
+	}
+	if s.BanList != nil {
+		if err := s.BanList.Restore(st.Bans); err != nil {
+			return err
+		}
+	}
+	if s.History != nil && st.History != nil {
+		s.History.Restore(st.History)
+	}
+	s.Saved = st.Saved
+	logrus.Infof("Restored state saved at %s from %s", st.Saved.Format(time.RFC3339), s.Path)
+	return nil
+}
+
+// Save writes the current state to Path
+func (s *StateStore) Save() error {
+	st := state{Saved: time.Now(), Stats: s.Server.Stats()}
+	if s.Quotas != nil {
+		st.Usage = s.Quotas.Usage()
+		st.Credit = s.Quotas.Credits()
+	}
+	if s.BanList != nil {
+		st.Bans = s.BanList.List()
+	}
+	if s.History != nil {
+		st.History = s.History.Hourly()
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	// Write atomically so a crash never leaves a truncated file
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// Run saves the state every interval until done is closed
+func (s *StateStore) Run(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := s.Save(); err != nil {
+				logrus.Errorf("failed to save state: %v", err)
+			}
+		}
+	}
+}
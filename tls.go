@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is the interval at which certificate files are
+// checked for changes
+const certCheckInterval = time.Minute
+
+// ACME configures automatic certificates for the TLS listeners
+type ACME struct {
+	Domains   []string
+	CacheDir  string
+	Email     string
+	Directory string
+	HTTPPort  string
+}
+
+// tlsConfig returns the configuration of the TLS listeners, with
+// certificates obtained through ACME if domains are set or loaded from
+// certFile and keyFile otherwise, reloaded when a value is received from
+// reload. It returns nil if neither is set.
+func tlsConfig(a ACME, certFile, keyFile string, reload <-chan struct{}) (*tls.Config, error) {
+	if len(a.Domains) > 0 {
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(a.Domains...),
+			Cache:      autocert.DirCache(a.CacheDir),
+			Email:      a.Email,
+		}
+		if a.Directory != "" {
+			m.Client = &acme.Client{DirectoryURL: a.Directory}
+		}
+
+		// Answer HTTP-01 challenges, TLS-ALPN-01 ones are answered by
+		// the TLS listeners
+		if a.HTTPPort != "" {
+			l, err := upgrades.listen("tcp", ":"+a.HTTPPort, net.Listen)
+			if err != nil {
+				return nil, err
+			}
+			logrus.Infof("Start listening ACME HTTP challenges on port %s", a.HTTPPort)
+			go func() {
+				if err := http.Serve(l, m.HTTPHandler(nil)); err != nil {
+					logrus.Errorf("ACME HTTP challenges: %v", err)
+				}
+			}()
+		}
+		return m.TLSConfig(), nil
+	}
+
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	certs, err := NewCertReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	go certs.Run(reload)
+	return &tls.Config{GetCertificate: certs.GetCertificate}, nil
+}
+
+// CertReloader serves a certificate loaded from files, reloading it when
+// they change so rotations don't require a restart. Established
+// connections keep the certificate they were opened with.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	cert    atomic.Pointer[tls.Certificate]
+	modTime time.Time
+}
+
+// NewCertReloader loads the certificate of certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	r := &CertReloader{CertFile: certFile, KeyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate files, keeping the current certificate if
+// they are invalid
+func (r *CertReloader) Reload() error {
+	r.modTime = r.lastModified()
+	cert, err := tls.LoadX509KeyPair(r.CertFile, r.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	r.cert.Store(&cert)
+	return nil
+}
+
+// lastModified returns the latest modification time of the files
+func (r *CertReloader) lastModified() time.Time {
+	var latest time.Time
+	for _, path := range []string{r.CertFile, r.KeyFile} {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+// Run reloads the certificate when the files change or a value is
+// received from reload
+func (r *CertReloader) Run(reload <-chan struct{}) {
+	ticker := time.NewTicker(certCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if r.lastModified().Equal(r.modTime) {
+				continue
+			}
+		case <-reload:
+		}
+		if err := r.Reload(); err != nil {
+			logrus.Errorf("%v, keeping the current certificate", err)
+			continue
+		}
+		logrus.Infof("Reloaded TLS certificate %s", r.CertFile)
+	}
+}
+
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// serveTLS serves SOCKS over TLS on port
+func serveTLS(server *socks5.Server, port string, conf *tls.Config) error {
+	l, err := upgrades.listen("tcp", ":"+port, net.Listen)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Start listening proxy service over TLS on port %s", port)
+	go func() {
+		if err := server.Serve(tls.NewListener(l, conf)); err != nil && err != socks5.ErrServerClosed {
+			logrus.Errorf("TLS proxy service stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+const (
+	// topTalkerBuckets is the number of slots the window is divided in
+	topTalkerBuckets = 60
+
+	// maxTopTalkers bounds the names counted per kind and slot, further
+	// ones are counted as topTalkerOther
+	maxTopTalkers = 10000
+
+	topTalkerOther = "(other)"
+)
+
+// Talker is the traffic of a user, client IP or destination host
+type Talker struct {
+	Name     string `json:"name"`
+	Bytes    uint64 `json:"bytes"`
+	Requests uint64 `json:"requests"`
+}
+
+// TalkerRanking are the top talkers of a kind by bytes and by requests
+type TalkerRanking struct {
+	ByBytes    []Talker `json:"by_bytes"`
+	ByRequests []Talker `json:"by_requests"`
+}
+
+// TopTable are the top talkers of each kind over the rolling window
+type TopTable struct {
+	Window       string        `json:"window"`
+	Users        TalkerRanking `json:"users"`
+	Clients      TalkerRanking `json:"clients"`
+	Destinations TalkerRanking `json:"destinations"`
+}
+
+// talkerKind indexes the counts of users, clients and destinations
+type talkerKind int
+
+const (
+	talkerUser talkerKind = iota
+	talkerClient
+	talkerDest
+	talkerKinds
+)
+
+// talkerBucket holds the counts of a slot of the window
+type talkerBucket struct {
+	start  time.Time
+	counts [talkerKinds]map[string]*Talker
+}
+
+// TopTalkers keeps rolling counts of the bytes and requests of users,
+// client IPs and destination hosts over Window. Requests are counted
+// when they finish.
+type TopTalkers struct {
+	Window time.Duration
+
+	mu      sync.Mutex
+	buckets [topTalkerBuckets]talkerBucket
+}
+
+// NewTopTalkers creates TopTalkers over window
+func NewTopTalkers(window time.Duration) *TopTalkers {
+	return &TopTalkers{Window: window}
+}
+
+// Record counts a finished request, it is a socks5.Config.OnSessionEnd
+// callback
+func (t *TopTalkers) Record(info socks5.SessionInfo) {
+	names := [talkerKinds]string{
+		talkerUser:   info.User,
+		talkerClient: info.Client.Addr().String(),
+	}
+	if info.Dest != nil {
+		names[talkerDest] = info.Dest.FQDN
+		if names[talkerDest] == "" {
+			names[talkerDest] = info.Dest.IP.String()
+		}
+	}
+	bytes := info.BytesUp + info.BytesDown
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b := t.bucket(time.Now())
+	for kind, name := range names {
+		if name == "" {
+			continue
+		}
+		counts := b.counts[kind]
+		if counts == nil {
+			counts = make(map[string]*Talker)
+			b.counts[kind] = counts
+		}
+		talker, found := counts[name]
+		if !found && len(counts) >= maxTopTalkers {
+			name = topTalkerOther
+			talker, found = counts[name]
+		}
+		if !found {
+			talker = &Talker{Name: name}
+			counts[name] = talker
+		}
+		talker.Bytes += bytes
+		talker.Requests++
+	}
+}
+
+// bucket returns the slot of now, clearing it if it holds counts of a
+// previous pass over the window. The caller must hold the lock.
+func (t *TopTalkers) bucket(now time.Time) *talkerBucket {
+	slot := t.Window / topTalkerBuckets
+	start := now.Truncate(slot)
+	b := &t.buckets[int(start.UnixNano()/int64(slot))%topTalkerBuckets]
+	if !b.start.Equal(start) {
+		*b = talkerBucket{start: start}
+	}
+	return b
+}
+
+// Top returns the n top talkers of each kind
+func (t *TopTalkers) Top(n int) TopTable {
+	t.mu.Lock()
+	var totals [talkerKinds]map[string]*Talker
+	since := time.Now().Add(-t.Window)
+	for i := range t.buckets {
+		b := &t.buckets[i]
+		if !b.start.After(since) {
+			continue
+		}
+		for kind, counts := range b.counts {
+			if totals[kind] == nil {
+				totals[kind] = make(map[string]*Talker)
+			}
+			for name, c := range counts {
+				total, found := totals[kind][name]
+				if !found {
+					total = &Talker{Name: name}
+					totals[kind][name] = total
+				}
+				total.Bytes += c.Bytes
+				total.Requests += c.Requests
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	return TopTable{
+		Window:       t.Window.String(),
+		Users:        rankTalkers(totals[talkerUser], n),
+		Clients:      rankTalkers(totals[talkerClient], n),
+		Destinations: rankTalkers(totals[talkerDest], n),
+	}
+}
+
+// rankTalkers returns the n largest talkers by bytes and by requests
+func rankTalkers(counts map[string]*Talker, n int) TalkerRanking {
+	talkers := make([]Talker, 0, len(counts))
+	for _, c := range counts {
+		talkers = append(talkers, *c)
+	}
+	top := func(field func(Talker) uint64) []Talker {
+		ranked := slices.Clone(talkers)
+		slices.SortFunc(ranked, func(a, b Talker) int {
+			if c := cmp.Compare(field(b), field(a)); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.Name, b.Name)
+		})
+		return ranked[:min(n, len(ranked))]
+	}
+	return TalkerRanking{
+		ByBytes:    top(func(t Talker) uint64 { return t.Bytes }),
+		ByRequests: top(func(t Talker) uint64 { return t.Requests }),
+	}
+}
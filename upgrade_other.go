@@ -0,0 +1,30 @@
+//go:build !unix
+
+package main
+
+import "net"
+
+// upgrades opens the listeners, upgrades are only supported on Unix
+var upgrades = &upgrader{}
+
+// upgrader is a no-op on platforms without upgrades
+type upgrader struct{}
+
+// listen opens the listener on addr with open
+func (u *upgrader) listen(network, addr string, open func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	return open(network, addr)
+}
+
+// listenPacket opens the packet connection on addr with open
+func (u *upgrader) listenPacket(network, addr string, open func(network, addr string) (net.PacketConn, error)) (net.PacketConn, error) {
+	return open(network, addr)
+}
+
+// started is a no-op on platforms without upgrades
+func (u *upgrader) started() {}
+
+// run is a no-op on platforms without upgrades, the channel is never
+// ready
+func (u *upgrader) run(sandboxed bool, before func()) <-chan int {
+	return nil
+}
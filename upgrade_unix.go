@@ -0,0 +1,254 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// upgradeListenersEnv lists the listeners handed over to an upgraded
+	// process as "network address" separated by commas, whose descriptors
+	// follow stderr in the same order. upgradeReadyEnv is the descriptor
+	// of the pipe the process reports it took over on.
+	upgradeListenersEnv = "SOCKS5_UPGRADE_LISTENERS"
+	upgradeReadyEnv     = "SOCKS5_UPGRADE_READY"
+
+	// upgradeTimeout is how long an upgraded process has to take over
+	// before it is killed and the upgrade abandoned
+	upgradeTimeout = time.Minute
+)
+
+// upgrades hands the listeners of the process over to a new one
+var upgrades = inheritListeners()
+
+// upgrader passes the listeners to a new process started from the
+// executable on SIGUSR2, usually a new version of the binary, and tells
+// when it took over: the old process then drains its connections while
+// the new one accepts, so that no tunnel is dropped and no connection
+// refused.
+type upgrader struct {
+	mu sync.Mutex
+	// inherited are the listeners handed over by the previous process,
+	// by "network address", until taken by listen
+	inherited map[string]*os.File
+	// ready is the pipe to the previous process, nil if not upgraded
+	ready *os.File
+	// listeners are those to hand over to the next process
+	listeners []upgradeListener
+}
+
+// upgradeListener is a listener or packet connection to hand over
+type upgradeListener struct {
+	key  string
+	file interface{ File() (*os.File, error) }
+}
+
+// inheritListeners returns the upgrader of the process, with the
+// listeners of the previous one if started by an upgrade
+func inheritListeners() *upgrader {
+	u := &upgrader{inherited: make(map[string]*os.File)}
+	keys, upgraded := os.LookupEnv(upgradeListenersEnv)
+	if !upgraded {
+		return u
+	}
+	if keys != "" {
+		for i, key := range strings.Split(keys, ",") {
+			u.inherited[key] = os.NewFile(uintptr(3+i), key)
+		}
+	}
+	if fd, err := strconv.Atoi(os.Getenv(upgradeReadyEnv)); err == nil {
+		u.ready = os.NewFile(uintptr(fd), "upgrade")
+	}
+	// Processes started by this one must not take them for their own
+	os.Unsetenv(upgradeListenersEnv)
+	os.Unsetenv(upgradeReadyEnv)
+	return u
+}
+
+// listen returns the listener on addr handed over by the previous
+// process, or opens it with open. It is handed over on upgrades.
+func (u *upgrader) listen(network, addr string, open func(network, addr string) (net.Listener, error)) (net.Listener, error) {
+	key := network + " " + addr
+	var l net.Listener
+	if f := u.take(key); f != nil {
+		var err error
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit %s listener on %s: %v", network, addr, err)
+		}
+	} else {
+		var err error
+		if l, err = open(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	if file, ok := l.(interface{ File() (*os.File, error) }); ok {
+		u.mu.Lock()
+		u.listeners = append(u.listeners, upgradeListener{key, file})
+		u.mu.Unlock()
+	}
+	return l, nil
+}
+
+// listenPacket is listen for packet connections
+func (u *upgrader) listenPacket(network, addr string, open func(network, addr string) (net.PacketConn, error)) (net.PacketConn, error) {
+	key := network + " " + addr
+	var pc net.PacketConn
+	if f := u.take(key); f != nil {
+		var err error
+		pc, err = net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to inherit %s listener on %s: %v", network, addr, err)
+		}
+	} else {
+		var err error
+		if pc, err = open(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	if file, ok := pc.(interface{ File() (*os.File, error) }); ok {
+		u.mu.Lock()
+		u.listeners = append(u.listeners, upgradeListener{key, file})
+		u.mu.Unlock()
+	}
+	return pc, nil
+}
+
+// take returns the inherited listener key, nil if there is none
+func (u *upgrader) take(key string) *os.File {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	f := u.inherited[key]
+	delete(u.inherited, key)
+	return f
+}
+
+// started tells the previous process, if any, that every listener is
+// served and it may drain. Listeners it handed over which are no longer
+// configured are closed.
+func (u *upgrader) started() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for key, f := range u.inherited {
+		logrus.Infof("Closing inherited listener %s, no longer configured", key)
+		f.Close()
+	}
+	clear(u.inherited)
+	if u.ready == nil {
+		return
+	}
+	if _, err := u.ready.Write([]byte{1}); err != nil {
+		logrus.Errorf("failed to notify the previous process: %v", err)
+	} else {
+		logrus.Infof("Took over the listeners of process %d", os.Getppid())
+	}
+	u.ready.Close()
+	u.ready = nil
+}
+
+// run upgrades on SIGUSR2, calling before first. The returned channel
+// receives the process ID of the new process once it took over. In the
+// sandbox, which forbids running programs, upgrades are refused.
+func (u *upgrader) run(sandboxed bool, before func()) <-chan int {
+	upgraded := make(chan int, 1)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR2)
+	go func() {
+		for range sig {
+			if sandboxed {
+				logrus.Error("Received SIGUSR2, upgrades are not possible with SANDBOX, restart instead")
+				continue
+			}
+			logrus.Info("Received SIGUSR2, upgrading")
+			before()
+			pid, err := u.upgrade()
+			if err != nil {
+				logrus.Errorf("upgrade failed: %v", err)
+				continue
+			}
+			signal.Stop(sig)
+			upgraded <- pid
+			return
+		}
+	}()
+	return upgraded
+}
+
+// upgrade starts the executable with the arguments and environment of
+// this process and the listeners, and waits for it to take over
+func (u *upgrader) upgrade() (int, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return 0, err
+	}
+
+	u.mu.Lock()
+	var keys []string
+	files := []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	for _, l := range u.listeners {
+		f, err := l.file.File()
+		if err != nil {
+			// Closed, e.g. a listener which failed
+			logrus.Debugf("not handing over %s: %v", l.key, err)
+			continue
+		}
+		keys = append(keys, l.key)
+		files = append(files, f)
+	}
+	u.mu.Unlock()
+	defer func() {
+		for _, f := range files[3:] {
+			f.Close()
+		}
+	}()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	env := append(os.Environ(),
+		upgradeListenersEnv+"="+strings.Join(keys, ","),
+		upgradeReadyEnv+"="+strconv.Itoa(len(files)),
+	)
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{Env: env, Files: append(files, w)})
+	w.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// The pipe is closed without a byte if the process exits first
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	go p.Wait()
+	select {
+	case err := <-ready:
+		if err == io.EOF {
+			return 0, fmt.Errorf("process %d exited before taking over", p.Pid)
+		}
+		if err != nil {
+			return 0, err
+		}
+	case <-time.After(upgradeTimeout):
+		p.Kill()
+		return 0, fmt.Errorf("process %d did not take over within %s", p.Pid, upgradeTimeout)
+	}
+	return p.Pid, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+)
+
+// maxUsageNames bounds the users or destinations counted per hour,
+// further ones are counted as topTalkerOther
+const maxUsageNames = 10000
+
+// UsageBucket is the traffic in bytes of each user or destination host
+// during the hour or day starting at Start
+type UsageBucket struct {
+	Start time.Time         `json:"start"`
+	Bytes map[string]uint64 `json:"bytes"`
+}
+
+// UsageHourly is the hourly traffic of users and destinations, as saved
+// in the state file
+type UsageHourly struct {
+	Users        []UsageBucket `json:"users,omitempty"`
+	Destinations []UsageBucket `json:"destinations,omitempty"`
+}
+
+// UsageHistory keeps the hourly traffic of users and destination hosts
+// for Retention. Requests are counted in the hour they finish.
+type UsageHistory struct {
+	Retention time.Duration
+
+	mu      sync.Mutex
+	current time.Time // hour of the last record
+	users   map[time.Time]map[string]uint64
+	dests   map[time.Time]map[string]uint64
+}
+
+// NewUsageHistory creates a UsageHistory keeping retention of traffic
+func NewUsageHistory(retention time.Duration) *UsageHistory {
+	return &UsageHistory{
+		Retention: retention,
+		users:     make(map[time.Time]map[string]uint64),
+		dests:     make(map[time.Time]map[string]uint64),
+	}
+}
+
+// Record counts the traffic of a finished request, it is a
+// socks5.Config.OnSessionEnd callback
+func (u *UsageHistory) Record(info socks5.SessionInfo) {
+	bytes := info.BytesUp + info.BytesDown
+	if bytes == 0 {
+		return
+	}
+	var dest string
+	if info.Dest != nil {
+		if dest = info.Dest.FQDN; dest == "" {
+			dest = info.Dest.IP.String()
+		}
+	}
+
+	hour := time.Now().UTC().Truncate(time.Hour)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if !hour.Equal(u.current) {
+		u.expire(hour)
+		u.current = hour
+	}
+	if info.User != "" {
+		addUsage(u.users, hour, info.User, bytes)
+	}
+	if dest != "" {
+		addUsage(u.dests, hour, dest, bytes)
+	}
+}
+
+// addUsage adds bytes to name in the bucket of hour
+func addUsage(buckets map[time.Time]map[string]uint64, hour time.Time, name string, bytes uint64) {
+	counts := buckets[hour]
+	if counts == nil {
+		counts = make(map[string]uint64)
+		buckets[hour] = counts
+	}
+	if _, found := counts[name]; !found && len(counts) >= maxUsageNames {
+		name = topTalkerOther
+	}
+	counts[name] += bytes
+}
+
+// expire drops the buckets older than Retention before now, the caller
+// must hold the lock
+func (u *UsageHistory) expire(now time.Time) {
+	for _, buckets := range []map[time.Time]map[string]uint64{u.users, u.dests} {
+		for hour := range buckets {
+			if now.Sub(hour) > u.Retention {
+				delete(buckets, hour)
+			}
+		}
+	}
+}
+
+// Report returns the traffic of users, or destinations if dests is set,
+// from since to until in buckets of an hour or, if daily is set, a day
+// of local time. If name is set only its traffic is returned.
+func (u *UsageHistory) Report(dests, daily bool, name string, since, until time.Time) []UsageBucket {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	source := u.users
+	if dests {
+		source = u.dests
+	}
+
+	report := make(map[time.Time]map[string]uint64)
+	for hour, counts := range source {
+		if hour.Before(since) || !hour.Before(until) {
+			continue
+		}
+		start := hour
+		if daily {
+			local := hour.Local()
+			start = time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, time.Local)
+		}
+		for n, bytes := range counts {
+			if name == "" || n == name {
+				addUsage(report, start, n, bytes)
+			}
+		}
+	}
+	return usageBuckets(report)
+}
+
+// usageBuckets returns buckets ordered by start
+func usageBuckets(buckets map[time.Time]map[string]uint64) []UsageBucket {
+	list := make([]UsageBucket, 0, len(buckets))
+	for start, counts := range buckets {
+		list = append(list, UsageBucket{Start: start, Bytes: counts})
+	}
+	slices.SortFunc(list, func(a, b UsageBucket) int {
+		return a.Start.Compare(b.Start)
+	})
+	return list
+}
+
+// Hourly returns a copy of the hourly traffic, e.g. to be saved before a
+// restart
+func (u *UsageHistory) Hourly() *UsageHourly {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	copyBuckets := func(buckets map[time.Time]map[string]uint64) []UsageBucket {
+		copied := make(map[time.Time]map[string]uint64, len(buckets))
+		for hour, counts := range buckets {
+			copied[hour] = make(map[string]uint64, len(counts))
+			for name, bytes := range counts {
+				copied[hour][name] = bytes
+			}
+		}
+		return usageBuckets(copied)
+	}
+	return &UsageHourly{Users: copyBuckets(u.users), Destinations: copyBuckets(u.dests)}
+}
+
+// Restore adds hourly traffic saved by Hourly
+func (u *UsageHistory) Restore(h *UsageHourly) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, b := range h.Users {
+		for name, bytes := range b.Bytes {
+			addUsage(u.users, b.Start.UTC(), name, bytes)
+		}
+	}
+	for _, b := range h.Destinations {
+		for name, bytes := range b.Bytes {
+			addUsage(u.dests, b.Start.UTC(), name, bytes)
+		}
+	}
+	u.expire(time.Now().UTC())
+}
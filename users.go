@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+// UserEntry is a user of PROXY_USERS_JSON, an object of entries by
+// username
+type UserEntry struct {
+	// PasswordHash is a bcrypt or argon2 hash, see socks5.CheckPasswordHash
+	PasswordHash string `json:"password_hash"`
+	// Sources are the IPs and CIDRs the user may connect from, any if empty
+	Sources []string `json:"sources"`
+	// Quota is the traffic quota in bytes, see USER_QUOTAS
+	Quota *uint64 `json:"quota"`
+	// BandwidthClass is the BANDWIDTH_CLASSES class of the tunnels
+	BandwidthClass string `json:"bandwidth_class"`
+	// Expires is when the user can no longer authenticate, never if zero
+	Expires time.Time `json:"expires"`
+
+	sources []netip.Prefix
+}
+
+// parseUsersJSON parses the users of PROXY_USERS_JSON, none if empty
+func parseUsersJSON(s string) (map[string]*UserEntry, error) {
+	if strings.TrimSpace(s) == "" {
+		return nil, nil
+	}
+	var users map[string]*UserEntry
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&users); err != nil {
+		return nil, fmt.Errorf("invalid PROXY_USERS_JSON: %v", err)
+	}
+	for name, u := range users {
+		if u == nil {
+			return nil, fmt.Errorf("invalid PROXY_USERS_JSON: user %q has no entry", name)
+		}
+		if err := socks5.ValidPasswordHash(u.PasswordHash); err != nil {
+			return nil, fmt.Errorf("invalid PROXY_USERS_JSON: password_hash of %q: %v", name, err)
+		}
+		for _, source := range u.Sources {
+			prefix, err := parsePrefix(strings.TrimSpace(source))
+			if err != nil {
+				return nil, fmt.Errorf("invalid PROXY_USERS_JSON: sources of %q: %v", name, err)
+			}
+			u.sources = append(u.sources, prefix.Masked())
+		}
+	}
+	return users, nil
+}
+
+// usersPolicyEntries returns the quotas and bandwidth classes of users as
+// policy entries
+func usersPolicyEntries(users map[string]*UserEntry) (classes map[string]string, quotas map[string]uint64) {
+	classes = make(map[string]string)
+	quotas = make(map[string]uint64)
+	for name, u := range users {
+		if u.BandwidthClass != "" {
+			classes[name] = u.BandwidthClass
+		}
+		if u.Quota != nil {
+			quotas[name] = *u.Quota
+		}
+	}
+	return classes, quotas
+}
+
+// JSONCredentials is an implementation of the ContextCredentialStore
+// checking the password hash, sources and expiry of the users of
+// PROXY_USERS_JSON
+type JSONCredentials map[string]*UserEntry
+
+func (j JSONCredentials) Valid(user, password string) bool {
+	return j.ValidContext(context.Background(), user, password, netip.AddrPort{})
+}
+
+func (j JSONCredentials) ValidContext(ctx context.Context, user, password string, client netip.AddrPort) bool {
+	u, found := j[user]
+	if !found {
+		return false
+	}
+	if !u.Expires.IsZero() && time.Now().After(u.Expires) {
+		logrus.Infof("rejecting user %q: expired on %s", user, u.Expires.Format(time.RFC3339))
+		return false
+	}
+	if len(u.sources) > 0 && !u.allowsSource(client.Addr().Unmap()) {
+		logrus.Infof("rejecting user %q: connecting from %v, not an allowed source", user, client.Addr())
+		return false
+	}
+	return socks5.CheckPasswordHash(u.PasswordHash, password)
+}
+
+// allowsSource reports whether the user may connect from ip
+func (u *UserEntry) allowsSource(ip netip.Addr) bool {
+	for _, prefix := range u.sources {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"jumoog/socks5-server/go-socks5"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// vaultTimeout bounds a single request to Vault
+	vaultTimeout = 30 * time.Second
+
+	// vaultRetry is the delay before retrying a failed login or read
+	vaultRetry = 30 * time.Second
+)
+
+// VaultClient reads secrets from HashiCorp Vault, authenticating with
+// Token or, if Role is set, with the Kubernetes service account token at
+// JWTPath. Tokens are renewed before they expire.
+type VaultClient struct {
+	Addr      string
+	Token     string
+	Role      string
+	AuthMount string
+	JWTPath   string
+	HTTP      *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time // zero if the token does not expire
+}
+
+// NewVaultClient creates a VaultClient for addr, trusting the CA
+// certificates in the PEM file caCert if set
+func NewVaultClient(addr, token, role, authMount, jwtPath, caCert string) (*VaultClient, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caCert != "" {
+		pem, err := os.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caCert)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &VaultClient{
+		Addr:      strings.TrimSuffix(addr, "/"),
+		Token:     token,
+		Role:      role,
+		AuthMount: authMount,
+		JWTPath:   jwtPath,
+		HTTP:      &http.Client{Transport: transport, Timeout: vaultTimeout},
+	}, nil
+}
+
+// vaultResponse is the part of Vault API responses used by the client
+type vaultResponse struct {
+	LeaseDuration int             `json:"lease_duration"`
+	Data          json.RawMessage `json:"data"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+		Renewable     bool   `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// do sends a request to the Vault API path with the given token
+func (v *VaultClient) do(ctx context.Context, method, path, token string, body any) (*vaultResponse, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.Addr+"/v1/"+strings.TrimPrefix(path, "/"), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	resp, err := v.HTTP.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var vr vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		if len(vr.Errors) > 0 {
+			return nil, fmt.Errorf("vault %s: %s: %s", path, resp.Status, strings.Join(vr.Errors, ", "))
+		}
+		return nil, fmt.Errorf("vault %s: %s", path, resp.Status)
+	}
+	return &vr, nil
+}
+
+// authToken returns a valid token, logging in or renewing it as needed
+func (v *VaultClient) authToken(ctx context.Context) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.token != "" && (v.expires.IsZero() || time.Until(v.expires) > vaultRetry*2) {
+		return v.token, nil
+	}
+
+	// Renew the current token before it expires
+	if v.token != "" {
+		if vr, err := v.do(ctx, http.MethodPost, "auth/token/renew-self", v.token, nil); err == nil && vr.Auth != nil {
+			v.setToken(vr.Auth.ClientToken, vr.Auth.LeaseDuration)
+			return v.token, nil
+		} else if err != nil {
+			logrus.Warnf("failed to renew Vault token: %v", err)
+		}
+	}
+
+	if v.Role == "" {
+		// Static tokens are looked up once to learn their lifetime
+		var info struct {
+			TTL int `json:"ttl"`
+		}
+		if vr, err := v.do(ctx, http.MethodGet, "auth/token/lookup-self", v.Token, nil); err == nil {
+			json.Unmarshal(vr.Data, &info)
+		} else {
+			logrus.Debugf("failed to look up Vault token, assuming it does not expire: %v", err)
+		}
+		v.setToken(v.Token, info.TTL)
+		return v.token, nil
+	}
+
+	jwt, err := os.ReadFile(v.JWTPath)
+	if err != nil {
+		return "", err
+	}
+	login := map[string]string{"role": v.Role, "jwt": strings.TrimSpace(string(jwt))}
+	vr, err := v.do(ctx, http.MethodPost, "auth/"+v.AuthMount+"/login", "", login)
+	if err != nil {
+		return "", err
+	}
+	if vr.Auth == nil || vr.Auth.ClientToken == "" {
+		return "", fmt.Errorf("vault login returned no token")
+	}
+	v.setToken(vr.Auth.ClientToken, vr.Auth.LeaseDuration)
+	return v.token, nil
+}
+
+// setToken records token valid for ttl seconds, the caller must hold the
+// lock
+func (v *VaultClient) setToken(token string, ttl int) {
+	v.token = token
+	v.expires = time.Time{}
+	if ttl > 0 {
+		v.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	}
+}
+
+// Read returns the string values of the secret at path and its lease
+// duration. KV version 2 secrets are unwrapped.
+func (v *VaultClient) Read(ctx context.Context, path string) (map[string]string, time.Duration, error) {
+	token, err := v.authToken(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	vr, err := v.do(ctx, http.MethodGet, path, token, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var data map[string]any
+	if err := json.Unmarshal(vr.Data, &data); err != nil {
+		return nil, 0, fmt.Errorf("vault %s: %v", path, err)
+	}
+	if inner, ok := data["data"].(map[string]any); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	values := make(map[string]string, len(data))
+	for key, value := range data {
+		if s, ok := value.(string); ok {
+			values[key] = s
+		}
+	}
+	return values, time.Duration(vr.LeaseDuration) * time.Second, nil
+}
+
+// VaultCredentials is an implementation of the CredentialStore serving the
+// usernames and passwords of a Vault secret, re-read every Refresh or
+// when its lease expires
+type VaultCredentials struct {
+	Client  *VaultClient
+	Path    string
+	Refresh time.Duration
+
+	creds atomic.Pointer[socks5.StaticCredentials]
+}
+
+// NewVaultCredentials reads the users of the secret at path
+func NewVaultCredentials(ctx context.Context, client *VaultClient, path string, refresh time.Duration) (*VaultCredentials, time.Duration, error) {
+	v := &VaultCredentials{Client: client, Path: path, Refresh: refresh}
+	next, err := v.load(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, next, nil
+}
+
+// load reads the secret and returns when to read it again
+func (v *VaultCredentials) load(ctx context.Context) (time.Duration, error) {
+	values, lease, err := v.Client.Read(ctx, v.Path)
+	if err != nil {
+		return vaultRetry, err
+	}
+	creds := socks5.StaticCredentials(values)
+	v.creds.Store(&creds)
+	return vaultNextRead(v.Refresh, lease), nil
+}
+
+// Run re-reads the secret, starting after next, until ctx is done
+func (v *VaultCredentials) Run(ctx context.Context, next time.Duration) {
+	runVault(ctx, next, v.load, "failed to read users from Vault, keeping the previous ones: %v")
+}
+
+// vaultNextRead returns when to read again a secret leased for lease,
+// every refresh or at half its lease if shorter
+func vaultNextRead(refresh, lease time.Duration) time.Duration {
+	if lease > 0 && lease/2 < refresh {
+		return lease / 2
+	}
+	return refresh
+}
+
+// runVault calls load, starting after next and then after the delay it
+// returns, until ctx is done, logging its errors with format
+func runVault(ctx context.Context, next time.Duration, load func(context.Context) (time.Duration, error), format string) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(next):
+		}
+		var err error
+		if next, err = load(ctx); err != nil {
+			logrus.Errorf(format, err)
+		}
+	}
+}
+
+func (v *VaultCredentials) Valid(user, password string) bool {
+	return v.creds.Load().Valid(user, password)
+}
+
+func (v *VaultCredentials) Secret(user string) (string, bool) {
+	return v.creds.Load().Secret(user)
+}
+
+// VaultCertificate serves the TLS certificate of a Vault secret, whose
+// "certificate" and "private_key" values are PEM encoded, re-read every
+// Refresh or when its lease expires. Established connections keep the
+// certificate they were opened with.
+type VaultCertificate struct {
+	Client  *VaultClient
+	Path    string
+	Refresh time.Duration
+
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// NewVaultCertificate reads the certificate of the secret at path
+func NewVaultCertificate(ctx context.Context, client *VaultClient, path string, refresh time.Duration) (*VaultCertificate, time.Duration, error) {
+	v := &VaultCertificate{Client: client, Path: path, Refresh: refresh}
+	next, err := v.load(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	return v, next, nil
+}
+
+// load reads the secret and returns when to read it again
+func (v *VaultCertificate) load(ctx context.Context) (time.Duration, error) {
+	values, lease, err := v.Client.Read(ctx, v.Path)
+	if err != nil {
+		return vaultRetry, err
+	}
+	cert, err := tls.X509KeyPair([]byte(values["certificate"]), []byte(values["private_key"]))
+	if err != nil {
+		return vaultRetry, fmt.Errorf("vault %s: invalid TLS certificate: %v", v.Path, err)
+	}
+	v.cert.Store(&cert)
+	return vaultNextRead(v.Refresh, lease), nil
+}
+
+// Run re-reads the secret, starting after next, until ctx is done
+func (v *VaultCertificate) Run(ctx context.Context, next time.Duration) {
+	runVault(ctx, next, v.load, "failed to read TLS certificate from Vault, keeping the current one: %v")
+}
+
+func (v *VaultCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return v.cert.Load(), nil
+}